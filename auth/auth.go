@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/mail"
+	"regexp"
 	"strings"
 	"time"
 
@@ -22,6 +23,8 @@ type ServerSalt string     // server-side KDF input for accounts
 type AuthTokenString string
 type VerifyTokenString string
 type AuthScope string
+type Locale string // i.e. "en" or "pt-BR", for picking which language to email in
+type InviteCode string
 
 const ScopeFull = AuthScope("*")
 
@@ -29,6 +32,7 @@ const ScopeFull = AuthScope("*")
 type AuthInterface interface {
 	NewAuthToken(UserId, DeviceId, AuthScope) (*AuthToken, error)
 	NewVerifyTokenString() (VerifyTokenString, error)
+	NewInviteCode() (InviteCode, error)
 }
 
 type Auth struct{}
@@ -42,6 +46,7 @@ type AuthToken struct {
 }
 
 const TokenLength = 32
+const InviteCodeLength = 10
 
 func (a *Auth) NewAuthToken(userId UserId, deviceId DeviceId, scope AuthScope) (*AuthToken, error) {
 	b := make([]byte, TokenLength)
@@ -69,6 +74,17 @@ func (a *Auth) NewVerifyTokenString() (VerifyTokenString, error) {
 	return VerifyTokenString(hex.EncodeToString(b)), nil
 }
 
+// Shorter than the other tokens, since people pass these around by hand.
+// Still too many to guess, especially with rate limiting.
+func (a *Auth) NewInviteCode() (InviteCode, error) {
+	b := make([]byte, InviteCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Error generating invite code: %+v", err)
+	}
+
+	return InviteCode(hex.EncodeToString(b)), nil
+}
+
 // NOTE - not stubbing methods of structs like this. more convoluted than it's worth right now
 func (at *AuthToken) ScopeValid(required AuthScope) bool {
 	// So far * is the only scope issued. Used to have more, didn't want to
@@ -155,6 +171,15 @@ func (p Password) Validate() bool {
 	return len(p) >= 8 // Should be much longer but it's a sanity check.
 }
 
+// A language tag, loosely: a language, then optionally a region, script and
+// such, separated by hyphens. Empty is fine; it means the default. Locales end
+// up in file paths (see mail), so this is also what keeps them safe there.
+var localeRegexp = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+func (l Locale) Validate() bool {
+	return l == "" || (len(l) <= 35 && localeRegexp.MatchString(string(l)))
+}
+
 // TODO consider unicode. Also some providers might be case sensitive, and/or
 // may have other ways of having email addresses be equivalent (which we may
 // not care about though)
@@ -40,6 +40,20 @@ func TestAuthNewVerifyTokenString(t *testing.T) {
 	}
 }
 
+func TestAuthNewInviteCode(t *testing.T) {
+	auth := Auth{}
+	inviteCode, err := auth.NewInviteCode()
+
+	if err != nil {
+		t.Fatalf("Error creating new invite code")
+	}
+
+	// In hex, InviteCodeLength is bytes in the original
+	if len(inviteCode) != InviteCodeLength*2 {
+		t.Fatalf("inviteCode isn't the expected length")
+	}
+}
+
 func TestAuthScopeValid(t *testing.T) {
 	fullAuthToken := AuthToken{Scope: "*"}
 	if !fullAuthToken.ScopeValid("*") {
@@ -142,3 +156,25 @@ func TestEmailNormalize(t *testing.T) {
 		t.Errorf("Email normalization failed. got: %s want: %s", got, want)
 	}
 }
+
+func TestLocaleValidate(t *testing.T) {
+	tt := []struct {
+		locale Locale
+		valid  bool
+	}{
+		{"", true},
+		{"en", true},
+		{"pt-BR", true},
+		{"zh-Hant-TW", true},
+		{"e", false},
+		{"en_US", false},
+		{"en-", false},
+		{"../en", false},
+		{"en/../../etc", false},
+	}
+	for _, tc := range tt {
+		if got := tc.locale.Validate(); got != tc.valid {
+			t.Errorf("Locale %q: expected valid %v, got %v", tc.locale, tc.valid, got)
+		}
+	}
+}
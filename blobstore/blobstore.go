@@ -0,0 +1,70 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Blobs are named by the sha256 of their contents, hex encoded. The same
+// contents always get the same Ref, so putting a blob twice is harmless.
+type Ref string
+
+var (
+	ErrNotFound   = fmt.Errorf("Blob not found")
+	ErrCorrupt    = fmt.Errorf("Blob contents don't match its ref")
+	ErrInvalidRef = fmt.Errorf("Invalid blob ref")
+)
+
+type BlobInfo struct {
+	Ref Ref
+
+	// When it was last put. Putting an existing blob again updates this.
+	Modified time.Time
+}
+
+type BlobStore interface {
+	Put(data []byte) (Ref, error)
+
+	// ErrNotFound if there's no such blob, ErrCorrupt if what's there doesn't
+	// hash to `ref`
+	Get(ref Ref) ([]byte, error)
+
+	// When it was last put, like BlobInfo.Modified. ErrNotFound if there's no
+	// such blob.
+	Modified(ref Ref) (time.Time, error)
+
+	// Deleting a blob that isn't there isn't an error
+	Delete(ref Ref) error
+
+	// Every blob, in no particular order. An error from `fn` stops the listing
+	// and is returned.
+	List(fn func(BlobInfo) error) error
+}
+
+func RefFor(data []byte) Ref {
+	hash := sha256.Sum256(data)
+	return Ref(hex.EncodeToString(hash[:]))
+}
+
+// Refs end up in file names and URLs, so make sure they're what we made
+func (r Ref) valid() bool {
+	if len(r) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range r {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// For Get implementations, once they have the data
+func checkContents(ref Ref, data []byte) ([]byte, error) {
+	if RefFor(data) != ref {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
@@ -0,0 +1,125 @@
+package blobstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Blobs as files in a directory, spread over subdirectories named for the
+// first two characters of the ref so that no one directory gets too big.
+type FS struct {
+	dir string
+}
+
+func NewFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FS{dir: dir}, nil
+}
+
+func (f *FS) path(ref Ref) string {
+	return filepath.Join(f.dir, string(ref[:2]), string(ref))
+}
+
+func (f *FS) Put(data []byte) (Ref, error) {
+	ref := RefFor(data)
+	path := f.path(ref)
+
+	// Already there. Just mark it as recently put, so it's not garbage
+	// collected out from under whoever's putting it.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return ref, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	// Write somewhere else and rename, so nobody ever sees half a blob
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (f *FS) Get(ref Ref) ([]byte, error) {
+	if !ref.valid() {
+		return nil, ErrInvalidRef
+	}
+	data, err := os.ReadFile(f.path(ref))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkContents(ref, data)
+}
+
+func (f *FS) Modified(ref Ref) (time.Time, error) {
+	if !ref.valid() {
+		return time.Time{}, ErrInvalidRef
+	}
+	info, err := os.Stat(f.path(ref))
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (f *FS) Delete(ref Ref) error {
+	if !ref.valid() {
+		return ErrInvalidRef
+	}
+	err := os.Remove(f.path(ref))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *FS) List(fn func(BlobInfo) error) error {
+	return filepath.WalkDir(f.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skips directories, and temp files from Put
+		ref := Ref(entry.Name())
+		if entry.IsDir() || !ref.valid() {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since we listed the directory
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Ref: ref, Modified: info.ModTime()})
+	})
+}
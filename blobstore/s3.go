@@ -0,0 +1,266 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Blobs as objects in an S3-compatible bucket. Just the handful of requests we
+// need, signed with AWS Signature Version 4, rather than a whole SDK. Uses
+// path-style URLs (endpoint/bucket/key), which every S3 clone supports.
+type S3 struct {
+	endpoint        *url.URL
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+
+	client *http.Client
+}
+
+// Wallets are small, so a request taking longer than this means something's
+// wrong
+const s3Timeout = 30 * time.Second
+
+func NewS3(endpoint string, bucket string, region string, accessKeyId string, secretAccessKey string) (*S3, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+		return nil, fmt.Errorf("S3 endpoint should be an http or https URL")
+	}
+	return &S3{
+		endpoint:        endpointURL,
+		bucket:          bucket,
+		region:          region,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+		client:          &http.Client{Timeout: s3Timeout},
+	}, nil
+}
+
+func (s *S3) Put(data []byte) (Ref, error) {
+	ref := RefFor(data)
+
+	// Putting it again is how we mark it as recently put (LastModified), so
+	// don't skip it if it's already there.
+	resp, err := s.do(http.MethodPut, string(ref), nil, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+	return ref, nil
+}
+
+func (s *S3) Get(ref Ref) ([]byte, error) {
+	if !ref.valid() {
+		return nil, ErrInvalidRef
+	}
+	resp, err := s.do(http.MethodGet, string(ref), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return checkContents(ref, data)
+}
+
+func (s *S3) Modified(ref Ref) (time.Time, error) {
+	if !ref.valid() {
+		return time.Time{}, ErrInvalidRef
+	}
+	resp, err := s.do(http.MethodHead, string(ref), nil, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return time.Time{}, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, s3Error(resp)
+	}
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+func (s *S3) Delete(ref Ref) error {
+	if !ref.valid() {
+		return ErrInvalidRef
+	}
+	resp, err := s.do(http.MethodDelete, string(ref), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(fn func(BlobInfo) error) error {
+	query := url.Values{"list-type": {"2"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			// Someone else's object, if the bucket is shared
+			if !Ref(object.Key).valid() {
+				continue
+			}
+			if err := fn(BlobInfo{Ref: Ref(object.Key), Modified: object.LastModified}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func s3Error(resp *http.Response) error {
+	// S3 puts the details in an XML body. Enough of it to tell what went wrong.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request failed with %s: %s", resp.Status, body)
+}
+
+// A signed request for an object in the bucket, or the bucket itself if `key`
+// is empty
+func (s *S3) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// AWS Signature Version 4. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Already sorted
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+// Sorted by key, and escaped the way SigV4 wants (%20 for spaces, not +), so
+// the query we send is the same as the one we sign
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sigV4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,136 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names as used in Content-Encoding and Accept-Encoding. Also what we record
+// in the database for wallets compressed at rest.
+type Encoding string
+
+const (
+	Identity = Encoding("")
+	Gzip     = Encoding("gzip")
+	Zstd     = Encoding("zstd")
+)
+
+var ErrUnsupportedEncoding = fmt.Errorf("Unsupported encoding")
+
+// The zstd decoder otherwise allows a window big enough that a small malicious
+// body could make us allocate a lot. Wallets are nowhere near this big.
+const zstdMaxWindow = 8 << 20
+
+func ParseEncoding(encodingStr string) (Encoding, error) {
+	encoding := Encoding(strings.ToLower(strings.TrimSpace(encodingStr)))
+	switch encoding {
+	case Identity, Gzip, Zstd:
+		return encoding, nil
+	case "identity":
+		return Identity, nil
+	}
+	return "", ErrUnsupportedEncoding
+}
+
+func Compress(encoding Encoding, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// For small things we already trust, like what we stored ourselves. For
+// anything from a client, use NewReader with a limit on how much to read.
+func Decompress(encoding Encoding, data []byte) ([]byte, error) {
+	reader, err := NewReader(encoding, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Close the writer to flush it. It doesn't close `w`.
+func NewWriter(encoding Encoding, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case Identity:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+// Closing the reader doesn't close `r`.
+func NewReader(encoding Encoding, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Identity:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstd.Decoder's Close doesn't return an error, so it isn't an io.Closer
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// The encoding we'd most like to respond with, given a request's
+// Accept-Encoding. Prefers zstd, then gzip, skipping anything the client gave
+// q=0. Identity if there's nothing we both support.
+func Negotiate(acceptEncoding string) Encoding {
+	accepted := map[Encoding]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := Encoding(strings.ToLower(strings.TrimSpace(fields[0])))
+		accepted[name] = true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				accepted[name] = err == nil && q > 0
+			}
+		}
+	}
+	for _, encoding := range []Encoding{Zstd, Gzip} {
+		if ok, listed := accepted[encoding]; ok || (!listed && accepted["*"]) {
+			return encoding
+		}
+	}
+	return Identity
+}
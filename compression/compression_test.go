@@ -0,0 +1,83 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("my-encrypted-wallet", 100))
+	for _, encoding := range []Encoding{Identity, Gzip, Zstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			compressed, err := Compress(encoding, data)
+			if err != nil {
+				t.Fatalf("Unexpected error compressing: %+v", err)
+			}
+			if encoding != Identity && len(compressed) >= len(data) {
+				t.Errorf("Expected %s to make it smaller, got %d bytes from %d", encoding, len(compressed), len(data))
+			}
+			decompressed, err := Decompress(encoding, compressed)
+			if err != nil {
+				t.Fatalf("Unexpected error decompressing: %+v", err)
+			}
+			if !bytes.Equal(data, decompressed) {
+				t.Errorf("Expected to get back what we compressed")
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := ParseEncoding("br"); err != ErrUnsupportedEncoding {
+		t.Errorf("Expected ErrUnsupportedEncoding, got %+v", err)
+	}
+	if _, err := NewReader("br", strings.NewReader("")); err != ErrUnsupportedEncoding {
+		t.Errorf("Expected ErrUnsupportedEncoding, got %+v", err)
+	}
+	if _, err := NewWriter("br", io.Discard); err != ErrUnsupportedEncoding {
+		t.Errorf("Expected ErrUnsupportedEncoding, got %+v", err)
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tt := []struct {
+		encodingStr string
+		expected    Encoding
+	}{
+		{"", Identity},
+		{"identity", Identity},
+		{"gzip", Gzip},
+		{" GZIP ", Gzip},
+		{"zstd", Zstd},
+	}
+	for _, tc := range tt {
+		if encoding, err := ParseEncoding(tc.encodingStr); err != nil || encoding != tc.expected {
+			t.Errorf("Expected %q to parse as %q, got %q, err %+v", tc.encodingStr, tc.expected, encoding, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tt := []struct {
+		acceptEncoding string
+		expected       Encoding
+	}{
+		{"", Identity},
+		{"br", Identity},
+		{"gzip", Gzip},
+		{"gzip, deflate, br", Gzip},
+		{"gzip, zstd", Zstd},
+		{"zstd;q=0, gzip", Gzip},
+		{"zstd;q=0.000, gzip;q=0.5", Gzip},
+		{"*", Zstd},
+		{"*, zstd;q=0", Gzip},
+		{"gzip;q=0, zstd;q=0", Identity},
+	}
+	for _, tc := range tt {
+		if encoding := Negotiate(tc.acceptEncoding); encoding != tc.expected {
+			t.Errorf("Expected %q to negotiate %q, got %q", tc.acceptEncoding, tc.expected, encoding)
+		}
+	}
+}
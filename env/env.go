@@ -1,11 +1,19 @@
 package env
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/migration"
 )
 
 // NOTE for users: If you have weird characters in your email address, please
@@ -24,6 +32,179 @@ const mailgunSendingDomainKey = "MAILGUN_SENDING_DOMAIN"
 // for links in the emails
 const mailgunServerDomainKey = "MAILGUN_SERVER_DOMAIN"
 
+// In InviteCode mode, how many people each user can invite. Unset or 0 means
+// only the server operator makes invite codes.
+const invitesPerUserKey = "INVITES_PER_USER"
+
+// Where email goes in EmailVerify and AdminApproval modes. See MailBackend.
+const mailBackendKey = "MAIL_BACKEND"
+
+// For the outbox backend: the directory to write messages to, and whether to
+// log the links in them so you don't have to open the files.
+const mailOutboxDirKey = "MAIL_OUTBOX_DIR"
+const mailOutboxLogLinksKey = "MAIL_OUTBOX_LOG_LINKS"
+
+// Limits on simultaneous notification clients (websockets, event streams and
+// long-polls). Unset or 0 means no limit.
+const maxSocketsPerUserKey = "MAX_SOCKETS_PER_USER"
+const maxSocketsPerDeviceKey = "MAX_SOCKETS_PER_DEVICE"
+const maxSocketsTotalKey = "MAX_SOCKETS_TOTAL"
+
+// How long to keep reporting "not ready" before we start draining, so that load
+// balancers have a chance to notice and stop sending us requests.
+const shutdownReadinessDelayKey = "SHUTDOWN_READINESS_DELAY"
+
+// How long to wait for requests in progress to finish before cutting them off
+const shutdownDrainTimeoutKey = "SHUTDOWN_DRAIN_TIMEOUT"
+
+const DefaultShutdownDrainTimeout = 30 * time.Second
+
+// Comma separated. Each one is host:port, or unix:/path/to/socket
+const listenAddressesKey = "LISTEN_ADDRESSES"
+
+const tlsCertFileKey = "TLS_CERT_FILE"
+const tlsKeyFileKey = "TLS_KEY_FILE"
+
+// Generate a throwaway certificate on startup. Only use for dev purposes.
+const tlsSelfSignedKey = "TLS_SELF_SIGNED"
+
+const unixAddressPrefix = "unix:"
+
+// Per client IP. Unset or 0 means no limit.
+const rateLimitPerMinuteKey = "RATE_LIMIT_PER_MINUTE"
+
+// How many requests a client can make in a quick burst before the per-minute
+// rate kicks in. Defaults to the per-minute rate.
+const rateLimitBurstKey = "RATE_LIMIT_BURST"
+
+// Set if we're behind a reverse proxy, so that we rate limit by the client's
+// IP (as reported by the proxy) rather than the proxy's.
+const rateLimitTrustProxyKey = "RATE_LIMIT_TRUST_PROXY"
+
+// How many times a day each user can download an export of their data. It's
+// every wallet and then some, so it's not cheap. 0 means no limit.
+const dataExportsPerDayKey = "DATA_EXPORTS_PER_DAY"
+
+const defaultDataExportsPerDay = 3
+
+// Directory of email templates that take the place of the built-in ones, file
+// by file. See mail for the layout. Unset means just the built-in ones.
+const mailTemplatesDirKey = "MAIL_TEMPLATES_DIR"
+
+// Comma separated origins, i.e. https://example.com, or * for any origin.
+// Unset means no cross-origin requests.
+const corsAllowedOriginsKey = "CORS_ALLOWED_ORIGINS"
+
+// How often to query the database for account and wallet counts for metrics.
+// They're full table scans, so on a big database make this longer. 0 turns it
+// off.
+const statsIntervalKey = "STATS_INTERVAL"
+
+const defaultStatsInterval = 5 * time.Minute
+
+// debug, info, warn or error
+const logLevelKey = "LOG_LEVEL"
+
+// text (logfmt) or json
+const logFormatKey = "LOG_FORMAT"
+
+// Largest request body, in bytes, for endpoints that don't have their own
+// limit in MAX_BODY_SIZES
+const maxBodySizeKey = "MAX_BODY_SIZE"
+
+// Comma separated endpoint=bytes, i.e. wallet=1000000,password=1000000. The
+// endpoint names are the same as in the metrics.
+const maxBodySizesKey = "MAX_BODY_SIZES"
+
+// Make the limit 100k. Increase from there as needed. I'd rather block some
+// people's large wallets and increase the limit than OOM for everybody and
+// decrease the limit.
+const DefaultMaxBodySize = 100000
+
+// Largest wallet, in bytes, that can be sent in parts. Each part is still
+// subject to the upload part endpoint's body limit.
+const maxWalletUploadSizeKey = "MAX_WALLET_UPLOAD_SIZE"
+
+const defaultMaxWalletUploadSize = 10000000
+
+// Compress wallets in the database: gzip or zstd. Unset means don't.
+const walletCompressionKey = "WALLET_COMPRESSION"
+
+// Where to keep wallets instead of the database: fs or s3. Unset means the
+// database.
+const blobStoreKey = "BLOB_STORE"
+
+// For fs
+const blobStoreDirKey = "BLOB_STORE_DIR"
+
+// For s3. The endpoint is a URL, i.e. https://s3.us-east-1.amazonaws.com, or
+// that of any S3-compatible service.
+const blobStoreS3EndpointKey = "BLOB_STORE_S3_ENDPOINT"
+const blobStoreS3BucketKey = "BLOB_STORE_S3_BUCKET"
+const blobStoreS3RegionKey = "BLOB_STORE_S3_REGION"
+const blobStoreS3AccessKeyIdKey = "BLOB_STORE_S3_ACCESS_KEY_ID"
+const blobStoreS3SecretAccessKeyKey = "BLOB_STORE_S3_SECRET_ACCESS_KEY"
+
+// Most S3 clones don't care about the region, but it's part of the signature
+const defaultBlobStoreS3Region = "us-east-1"
+
+// Bearer token for the admin endpoints, i.e. the audit log export. Unset turns
+// them off.
+const adminTokenKey = "ADMIN_TOKEN"
+
+// Long enough that it can't be guessed, given that we don't rate limit by
+// anything but IP.
+const minAdminTokenLength = 32
+
+// For moving accounts to another server: the base64 encoded ed25519 seed that
+// this server signs migration bundles with. Unset turns off migration export.
+const migrationSigningKeyKey = "MIGRATION_SIGNING_KEY"
+
+// For moving accounts from other servers: comma separated base64 encoded
+// ed25519 public keys of the servers whose bundles we accept. Unset turns off
+// migration import.
+const migrationTrustedKeysKey = "MIGRATION_TRUSTED_KEYS"
+
+// For moving accounts from other servers: the base64 encoded X25519 key that
+// the password hashes in migration bundles are sealed to. Needed along with
+// MIGRATION_TRUSTED_KEYS for migration import.
+const migrationEncryptionKeyKey = "MIGRATION_ENCRYPTION_KEY"
+
+// For moving accounts to other servers: comma separated url=key pairs, for the
+// servers that users can take their accounts to, with the public half of each
+// one's MIGRATION_ENCRYPTION_KEY. Logging in to a moved account sends the
+// client there, so it can't be just anywhere. Unset means migration export
+// has nowhere to go.
+const migrationDestinationsKey = "MIGRATION_DESTINATIONS"
+
+// Something the server should listen on. Network is "tcp" or "unix", as with
+// net.Listen.
+type ListenAddress struct {
+	Network string
+	Address string
+}
+
+type BlobStoreKind string
+
+const (
+	BlobStoreNone = BlobStoreKind("")
+	BlobStoreFS   = BlobStoreKind("fs")
+	BlobStoreS3   = BlobStoreKind("s3")
+)
+
+// Only the fields for the given Kind are set
+type BlobStoreConfig struct {
+	Kind BlobStoreKind
+
+	Dir string
+
+	S3Endpoint        string
+	S3Bucket          string
+	S3Region          string
+	S3AccessKeyId     string
+	S3SecretAccessKey string
+}
+
 type AccountVerificationMode string
 
 // Everyone can make an account. Only use for dev purposes.
@@ -36,6 +217,22 @@ const AccountVerificationModeEmailVerify = AccountVerificationMode("EmailVerify"
 // self-hosting users.
 const AccountVerificationModeWhitelist = AccountVerificationMode("Whitelist")
 
+// Anyone with an invite code can make an account. Good for small communities.
+const AccountVerificationModeInviteCode = AccountVerificationMode("InviteCode")
+
+// New accounts wait for the server operator to approve them. Good for
+// semi-public servers.
+const AccountVerificationModeAdminApproval = AccountVerificationMode("AdminApproval")
+
+type MailBackend string
+
+// Send through Mailgun. The default.
+const MailBackendMailgun = MailBackend("mailgun")
+
+// Write each message to a file instead of sending it. Only use for dev
+// purposes.
+const MailBackendOutbox = MailBackend("outbox")
+
 // For test stubs
 type EnvInterface interface {
 	Getenv(key string) string
@@ -55,8 +252,131 @@ func GetAccountWhitelist(e EnvInterface, mode AccountVerificationMode) (emails [
 	return getAccountWhitelist(e.Getenv(whitelistKey), mode)
 }
 
-func GetMailgunConfigs(e EnvInterface, mode AccountVerificationMode) (sendingDomain string, serverDomain string, isDomainEU bool, privateAPIKey string, err error) {
-	return getMailgunConfigs(e.Getenv(mailgunSendingDomainKey), e.Getenv(mailgunServerDomainKey), e.Getenv(mailgunIsDomainEUKey), e.Getenv(mailgunPrivateAPIKeyKey), mode)
+func GetInvitesPerUser(e EnvInterface, mode AccountVerificationMode) (int, error) {
+	return getInvitesPerUser(e.Getenv(invitesPerUserKey), mode)
+}
+
+func GetMailBackend(e EnvInterface, mode AccountVerificationMode) (MailBackend, error) {
+	return getMailBackend(e.Getenv(mailBackendKey), mode)
+}
+
+func GetMailgunConfigs(e EnvInterface, mode AccountVerificationMode, backend MailBackend) (sendingDomain string, serverDomain string, isDomainEU bool, privateAPIKey string, err error) {
+	return getMailgunConfigs(e.Getenv(mailgunSendingDomainKey), e.Getenv(mailgunServerDomainKey), e.Getenv(mailgunIsDomainEUKey), e.Getenv(mailgunPrivateAPIKeyKey), mode, backend)
+}
+
+// Whether the server sends email at all. It always does in EmailVerify mode.
+// In AdminApproval mode it's optional, and on if mail is configured. This
+// doesn't check that the configs are valid; startup and the health check do
+// that.
+func GetMailEnabled(e EnvInterface) (bool, error) {
+	mode, err := GetAccountVerificationMode(e)
+	if err != nil {
+		return false, err
+	}
+	switch mode {
+	case AccountVerificationModeEmailVerify:
+		return true, nil
+	case AccountVerificationModeAdminApproval:
+		return e.Getenv(mailgunSendingDomainKey) != "" || e.Getenv(mailBackendKey) == string(MailBackendOutbox), nil
+	}
+	return false, nil
+}
+
+func GetMailOutboxConfigs(e EnvInterface, backend MailBackend) (dir string, logLinks bool, err error) {
+	return getMailOutboxConfigs(e.Getenv(mailOutboxDirKey), e.Getenv(mailOutboxLogLinksKey), backend)
+}
+
+func GetSocketLimits(e EnvInterface) (perUser int, perDevice int, total int, err error) {
+	return getSocketLimits(e.Getenv(maxSocketsPerUserKey), e.Getenv(maxSocketsPerDeviceKey), e.Getenv(maxSocketsTotalKey))
+}
+
+func GetShutdownConfigs(e EnvInterface) (readinessDelay time.Duration, drainTimeout time.Duration, err error) {
+	return getShutdownConfigs(e.Getenv(shutdownReadinessDelayKey), e.Getenv(shutdownDrainTimeoutKey))
+}
+
+// If no addresses are given, listen on localhost at the given port
+func GetListenAddresses(e EnvInterface, defaultPort int) ([]ListenAddress, error) {
+	return getListenAddresses(e.Getenv(listenAddressesKey), defaultPort)
+}
+
+func GetTLSConfigs(e EnvInterface) (certFile string, keyFile string, selfSigned bool, err error) {
+	return getTLSConfigs(e.Getenv(tlsCertFileKey), e.Getenv(tlsKeyFileKey), e.Getenv(tlsSelfSignedKey))
+}
+
+func GetRateLimitConfigs(e EnvInterface) (perMinute int, burst int, trustProxy bool, err error) {
+	return getRateLimitConfigs(e.Getenv(rateLimitPerMinuteKey), e.Getenv(rateLimitBurstKey), e.Getenv(rateLimitTrustProxyKey))
+}
+
+func GetDataExportsPerDay(e EnvInterface) (int, error) {
+	return getDataExportsPerDay(e.Getenv(dataExportsPerDayKey))
+}
+
+func GetMailTemplatesDir(e EnvInterface) (string, error) {
+	return getMailTemplatesDir(e.Getenv(mailTemplatesDirKey))
+}
+
+func GetCORSAllowedOrigins(e EnvInterface) ([]string, error) {
+	return getCORSAllowedOrigins(e.Getenv(corsAllowedOriginsKey))
+}
+
+func GetStatsInterval(e EnvInterface) (time.Duration, error) {
+	return getStatsInterval(e.Getenv(statsIntervalKey))
+}
+
+func GetLogConfigs(e EnvInterface) (level logging.Level, format logging.Format, err error) {
+	return getLogConfigs(e.Getenv(logLevelKey), e.Getenv(logFormatKey))
+}
+
+// Limits for request bodies after decompression. perEndpoint is keyed by
+// endpoint name and overrides defaultLimit.
+func GetMaxBodySizes(e EnvInterface) (defaultLimit int64, perEndpoint map[string]int64, err error) {
+	return getMaxBodySizes(e.Getenv(maxBodySizeKey), e.Getenv(maxBodySizesKey))
+}
+
+func GetMaxWalletUploadSize(e EnvInterface) (int64, error) {
+	return getMaxWalletUploadSize(e.Getenv(maxWalletUploadSizeKey))
+}
+
+func GetBlobStoreConfig(e EnvInterface) (BlobStoreConfig, error) {
+	return getBlobStoreConfig(
+		e.Getenv(blobStoreKey),
+		e.Getenv(blobStoreDirKey),
+		e.Getenv(blobStoreS3EndpointKey),
+		e.Getenv(blobStoreS3BucketKey),
+		e.Getenv(blobStoreS3RegionKey),
+		e.Getenv(blobStoreS3AccessKeyIdKey),
+		e.Getenv(blobStoreS3SecretAccessKeyKey),
+	)
+}
+
+func GetWalletCompression(e EnvInterface) (compression.Encoding, error) {
+	return getWalletCompression(e.Getenv(walletCompressionKey))
+}
+
+// Empty means the admin endpoints are off
+func GetAdminToken(e EnvInterface) (string, error) {
+	return getAdminToken(e.Getenv(adminTokenKey))
+}
+
+// Nil means migration export is off
+func GetMigrationSigningKey(e EnvInterface) (ed25519.PrivateKey, error) {
+	return getMigrationSigningKey(e.Getenv(migrationSigningKeyKey))
+}
+
+// Empty means migration import is off
+func GetMigrationTrustedKeys(e EnvInterface) ([]ed25519.PublicKey, error) {
+	return getMigrationTrustedKeys(e.Getenv(migrationTrustedKeysKey))
+}
+
+// Nil means migration import is off
+func GetMigrationEncryptionKey(e EnvInterface) (*[32]byte, error) {
+	return getMigrationEncryptionKey(e.Getenv(migrationEncryptionKeyKey))
+}
+
+// By base URL, with trailing slashes trimmed. Empty means accounts can't be
+// exported anywhere.
+func GetMigrationDestinations(e EnvInterface) (map[string]*[32]byte, error) {
+	return getMigrationDestinations(e.Getenv(migrationDestinationsKey))
 }
 
 // Factor out the guts of the functions so we can test them by just passing in
@@ -72,6 +392,8 @@ func getAccountVerificationMode(modeStr string) (AccountVerificationMode, error)
 	case AccountVerificationModeAllowAll:
 	case AccountVerificationModeEmailVerify:
 	case AccountVerificationModeWhitelist:
+	case AccountVerificationModeInviteCode:
+	case AccountVerificationModeAdminApproval:
 	default:
 		return "", fmt.Errorf("Invalid account verification mode in %s: %s", verificationModeKey, mode)
 	}
@@ -107,24 +429,84 @@ func getAccountWhitelist(whitelist string, mode AccountVerificationMode) (emails
 	return emails, nil
 }
 
-func getMailgunConfigs(sendingDomain string, serverDomain string, isDomainEUStr string, privateAPIKey string, mode AccountVerificationMode) (string, string, bool, string, error) {
-	if mode != AccountVerificationModeEmailVerify && (sendingDomain != "" || serverDomain != "" || isDomainEUStr != "" || privateAPIKey != "") {
-		return "", "", false, "", fmt.Errorf("Do not specify %s, %s, %s or %s in env if %s is not %s",
+func getInvitesPerUser(perUserStr string, mode AccountVerificationMode) (int, error) {
+	if perUserStr != "" && mode != AccountVerificationModeInviteCode {
+		return 0, fmt.Errorf("Do not specify %s in env if %s is not %s",
+			invitesPerUserKey,
+			verificationModeKey,
+			AccountVerificationModeInviteCode,
+		)
+	}
+	return getLimit(invitesPerUserKey, perUserStr)
+}
+
+// EmailVerify mode needs email. AdminApproval mode can use it, to tell users
+// they've been approved.
+func modeSendsMail(mode AccountVerificationMode) bool {
+	return mode == AccountVerificationModeEmailVerify || mode == AccountVerificationModeAdminApproval
+}
+
+func getMailBackend(backendStr string, mode AccountVerificationMode) (MailBackend, error) {
+	backend := MailBackend(backendStr)
+	if !modeSendsMail(mode) && backend != "" {
+		return "", fmt.Errorf("Do not specify %s in env if %s is not %s or %s", mailBackendKey, verificationModeKey, AccountVerificationModeEmailVerify, AccountVerificationModeAdminApproval)
+	}
+	switch backend {
+	case "":
+		return MailBackendMailgun, nil
+	case MailBackendMailgun:
+	case MailBackendOutbox:
+	default:
+		return "", fmt.Errorf("Invalid mail backend in %s: %s", mailBackendKey, backend)
+	}
+	return backend, nil
+}
+
+// The outbox backend still uses the domains, for the "from" address and the
+// links, but it doesn't talk to Mailgun, so it doesn't take an API key.
+//
+// Mail is optional in AdminApproval mode. Setting any of these, or the outbox
+// backend, turns it on, and then they're required the same as in EmailVerify
+// mode.
+func getMailgunConfigs(sendingDomain string, serverDomain string, isDomainEUStr string, privateAPIKey string, mode AccountVerificationMode, backend MailBackend) (string, string, bool, string, error) {
+	anySet := sendingDomain != "" || serverDomain != "" || isDomainEUStr != "" || privateAPIKey != ""
+	if !modeSendsMail(mode) && anySet {
+		return "", "", false, "", fmt.Errorf("Do not specify %s, %s, %s or %s in env if %s is not %s or %s",
 			mailgunSendingDomainKey,
 			mailgunServerDomainKey,
 			mailgunIsDomainEUKey,
 			mailgunPrivateAPIKeyKey,
 			verificationModeKey,
 			AccountVerificationModeEmailVerify,
+			AccountVerificationModeAdminApproval,
 		)
 	}
-	if mode == AccountVerificationModeEmailVerify && (sendingDomain == "" || serverDomain == "" || privateAPIKey == "") {
+	required := mode == AccountVerificationModeEmailVerify ||
+		(mode == AccountVerificationModeAdminApproval && (anySet || backend == MailBackendOutbox))
+	if required && backend == MailBackendOutbox {
+		if sendingDomain == "" || serverDomain == "" {
+			return "", "", false, "", fmt.Errorf("Specify %s and %s in env if %s is %s",
+				mailgunSendingDomainKey,
+				mailgunServerDomainKey,
+				mailBackendKey,
+				MailBackendOutbox,
+			)
+		}
+		if isDomainEUStr != "" || privateAPIKey != "" {
+			return "", "", false, "", fmt.Errorf("Do not specify %s or %s in env if %s is %s",
+				mailgunIsDomainEUKey,
+				mailgunPrivateAPIKeyKey,
+				mailBackendKey,
+				MailBackendOutbox,
+			)
+		}
+	} else if required && (sendingDomain == "" || serverDomain == "" || privateAPIKey == "") {
 		return "", "", false, "", fmt.Errorf("Specify %s, %s and %s in env if %s is %s",
 			mailgunSendingDomainKey,
 			mailgunServerDomainKey,
 			mailgunPrivateAPIKeyKey,
 			verificationModeKey,
-			AccountVerificationModeEmailVerify,
+			mode,
 		)
 	}
 
@@ -134,3 +516,344 @@ func getMailgunConfigs(sendingDomain string, serverDomain string, isDomainEUStr
 
 	return sendingDomain, serverDomain, isDomainEUStr == "true", privateAPIKey, nil
 }
+
+func getMailOutboxConfigs(dir string, logLinksStr string, backend MailBackend) (string, bool, error) {
+	if backend != MailBackendOutbox {
+		if dir != "" || logLinksStr != "" {
+			return "", false, fmt.Errorf("Do not specify %s or %s in env if %s is not %s", mailOutboxDirKey, mailOutboxLogLinksKey, mailBackendKey, MailBackendOutbox)
+		}
+		return "", false, nil
+	}
+
+	if dir == "" {
+		return "", false, fmt.Errorf("Specify %s in env if %s is %s", mailOutboxDirKey, mailBackendKey, MailBackendOutbox)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false, fmt.Errorf("%s is not a directory: %s", mailOutboxDirKey, dir)
+	}
+
+	if logLinksStr != "true" && logLinksStr != "false" && logLinksStr != "" {
+		return "", false, fmt.Errorf("%s must be 'true' or 'false'", mailOutboxLogLinksKey)
+	}
+
+	return dir, logLinksStr == "true", nil
+}
+
+// Empty means 0, which callers should take to mean "no limit"
+func getLimit(key string, limitStr string) (int, error) {
+	if limitStr == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return limit, nil
+}
+
+func getSocketLimits(perUserStr string, perDeviceStr string, totalStr string) (perUser int, perDevice int, total int, err error) {
+	if perUser, err = getLimit(maxSocketsPerUserKey, perUserStr); err != nil {
+		return 0, 0, 0, err
+	}
+	if perDevice, err = getLimit(maxSocketsPerDeviceKey, perDeviceStr); err != nil {
+		return 0, 0, 0, err
+	}
+	if total, err = getLimit(maxSocketsTotalKey, totalStr); err != nil {
+		return 0, 0, 0, err
+	}
+	return
+}
+
+// Durations in Go format, i.e. "30s" or "1m30s"
+func getDuration(key string, durationStr string, defaultDuration time.Duration) (time.Duration, error) {
+	if durationStr == "" {
+		return defaultDuration, nil
+	}
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration such as 30s", key)
+	}
+	return duration, nil
+}
+
+func getShutdownConfigs(readinessDelayStr string, drainTimeoutStr string) (readinessDelay time.Duration, drainTimeout time.Duration, err error) {
+	if readinessDelay, err = getDuration(shutdownReadinessDelayKey, readinessDelayStr, 0); err != nil {
+		return 0, 0, err
+	}
+	if drainTimeout, err = getDuration(shutdownDrainTimeoutKey, drainTimeoutStr, DefaultShutdownDrainTimeout); err != nil {
+		return 0, 0, err
+	}
+	return
+}
+
+func getListenAddresses(addressesStr string, defaultPort int) (addresses []ListenAddress, err error) {
+	if addressesStr == "" {
+		return []ListenAddress{{Network: "tcp", Address: fmt.Sprintf("localhost:%d", defaultPort)}}, nil
+	}
+
+	for _, rawAddress := range strings.Split(addressesStr, ",") {
+		if strings.TrimSpace(rawAddress) != rawAddress || rawAddress == "" {
+			return nil, fmt.Errorf("Addresses in %s should be comma separated with no spaces.", listenAddressesKey)
+		}
+		if strings.HasPrefix(rawAddress, unixAddressPrefix) {
+			path := strings.TrimPrefix(rawAddress, unixAddressPrefix)
+			if path == "" {
+				return nil, fmt.Errorf("Missing socket path in %s: %s", listenAddressesKey, rawAddress)
+			}
+			addresses = append(addresses, ListenAddress{Network: "unix", Address: path})
+			continue
+		}
+		// Host may be empty (all interfaces) but port may not
+		if _, port, splitErr := net.SplitHostPort(rawAddress); splitErr != nil || port == "" {
+			return nil, fmt.Errorf("Invalid address in %s: %s", listenAddressesKey, rawAddress)
+		}
+		addresses = append(addresses, ListenAddress{Network: "tcp", Address: rawAddress})
+	}
+	return addresses, nil
+}
+
+func getTLSConfigs(certFile string, keyFile string, selfSignedStr string) (string, string, bool, error) {
+	if selfSignedStr != "true" && selfSignedStr != "false" && selfSignedStr != "" {
+		return "", "", false, fmt.Errorf("%s must be 'true' or 'false'", tlsSelfSignedKey)
+	}
+	selfSigned := selfSignedStr == "true"
+
+	if (certFile == "") != (keyFile == "") {
+		return "", "", false, fmt.Errorf("Specify both %s and %s, or neither", tlsCertFileKey, tlsKeyFileKey)
+	}
+	if selfSigned && certFile != "" {
+		return "", "", false, fmt.Errorf("Do not specify %s and %s in env if %s is true", tlsCertFileKey, tlsKeyFileKey, tlsSelfSignedKey)
+	}
+	return certFile, keyFile, selfSigned, nil
+}
+
+func getRateLimitConfigs(perMinuteStr string, burstStr string, trustProxyStr string) (perMinute int, burst int, trustProxy bool, err error) {
+	if perMinute, err = getLimit(rateLimitPerMinuteKey, perMinuteStr); err != nil {
+		return 0, 0, false, err
+	}
+	if burst, err = getLimit(rateLimitBurstKey, burstStr); err != nil {
+		return 0, 0, false, err
+	}
+	if burst == 0 {
+		burst = perMinute
+	}
+	if trustProxyStr != "true" && trustProxyStr != "false" && trustProxyStr != "" {
+		return 0, 0, false, fmt.Errorf("%s must be 'true' or 'false'", rateLimitTrustProxyKey)
+	}
+	return perMinute, burst, trustProxyStr == "true", nil
+}
+
+func getDataExportsPerDay(perDayStr string) (int, error) {
+	if perDayStr == "" {
+		return defaultDataExportsPerDay, nil
+	}
+	return getLimit(dataExportsPerDayKey, perDayStr)
+}
+
+func getMailTemplatesDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	// Templates are read when they're needed, so catch a typo now rather than
+	// when sending somebody's verification email.
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory: %s", mailTemplatesDirKey, dir)
+	}
+	return dir, nil
+}
+
+func getCORSAllowedOrigins(originsStr string) (origins []string, err error) {
+	if originsStr == "" {
+		return []string{}, nil
+	}
+	for _, origin := range strings.Split(originsStr, ",") {
+		if strings.TrimSpace(origin) != origin || origin == "" {
+			return nil, fmt.Errorf("Origins in %s should be comma separated with no spaces.", corsAllowedOriginsKey)
+		}
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return nil, fmt.Errorf("Invalid origin in %s: %s", corsAllowedOriginsKey, origin)
+		}
+		// Browsers send the origin without a trailing slash
+		origins = append(origins, strings.TrimSuffix(origin, "/"))
+	}
+	return origins, nil
+}
+
+func getStatsInterval(intervalStr string) (time.Duration, error) {
+	return getDuration(statsIntervalKey, intervalStr, defaultStatsInterval)
+}
+
+func getLogConfigs(levelStr string, formatStr string) (level logging.Level, format logging.Format, err error) {
+	level, format = logging.LevelInfo, logging.FormatText
+	if levelStr != "" {
+		if level, err = logging.ParseLevel(levelStr); err != nil {
+			return 0, "", fmt.Errorf("%s must be debug, info, warn or error", logLevelKey)
+		}
+	}
+	if formatStr != "" {
+		if format, err = logging.ParseFormat(formatStr); err != nil {
+			return 0, "", fmt.Errorf("%s must be text or json", logFormatKey)
+		}
+	}
+	return
+}
+
+func getAdminToken(token string) (string, error) {
+	if token != "" && len(token) < minAdminTokenLength {
+		return "", fmt.Errorf("%s must be at least %d characters", adminTokenKey, minAdminTokenLength)
+	}
+	return token, nil
+}
+
+func getMigrationSigningKey(keyStr string) (ed25519.PrivateKey, error) {
+	if keyStr == "" {
+		return nil, nil
+	}
+	key, err := migration.ParseSigningKey(keyStr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", migrationSigningKeyKey, err.Error())
+	}
+	return key, nil
+}
+
+func getMigrationTrustedKeys(keysStr string) (keys []ed25519.PublicKey, err error) {
+	keys = []ed25519.PublicKey{}
+	if keysStr == "" {
+		return
+	}
+	for _, keyStr := range strings.Split(keysStr, ",") {
+		key, err := migration.ParseTrustedKey(keyStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s should be comma separated with no spaces. %s", migrationTrustedKeysKey, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func getMigrationEncryptionKey(keyStr string) (*[32]byte, error) {
+	if keyStr == "" {
+		return nil, nil
+	}
+	key, err := migration.ParseEncryptionKey(keyStr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", migrationEncryptionKeyKey, err.Error())
+	}
+	return key, nil
+}
+
+func getMigrationDestinations(destinationsStr string) (destinations map[string]*[32]byte, err error) {
+	destinations = map[string]*[32]byte{}
+	if destinationsStr == "" {
+		return
+	}
+	for _, pair := range strings.Split(destinationsStr, ",") {
+		destination, keyStr, found := strings.Cut(pair, "=")
+		destinationURL, err := url.Parse(destination)
+		if !found || err != nil || (destinationURL.Scheme != "https" && destinationURL.Scheme != "http") || destinationURL.Host == "" {
+			return nil, fmt.Errorf("%s should be comma separated url=key with http or https URLs and no spaces", migrationDestinationsKey)
+		}
+		key, err := migration.ParseDestinationKey(keyStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", migrationDestinationsKey, err.Error())
+		}
+		destinations[strings.TrimSuffix(destination, "/")] = key
+	}
+	return
+}
+
+func getMaxBodySize(key string, sizeStr string) (int64, error) {
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+	return size, nil
+}
+
+func getMaxBodySizes(defaultStr string, perEndpointStr string) (defaultLimit int64, perEndpoint map[string]int64, err error) {
+	defaultLimit = DefaultMaxBodySize
+	if defaultStr != "" {
+		if defaultLimit, err = getMaxBodySize(maxBodySizeKey, defaultStr); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	perEndpoint = map[string]int64{}
+	if perEndpointStr == "" {
+		return
+	}
+	for _, pair := range strings.Split(perEndpointStr, ",") {
+		endpoint, sizeStr, found := strings.Cut(pair, "=")
+		if !found || endpoint == "" || strings.TrimSpace(pair) != pair {
+			return 0, nil, fmt.Errorf("%s should be comma separated endpoint=bytes with no spaces.", maxBodySizesKey)
+		}
+		if perEndpoint[endpoint], err = getMaxBodySize(maxBodySizesKey, sizeStr); err != nil {
+			return 0, nil, err
+		}
+	}
+	return
+}
+
+func getMaxWalletUploadSize(sizeStr string) (int64, error) {
+	if sizeStr == "" {
+		return defaultMaxWalletUploadSize, nil
+	}
+	return getMaxBodySize(maxWalletUploadSizeKey, sizeStr)
+}
+
+func getBlobStoreConfig(kindStr string, dir string, s3Endpoint string, s3Bucket string, s3Region string, s3AccessKeyId string, s3SecretAccessKey string) (config BlobStoreConfig, err error) {
+	hasS3Configs := s3Endpoint != "" || s3Bucket != "" || s3Region != "" || s3AccessKeyId != "" || s3SecretAccessKey != ""
+
+	switch BlobStoreKind(kindStr) {
+	case BlobStoreNone:
+		if dir != "" || hasS3Configs {
+			err = fmt.Errorf("Do not specify %s or any %s_S3_ settings in env if %s is not set", blobStoreDirKey, blobStoreKey, blobStoreKey)
+		}
+	case BlobStoreFS:
+		if dir == "" {
+			err = fmt.Errorf("Specify %s in env if %s is %s", blobStoreDirKey, blobStoreKey, BlobStoreFS)
+		} else if hasS3Configs {
+			err = fmt.Errorf("Do not specify any %s_S3_ settings in env if %s is %s", blobStoreKey, blobStoreKey, BlobStoreFS)
+		}
+		config = BlobStoreConfig{Kind: BlobStoreFS, Dir: dir}
+	case BlobStoreS3:
+		if s3Endpoint == "" || s3Bucket == "" || s3AccessKeyId == "" || s3SecretAccessKey == "" {
+			err = fmt.Errorf("Specify %s, %s, %s and %s in env if %s is %s",
+				blobStoreS3EndpointKey,
+				blobStoreS3BucketKey,
+				blobStoreS3AccessKeyIdKey,
+				blobStoreS3SecretAccessKeyKey,
+				blobStoreKey,
+				BlobStoreS3,
+			)
+		} else if dir != "" {
+			err = fmt.Errorf("Do not specify %s in env if %s is %s", blobStoreDirKey, blobStoreKey, BlobStoreS3)
+		}
+		if s3Region == "" {
+			s3Region = defaultBlobStoreS3Region
+		}
+		config = BlobStoreConfig{
+			Kind:              BlobStoreS3,
+			S3Endpoint:        s3Endpoint,
+			S3Bucket:          s3Bucket,
+			S3Region:          s3Region,
+			S3AccessKeyId:     s3AccessKeyId,
+			S3SecretAccessKey: s3SecretAccessKey,
+		}
+	default:
+		err = fmt.Errorf("%s must be %s or %s, or unset", blobStoreKey, BlobStoreFS, BlobStoreS3)
+	}
+
+	if err != nil {
+		return BlobStoreConfig{}, err
+	}
+	return
+}
+
+func getWalletCompression(encodingStr string) (compression.Encoding, error) {
+	encoding, err := compression.ParseEncoding(encodingStr)
+	if err != nil {
+		return "", fmt.Errorf("%s must be gzip or zstd, or unset", walletCompressionKey)
+	}
+	return encoding, nil
+}
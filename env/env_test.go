@@ -3,9 +3,13 @@ package env
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/logging"
 )
 
 func TestAccountVerificationMode(t *testing.T) {
@@ -34,6 +38,18 @@ func TestAccountVerificationMode(t *testing.T) {
 			modeStr:      "Whitelist",
 			expectedMode: AccountVerificationModeWhitelist,
 		},
+		{
+			name: "invite code",
+
+			modeStr:      "InviteCode",
+			expectedMode: AccountVerificationModeInviteCode,
+		},
+		{
+			name: "admin approval",
+
+			modeStr:      "AdminApproval",
+			expectedMode: AccountVerificationModeAdminApproval,
+		},
 		{
 			name: "blank",
 
@@ -124,6 +140,7 @@ func TestMailgunConfigs(t *testing.T) {
 		isDomainEUStr  string
 		expectDomainEU bool
 		mode           AccountVerificationMode
+		backend        MailBackend
 
 		expectErr bool
 	}{
@@ -186,10 +203,62 @@ func TestMailgunConfigs(t *testing.T) {
 			serverDomain:  "server.example.com",
 			expectErr:     true,
 		},
+		{
+			name:          "outbox without private api key",
+			mode:          AccountVerificationModeEmailVerify,
+			backend:       MailBackendOutbox,
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			expectErr:     false,
+		},
+		{
+			name:          "outbox with private api key",
+			mode:          AccountVerificationModeEmailVerify,
+			backend:       MailBackendOutbox,
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			privateAPIKey: "my-private-api-key",
+			expectErr:     true,
+		},
+		{
+			name:      "outbox missing domains",
+			mode:      AccountVerificationModeEmailVerify,
+			backend:   MailBackendOutbox,
+			expectErr: true,
+		},
+		{
+			name:      "admin approval without mail",
+			mode:      AccountVerificationModeAdminApproval,
+			backend:   MailBackendMailgun,
+			expectErr: false,
+		},
+		{
+			name:          "admin approval with mail",
+			mode:          AccountVerificationModeAdminApproval,
+			backend:       MailBackendMailgun,
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			privateAPIKey: "my-private-api-key",
+			expectErr:     false,
+		},
+		{
+			name:          "admin approval with mail missing private api key",
+			mode:          AccountVerificationModeAdminApproval,
+			backend:       MailBackendMailgun,
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			expectErr:     true,
+		},
+		{
+			name:      "admin approval outbox missing domains",
+			mode:      AccountVerificationModeAdminApproval,
+			backend:   MailBackendOutbox,
+			expectErr: true,
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			sendingDomain, serverDomain, isDomainEu, privateAPIKey, err := getMailgunConfigs(tc.sendingDomain, tc.serverDomain, tc.isDomainEUStr, tc.privateAPIKey, tc.mode)
+			sendingDomain, serverDomain, isDomainEu, privateAPIKey, err := getMailgunConfigs(tc.sendingDomain, tc.serverDomain, tc.isDomainEUStr, tc.privateAPIKey, tc.mode, tc.backend)
 			if tc.expectErr && err == nil {
 				t.Errorf("Expected err")
 			}
@@ -212,3 +281,1005 @@ func TestMailgunConfigs(t *testing.T) {
 	}
 
 }
+
+func TestInvitesPerUser(t *testing.T) {
+	tt := []struct {
+		name string
+
+		perUserStr string
+		mode       AccountVerificationMode
+
+		expectedPerUser int
+		expectErr       bool
+	}{
+		{
+			name: "unset",
+			mode: AccountVerificationModeInviteCode,
+		},
+		{
+			name:            "set",
+			perUserStr:      "5",
+			mode:            AccountVerificationModeInviteCode,
+			expectedPerUser: 5,
+		},
+		{
+			name:       "negative",
+			perUserStr: "-1",
+			mode:       AccountVerificationModeInviteCode,
+			expectErr:  true,
+		},
+		{
+			name:       "wrong mode",
+			perUserStr: "5",
+			mode:       AccountVerificationModeEmailVerify,
+			expectErr:  true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			perUser, err := getInvitesPerUser(tc.perUserStr, tc.mode)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if perUser != tc.expectedPerUser {
+				t.Errorf("Expected %d invites per user, got %d", tc.expectedPerUser, perUser)
+			}
+		})
+	}
+}
+
+func TestMailBackend(t *testing.T) {
+	tt := []struct {
+		name string
+
+		backendStr string
+		mode       AccountVerificationMode
+
+		expectedBackend MailBackend
+		expectErr       bool
+	}{
+		{
+			name:            "default",
+			mode:            AccountVerificationModeEmailVerify,
+			expectedBackend: MailBackendMailgun,
+		},
+		{
+			name:            "mailgun",
+			backendStr:      "mailgun",
+			mode:            AccountVerificationModeEmailVerify,
+			expectedBackend: MailBackendMailgun,
+		},
+		{
+			name:            "outbox",
+			backendStr:      "outbox",
+			mode:            AccountVerificationModeEmailVerify,
+			expectedBackend: MailBackendOutbox,
+		},
+		{
+			name:            "admin approval",
+			backendStr:      "outbox",
+			mode:            AccountVerificationModeAdminApproval,
+			expectedBackend: MailBackendOutbox,
+		},
+		{
+			name:       "invalid",
+			backendStr: "carrier-pigeon",
+			mode:       AccountVerificationModeEmailVerify,
+			expectErr:  true,
+		},
+		{
+			name:       "wrong mode",
+			backendStr: "outbox",
+			mode:       AccountVerificationModeAllowAll,
+			expectErr:  true,
+		},
+		{
+			name: "wrong mode unset",
+			mode: AccountVerificationModeAllowAll,
+			// Doesn't matter what it is, nothing gets sent
+			expectedBackend: MailBackendMailgun,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			backend, err := getMailBackend(tc.backendStr, tc.mode)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if backend != tc.expectedBackend {
+				t.Errorf("Expected backend %s, got %s", tc.expectedBackend, backend)
+			}
+		})
+	}
+}
+
+func TestMailOutboxConfigs(t *testing.T) {
+	dir := t.TempDir()
+
+	tt := []struct {
+		name string
+
+		dir         string
+		logLinksStr string
+		backend     MailBackend
+
+		expectedLogLinks bool
+		expectErr        bool
+	}{
+		{
+			name:    "mailgun",
+			backend: MailBackendMailgun,
+		},
+		{
+			name:      "mailgun with outbox dir",
+			backend:   MailBackendMailgun,
+			dir:       dir,
+			expectErr: true,
+		},
+		{
+			name:    "outbox",
+			backend: MailBackendOutbox,
+			dir:     dir,
+		},
+		{
+			name:             "outbox logging links",
+			backend:          MailBackendOutbox,
+			dir:              dir,
+			logLinksStr:      "true",
+			expectedLogLinks: true,
+		},
+		{
+			name:        "invalid log links",
+			backend:     MailBackendOutbox,
+			dir:         dir,
+			logLinksStr: "yes",
+			expectErr:   true,
+		},
+		{
+			name:      "outbox missing dir",
+			backend:   MailBackendOutbox,
+			expectErr: true,
+		},
+		{
+			name:      "outbox dir doesn't exist",
+			backend:   MailBackendOutbox,
+			dir:       dir + "/nope",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gotDir, logLinks, err := getMailOutboxConfigs(tc.dir, tc.logLinksStr, tc.backend)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && gotDir != tc.dir {
+				t.Errorf("Expected dir %s, got %s", tc.dir, gotDir)
+			}
+			if logLinks != tc.expectedLogLinks {
+				t.Errorf("Expected logLinks %v, got %v", tc.expectedLogLinks, logLinks)
+			}
+		})
+	}
+}
+
+func TestSocketLimits(t *testing.T) {
+	tt := []struct {
+		name string
+
+		perUserStr   string
+		perDeviceStr string
+		totalStr     string
+
+		expectedPerUser   int
+		expectedPerDevice int
+		expectedTotal     int
+		expectedErr       error
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "all set",
+
+			perUserStr:   "10",
+			perDeviceStr: "3",
+			totalStr:     "10000",
+
+			expectedPerUser:   10,
+			expectedPerDevice: 3,
+			expectedTotal:     10000,
+		},
+		{
+			name: "negative",
+
+			perUserStr:  "-1",
+			expectedErr: fmt.Errorf("MAX_SOCKETS_PER_USER must be a non-negative integer"),
+		},
+		{
+			name: "not a number",
+
+			totalStr:    "lots",
+			expectedErr: fmt.Errorf("MAX_SOCKETS_TOTAL must be a non-negative integer"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			perUser, perDevice, total, err := getSocketLimits(tc.perUserStr, tc.perDeviceStr, tc.totalStr)
+			if perUser != tc.expectedPerUser || perDevice != tc.expectedPerDevice || total != tc.expectedTotal {
+				t.Errorf("Expected limits %d %d %d got %d %d %d", tc.expectedPerUser, tc.expectedPerDevice, tc.expectedTotal, perUser, perDevice, total)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tc.expectedErr) {
+				t.Errorf("Expected error `%s` got `%s`", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestShutdownConfigs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		readinessDelayStr string
+		drainTimeoutStr   string
+
+		expectedReadinessDelay time.Duration
+		expectedDrainTimeout   time.Duration
+		expectedErr            error
+	}{
+		{
+			name: "defaults",
+
+			expectedDrainTimeout: 30 * time.Second,
+		},
+		{
+			name: "all set",
+
+			readinessDelayStr: "5s",
+			drainTimeoutStr:   "1m",
+
+			expectedReadinessDelay: 5 * time.Second,
+			expectedDrainTimeout:   time.Minute,
+		},
+		{
+			name: "no unit",
+
+			drainTimeoutStr: "30",
+			expectedErr:     fmt.Errorf("SHUTDOWN_DRAIN_TIMEOUT must be a non-negative duration such as 30s"),
+		},
+		{
+			name: "negative",
+
+			readinessDelayStr: "-5s",
+			expectedErr:       fmt.Errorf("SHUTDOWN_READINESS_DELAY must be a non-negative duration such as 30s"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			readinessDelay, drainTimeout, err := getShutdownConfigs(tc.readinessDelayStr, tc.drainTimeoutStr)
+			if readinessDelay != tc.expectedReadinessDelay || drainTimeout != tc.expectedDrainTimeout {
+				t.Errorf("Expected %s %s got %s %s", tc.expectedReadinessDelay, tc.expectedDrainTimeout, readinessDelay, drainTimeout)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tc.expectedErr) {
+				t.Errorf("Expected error `%s` got `%s`", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tt := []struct {
+		name string
+
+		addressesStr      string
+		expectedAddresses []ListenAddress
+		expectedErr       error
+	}{
+		{
+			name: "default",
+
+			expectedAddresses: []ListenAddress{{"tcp", "localhost:8090"}},
+		},
+		{
+			name: "multiple",
+
+			addressesStr: "localhost:8090,192.168.1.5:443,:8091,unix:/run/wallet-sync.sock",
+			expectedAddresses: []ListenAddress{
+				{"tcp", "localhost:8090"},
+				{"tcp", "192.168.1.5:443"},
+				{"tcp", ":8091"},
+				{"unix", "/run/wallet-sync.sock"},
+			},
+		},
+		{
+			name: "spaces",
+
+			addressesStr: "localhost:8090, :8091",
+			expectedErr:  fmt.Errorf("Addresses in LISTEN_ADDRESSES should be comma separated with no spaces."),
+		},
+		{
+			name: "missing port",
+
+			addressesStr: "localhost",
+			expectedErr:  fmt.Errorf("Invalid address in LISTEN_ADDRESSES: localhost"),
+		},
+		{
+			name: "missing socket path",
+
+			addressesStr: "unix:",
+			expectedErr:  fmt.Errorf("Missing socket path in LISTEN_ADDRESSES: unix:"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			addresses, err := getListenAddresses(tc.addressesStr, 8090)
+			if !reflect.DeepEqual(addresses, tc.expectedAddresses) {
+				t.Errorf("Expected addresses %+v got %+v", tc.expectedAddresses, addresses)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tc.expectedErr) {
+				t.Errorf("Expected error `%s` got `%s`", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		certFile      string
+		keyFile       string
+		selfSignedStr string
+
+		expectSelfSigned bool
+		expectErr        bool
+	}{
+		{
+			name: "no tls",
+		},
+		{
+			name:     "cert files",
+			certFile: "/etc/wallet-sync/cert.pem",
+			keyFile:  "/etc/wallet-sync/key.pem",
+		},
+		{
+			name:             "self signed",
+			selfSignedStr:    "true",
+			expectSelfSigned: true,
+		},
+		{
+			name:      "missing key file",
+			certFile:  "/etc/wallet-sync/cert.pem",
+			expectErr: true,
+		},
+		{
+			name:          "cert files and self signed",
+			certFile:      "/etc/wallet-sync/cert.pem",
+			keyFile:       "/etc/wallet-sync/key.pem",
+			selfSignedStr: "true",
+			expectErr:     true,
+		},
+		{
+			name:          "invalid self signed",
+			selfSignedStr: "yes",
+			expectErr:     true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			certFile, keyFile, selfSigned, err := getTLSConfigs(tc.certFile, tc.keyFile, tc.selfSignedStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && (certFile != tc.certFile || keyFile != tc.keyFile || selfSigned != tc.expectSelfSigned) {
+				t.Errorf("Unexpected values: %s %s %v", certFile, keyFile, selfSigned)
+			}
+		})
+	}
+}
+
+func TestRateLimitConfigs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		perMinuteStr  string
+		burstStr      string
+		trustProxyStr string
+
+		expectedPerMinute  int
+		expectedBurst      int
+		expectedTrustProxy bool
+		expectErr          bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:              "burst defaults to per minute",
+			perMinuteStr:      "60",
+			expectedPerMinute: 60,
+			expectedBurst:     60,
+		},
+		{
+			name:               "all set",
+			perMinuteStr:       "60",
+			burstStr:           "10",
+			trustProxyStr:      "true",
+			expectedPerMinute:  60,
+			expectedBurst:      10,
+			expectedTrustProxy: true,
+		},
+		{
+			name:         "negative",
+			perMinuteStr: "-1",
+			expectErr:    true,
+		},
+		{
+			name:          "invalid trust proxy",
+			trustProxyStr: "yes",
+			expectErr:     true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			perMinute, burst, trustProxy, err := getRateLimitConfigs(tc.perMinuteStr, tc.burstStr, tc.trustProxyStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && (perMinute != tc.expectedPerMinute || burst != tc.expectedBurst || trustProxy != tc.expectedTrustProxy) {
+				t.Errorf("Unexpected values: %d %d %v", perMinute, burst, trustProxy)
+			}
+		})
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	tt := []struct {
+		name string
+
+		originsStr      string
+		expectedOrigins []string
+		expectErr       bool
+	}{
+		{
+			name:            "unset",
+			expectedOrigins: []string{},
+		},
+		{
+			name:            "multiple",
+			originsStr:      "https://example.com/,http://localhost:1337",
+			expectedOrigins: []string{"https://example.com", "http://localhost:1337"},
+		},
+		{
+			name:            "any",
+			originsStr:      "*",
+			expectedOrigins: []string{"*"},
+		},
+		{
+			name:       "spaces",
+			originsStr: "https://example.com, http://localhost:1337",
+			expectErr:  true,
+		},
+		{
+			name:       "no scheme",
+			originsStr: "example.com",
+			expectErr:  true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			origins, err := getCORSAllowedOrigins(tc.originsStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && !reflect.DeepEqual(origins, tc.expectedOrigins) {
+				t.Errorf("Expected origins %+v got %+v", tc.expectedOrigins, origins)
+			}
+		})
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	tt := []struct {
+		name string
+
+		intervalStr      string
+		expectedInterval time.Duration
+		expectErr        bool
+	}{
+		{name: "default", expectedInterval: 5 * time.Minute},
+		{name: "set", intervalStr: "1h", expectedInterval: time.Hour},
+		{name: "off", intervalStr: "0s", expectedInterval: 0},
+		{name: "invalid", intervalStr: "hourly", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			interval, err := getStatsInterval(tc.intervalStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && interval != tc.expectedInterval {
+				t.Errorf("Expected interval %s got %s", tc.expectedInterval, interval)
+			}
+		})
+	}
+}
+
+func TestLogConfigs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		levelStr  string
+		formatStr string
+
+		expectedLevel  logging.Level
+		expectedFormat logging.Format
+		expectErr      bool
+	}{
+		{name: "default", expectedLevel: logging.LevelInfo, expectedFormat: logging.FormatText},
+		{name: "set", levelStr: "debug", formatStr: "json", expectedLevel: logging.LevelDebug, expectedFormat: logging.FormatJSON},
+		{name: "case insensitive", levelStr: "WARN", expectedLevel: logging.LevelWarn, expectedFormat: logging.FormatText},
+		{name: "invalid level", levelStr: "loud", expectErr: true},
+		{name: "invalid format", formatStr: "xml", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			level, format, err := getLogConfigs(tc.levelStr, tc.formatStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && (level != tc.expectedLevel || format != tc.expectedFormat) {
+				t.Errorf("Expected %s %s, got %s %s", tc.expectedLevel, tc.expectedFormat, level, format)
+			}
+		})
+	}
+}
+
+func TestDataExportsPerDay(t *testing.T) {
+	tt := []struct {
+		name string
+
+		perDayStr      string
+		expectedPerDay int
+		expectErr      bool
+	}{
+		{name: "default", perDayStr: "", expectedPerDay: 3},
+		{name: "set", perDayStr: "10", expectedPerDay: 10},
+		{name: "no limit", perDayStr: "0", expectedPerDay: 0},
+		{name: "negative", perDayStr: "-1", expectErr: true},
+		{name: "not a number", perDayStr: "lots", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			perDay, err := getDataExportsPerDay(tc.perDayStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && perDay != tc.expectedPerDay {
+				t.Errorf("Expected %d per day got %d", tc.expectedPerDay, perDay)
+			}
+		})
+	}
+}
+
+func TestMailTemplatesDir(t *testing.T) {
+	dir := t.TempDir()
+
+	tt := []struct {
+		name string
+
+		dirStr      string
+		expectedDir string
+		expectErr   bool
+	}{
+		{name: "built-in only", dirStr: "", expectedDir: ""},
+		{name: "set", dirStr: dir, expectedDir: dir},
+		{name: "missing", dirStr: dir + "/nope", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gotDir, err := getMailTemplatesDir(tc.dirStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && gotDir != tc.expectedDir {
+				t.Errorf("Expected dir %s got %s", tc.expectedDir, gotDir)
+			}
+		})
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	tt := []struct {
+		name string
+
+		tokenStr      string
+		expectedToken string
+		expectErr     bool
+	}{
+		{name: "off", tokenStr: "", expectedToken: ""},
+		{name: "set", tokenStr: "abcd1234abcd1234abcd1234abcd1234", expectedToken: "abcd1234abcd1234abcd1234abcd1234"},
+		{name: "too short", tokenStr: "abcd1234", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := getAdminToken(tc.tokenStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && token != tc.expectedToken {
+				t.Errorf("Expected token %s got %s", tc.expectedToken, token)
+			}
+		})
+	}
+}
+
+func TestMigrationSigningKey(t *testing.T) {
+	tt := []struct {
+		name string
+
+		keyStr    string
+		expectKey bool
+		expectErr bool
+	}{
+		{name: "off", keyStr: ""},
+		{name: "set", keyStr: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", expectKey: true},
+		{name: "too short", keyStr: "AAECAwQF", expectErr: true},
+		{name: "not base64", keyStr: "not base64!", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := getMigrationSigningKey(tc.keyStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if tc.expectKey != (key != nil) {
+				t.Errorf("Expected key: %v got %v", tc.expectKey, key)
+			}
+		})
+	}
+}
+
+func TestMigrationTrustedKeys(t *testing.T) {
+	tt := []struct {
+		name string
+
+		keysStr         string
+		expectedNumKeys int
+		expectErr       bool
+	}{
+		{name: "off", keysStr: "", expectedNumKeys: 0},
+		{name: "one", keysStr: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", expectedNumKeys: 1},
+		{name: "two", keysStr: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=,HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE=", expectedNumKeys: 2},
+		{name: "spaces", keysStr: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=, HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE=", expectErr: true},
+		{name: "too short", keysStr: "AAECAwQF", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := getMigrationTrustedKeys(tc.keysStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && len(keys) != tc.expectedNumKeys {
+				t.Errorf("Expected %d keys got %d", tc.expectedNumKeys, len(keys))
+			}
+		})
+	}
+}
+
+func TestMigrationEncryptionKey(t *testing.T) {
+	if key, err := getMigrationEncryptionKey(""); key != nil || err != nil {
+		t.Errorf("Expected no key and no error when unset, got %+v %+v", key, err)
+	}
+	if key, err := getMigrationEncryptionKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="); key == nil || err != nil {
+		t.Errorf("Expected a key, got %+v %+v", key, err)
+	}
+	if _, err := getMigrationEncryptionKey("AAECAwQF"); err == nil {
+		t.Errorf("Expected err for a short key")
+	}
+}
+
+func TestMigrationDestinations(t *testing.T) {
+	const key = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	const otherKey = "HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE="
+
+	tt := []struct {
+		name string
+
+		destinationsStr      string
+		expectedDestinations []string
+		expectErr            bool
+	}{
+		{name: "off", destinationsStr: "", expectedDestinations: []string{}},
+		{name: "one", destinationsStr: "https://other.example.com=" + key, expectedDestinations: []string{"https://other.example.com"}},
+		{name: "two", destinationsStr: "https://other.example.com/=" + key + ",http://localhost:8090=" + otherKey, expectedDestinations: []string{"http://localhost:8090", "https://other.example.com"}},
+		{name: "spaces", destinationsStr: "https://other.example.com=" + key + ", http://localhost:8090=" + otherKey, expectErr: true},
+		{name: "no key", destinationsStr: "https://other.example.com", expectErr: true},
+		{name: "short key", destinationsStr: "https://other.example.com=AAECAwQF", expectErr: true},
+		{name: "not http", destinationsStr: "ftp://other.example.com=" + key, expectErr: true},
+		{name: "no host", destinationsStr: "https://=" + key, expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			destinations, err := getMigrationDestinations(tc.destinationsStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if tc.expectErr {
+				return
+			}
+			urls := []string{}
+			for url := range destinations {
+				urls = append(urls, url)
+			}
+			sort.Strings(urls)
+			if !reflect.DeepEqual(urls, tc.expectedDestinations) {
+				t.Errorf("Expected destinations %+v got %+v", tc.expectedDestinations, urls)
+			}
+		})
+	}
+}
+
+func TestMaxBodySizes(t *testing.T) {
+	tt := []struct {
+		name string
+
+		defaultStr          string
+		perEndpointStr      string
+		expectedDefault     int64
+		expectedPerEndpoint map[string]int64
+		expectErr           bool
+	}{
+		{
+			name:                "unset",
+			expectedDefault:     100000,
+			expectedPerEndpoint: map[string]int64{},
+		},
+		{
+			name:                "set",
+			defaultStr:          "50000",
+			perEndpointStr:      "wallet=1000000,password=2000000",
+			expectedDefault:     50000,
+			expectedPerEndpoint: map[string]int64{"wallet": 1000000, "password": 2000000},
+		},
+		{
+			name:       "invalid default",
+			defaultStr: "0",
+			expectErr:  true,
+		},
+		{
+			name:           "invalid endpoint size",
+			perEndpointStr: "wallet=lots",
+			expectErr:      true,
+		},
+		{
+			name:           "missing size",
+			perEndpointStr: "wallet",
+			expectErr:      true,
+		},
+		{
+			name:           "spaces",
+			perEndpointStr: "wallet=1000000, password=1000000",
+			expectErr:      true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			defaultLimit, perEndpoint, err := getMaxBodySizes(tc.defaultStr, tc.perEndpointStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && (defaultLimit != tc.expectedDefault || !reflect.DeepEqual(perEndpoint, tc.expectedPerEndpoint)) {
+				t.Errorf("Expected limits %d %+v got %d %+v", tc.expectedDefault, tc.expectedPerEndpoint, defaultLimit, perEndpoint)
+			}
+		})
+	}
+}
+
+func TestMaxWalletUploadSize(t *testing.T) {
+	tt := []struct {
+		name string
+
+		sizeStr      string
+		expectedSize int64
+		expectErr    bool
+	}{
+		{name: "unset", sizeStr: "", expectedSize: 10000000},
+		{name: "set", sizeStr: "50000000", expectedSize: 50000000},
+		{name: "zero", sizeStr: "0", expectErr: true},
+		{name: "invalid", sizeStr: "lots", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			size, err := getMaxWalletUploadSize(tc.sizeStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && size != tc.expectedSize {
+				t.Errorf("Expected size %d got %d", tc.expectedSize, size)
+			}
+		})
+	}
+}
+
+func TestBlobStoreConfig(t *testing.T) {
+	tt := []struct {
+		name string
+
+		kindStr           string
+		dir               string
+		s3Endpoint        string
+		s3Bucket          string
+		s3Region          string
+		s3AccessKeyId     string
+		s3SecretAccessKey string
+
+		expectedConfig BlobStoreConfig
+		expectErr      bool
+	}{
+		{
+			name:           "unset",
+			expectedConfig: BlobStoreConfig{},
+		},
+		{
+			name:           "fs",
+			kindStr:        "fs",
+			dir:            "/var/lib/wallets",
+			expectedConfig: BlobStoreConfig{Kind: BlobStoreFS, Dir: "/var/lib/wallets"},
+		},
+		{
+			name:              "s3",
+			kindStr:           "s3",
+			s3Endpoint:        "https://s3.example.com",
+			s3Bucket:          "wallets",
+			s3Region:          "eu-west-1",
+			s3AccessKeyId:     "key-id",
+			s3SecretAccessKey: "secret",
+			expectedConfig: BlobStoreConfig{
+				Kind:              BlobStoreS3,
+				S3Endpoint:        "https://s3.example.com",
+				S3Bucket:          "wallets",
+				S3Region:          "eu-west-1",
+				S3AccessKeyId:     "key-id",
+				S3SecretAccessKey: "secret",
+			},
+		},
+		{
+			name:              "s3 default region",
+			kindStr:           "s3",
+			s3Endpoint:        "https://s3.example.com",
+			s3Bucket:          "wallets",
+			s3AccessKeyId:     "key-id",
+			s3SecretAccessKey: "secret",
+			expectedConfig: BlobStoreConfig{
+				Kind:              BlobStoreS3,
+				S3Endpoint:        "https://s3.example.com",
+				S3Bucket:          "wallets",
+				S3Region:          "us-east-1",
+				S3AccessKeyId:     "key-id",
+				S3SecretAccessKey: "secret",
+			},
+		},
+		{
+			name:      "invalid kind",
+			kindStr:   "ftp",
+			expectErr: true,
+		},
+		{
+			name:      "fs missing dir",
+			kindStr:   "fs",
+			expectErr: true,
+		},
+		{
+			name:       "fs with s3 settings",
+			kindStr:    "fs",
+			dir:        "/var/lib/wallets",
+			s3Endpoint: "https://s3.example.com",
+			expectErr:  true,
+		},
+		{
+			name:          "s3 missing secret",
+			kindStr:       "s3",
+			s3Endpoint:    "https://s3.example.com",
+			s3Bucket:      "wallets",
+			s3AccessKeyId: "key-id",
+			expectErr:     true,
+		},
+		{
+			name:      "settings without a kind",
+			dir:       "/var/lib/wallets",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := getBlobStoreConfig(tc.kindStr, tc.dir, tc.s3Endpoint, tc.s3Bucket, tc.s3Region, tc.s3AccessKeyId, tc.s3SecretAccessKey)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && config != tc.expectedConfig {
+				t.Errorf("Expected config %+v got %+v", tc.expectedConfig, config)
+			}
+		})
+	}
+}
+
+func TestWalletCompression(t *testing.T) {
+	tt := []struct {
+		name string
+
+		encodingStr      string
+		expectedEncoding compression.Encoding
+		expectErr        bool
+	}{
+		{name: "unset", encodingStr: "", expectedEncoding: compression.Identity},
+		{name: "gzip", encodingStr: "gzip", expectedEncoding: compression.Gzip},
+		{name: "zstd", encodingStr: "zstd", expectedEncoding: compression.Zstd},
+		{name: "invalid", encodingStr: "br", expectErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			encoding, err := getWalletCompression(tc.encodingStr)
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if !tc.expectErr && encoding != tc.expectedEncoding {
+				t.Errorf("Expected encoding %q got %q", tc.expectedEncoding, encoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package logging
+
+// A small structured logger, along the lines of log/slog (which we can't use
+// yet since we're on Go 1.18). Every line has a time, level and message, plus
+// key/value fields, written as logfmt or JSON.
+//
+// Values go through redact before they're written. Emails are hashed, and
+// tokens and passwords are never written at all. Prefer passing the typed
+// values (auth.Email, auth.AuthTokenString etc) so that redaction doesn't rely
+// on the field name.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+func ParseLevel(levelStr string) (Level, error) {
+	switch strings.ToLower(levelStr) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("Invalid log level: %s", levelStr)
+	}
+}
+
+type Format string
+
+// logfmt, i.e. time=... level=INFO msg="Server start" address=localhost:8090
+const FormatText = Format("text")
+const FormatJSON = Format("json")
+
+func ParseFormat(formatStr string) (Format, error) {
+	switch format := Format(strings.ToLower(formatStr)); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Invalid log format: %s", formatStr)
+	}
+}
+
+type Field struct {
+	Key   string
+	Value any
+}
+
+func F(key string, value any) Field {
+	return Field{key, value}
+}
+
+func Err(err error) Field {
+	return Field{"error", err}
+}
+
+const requestIdKey = "request_id"
+
+type Logger struct {
+	// Shared between a logger and everything derived from it with With, so that
+	// lines don't get interleaved
+	mu *sync.Mutex
+
+	out    io.Writer
+	level  Level
+	format Format
+	fields []Field
+
+	// For tests
+	now func() time.Time
+}
+
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, format: format, now: time.Now}
+}
+
+// A logger that adds the given fields to every line
+func (l *Logger) With(fields ...Field) *Logger {
+	child := *l
+	child.fields = append(append([]Field{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+// For startup errors
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]Field, 0, 3+len(l.fields)+len(fields))
+	all = append(all,
+		Field{"time", l.now().UTC().Format(time.RFC3339Nano)},
+		Field{"level", level.String()},
+		Field{"msg", msg},
+	)
+	for _, field := range append(append([]Field{}, l.fields...), fields...) {
+		all = append(all, Field{field.Key, redact(field.Key, field.Value)})
+	}
+
+	var line []byte
+	if l.format == FormatJSON {
+		line = formatJSON(all)
+	} else {
+		line = formatText(all)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+const redacted = "[REDACTED]"
+
+// Field names that should never have their values logged, whatever the type.
+// Names are compared in snake case, so verifyToken is verify_token. A key is
+// sensitive if it's one of sensitiveKeys, or ends with one of
+// sensitiveSuffixes (i.e. new_password, auth_token). Anything else with "key"
+// in it (public_key, trusted_keys) is fine to log.
+var sensitiveKeys = []string{"key", "private_key", "signing_key", "encryption_key", "api_key"}
+var sensitiveSuffixes = []string{"token", "password", "secret", "hmac"}
+
+func isSensitiveKey(key string) bool {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		if r == '-' {
+			r = '_'
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	snakeKey := b.String()
+
+	for _, sensitiveKey := range sensitiveKeys {
+		if snakeKey == sensitiveKey {
+			return true
+		}
+	}
+	for _, suffix := range sensitiveSuffixes {
+		if snakeKey == suffix || strings.HasSuffix(snakeKey, "_"+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Short enough to read, long enough to tell users apart. Not meant to stop
+// a determined attacker with a list of emails; just to keep them out of
+// plain sight in the logs.
+func HashEmail(email auth.Email) string {
+	sum := sha256.Sum256([]byte(email.Normalize()))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func redact(key string, value any) any {
+	switch v := value.(type) {
+	case auth.Email:
+		return HashEmail(v)
+	case auth.NormalizedEmail:
+		return HashEmail(auth.Email(v))
+	case auth.Password, auth.AuthTokenString, auth.VerifyTokenString:
+		return redacted
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	if isSensitiveKey(key) {
+		return redacted
+	}
+	if strings.Contains(strings.ToLower(key), "email") {
+		if s, ok := value.(string); ok {
+			return HashEmail(auth.Email(s))
+		}
+	}
+	return value
+}
+
+func formatJSON(fields []Field) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.Key)
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%+v", field.Value))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatText(fields []Field) []byte {
+	var b strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		value := fmt.Sprintf("%+v", field.Value)
+		if needsQuoting(value) {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(field.Key)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+///////////////////////
+// Default and context
+///////////////////////
+
+var defaultLogger = New(os.Stderr, LevelInfo, FormatText)
+var defaultLoggerMu sync.RWMutex
+
+func Default() *Logger {
+	defaultLoggerMu.RLock()
+	defer defaultLoggerMu.RUnlock()
+	return defaultLogger
+}
+
+// Also sends anything written with the standard library's log package (i.e.
+// net/http's errors) through the new logger.
+func SetDefault(l *Logger) {
+	defaultLoggerMu.Lock()
+	defaultLogger = l
+	defaultLoggerMu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{LevelInfo})
+}
+
+func Debug(msg string, fields ...Field) { Default().log(LevelDebug, msg, fields) }
+func Info(msg string, fields ...Field)  { Default().log(LevelInfo, msg, fields) }
+func Warn(msg string, fields ...Field)  { Default().log(LevelWarn, msg, fields) }
+func Error(msg string, fields ...Field) { Default().log(LevelError, msg, fields) }
+func Fatal(msg string, fields ...Field) { Default().Fatal(msg, fields...) }
+
+// Adapts the default logger to an io.Writer, for the standard library's
+// log.Logger.
+type stdWriter struct {
+	level Level
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	Default().log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// For http.Server.ErrorLog
+func NewStdLogger(level Level) *log.Logger {
+	return log.New(stdWriter{level}, "", 0)
+}
+
+type contextKey int
+
+const requestIdContextKey contextKey = iota
+
+func ContextWithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey, requestId)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey).(string)
+	return requestId
+}
+
+// The default logger, with the request id if there is one
+func FromContext(ctx context.Context) *Logger {
+	if requestId := RequestIdFromContext(ctx); requestId != "" {
+		return Default().With(Field{requestIdKey, requestId})
+	}
+	return Default()
+}
@@ -0,0 +1,168 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+func newTestLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := New(&buf, level, format)
+	logger.now = func() time.Time { return time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC) }
+	return logger, &buf
+}
+
+func TestLoggerText(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo, FormatText)
+	logger.With(F("request_id", "abc123")).Info("Something happened", F("user_id", auth.UserId(5)), F("detail", "with spaces"))
+
+	expected := `time=2022-07-01T12:00:00Z level=INFO msg="Something happened" request_id=abc123 user_id=5 detail="with spaces"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected log line:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo, FormatJSON)
+	logger.Error("Something failed", Err(fmt.Errorf("Some random DB Error!")), F("duration", 2*time.Second))
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected a JSON log line, got %s: %+v", buf.String(), err)
+	}
+	expected := map[string]any{
+		"time":     "2022-07-01T12:00:00Z",
+		"level":    "ERROR",
+		"msg":      "Something failed",
+		"error":    "Some random DB Error!",
+		"duration": "2s",
+	}
+	if fmt.Sprint(line) != fmt.Sprint(expected) {
+		t.Errorf("Expected %+v, got %+v", expected, line)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	logger, buf := newTestLogger(LevelWarn, FormatText)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("Expected only warn and error to be logged, got: %s", buf.String())
+	}
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	tt := []struct {
+		name string
+
+		field    Field
+		expected string
+	}{
+		{
+			name:     "email type",
+			field:    F("who", auth.Email("Abc@Example.Com")),
+			expected: "who=" + HashEmail("abc@example.com"),
+		},
+		{
+			name:     "email key",
+			field:    F("email", "abc@example.com"),
+			expected: "email=" + HashEmail("abc@example.com"),
+		},
+		{
+			name:     "auth token type",
+			field:    F("thing", auth.AuthTokenString("seekrit")),
+			expected: "thing=[REDACTED]",
+		},
+		{
+			name:     "verify token type",
+			field:    F("thing", auth.VerifyTokenString("seekrit")),
+			expected: "thing=[REDACTED]",
+		},
+		{
+			name:     "password type",
+			field:    F("thing", auth.Password("123")),
+			expected: "thing=[REDACTED]",
+		},
+		{
+			name:     "token key",
+			field:    F("verifyToken", "seekrit"),
+			expected: "verifyToken=[REDACTED]",
+		},
+		{
+			name:     "password key",
+			field:    F("new_password", "123"),
+			expected: "new_password=[REDACTED]",
+		},
+		{
+			name:     "not sensitive",
+			field:    F("device_id", "dev-1"),
+			expected: "device_id=dev-1",
+		},
+		{
+			name:     "private key",
+			field:    F("signing_key", "seekrit"),
+			expected: "signing_key=[REDACTED]",
+		},
+		{
+			name:     "hmac key",
+			field:    F("wallet_hmac", "seekrit"),
+			expected: "wallet_hmac=[REDACTED]",
+		},
+		{
+			name:     "public key",
+			field:    F("public_key", "pub-1"),
+			expected: "public_key=pub-1",
+		},
+		{
+			name:     "key count",
+			field:    F("trusted_keys", 2),
+			expected: "trusted_keys=2",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, buf := newTestLogger(LevelInfo, FormatText)
+			logger.Info("msg", tc.field)
+			if !strings.HasSuffix(buf.String(), " "+tc.expected+"\n") {
+				t.Errorf("Expected log line to end with %s, got %s", tc.expected, buf.String())
+			}
+			if strings.Contains(buf.String(), "seekrit") || strings.Contains(buf.String(), "123") || strings.Contains(buf.String(), "example.com") {
+				t.Errorf("Sensitive value made it into the log: %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestHashEmailNormalized(t *testing.T) {
+	if HashEmail("Abc@Example.Com") != HashEmail("abc@example.com") {
+		t.Errorf("Expected the same user's email to hash the same regardless of case")
+	}
+	if HashEmail("abc@example.com") == HashEmail("def@example.com") {
+		t.Errorf("Expected different emails to hash differently")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo, FormatText)
+	oldDefault := Default()
+	SetDefault(logger)
+	defer SetDefault(oldDefault)
+
+	FromContext(ContextWithRequestId(context.Background(), "abc123")).Info("With id")
+	FromContext(context.Background()).Info("Without id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "request_id=abc123") || strings.Contains(lines[1], "request_id") {
+		t.Errorf("Expected only the first line to have a request id, got: %s", buf.String())
+	}
+}
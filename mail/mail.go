@@ -3,46 +3,50 @@ package mail
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/mailgun/mailgun-go/v4"
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/server/paths"
 )
 
-const MAILGUN_DEBUG = false
+// Every email goes out in the recipient's locale if there are templates for
+// it, and in English otherwise (see templates.go).
+type MailInterface interface {
+	SendVerificationEmail(auth.Email, auth.VerifyTokenString, auth.Locale) error
 
-// useful with MAILGUN_DEBUG to see what gets called with what
-const MAILGUN_DRY_RUN = false
+	// To the new address, with a link to confirm the change
+	SendEmailChangeVerification(newEmail auth.Email, token auth.VerifyTokenString, locale auth.Locale) error
 
-type MailInterface interface {
-	SendVerificationEmail(auth.Email, auth.VerifyTokenString) error
+	// To the old address, so the user finds out if it wasn't them
+	SendEmailChangeNotification(oldEmail auth.Email, newEmail auth.Email, locale auth.Locale) error
+
+	// Telling the user about things that happened to their account. The caller
+	// checks whether they opted out.
+	SendPasswordChangedNotification(auth.Email, auth.Locale) error
+	SendNewDeviceNotification(auth.Email, auth.DeviceId, auth.Locale) error
+	SendAccountApprovedNotification(auth.Email, auth.Locale) error
 }
 
 type Mail struct {
 	Env env.EnvInterface
 }
 
-// Split out everything I can to make it testable. Right now
-// mailgun.MailgunImpl is inspectable enough to test but
-// mailgun.Message is not.
-func (m *Mail) prepareMessage(token auth.VerifyTokenString) (
-	mg *mailgun.MailgunImpl,
-	sender string,
-	subject string,
-	text string,
-	html string,
-	err error,
-) {
+func (m *Mail) newMailgun() (mg *mailgun.MailgunImpl, sender string, serverDomain string, err error) {
 	verificationMode, err := env.GetAccountVerificationMode(m.Env)
 	if err != nil {
 		return
 	}
 
-	sendingDomain, serverDomain, isDomainEU, privateAPIKey, err := env.GetMailgunConfigs(m.Env, verificationMode)
+	backend, err := env.GetMailBackend(m.Env, verificationMode)
+	if err != nil {
+		return
+	}
+
+	sendingDomain, serverDomain, isDomainEU, privateAPIKey, err := env.GetMailgunConfigs(m.Env, verificationMode, backend)
 	if err != nil {
 		return
 	}
@@ -56,51 +60,124 @@ func (m *Mail) prepareMessage(token auth.VerifyTokenString) (
 	}
 
 	sender = fmt.Sprintf("wallet-sync@%s", sendingDomain)
-	subject = fmt.Sprintf("Verify your wallet sync account on %s", serverDomain)
-	url := fmt.Sprintf("https://%s%s?verifyToken=%s", serverDomain, paths.PathVerify, token)
+	return
+}
+
+// nil unless MAIL_BACKEND is outbox
+func (m *Mail) newOutbox() (*outbox, error) {
+	verificationMode, err := env.GetAccountVerificationMode(m.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := env.GetMailBackend(m.Env, verificationMode)
+	if err != nil || backend != env.MailBackendOutbox {
+		return nil, err
+	}
+
+	dir, logLinks, err := env.GetMailOutboxConfigs(m.Env, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &outbox{dir: dir, logLinks: logLinks}, nil
+}
 
-	text = fmt.Sprintf("Click here to verify your account:\n\n%s", url)
-	html = fmt.Sprintf("Click here to verify your account:\n\n<a href=\"%s\">%s</a>", url, url)
+// Split out everything I can to make it testable. Right now
+// mailgun.MailgunImpl is inspectable enough to test but
+// mailgun.Message is not.
+func (m *Mail) prepareMessage(name messageName, locale auth.Locale, data templateData) (
+	mg *mailgun.MailgunImpl,
+	sender string,
+	subject string,
+	text string,
+	html string,
+	err error,
+) {
+	mg, sender, serverDomain, err := m.newMailgun()
+	if err != nil {
+		return
+	}
 
-	if MAILGUN_DEBUG {
-		log.Printf(
-			"NewMessage\n\n%s\n\n%s\n\n%s\n\n%s",
-			sender, subject, text, html,
-		)
+	templatesDir, err := env.GetMailTemplatesDir(m.Env)
+	if err != nil {
+		return
 	}
 
+	data.ServerDomain = serverDomain
+	subject, text, html, err = render(templatesDir, name, locale, data)
+
+	// Not the body, which may have a verify token in it
+	logging.Debug("NewMessage", logging.F("sender", sender), logging.F("subject", subject))
+
 	return
 }
 
-func (m *Mail) SendVerificationEmail(recipient auth.Email, token auth.VerifyTokenString) (err error) {
-	mg, sender, subject, text, html, err := m.prepareMessage(token)
+func (m *Mail) sendMessage(recipient auth.Email, name messageName, locale auth.Locale, data templateData) (err error) {
+	mg, sender, subject, text, html, err := m.prepareMessage(name, locale, data)
 
 	if err != nil {
 		return err
 	}
 
-	message := mg.NewMessage(sender, subject, text, string(recipient))
-	message.SetHtml(html)
+	outbox, err := m.newOutbox()
+	if err != nil {
+		return err
+	}
+	if outbox == nil {
+		return send(mg, sender, subject, text, html, recipient)
+	}
 
-	if MAILGUN_DEBUG {
-		log.Printf("Send\n\n%+v\n", message)
+	if _, err = outbox.write(sender, recipient, subject, text, html); err != nil {
+		return err
+	}
+	// Since it's only for dev, save a trip to the file
+	if outbox.logLinks && data.LinkPath != "" {
+		logging.Info("Outbox email link", logging.F("recipient_email", recipient), logging.F("url", data.URL()))
 	}
+	return nil
+}
+
+func (m *Mail) SendVerificationEmail(recipient auth.Email, token auth.VerifyTokenString, locale auth.Locale) error {
+	return m.sendMessage(recipient, messageVerify, locale, templateData{LinkPath: paths.PathVerify, Token: token})
+}
+
+func (m *Mail) SendEmailChangeVerification(newEmail auth.Email, token auth.VerifyTokenString, locale auth.Locale) error {
+	return m.sendMessage(newEmail, messageEmailChangeVerify, locale, templateData{LinkPath: paths.PathEmailVerify, Token: token})
+}
+
+func (m *Mail) SendEmailChangeNotification(oldEmail auth.Email, newEmail auth.Email, locale auth.Locale) error {
+	return m.sendMessage(oldEmail, messageEmailChange, locale, templateData{NewEmail: newEmail})
+}
+
+func (m *Mail) SendPasswordChangedNotification(recipient auth.Email, locale auth.Locale) error {
+	return m.sendMessage(recipient, messagePasswordChanged, locale, templateData{})
+}
 
-	if !MAILGUN_DRY_RUN {
-		// Send the message with a 10 second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-		defer cancel()
+func (m *Mail) SendNewDeviceNotification(recipient auth.Email, deviceId auth.DeviceId, locale auth.Locale) error {
+	return m.sendMessage(recipient, messageNewDevice, locale, templateData{DeviceId: deviceId})
+}
+
+func (m *Mail) SendAccountApprovedNotification(recipient auth.Email, locale auth.Locale) error {
+	return m.sendMessage(recipient, messageAccountApproved, locale, templateData{})
+}
 
-		resp, id, err := mg.Send(ctx, message)
+func send(mg *mailgun.MailgunImpl, sender, subject, text, html string, recipient auth.Email) (err error) {
+	message := mg.NewMessage(sender, subject, text, string(recipient))
+	message.SetHtml(html)
 
-		if err != nil {
-			log.Fatal(err)
-		}
+	logging.Debug("Send", logging.F("recipient_email", recipient))
 
-		if MAILGUN_DEBUG {
-			log.Printf("Sent Mailgun message. ID: %s Resp: %s\n", id, resp)
-		}
+	// Send the message with a 10 second timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	resp, id, err := mg.Send(ctx, message)
+
+	if err != nil {
+		return fmt.Errorf("Error sending Mailgun message: %w", err)
 	}
 
+	logging.Debug("Sent Mailgun message", logging.F("id", id), logging.F("response", resp))
+
 	return
 }
@@ -1,10 +1,20 @@
 package mail
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
 )
 
 type TestEnv struct {
@@ -33,7 +43,7 @@ func TestPrepareEmailNotEU(t *testing.T) {
 
 	m := Mail{&TestEnv{env}}
 
-	mg, sender, subject, text, html, err := m.prepareMessage(token)
+	mg, sender, subject, text, html, err := m.prepareMessage(messageVerify, "", templateData{LinkPath: paths.PathVerify, Token: token})
 
 	if err != nil || mg == nil {
 		t.Errorf("Unexpected values from prepareMessage: %+v %s", mg, err.Error())
@@ -82,7 +92,7 @@ func TestPrepareEmailEU(t *testing.T) {
 
 	m := Mail{&TestEnv{env}}
 
-	mg, _, _, _, _, err := m.prepareMessage(token)
+	mg, _, _, _, _, err := m.prepareMessage(messageVerify, "", templateData{LinkPath: paths.PathVerify, Token: token})
 
 	if err != nil || mg == nil {
 		t.Errorf("Unexpected values from prepareMessage: %+v %s", mg, err.Error())
@@ -92,3 +102,242 @@ func TestPrepareEmailEU(t *testing.T) {
 		t.Errorf("Unexpected mg.APIBase(). Got: %s Want: %s", want, got)
 	}
 }
+
+func TestPrepareEmailChangeVerification(t *testing.T) {
+	const serverDomain = "server.example.com"
+	const token = auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+
+	env := map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
+		"MAILGUN_PRIVATE_API_KEY":   "mg-api-key",
+		"MAILGUN_SENDING_DOMAIN":    "sending.example.com",
+		"MAILGUN_SERVER_DOMAIN":     serverDomain,
+	}
+
+	m := Mail{&TestEnv{env}}
+
+	mg, _, subject, text, html, err := m.prepareMessage(messageEmailChangeVerify, "", templateData{LinkPath: paths.PathEmailVerify, Token: token})
+
+	if err != nil || mg == nil {
+		t.Fatalf("Unexpected values from prepareMessage: %+v %+v", mg, err)
+	}
+
+	if !strings.Contains(subject, serverDomain) {
+		t.Errorf("Expected subject to contain %s. Got: %s", serverDomain, subject)
+	}
+
+	url := "https://server.example.com/api/3/email/verify?verifyToken=" + string(token)
+	if !strings.Contains(text, url) {
+		t.Errorf("Expected text to contain %s. Got: %s", url, text)
+	}
+
+	if !strings.Contains(html, url) {
+		t.Errorf("Expected html to contain %s. Got: %s", url, html)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Every built in template, rendered with the same data, compared against
+// testdata/golden/<locale>/. Run with -update after changing a template.
+func TestTemplatesGolden(t *testing.T) {
+	data := templateData{
+		ServerDomain: "server.example.com",
+		LinkPath:     paths.PathVerify,
+		Token:        "abcd1234abcd1234abcd1234abcd1234",
+		// Users type these in, so they shouldn't turn into markup
+		NewEmail: "<new>@example.com",
+		DeviceId: "<my-dev>",
+	}
+
+	locales, err := fs.ReadDir(embeddedTemplates, "templates")
+	if err != nil {
+		t.Fatalf("Error listing locales: %+v", err)
+	}
+	for _, locale := range locales {
+		for _, name := range messages {
+			t.Run(locale.Name()+"/"+string(name), func(t *testing.T) {
+				subject, text, html, err := render("", name, auth.Locale(locale.Name()), data)
+				if err != nil {
+					t.Fatalf("Unexpected error rendering: %+v", err)
+				}
+
+				got := fmt.Sprintf("Subject: %s\n\n%s\n----\n\n%s", subject, text, html)
+				golden := filepath.Join("testdata", "golden", locale.Name(), string(name)+".golden")
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+						t.Fatalf("Error making golden dir: %+v", err)
+					}
+					if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+						t.Fatalf("Error writing golden file: %+v", err)
+					}
+				}
+
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("Error reading golden file (run with -update to make it): %+v", err)
+				}
+				if string(want) != got {
+					t.Errorf("Rendered %s doesn't match %s. Got:\n%s", name, golden, got)
+				}
+			})
+		}
+	}
+}
+
+func TestTemplatesLocales(t *testing.T) {
+	templatesDir := t.TempDir()
+	writeTemplate := func(locale, fileName, contents string) {
+		dir := filepath.Join(templatesDir, locale)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Error making template dir: %+v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fileName), []byte(contents), 0644); err != nil {
+			t.Fatalf("Error writing template: %+v", err)
+		}
+	}
+	writeTemplate("en", "verify.subject.txt", "Overridden on {{.ServerDomain}}\n")
+	writeTemplate("pt", "verify.txt", "Clique aqui: {{.URL}}")
+	writeTemplate("pt-BR", "verify.html", "<p>Clique aqui: {{.URL}}</p>")
+
+	data := templateData{ServerDomain: "server.example.com", LinkPath: paths.PathVerify, Token: "abcd1234"}
+	url := "https://server.example.com/api/3/verify?verifyToken=abcd1234"
+
+	tt := []struct {
+		name   string
+		locale auth.Locale
+
+		expectedSubject string
+		expectedText    string
+		expectedHtml    string
+	}{
+		{
+			name:            "exact locale",
+			locale:          "pt-BR",
+			expectedSubject: "Overridden on server.example.com",
+			expectedText:    "Clique aqui: " + url,
+			expectedHtml:    "<p>Clique aqui: " + url + "</p>",
+		},
+		{
+			name:            "any case",
+			locale:          "PT-br",
+			expectedSubject: "Overridden on server.example.com",
+			expectedText:    "Clique aqui: " + url,
+			expectedHtml:    "<p>Clique aqui: " + url + "</p>",
+		},
+		{
+			name:            "language only",
+			locale:          "pt-PT",
+			expectedSubject: "Overridden on server.example.com",
+			expectedText:    "Clique aqui: " + url,
+			expectedHtml:    "<p>Click here to verify your account:</p>\n\n<p><a href=\"" + url + "\">" + url + "</a></p>\n",
+		},
+		{
+			name:            "unknown locale",
+			locale:          "de",
+			expectedSubject: "Overridden on server.example.com",
+			expectedText:    "Click here to verify your account:\n\n" + url + "\n",
+			expectedHtml:    "<p>Click here to verify your account:</p>\n\n<p><a href=\"" + url + "\">" + url + "</a></p>\n",
+		},
+		{
+			name:            "invalid locale",
+			locale:          "../pt",
+			expectedSubject: "Overridden on server.example.com",
+			expectedText:    "Click here to verify your account:\n\n" + url + "\n",
+			expectedHtml:    "<p>Click here to verify your account:</p>\n\n<p><a href=\"" + url + "\">" + url + "</a></p>\n",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, text, html, err := render(templatesDir, messageVerify, tc.locale, data)
+			if err != nil {
+				t.Fatalf("Unexpected error rendering: %+v", err)
+			}
+			if subject != tc.expectedSubject {
+				t.Errorf("Unexpected subject. Got: %q Want: %q", subject, tc.expectedSubject)
+			}
+			if text != tc.expectedText {
+				t.Errorf("Unexpected text. Got: %q Want: %q", text, tc.expectedText)
+			}
+			if html != tc.expectedHtml {
+				t.Errorf("Unexpected html. Got: %q Want: %q", html, tc.expectedHtml)
+			}
+		})
+	}
+}
+
+func TestTemplatesBroken(t *testing.T) {
+	templatesDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(templatesDir, "en"), 0755); err != nil {
+		t.Fatalf("Error making template dir: %+v", err)
+	}
+	if err := os.WriteFile(filepath.Join(templatesDir, "en", "verify.txt"), []byte("{{.Nope"), 0644); err != nil {
+		t.Fatalf("Error writing template: %+v", err)
+	}
+
+	if _, _, _, err := render(templatesDir, messageVerify, "en", templateData{}); err == nil {
+		t.Errorf("Expected an error rendering a broken template")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
+		"MAIL_BACKEND":              "outbox",
+		"MAIL_OUTBOX_DIR":           dir,
+		"MAILGUN_SENDING_DOMAIN":    "sending.example.com",
+		"MAILGUN_SERVER_DOMAIN":     "server.example.com",
+	}
+	m := Mail{&TestEnv{env}}
+
+	const token = auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+	if err := m.SendVerificationEmail("recipient@example.com", token, ""); err != nil {
+		t.Fatalf("Unexpected error sending to the outbox: %+v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(files) != 1 || filepath.Ext(files[0]) != ".eml" {
+		t.Fatalf("Expected one .eml file in the outbox, got %+v %+v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("Error opening outbox file: %+v", err)
+	}
+	defer f.Close()
+
+	message, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("Error parsing outbox file: %+v", err)
+	}
+	if got, want := message.Header.Get("From"), "wallet-sync@sending.example.com"; got != want {
+		t.Errorf("Unexpected From. Got: %s Want: %s", got, want)
+	}
+	if got, want := message.Header.Get("To"), "recipient@example.com"; got != want {
+		t.Errorf("Unexpected To. Got: %s Want: %s", got, want)
+	}
+	if got, want := message.Header.Get("Subject"), "Verify your wallet sync account on server.example.com"; got != want {
+		t.Errorf("Unexpected Subject. Got: %s Want: %s", got, want)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Unexpected Content-Type: %s %+v", mediaType, err)
+	}
+	url := "https://server.example.com/api/3/verify?verifyToken=" + string(token)
+	mr := multipart.NewReader(message.Body, params["boundary"])
+	for _, contentType := range []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Error reading %s part: %+v", contentType, err)
+		}
+		if got := part.Header.Get("Content-Type"); got != contentType {
+			t.Errorf("Unexpected part Content-Type. Got: %s Want: %s", got, contentType)
+		}
+		// Decoded from quoted-printable by the reader
+		content, _ := io.ReadAll(part)
+		if !strings.Contains(string(content), url) {
+			t.Errorf("Expected %s part to contain %s. Got: %s", contentType, url, content)
+		}
+	}
+}
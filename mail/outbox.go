@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/logging"
+)
+
+// Instead of sending messages, write each one to a directory as an .eml file,
+// which mail clients can open. For trying out EmailVerify mode locally and for
+// tests that need to follow the link in a message, without any network.
+type outbox struct {
+	dir      string
+	logLinks bool
+}
+
+// The message as it would go over the wire, with text and HTML versions
+func formatEml(sender string, recipient auth.Email, subject, text, html string, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var eml bytes.Buffer
+	fmt.Fprintf(&eml, "From: %s\r\n", sender)
+	fmt.Fprintf(&eml, "To: %s\r\n", recipient)
+	fmt.Fprintf(&eml, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&eml, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&eml, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&eml, "Content-Type: multipart/alternative; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&eml, "\r\n")
+	eml.Write(body.Bytes())
+	return eml.Bytes(), nil
+}
+
+// Returns the path of the new file. Names start with the time, so they sort in
+// the order they were written.
+func (o *outbox) write(sender string, recipient auth.Email, subject, text, html string) (path string, err error) {
+	now := time.Now().UTC()
+	eml, err := formatEml(sender, recipient, subject, text, html, now)
+	if err != nil {
+		return
+	}
+
+	// Write it under a temporary name and then rename it, so anything watching
+	// the directory for .eml files never sees half of one.
+	f, err := os.CreateTemp(o.dir, now.Format("20060102T150405.000000000Z")+"-*.eml.tmp")
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(eml); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	path = strings.TrimSuffix(f.Name(), ".tmp")
+	if err = os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	logging.Info("Wrote email to outbox", logging.F("path", path))
+	return
+}
@@ -0,0 +1,170 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	textTemplate "text/template"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+// Every email is made of three templates under templates/<locale>/:
+//
+//	<name>.subject.txt
+//	<name>.txt
+//	<name>.html
+//
+// The ones built in are embedded here. An operator can override any of them by
+// putting a file at the same path under MAIL_TEMPLATES_DIR, and can add
+// locales the same way.
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+const defaultLocale = auth.Locale("en")
+
+type messageName string
+
+const (
+	messageVerify            messageName = "verify"
+	messageEmailChangeVerify messageName = "email-change-verify"
+	messageEmailChange       messageName = "email-change"
+	messagePasswordChanged   messageName = "password-changed"
+	messageNewDevice         messageName = "new-device"
+	messageAccountApproved   messageName = "account-approved"
+)
+
+// Every message we send, so tests can render all of them
+var messages = []messageName{
+	messageVerify,
+	messageEmailChangeVerify,
+	messageEmailChange,
+	messagePasswordChanged,
+	messageNewDevice,
+	messageAccountApproved,
+}
+
+// What the templates have to work with. Only some of it is set for any given
+// message.
+type templateData struct {
+	ServerDomain string
+	LinkPath     string
+	Token        auth.VerifyTokenString
+	NewEmail     auth.Email
+	DeviceId     auth.DeviceId
+}
+
+// The link for messages that have one
+func (d templateData) URL() string {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     d.ServerDomain,
+		Path:     d.LinkPath,
+		RawQuery: url.Values{"verifyToken": {string(d.Token)}}.Encode(),
+	}
+	return u.String()
+}
+
+// Locales to try in order. For "pt-BR" that's "pt-BR", "pt", then the
+// default. Case doesn't matter in a locale, so it's put in the usual form
+// ("pt-br" becomes "pt-BR") to match directory names.
+func localeCandidates(locale auth.Locale) (candidates []auth.Locale) {
+	if locale != "" && locale.Validate() {
+		subtags := strings.Split(string(locale), "-")
+		subtags[0] = strings.ToLower(subtags[0])
+		for i := 1; i < len(subtags); i++ {
+			if len(subtags[i]) == 2 {
+				subtags[i] = strings.ToUpper(subtags[i])
+			}
+		}
+		for i := len(subtags); i > 0; i-- {
+			candidates = append(candidates, auth.Locale(strings.Join(subtags[:i], "-")))
+		}
+	}
+	if len(candidates) == 0 || candidates[len(candidates)-1] != defaultLocale {
+		candidates = append(candidates, defaultLocale)
+	}
+	return
+}
+
+// Find the template file for the locale, falling back through
+// localeCandidates. Files in templatesDir (if set) win over embedded ones.
+func readTemplate(templatesDir string, locale auth.Locale, fileName string) (string, error) {
+	for _, candidate := range localeCandidates(locale) {
+		if templatesDir != "" {
+			contents, err := os.ReadFile(filepath.Join(templatesDir, string(candidate), fileName))
+			if err == nil {
+				return string(contents), nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+
+		contents, err := embeddedTemplates.ReadFile(path.Join("templates", string(candidate), fileName))
+		if err == nil {
+			return string(contents), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("No mail template %s for locale %s", fileName, locale)
+}
+
+func renderText(templatesDir string, locale auth.Locale, fileName string, data templateData) (string, error) {
+	contents, err := readTemplate(templatesDir, locale, fileName)
+	if err != nil {
+		return "", err
+	}
+	t, err := textTemplate.New(fileName).Parse(contents)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Parts of the data come from users (i.e. a device id), so the HTML goes
+// through html/template to escape them.
+func renderHtml(templatesDir string, locale auth.Locale, fileName string, data templateData) (string, error) {
+	contents, err := readTemplate(templatesDir, locale, fileName)
+	if err != nil {
+		return "", err
+	}
+	t, err := htmlTemplate.New(fileName).Parse(contents)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func render(templatesDir string, name messageName, locale auth.Locale, data templateData) (subject, text, html string, err error) {
+	if subject, err = renderText(templatesDir, locale, string(name)+".subject.txt", data); err != nil {
+		return
+	}
+	// Template files end in a newline, which doesn't belong in a subject line
+	subject = strings.TrimSpace(subject)
+
+	if text, err = renderText(templatesDir, locale, string(name)+".txt", data); err != nil {
+		return
+	}
+	html, err = renderHtml(templatesDir, locale, string(name)+".html", data)
+	return
+}
@@ -1,23 +1,50 @@
 package main
 
 import (
-	"log"
+	"os"
+	"sort"
+	"strings"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blobstore"
+	"lbryio/wallet-sync-server/compression"
 	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/mail"
+	"lbryio/wallet-sync-server/migration"
 	"lbryio/wallet-sync-server/server"
 	"lbryio/wallet-sync-server/store"
 )
 
-func storeInit() (s store.Store) {
+func storeInit(e *env.Env) (s store.Store) {
 	s = store.Store{}
 
+	// Config errors are reported on startup, before we get here
+	s.WalletCompression, _ = env.GetWalletCompression(e)
+	blobStoreConfig, _ := env.GetBlobStoreConfig(e)
+
+	var err error
+	switch blobStoreConfig.Kind {
+	case env.BlobStoreFS:
+		s.Blobs, err = blobstore.NewFS(blobStoreConfig.Dir)
+	case env.BlobStoreS3:
+		s.Blobs, err = blobstore.NewS3(
+			blobStoreConfig.S3Endpoint,
+			blobStoreConfig.S3Bucket,
+			blobStoreConfig.S3Region,
+			blobStoreConfig.S3AccessKeyId,
+			blobStoreConfig.S3SecretAccessKey,
+		)
+	}
+	if err != nil {
+		logging.Fatal("Blob store setup failure", logging.Err(err))
+	}
+
 	s.Init("sql.db")
 
-	err := s.Migrate()
+	err = s.Migrate()
 	if err != nil {
-		log.Fatalf("DB setup failure: %+v", err)
+		logging.Fatal("DB setup failure", logging.Err(err))
 	}
 
 	return
@@ -35,36 +62,304 @@ func logEmailVerificationConfigs(e *env.Env) (err error) {
 	if err != nil {
 		return
 	}
+	invitesPerUser, err := env.GetInvitesPerUser(e, verificationMode)
+	if err != nil {
+		return
+	}
 
 	// just to report config errors to the user on startup
-	sendingDomain, serverDomain, _, _, err := env.GetMailgunConfigs(e, verificationMode)
+	backend, err := env.GetMailBackend(e, verificationMode)
+	if err != nil {
+		return
+	}
+	sendingDomain, serverDomain, _, _, err := env.GetMailgunConfigs(e, verificationMode, backend)
+	if err != nil {
+		return
+	}
+	outboxDir, logLinks, err := env.GetMailOutboxConfigs(e, backend)
+	if err != nil {
+		return
+	}
+	templatesDir, err := env.GetMailTemplatesDir(e)
 	if err != nil {
 		return
 	}
 
 	if verificationMode == env.AccountVerificationModeWhitelist {
-		log.Printf("Account verification mode: %s - Whitelist has %d email(s).\n", verificationMode, len(accountWhitelist))
+		logging.Info("Account verification mode", logging.F("mode", verificationMode), logging.F("whitelist_size", len(accountWhitelist)))
+	} else if verificationMode == env.AccountVerificationModeInviteCode {
+		logging.Info("Account verification mode", logging.F("mode", verificationMode), logging.F("invites_per_user", invitesPerUser))
+	} else {
+		logging.Info("Account verification mode", logging.F("mode", verificationMode))
+	}
+	if verificationMode == env.AccountVerificationModeAdminApproval && sendingDomain == "" {
+		logging.Info("Mail is not configured, so users won't be told when they're approved")
+	}
+	// Required in EmailVerify mode, optional in AdminApproval mode
+	if sendingDomain != "" {
+		logging.Info("Mailgun domains", logging.F("sending_domain", sendingDomain), logging.F("server_domain", serverDomain))
+		if backend == env.MailBackendOutbox {
+			logging.Warn("Writing emails to an outbox instead of sending them. Only use for dev purposes.", logging.F("dir", outboxDir), logging.F("log_links", logLinks))
+		}
+		if templatesDir != "" {
+			logging.Info("Overriding mail templates", logging.F("dir", templatesDir))
+		}
+	}
+	return
+}
+
+// Same idea as logEmailVerificationConfigs
+func logSocketLimitConfigs(e *env.Env) (err error) {
+	perUser, perDevice, total, err := env.GetSocketLimits(e)
+	if err != nil {
+		return
+	}
+	logging.Info("Socket limits (0 is unlimited)", logging.F("per_user", perUser), logging.F("per_device", perDevice), logging.F("total", total))
+	return
+}
+
+// Same idea as logEmailVerificationConfigs
+func logShutdownConfigs(e *env.Env) (err error) {
+	readinessDelay, drainTimeout, err := env.GetShutdownConfigs(e)
+	if err != nil {
+		return
+	}
+	logging.Info("On shutdown: report not ready, then drain requests", logging.F("readiness_delay", readinessDelay), logging.F("drain_timeout", drainTimeout))
+	return
+}
+
+// Same idea as logEmailVerificationConfigs
+func logListenConfigs(e *env.Env, port int) (err error) {
+	addresses, err := env.GetListenAddresses(e, port)
+	if err != nil {
+		return
+	}
+	for _, address := range addresses {
+		logging.Info("Listening", logging.F("network", address.Network), logging.F("address", address.Address))
+	}
+
+	certFile, _, selfSigned, err := env.GetTLSConfigs(e)
+	if err != nil {
+		return
+	}
+	switch {
+	case selfSigned:
+		logging.Warn("Serving TLS with a self-signed certificate. Only use this for development!")
+	case certFile != "":
+		logging.Info("Serving TLS", logging.F("cert_file", certFile))
+	default:
+		logging.Info("Not serving TLS")
+	}
+	return
+}
+
+// Same idea as logEmailVerificationConfigs
+func logStatsConfigs(e *env.Env) (err error) {
+	interval, err := env.GetStatsInterval(e)
+	if err != nil {
+		return
+	}
+	if interval == 0 {
+		logging.Info("Not collecting account and wallet stats for metrics")
+	} else {
+		logging.Info("Collecting account and wallet stats for metrics", logging.F("interval", interval))
+	}
+	return
+}
+
+// Same idea as logEmailVerificationConfigs
+func logAdminConfigs(e *env.Env) (err error) {
+	adminToken, err := env.GetAdminToken(e)
+	if err != nil {
+		return
+	}
+	if adminToken == "" {
+		logging.Info("Admin endpoints are off")
+	} else {
+		logging.Info("Admin endpoints are on")
+	}
+	return
+}
+
+func logDataExportConfigs(e *env.Env) (err error) {
+	perDay, err := env.GetDataExportsPerDay(e)
+	if err != nil {
+		return
+	}
+	if perDay == 0 {
+		logging.Info("Not limiting data exports")
+	} else {
+		logging.Info("Limiting data exports", logging.F("per_day", perDay))
+	}
+	return
+}
+
+func logMigrationConfigs(e *env.Env) (err error) {
+	signingKey, err := env.GetMigrationSigningKey(e)
+	if err != nil {
+		return
+	}
+	trustedKeys, err := env.GetMigrationTrustedKeys(e)
+	if err != nil {
+		return
+	}
+	encryptionKey, err := env.GetMigrationEncryptionKey(e)
+	if err != nil {
+		return
+	}
+	destinations, err := env.GetMigrationDestinations(e)
+	if err != nil {
+		return
+	}
+	if signingKey == nil {
+		logging.Info("Account migration export is off")
+	} else {
+		logging.Info("Account migration export is on", logging.F("public_key", migration.PublicKeyString(signingKey)))
+		if len(destinations) == 0 {
+			logging.Warn("Account migration export is on, but there are no destinations to export to")
+		} else {
+			urls := []string{}
+			for url := range destinations {
+				urls = append(urls, url)
+			}
+			sort.Strings(urls)
+			logging.Info("Account migration destinations", logging.F("destinations", strings.Join(urls, ",")))
+		}
+	}
+	if len(trustedKeys) == 0 || encryptionKey == nil {
+		logging.Info("Account migration import is off")
+		if len(trustedKeys) != 0 || encryptionKey != nil {
+			logging.Warn("Account migration import needs both MIGRATION_TRUSTED_KEYS and MIGRATION_ENCRYPTION_KEY")
+		}
+	} else {
+		logging.Info("Account migration import is on", logging.F("trusted_keys", len(trustedKeys)), logging.F("encryption_public_key", migration.EncryptionPublicKeyString(encryptionKey)))
+	}
+	return
+}
+
+func logMiddlewareConfigs(e *env.Env) (err error) {
+	perMinute, burst, trustProxy, err := env.GetRateLimitConfigs(e)
+	if err != nil {
+		return
+	}
+	if perMinute == 0 {
+		logging.Info("Not rate limiting requests")
+	} else {
+		logging.Info("Rate limiting requests per IP", logging.F("per_minute", perMinute), logging.F("burst", burst), logging.F("trust_proxy", trustProxy))
+	}
+
+	allowedOrigins, err := env.GetCORSAllowedOrigins(e)
+	if err != nil {
+		return
+	}
+	if len(allowedOrigins) == 0 {
+		logging.Info("Not allowing cross-origin requests")
 	} else {
-		log.Printf("Account verification mode: %s", verificationMode)
+		logging.Info("Allowing cross-origin requests", logging.F("origins", strings.Join(allowedOrigins, ",")))
 	}
-	if verificationMode == env.AccountVerificationModeEmailVerify {
-		log.Printf("Mailgun domains: %s for sending addresses, %s for links in the email", sendingDomain, serverDomain)
+
+	defaultBodyLimit, bodyLimits, err := env.GetMaxBodySizes(e)
+	if err != nil {
+		return
+	}
+	logging.Info("Limiting request body sizes", logging.F("default", defaultBodyLimit))
+	for endpoint, limit := range bodyLimits {
+		logging.Info("Limiting request body size for endpoint", logging.F("endpoint", endpoint), logging.F("limit", limit))
 	}
 	return
 }
 
+func logWalletCompressionConfigs(e *env.Env) (err error) {
+	encoding, err := env.GetWalletCompression(e)
+	if err != nil {
+		return
+	}
+	if encoding == compression.Identity {
+		logging.Info("Not compressing wallets in the database")
+	} else {
+		logging.Info("Compressing new and updated wallets in the database", logging.F("encoding", encoding))
+	}
+	return
+}
+
+func logBlobStoreConfigs(e *env.Env) (err error) {
+	config, err := env.GetBlobStoreConfig(e)
+	if err != nil {
+		return
+	}
+	switch config.Kind {
+	case env.BlobStoreNone:
+		logging.Info("Keeping wallets in the database")
+	case env.BlobStoreFS:
+		logging.Info("Keeping new and updated wallets in a directory", logging.F("dir", config.Dir))
+	case env.BlobStoreS3:
+		logging.Info("Keeping new and updated wallets in S3", logging.F("endpoint", config.S3Endpoint), logging.F("bucket", config.S3Bucket))
+	}
+	return
+}
+
+func logWalletUploadConfigs(e *env.Env) (err error) {
+	maxSize, err := env.GetMaxWalletUploadSize(e)
+	if err != nil {
+		return
+	}
+	logging.Info("Wallet upload limit", logging.F("max_size", maxSize))
+	return
+}
+
 func main() {
 	e := env.Env{}
 
-	if err := logEmailVerificationConfigs(&e); err != nil {
-		log.Fatal(err.Error())
+	logLevel, logFormat, err := env.GetLogConfigs(&e)
+	if err != nil {
+		logging.Fatal(err.Error())
 	}
+	logging.SetDefault(logging.New(os.Stderr, logLevel, logFormat))
 
-	store := storeInit()
+	if err := logEmailVerificationConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logSocketLimitConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logShutdownConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logMiddlewareConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logStatsConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logAdminConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logDataExportConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logMigrationConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logWalletCompressionConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logWalletUploadConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
+	if err := logBlobStoreConfigs(&e); err != nil {
+		logging.Fatal(err.Error())
+	}
 
-	// The port that the sync server serves from.
+	// The port that the sync server serves from, unless LISTEN_ADDRESSES is
+	// set.
 	internalPort := 8090
 
-	srv := server.Init(&auth.Auth{}, &store, &e, &mail.Mail{&e}, internalPort)
+	if err := logListenConfigs(&e, internalPort); err != nil {
+		logging.Fatal(err.Error())
+	}
+
+	store := storeInit(&e)
+
+	srv := server.Init(&auth.Auth{}, &store, &e, &mail.Mail{Env: &e}, internalPort)
 	srv.Serve()
 }
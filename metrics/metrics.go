@@ -15,6 +15,33 @@ var (
 		},
 		[]string{"method", "endpoint"},
 	)
+	ResponsesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wallet_sync_responses_count",
+			Help: "Total number of responses from various endpoints, by status code",
+		},
+		[]string{"method", "endpoint", "status"},
+	)
+
+	// Websockets and event streams are included here, and take as long as the
+	// client stays connected.
+	RequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wallet_sync_request_duration_seconds",
+			Help:    "Time taken to handle requests to various endpoints",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method", "endpoint"},
+	)
+	StoreQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "wallet_sync_store_query_duration_seconds",
+			Help: "Time taken by various database operations",
+			// Most queries should be well under the default smallest bucket
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+		[]string{"query"},
+	)
 	ErrorsCount = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "wallet_sync_error_count",
@@ -22,9 +49,85 @@ var (
 		},
 		[]string{"error_type"},
 	)
+
+	// Websockets, event streams and long-polls all count as sockets here
+	ConnectedUsers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_connected_users",
+			Help: "Number of users with at least one connected socket",
+		},
+	)
+	ConnectedSockets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_connected_sockets",
+			Help: "Number of connected sockets",
+		},
+	)
+
+	// Set periodically from the database, rather than as things happen. See
+	// STATS_INTERVAL.
+	Accounts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_accounts",
+			Help: "Number of accounts",
+		},
+	)
+	VerifiedAccounts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_verified_accounts",
+			Help: "Number of verified accounts",
+		},
+	)
+	Wallets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_wallets",
+			Help: "Number of wallets, including each of an account's named wallets",
+		},
+	)
+	AccountsWithWallets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_accounts_with_wallets",
+			Help: "Number of accounts with at least one wallet",
+		},
+	)
+	AuthTokens = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_auth_tokens",
+			Help: "Number of unexpired auth tokens",
+		},
+	)
+	// Cumulative like a histogram: "le" is the size in bytes, and "+Inf" counts
+	// every wallet.
+	WalletsBySize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_wallets_by_size",
+			Help: "Number of wallets at most a given size in bytes",
+		},
+		[]string{"le"},
+	)
+
+	RejectedSocketsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wallet_sync_rejected_sockets_count",
+			Help: "Total number of sockets rejected for being over a connection limit",
+		},
+		[]string{"limit"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(RequestsCount)
+	prometheus.MustRegister(ResponsesCount)
+	prometheus.MustRegister(RequestDuration)
+	prometheus.MustRegister(StoreQueryDuration)
 	prometheus.MustRegister(ErrorsCount)
+	prometheus.MustRegister(ConnectedUsers)
+	prometheus.MustRegister(ConnectedSockets)
+	prometheus.MustRegister(RejectedSocketsCount)
+	prometheus.MustRegister(Accounts)
+	prometheus.MustRegister(VerifiedAccounts)
+	prometheus.MustRegister(Wallets)
+	prometheus.MustRegister(AccountsWithWallets)
+	prometheus.MustRegister(AuthTokens)
+	prometheus.MustRegister(WalletsBySize)
 }
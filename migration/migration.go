@@ -0,0 +1,219 @@
+package migration
+
+// Moving an account from one server to another. The source server signs a
+// bundle with everything the destination needs to recreate the account, the
+// client carries it over, and the destination checks the signature against the
+// keys of servers it trusts. The wallets in it are still encrypted, so neither
+// server (nor the client's connection) learns anything it didn't already know.
+// The password hash is sealed to the destination's encryption key, so a leaked
+// bundle can't be used to brute force the password offline.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+var (
+	ErrMalformedBundle    = fmt.Errorf("Migration bundle is malformed")
+	ErrUntrustedBundle    = fmt.Errorf("Migration bundle is not signed by a trusted server")
+	ErrExpiredBundle      = fmt.Errorf("Migration bundle has expired")
+	ErrUnsupportedVersion = fmt.Errorf("Migration bundle version is not supported")
+	ErrWrongDestination   = fmt.Errorf("Migration bundle is for a different server")
+)
+
+// Bump this if the contents of Account change in a way an older server
+// wouldn't understand
+const BundleVersion = 3
+
+// Long enough for a user to get around to importing it, short enough that a
+// leaked bundle isn't good for long
+const BundleLifespan = time.Hour * 24
+
+// One of the account's wallets, at the sequence it's on
+type Wallet struct {
+	WalletId        wallet.WalletId        `json:"walletId"`
+	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
+	Sequence        wallet.Sequence        `json:"sequence"`
+	Hmac            wallet.WalletHmac      `json:"hmac"`
+}
+
+// What gets signed
+type Account struct {
+	Version        int                 `json:"version"`
+	Email          auth.Email          `json:"email"`
+	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
+
+	// The account's password hash on the source server, sealed with
+	// SealCredential. The destination only imports the account for someone who
+	// knows the password, so holding the bundle isn't enough to claim it.
+	Credential string `json:"credential"`
+
+	Wallets    []Wallet  `json:"wallets"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// What gets passed around. The account stays as the exact bytes that were
+// signed (base64 encoded JSON), so nothing has to agree on how to re-encode it
+// in order to check the signature.
+type Bundle struct {
+	Account   string `json:"account"`
+	Signature string `json:"signature"`
+}
+
+// Sets the version and expiration, and signs
+func Sign(account Account, key ed25519.PrivateKey, now time.Time) (bundle Bundle, err error) {
+	account.Version = BundleVersion
+	account.Expiration = now.UTC().Add(BundleLifespan)
+
+	accountJson, err := json.Marshal(account)
+	if err != nil {
+		return
+	}
+	bundle.Account = base64.StdEncoding.EncodeToString(accountJson)
+	bundle.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, accountJson))
+	return
+}
+
+// Checks the signature against each of the trusted keys, and that the bundle
+// hasn't expired. The account's contents are not otherwise validated.
+func Open(bundle Bundle, trustedKeys []ed25519.PublicKey, now time.Time) (account Account, err error) {
+	accountJson, err := base64.StdEncoding.DecodeString(bundle.Account)
+	if err != nil {
+		return Account{}, ErrMalformedBundle
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return Account{}, ErrMalformedBundle
+	}
+
+	trusted := false
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, accountJson, signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return Account{}, ErrUntrustedBundle
+	}
+
+	if err = json.Unmarshal(accountJson, &account); err != nil {
+		return Account{}, ErrMalformedBundle
+	}
+	if account.Version != BundleVersion {
+		return Account{}, ErrUnsupportedVersion
+	}
+	if !now.Before(account.Expiration) {
+		return Account{}, ErrExpiredBundle
+	}
+	return
+}
+
+// The signing key is the base64 encoded 32 byte seed, i.e. what
+// `openssl rand -base64 32` gives
+func ParseSigningKey(keyStr string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Signing key should be %d bytes, base64 encoded", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// A trusted key is the base64 encoded public key, as given by PublicKeyString
+// on the other server
+func ParseTrustedKey(keyStr string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Trusted key should be %d bytes, base64 encoded", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// For the operator of the source server to give to the operator of the
+// destination server
+func PublicKeyString(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// What Credential is sealed from
+type credential struct {
+	Key        auth.KDFKey     `json:"key"`
+	ServerSalt auth.ServerSalt `json:"serverSalt"`
+}
+
+// Seals the password hash to the destination server's encryption key
+// (anonymously, since the bundle's signature already says who it's from)
+func SealCredential(key auth.KDFKey, salt auth.ServerSalt, destinationKey *[32]byte) (string, error) {
+	credentialJson, err := json.Marshal(credential{key, salt})
+	if err != nil {
+		return "", err
+	}
+	sealed, err := box.SealAnonymous(nil, credentialJson, destinationKey, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Gets the password hash back out, with this server's encryption key. Gives
+// ErrWrongDestination if it was sealed to some other key.
+func OpenCredential(sealedStr string, encryptionKey *[32]byte) (key auth.KDFKey, salt auth.ServerSalt, err error) {
+	sealed, err := base64.StdEncoding.DecodeString(sealedStr)
+	if err != nil {
+		return "", "", ErrMalformedBundle
+	}
+	credentialJson, ok := box.OpenAnonymous(nil, sealed, encryptionPublicKey(encryptionKey), encryptionKey)
+	if !ok {
+		return "", "", ErrWrongDestination
+	}
+	var c credential
+	if err = json.Unmarshal(credentialJson, &c); err != nil {
+		return "", "", ErrMalformedBundle
+	}
+	return c.Key, c.ServerSalt, nil
+}
+
+func encryptionPublicKey(encryptionKey *[32]byte) *[32]byte {
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, encryptionKey)
+	return &publicKey
+}
+
+// The encryption key is 32 random bytes, base64 encoded, like the signing key
+func ParseEncryptionKey(keyStr string) (*[32]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Encryption key should be 32 bytes, base64 encoded")
+	}
+	var encryptionKey [32]byte
+	copy(encryptionKey[:], key)
+	return &encryptionKey, nil
+}
+
+// A destination key is the base64 encoded public key, as given by
+// EncryptionPublicKeyString on the other server
+func ParseDestinationKey(keyStr string) (*[32]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Destination key should be 32 bytes, base64 encoded")
+	}
+	var destinationKey [32]byte
+	copy(destinationKey[:], key)
+	return &destinationKey, nil
+}
+
+// For the operator of the destination server to give to the operator of the
+// source server
+func EncryptionPublicKeyString(encryptionKey *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(encryptionPublicKey(encryptionKey)[:])
+}
@@ -0,0 +1,166 @@
+package migration
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningKey = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+const testEncryptionKey = "HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE="
+
+func testKeys(t *testing.T) (ed25519.PrivateKey, ed25519.PublicKey) {
+	key, err := ParseSigningKey(testSigningKey)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing signing key: %+v", err)
+	}
+	trustedKey, err := ParseTrustedKey(PublicKeyString(key))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing trusted key: %+v", err)
+	}
+	return key, trustedKey
+}
+
+func testAccount() Account {
+	return Account{
+		Email:          "abc@example.com",
+		ClientSaltSeed: "abcd1234abcd1234",
+		Credential:     "my-sealed-credential",
+		Wallets: []Wallet{
+			{WalletId: "default_wallet", EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+			{WalletId: "other", EncryptedWallet: "my-other-enc-wallet", Sequence: 2, Hmac: "my-other-hmac"},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, trustedKey := testKeys(t)
+	now := time.Now()
+
+	bundle, err := Sign(testAccount(), key, now)
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %+v", err)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	account, err := Open(bundle, []ed25519.PublicKey{otherKey.Public().(ed25519.PublicKey), trustedKey}, now)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %+v", err)
+	}
+
+	expected := testAccount()
+	expected.Version = BundleVersion
+	expected.Expiration = now.UTC().Add(BundleLifespan)
+	if !account.Expiration.Equal(expected.Expiration) {
+		t.Errorf("Expected expiration %v, got %v", expected.Expiration, account.Expiration)
+	}
+	account.Expiration = expected.Expiration
+	if !reflect.DeepEqual(expected, account) {
+		t.Errorf("Expected account %+v, got %+v", expected, account)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	key, trustedKey := testKeys(t)
+	now := time.Now()
+
+	bundle, err := Sign(testAccount(), key, now)
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %+v", err)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	otherBundle, err := Sign(testAccount(), otherKey, now)
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %+v", err)
+	}
+
+	// Signed correctly, but with an account we don't understand
+	futureAccountJson := []byte(fmt.Sprintf(`{"version": %d}`, BundleVersion+1))
+	futureBundle := Bundle{
+		Account:   base64.StdEncoding.EncodeToString(futureAccountJson),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, futureAccountJson)),
+	}
+
+	tamperedAccountJson, _ := base64.StdEncoding.DecodeString(bundle.Account)
+	tamperedAccountJson[len(tamperedAccountJson)-2] ^= 1
+
+	tt := []struct {
+		name        string
+		bundle      Bundle
+		now         time.Time
+		expectedErr error
+	}{
+		{"bad account encoding", Bundle{Account: "!", Signature: bundle.Signature}, now, ErrMalformedBundle},
+		{"bad signature encoding", Bundle{Account: bundle.Account, Signature: "!"}, now, ErrMalformedBundle},
+		{"short signature", Bundle{Account: bundle.Account, Signature: "AAAA"}, now, ErrMalformedBundle},
+		{"untrusted key", otherBundle, now, ErrUntrustedBundle},
+		{"tampered", Bundle{Account: base64.StdEncoding.EncodeToString(tamperedAccountJson), Signature: bundle.Signature}, now, ErrUntrustedBundle},
+		{"unsupported version", futureBundle, now, ErrUnsupportedVersion},
+		{"expired", bundle, now.Add(BundleLifespan), ErrExpiredBundle},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Open(tc.bundle, []ed25519.PublicKey{trustedKey}, tc.now); err != tc.expectedErr {
+				t.Errorf("Expected error %+v, got %+v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestCredentialRoundTrip(t *testing.T) {
+	encryptionKey, err := ParseEncryptionKey(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing encryption key: %+v", err)
+	}
+	destinationKey, err := ParseDestinationKey(EncryptionPublicKeyString(encryptionKey))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing destination key: %+v", err)
+	}
+
+	sealed, err := SealCredential("my-key", "my-salt", destinationKey)
+	if err != nil {
+		t.Fatalf("Unexpected error sealing: %+v", err)
+	}
+	if strings.Contains(sealed, "my-key") || strings.Contains(sealed, base64.StdEncoding.EncodeToString([]byte("my-key"))) {
+		t.Errorf("Expected the key not to be readable in the sealed credential")
+	}
+
+	key, salt, err := OpenCredential(sealed, encryptionKey)
+	if err != nil || key != "my-key" || salt != "my-salt" {
+		t.Errorf("Expected to get the key and salt back, got %s %s %+v", key, salt, err)
+	}
+
+	otherEncryptionKey, _ := ParseEncryptionKey(testSigningKey)
+	if _, _, err := OpenCredential(sealed, otherEncryptionKey); err != ErrWrongDestination {
+		t.Errorf("Expected ErrWrongDestination opening with another key, got %+v", err)
+	}
+	if _, _, err := OpenCredential("!", encryptionKey); err != ErrMalformedBundle {
+		t.Errorf("Expected ErrMalformedBundle for a credential that isn't base64, got %+v", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	if _, err := ParseSigningKey("AAEC"); err == nil {
+		t.Errorf("Expected error for a short signing key")
+	}
+	if _, err := ParseSigningKey("not base64!"); err == nil {
+		t.Errorf("Expected error for a signing key that isn't base64")
+	}
+	if _, err := ParseTrustedKey("AAEC"); err == nil {
+		t.Errorf("Expected error for a short trusted key")
+	}
+	if _, err := ParseTrustedKey(testSigningKey); err != nil {
+		t.Errorf("Unexpected error for a 32 byte trusted key: %+v", err)
+	}
+	if _, err := ParseEncryptionKey("AAEC"); err == nil {
+		t.Errorf("Expected error for a short encryption key")
+	}
+	if _, err := ParseDestinationKey("AAEC"); err == nil {
+		t.Errorf("Expected error for a short destination key")
+	}
+}
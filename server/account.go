@@ -3,11 +3,11 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/store"
 )
 
@@ -15,6 +15,12 @@ type RegisterRequest struct {
 	Email          auth.Email          `json:"email"`
 	Password       auth.Password       `json:"password"`
 	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
+
+	// Optional. Which language to send this user's emails in.
+	Locale auth.Locale `json:"locale"`
+
+	// Only for InviteCode mode
+	InviteCode auth.InviteCode `json:"inviteCode"`
 }
 
 type RegisterResponse struct {
@@ -32,6 +38,9 @@ func (r *RegisterRequest) validate() error {
 	if !r.ClientSaltSeed.Validate() {
 		return fmt.Errorf("Invalid or missing 'clientSaltSeed'")
 	}
+	if !r.Locale.Validate() {
+		return fmt.Errorf("Invalid 'locale'")
+	}
 	return nil
 }
 
@@ -43,18 +52,19 @@ func (s *Server) register(w http.ResponseWriter, req *http.Request) {
 
 	verificationMode, err := env.GetAccountVerificationMode(s.env)
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting account verification mode")
+		internalServiceErrorJson(w, req, err, "Error getting account verification mode")
 		return
 	}
 	accountWhitelist, err := env.GetAccountWhitelist(s.env, verificationMode)
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting account whitelist")
+		internalServiceErrorJson(w, req, err, "Error getting account whitelist")
 		return
 	}
 
 	var registerResponse RegisterResponse
 
 	var token *auth.VerifyTokenString
+	var pendingToken *auth.VerifyTokenString
 
 modes:
 	switch verificationMode {
@@ -82,47 +92,86 @@ modes:
 		token = &newToken
 
 		if err != nil {
-			internalServiceErrorJson(w, err, "Error generating verify token string")
+			internalServiceErrorJson(w, req, err, "Error generating verify token string")
+			return
+		}
+	case env.AccountVerificationModeInviteCode:
+		// The invite code is as good as verification
+		if registerRequest.InviteCode == "" {
+			errorJson(w, http.StatusForbidden, "Invite code required")
+			return
+		}
+		registerResponse.Verified = true
+	case env.AccountVerificationModeAdminApproval:
+		// Not verified until the server operator approves it. The token only
+		// marks the account unverified. Nobody gets it, so there's no email.
+		registerResponse.Verified = false
+		newToken, err := s.auth.NewVerifyTokenString()
+		if err != nil {
+			internalServiceErrorJson(w, req, err, "Error generating verify token string")
 			return
 		}
+		pendingToken = &newToken
 	}
 
-	err = s.store.CreateAccount(
-		registerRequest.Email,
-		registerRequest.Password,
-		registerRequest.ClientSaltSeed,
-		token, // if it's not set, the user is marked as verified
-	)
+	if verificationMode == env.AccountVerificationModeInviteCode {
+		err = s.store.CreateAccountWithInviteCode(
+			registerRequest.Email,
+			registerRequest.Password,
+			registerRequest.ClientSaltSeed,
+			registerRequest.Locale,
+			registerRequest.InviteCode,
+		)
+	} else if pendingToken != nil {
+		err = s.store.CreatePendingAccount(
+			registerRequest.Email,
+			registerRequest.Password,
+			registerRequest.ClientSaltSeed,
+			*pendingToken,
+			registerRequest.Locale,
+		)
+	} else {
+		err = s.store.CreateAccount(
+			registerRequest.Email,
+			registerRequest.Password,
+			registerRequest.ClientSaltSeed,
+			token, // if it's not set, the user is marked as verified
+			registerRequest.Locale,
+		)
+	}
 
 	if err != nil {
-		if err == store.ErrDuplicateEmail || err == store.ErrDuplicateAccount {
+		if err == store.ErrInvalidInviteCode {
+			errorJson(w, http.StatusForbidden, "Invalid invite code")
+		} else if err == store.ErrDuplicateEmail || err == store.ErrDuplicateAccount {
 			errorJson(w, http.StatusConflict, "Error registering")
 		} else {
-			internalServiceErrorJson(w, err, "Error registering")
+			internalServiceErrorJson(w, req, err, "Error registering")
 		}
 		return
 	}
+	s.recordAuditEventForEmail(req, store.AuditEventRegister, registerRequest.Email, "")
 
 	if token != nil {
-		err = s.mail.SendVerificationEmail(registerRequest.Email, *token)
+		err = s.mail.SendVerificationEmail(registerRequest.Email, *token, registerRequest.Locale)
 	}
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error sending verification email")
+		internalServiceErrorJson(w, req, err, "Error sending verification email")
 		return
 	}
 
 	response, err := json.Marshal(registerResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating register response")
+		internalServiceErrorJson(w, req, err, "Error generating register response")
 		return
 	}
 
 	// TODO StatusCreated also for first wallet and/or for get auth token?
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, string(response))
-	log.Printf("User %s has registered", registerRequest.Email)
+	logging.FromContext(req.Context()).Info("User has registered", logging.F("email", registerRequest.Email))
 }
 
 // TODO - There's probably a struct-based solution here like with POST/PUT.
@@ -155,7 +204,7 @@ func (r *ResendVerifyEmailRequest) validate() error {
 func (s *Server) resendVerifyEmail(w http.ResponseWriter, req *http.Request) {
 	verificationMode, err := env.GetAccountVerificationMode(s.env)
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting account verification mode")
+		internalServiceErrorJson(w, req, err, "Error getting account verification mode")
 		return
 	}
 	if verificationMode != env.AccountVerificationModeEmailVerify {
@@ -171,24 +220,24 @@ func (s *Server) resendVerifyEmail(w http.ResponseWriter, req *http.Request) {
 	token, err := s.auth.NewVerifyTokenString()
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating verify token string")
+		internalServiceErrorJson(w, req, err, "Error generating verify token string")
 		return
 	}
 
-	err = s.store.UpdateVerifyTokenString(resendVerifyEmailRequest.Email, token)
+	locale, err := s.store.UpdateVerifyTokenString(resendVerifyEmailRequest.Email, token)
 	if err == store.ErrWrongCredentials {
 		errorJson(w, http.StatusUnauthorized, "No match for email")
 		return
 	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error updating verify token string")
+		internalServiceErrorJson(w, req, err, "Error updating verify token string")
 		return
 	}
 
-	err = s.mail.SendVerificationEmail(resendVerifyEmailRequest.Email, token)
+	err = s.mail.SendVerificationEmail(resendVerifyEmailRequest.Email, token, locale)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error re-sending verification email")
+		internalServiceErrorJson(w, req, err, "Error re-sending verification email")
 		return
 	}
 
@@ -196,7 +245,7 @@ func (s *Server) resendVerifyEmail(w http.ResponseWriter, req *http.Request) {
 	response, err := json.Marshal(verifyResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating verify response")
+		internalServiceErrorJson(w, req, err, "Error generating verify response")
 		return
 	}
 
@@ -217,20 +266,21 @@ func (s *Server) verify(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err := s.store.VerifyAccount(token)
+	userId, err := s.store.VerifyAccount(token)
 
 	if err == store.ErrNoTokenForUser {
 		http.Error(w, "The verification token was not found, already used, or expired. If you want to try again, generate a new one from your app.", http.StatusForbidden)
 		return
 	} else if err != nil {
 		http.Error(w, "Something went wrong trying to verify your account.", http.StatusInternalServerError)
-		log.Printf("%s: %+v\n", "Error verifying account", err)
+		logging.FromContext(req.Context()).Error("Error verifying account", logging.Err(err))
 		return
 	}
+	s.recordAuditEvent(req, store.AuditEventAccountVerified, userId, "")
 
 	fmt.Fprintf(w, "Your account has been verified.")
 
-	// if we really want to log the user's email at some point
-	// we can put in the effort then to fetch it
-	log.Printf("User has been verified with token %s", token)
+	// if we really want to log the user's (hashed) email at some point we can
+	// put in the effort then to fetch it. The token is never logged.
+	logging.FromContext(req.Context()).Info("User has been verified")
 }
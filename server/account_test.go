@@ -24,7 +24,7 @@ func TestServerRegisterSuccess(t *testing.T) {
 	testAuth := TestAuth{TestNewVerifyTokenString: "abcd1234abcd1234abcd1234abcd1234"}
 	s := Init(&testAuth, testStore, &TestEnv{env}, &testMail, TestPort)
 
-	requestBody := []byte(`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234" }`)
+	requestBody := []byte(`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234", "locale": "pt-BR" }`)
 
 	req := httptest.NewRequest(http.MethodPost, paths.PathRegister, bytes.NewBuffer(requestBody))
 	w := httptest.NewRecorder()
@@ -42,14 +42,17 @@ func TestServerRegisterSuccess(t *testing.T) {
 		t.Errorf("Unexpected value for register response. Want: %+v Got: %+v Err: %+v", expectedResponse, result, err)
 	}
 
-	if testStore.Called.CreateAccount == nil {
-		t.Errorf("Expected Store.CreateAccount to be called")
+	if testStore.Called.CreateAccount == nil || testStore.Called.CreateAccount.Locale != "pt-BR" {
+		t.Errorf("Expected Store.CreateAccount to be called with locale pt-BR, got %+v", testStore.Called.CreateAccount)
 	}
 
 	if testMail.SendVerificationEmailCall == nil {
 		// We're doing EmailVerify for this test.
 		t.Fatalf("Expected Store.SendVerificationEmail to be called")
 	}
+	if testMail.SendVerificationEmailCall.Locale != "pt-BR" {
+		t.Errorf("Expected the verification email in pt-BR, got %q", testMail.SendVerificationEmailCall.Locale)
+	}
 }
 
 func TestServerRegisterErrors(t *testing.T) {
@@ -323,10 +326,16 @@ func TestServerValidateRegisterRequest(t *testing.T) {
 	if !strings.Contains(err.Error(), "clientSaltSeed") {
 		t.Errorf("Expected RegisterRequest with clientSaltSeed with a non-hex string to return an appropriate error")
 	}
+
+	registerRequest = RegisterRequest{Email: "joe@example.com", Password: "12345678", ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234", Locale: "../en"}
+	err = registerRequest.validate()
+	if !strings.Contains(err.Error(), "locale") {
+		t.Errorf("Expected RegisterRequest with an invalid locale to return an appropriate error")
+	}
 }
 
 func TestServerResendVerifyEmailSuccess(t *testing.T) {
-	testStore := TestStore{}
+	testStore := TestStore{TestLocale: "pt-BR"}
 	testMail := TestMail{}
 
 	env := map[string]string{
@@ -355,6 +364,10 @@ func TestServerResendVerifyEmailSuccess(t *testing.T) {
 		// We're doing EmailVerify for this test.
 		t.Fatalf("Expected Store.SendVerificationEmail to be called")
 	}
+	// In whatever language they registered with
+	if testMail.SendVerificationEmailCall.Locale != "pt-BR" {
+		t.Errorf("Expected the verification email in pt-BR, got %q", testMail.SendVerificationEmailCall.Locale)
+	}
 }
 
 func TestServerResendVerifyEmailErrors(t *testing.T) {
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+)
+
+type PendingAccountRequest struct {
+	UserId auth.UserId `json:"userId"`
+}
+
+func (r *PendingAccountRequest) validate() error {
+	if r.UserId <= 0 {
+		return fmt.Errorf("Invalid or missing 'userId'")
+	}
+	return nil
+}
+
+type PendingAccountResponse struct {
+	UserId  auth.UserId `json:"userId"`
+	Email   auth.Email  `json:"email"`
+	Locale  auth.Locale `json:"locale,omitempty"`
+	Created time.Time   `json:"created"`
+}
+
+type PendingAccountsResponse struct {
+	PendingAccounts []PendingAccountResponse `json:"pendingAccounts"`
+}
+
+// Every account that isn't verified yet, oldest first. In AdminApproval mode,
+// that's everyone waiting on the server operator.
+func (s *Server) getPendingAccounts(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	accounts, err := s.store.GetPendingAccounts()
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting pending accounts")
+		return
+	}
+
+	pendingAccountsResponse := PendingAccountsResponse{PendingAccounts: []PendingAccountResponse{}}
+	for _, account := range accounts {
+		pendingAccountsResponse.PendingAccounts = append(pendingAccountsResponse.PendingAccounts, PendingAccountResponse{
+			UserId:  account.UserId,
+			Email:   account.Email,
+			Locale:  account.Locale,
+			Created: account.Created,
+		})
+	}
+
+	response, err := json.Marshal(pendingAccountsResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating pending accounts response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Verify a pending account, and tell the user if the server sends email. The
+// account is approved either way, so if we can't tell them, we log it rather
+// than failing the request.
+//
+// Response Code:
+//
+//	200: Account approved
+//	401: Wrong admin token
+//	404: No such account, or it's already verified
+//	500: Account not approved for unanticipated reasons
+func (s *Server) approveAccount(w http.ResponseWriter, req *http.Request) {
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	var pendingAccountRequest PendingAccountRequest
+	if !getPostData(w, req, &pendingAccountRequest) {
+		return
+	}
+
+	email, locale, err := s.store.ApproveAccount(pendingAccountRequest.UserId)
+	if err == store.ErrNotPending {
+		errorJson(w, http.StatusNotFound, "No pending account")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error approving account")
+		return
+	}
+	s.recordAuditEvent(req, store.AuditEventAccountApproved, pendingAccountRequest.UserId, "")
+
+	mailEnabled, err := env.GetMailEnabled(s.env)
+	if err == nil && mailEnabled {
+		err = s.mail.SendAccountApprovedNotification(email, locale)
+	}
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "notification-email"}).Inc()
+		logging.FromContext(req.Context()).Warn("Error sending account approved email", logging.Err(err))
+	}
+
+	var approveAccountResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(approveAccountResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating approve account response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	logging.FromContext(req.Context()).Info("Account approved", logging.F("user_id", pendingAccountRequest.UserId), logging.F("email", email))
+}
+
+// Delete a pending account. The email is free to sign up again.
+//
+// Response Code:
+//
+//	200: Account rejected
+//	401: Wrong admin token
+//	404: No such account, or it's already verified
+//	500: Account not rejected for unanticipated reasons
+func (s *Server) rejectAccount(w http.ResponseWriter, req *http.Request) {
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	var pendingAccountRequest PendingAccountRequest
+	if !getPostData(w, req, &pendingAccountRequest) {
+		return
+	}
+
+	email, err := s.store.RejectAccount(pendingAccountRequest.UserId)
+	if err == store.ErrNotPending {
+		errorJson(w, http.StatusNotFound, "No pending account")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error rejecting account")
+		return
+	}
+	s.recordAuditEvent(req, store.AuditEventAccountRejected, pendingAccountRequest.UserId, "")
+
+	var rejectAccountResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(rejectAccountResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating reject account response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	logging.FromContext(req.Context()).Info("Account rejected", logging.F("user_id", pendingAccountRequest.UserId), logging.F("email", email))
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerRegisterAdminApproval(t *testing.T) {
+	const seed = "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	requestBody := `{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "` + seed + `", "locale": "pt-BR"}`
+
+	testStore := TestStore{}
+	testAuth := TestAuth{TestNewVerifyTokenString: "abcd1234abcd1234abcd1234abcd1234"}
+	testMail := TestMail{}
+	env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "AdminApproval"}
+	s := Init(&testAuth, &testStore, &TestEnv{env}, &testMail, TestPort)
+
+	req := httptest.NewRequest(http.MethodPost, paths.PathRegister, bytes.NewBuffer([]byte(requestBody)))
+	w := httptest.NewRecorder()
+
+	s.register(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusCreated)
+
+	expectedCall := &CreatePendingAccountCall{
+		Email:          "abc@example.com",
+		Password:       "12345678",
+		ClientSaltSeed: seed,
+		VerifyToken:    "abcd1234abcd1234abcd1234abcd1234",
+		Locale:         "pt-BR",
+	}
+	if !reflect.DeepEqual(expectedCall, testStore.Called.CreatePendingAccount) {
+		t.Errorf("Expected Store.CreatePendingAccount to be called with %+v, got %+v", expectedCall, testStore.Called.CreatePendingAccount)
+	}
+	if testStore.Called.CreateAccount != nil {
+		t.Errorf("Expected Store.CreateAccount not to be called")
+	}
+	if testMail.SendVerificationEmailCall != nil {
+		t.Errorf("Expected no verification email")
+	}
+	if string(body) != `{"verified":false}` {
+		t.Errorf("Unexpected response %s", body)
+	}
+}
+
+func TestServerGetPendingAccounts(t *testing.T) {
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	testStore := TestStore{
+		TestPendingAccounts: []store.PendingAccount{
+			{UserId: 5, Email: "abc@example.com", Locale: "pt-BR", Created: created},
+			{UserId: 7, Email: "def@example.com", Created: created},
+		},
+	}
+	env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "AdminApproval", "ADMIN_TOKEN": testAdminToken}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathAdminPendingAccounts, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+
+	s.getPendingAccounts(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+	expectedBody := `{"pendingAccounts":[` +
+		`{"userId":5,"email":"abc@example.com","locale":"pt-BR","created":"2022-01-02T03:04:05Z"},` +
+		`{"userId":7,"email":"def@example.com","created":"2022-01-02T03:04:05Z"}]}`
+	if string(body) != expectedBody {
+		t.Errorf("Expected %s, got %s", expectedBody, body)
+	}
+}
+
+func TestServerApproveAccount(t *testing.T) {
+	mailEnv := map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "AdminApproval",
+		"ADMIN_TOKEN":               testAdminToken,
+		"MAILGUN_SENDING_DOMAIN":    "sending.example.com",
+		"MAILGUN_SERVER_DOMAIN":     "server.example.com",
+		"MAILGUN_PRIVATE_API_KEY":   "my-private-api-key",
+	}
+	noMailEnv := map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "AdminApproval",
+		"ADMIN_TOKEN":               testAdminToken,
+	}
+
+	tt := []struct {
+		name          string
+		env           map[string]string
+		authorization string
+		requestBody   string
+		storeErrors   TestStoreFunctionsErrors
+		mailError     error
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        auth.UserId
+		expectEmail         bool
+	}{
+		{
+			name:               "success",
+			env:                mailEnv,
+			authorization:      "Bearer " + testAdminToken,
+			requestBody:        `{"userId": 5}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       5,
+			expectEmail:        true,
+		},
+		{
+			name:               "success without mail",
+			env:                noMailEnv,
+			authorization:      "Bearer " + testAdminToken,
+			requestBody:        `{"userId": 5}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       5,
+		},
+		{
+			name:               "email error", // still approved
+			env:                mailEnv,
+			authorization:      "Bearer " + testAdminToken,
+			requestBody:        `{"userId": 5}`,
+			mailError:          fmt.Errorf("Mailgun is down"),
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       5,
+			expectEmail:        true,
+		},
+		{
+			name:                "not pending",
+			env:                 mailEnv,
+			authorization:       "Bearer " + testAdminToken,
+			requestBody:         `{"userId": 5}`,
+			storeErrors:         TestStoreFunctionsErrors{ApproveAccount: store.ErrNotPending},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No pending account",
+			expectedCall:        5,
+		},
+		{
+			name:                "missing user id",
+			env:                 mailEnv,
+			authorization:       "Bearer " + testAdminToken,
+			requestBody:         `{}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'userId'",
+		},
+		{
+			name:                "wrong admin token",
+			env:                 mailEnv,
+			authorization:       "Bearer nope",
+			requestBody:         `{"userId": 5}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors, TestEmail: "abc@example.com", TestLocale: "pt-BR"}
+			testMail := TestMail{SendNotificationError: tc.mailError}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &testMail, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAdminPendingAccountsApprove, bytes.NewBuffer([]byte(tc.requestBody)))
+			req.Header.Set("Authorization", tc.authorization)
+			w := httptest.NewRecorder()
+
+			s.approveAccount(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.ApproveAccount != tc.expectedCall {
+				t.Errorf("Expected Store.ApproveAccount to be called with %d, got %d", tc.expectedCall, testStore.Called.ApproveAccount)
+			}
+			if tc.expectEmail {
+				if testMail.SendAccountApprovedNotificationCall == nil || *testMail.SendAccountApprovedNotificationCall != "abc@example.com" {
+					t.Errorf("Expected an approval email to abc@example.com, got %v", testMail.SendAccountApprovedNotificationCall)
+				}
+			} else if testMail.SendAccountApprovedNotificationCall != nil {
+				t.Errorf("Expected no approval email")
+			}
+			if tc.expectedStatusCode == http.StatusOK && string(body) != "{}" {
+				t.Errorf("Unexpected response %s", body)
+			}
+		})
+	}
+}
+
+func TestServerRejectAccount(t *testing.T) {
+	env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "AdminApproval", "ADMIN_TOKEN": testAdminToken}
+
+	tt := []struct {
+		name        string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "not pending",
+			storeErrors:         TestStoreFunctionsErrors{RejectAccount: store.ErrNotPending},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No pending account",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors, TestEmail: "abc@example.com"}
+			testMail := TestMail{}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAdminPendingAccountsReject, bytes.NewBuffer([]byte(`{"userId": 5}`)))
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			w := httptest.NewRecorder()
+
+			s.rejectAccount(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.RejectAccount != 5 {
+				t.Errorf("Expected Store.RejectAccount to be called with 5, got %d", testStore.Called.RejectAccount)
+			}
+			if testMail.SendAccountApprovedNotificationCall != nil {
+				t.Errorf("Expected no email")
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+)
+
+// Longer than any real user agent. Just so nobody can fill the table with junk.
+const maxAuditUserAgentLength = 256
+
+// How many of their own events a user gets to see
+const maxAuditEventsListed = 100
+
+type AuditEventResponse struct {
+	Type      store.AuditEventType `json:"type"`
+	DeviceId  auth.DeviceId        `json:"deviceId,omitempty"`
+	IP        string               `json:"ip"`
+	UserAgent string               `json:"userAgent"`
+	Created   time.Time            `json:"created"`
+}
+
+type AuditEventsResponse struct {
+	Events []AuditEventResponse `json:"events"`
+}
+
+// One line of the admin export
+type AuditEventExportLine struct {
+	UserId auth.UserId `json:"userId,omitempty"`
+	AuditEventResponse
+}
+
+// Fill in where the request came from
+func (s *Server) newAuditEvent(req *http.Request, eventType store.AuditEventType, userId auth.UserId, deviceId auth.DeviceId) store.AuditEvent {
+	// Config errors are reported on startup, so this shouldn't happen. If it
+	// does, the address we see is still better than nothing.
+	_, _, trustProxy, err := env.GetRateLimitConfigs(s.env)
+	if err != nil {
+		trustProxy = false
+	}
+
+	userAgent := req.UserAgent()
+	if len(userAgent) > maxAuditUserAgentLength {
+		userAgent = userAgent[:maxAuditUserAgentLength]
+	}
+
+	return store.AuditEvent{
+		UserId:    userId,
+		DeviceId:  deviceId,
+		Type:      eventType,
+		IP:        clientIP(req, trustProxy),
+		UserAgent: userAgent,
+	}
+}
+
+// Failing to record an event shouldn't fail the request it's about; by the
+// time we get here the thing has already happened. So we just log it and
+// count it so that someone notices.
+func (s *Server) auditEventError(req *http.Request, event store.AuditEvent, err error) {
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "audit"}).Inc()
+		logging.FromContext(req.Context()).Error("Error recording audit event", logging.F("event_type", event.Type), logging.Err(err))
+	}
+}
+
+func (s *Server) recordAuditEvent(req *http.Request, eventType store.AuditEventType, userId auth.UserId, deviceId auth.DeviceId) {
+	event := s.newAuditEvent(req, eventType, userId, deviceId)
+	s.auditEventError(req, event, s.store.AddAuditEvent(event))
+}
+
+// For when all we know is the email the client sent
+func (s *Server) recordAuditEventForEmail(req *http.Request, eventType store.AuditEventType, email auth.Email, deviceId auth.DeviceId) {
+	event := s.newAuditEvent(req, eventType, 0, deviceId)
+	s.auditEventError(req, event, s.store.AddAuditEventForEmail(email, event))
+}
+
+func auditEventResponse(event store.AuditEvent) AuditEventResponse {
+	return AuditEventResponse{
+		Type:      event.Type,
+		DeviceId:  event.DeviceId,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		Created:   event.Created,
+	}
+}
+
+// A user's own recent events, newest first
+func (s *Server) getAuditEvents(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	events, err := s.store.GetAuditEvents(authToken.UserId, maxAuditEventsListed)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting audit events")
+		return
+	}
+
+	auditEventsResponse := AuditEventsResponse{Events: []AuditEventResponse{}}
+	for _, event := range events {
+		auditEventsResponse.Events = append(auditEventsResponse.Events, auditEventResponse(event))
+	}
+
+	response, err := json.Marshal(auditEventsResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating audit events response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Returns whether the request has the admin token. If not, this responds to
+// the request.
+func (s *Server) checkAdminAuth(w http.ResponseWriter, req *http.Request) bool {
+	adminToken, err := env.GetAdminToken(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting admin token")
+		return false
+	}
+	if adminToken == "" {
+		// Turned off. Don't advertise that it exists.
+		s.unknownEndpoint(w, req)
+		return false
+	}
+
+	bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		errorJson(w, http.StatusUnauthorized, "")
+		return false
+	}
+	return true
+}
+
+// Every user's events since the `since` param (RFC 3339, default everything),
+// oldest first, as newline-delimited JSON.
+func (s *Server) exportAuditEvents(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	var since time.Time
+	if sinceStr := req.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			errorJson(w, http.StatusBadRequest, "Invalid 'since' parameter. Should be RFC 3339, i.e. 2006-01-02T15:04:05Z")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	exported := 0
+	err := s.store.ExportAuditEvents(since, func(event store.AuditEvent) error {
+		exported++
+		return encoder.Encode(AuditEventExportLine{
+			UserId:             event.UserId,
+			AuditEventResponse: auditEventResponse(event),
+		})
+	})
+	if err != nil && exported == 0 {
+		internalServiceErrorJson(w, req, err, "Error exporting audit events")
+	} else if err != nil {
+		// We've already sent some of it, so it's too late for an error response.
+		// Cutting it off short will have to do.
+		logging.FromContext(req.Context()).Error("Error exporting audit events", logging.Err(err))
+	}
+}
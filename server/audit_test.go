@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+const testAdminToken = "abcd1234abcd1234abcd1234abcd1234"
+
+func TestServerAuditEventsRecorded(t *testing.T) {
+	tt := []struct {
+		name string
+
+		handler     func(*Server) http.HandlerFunc
+		method      string
+		path        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode int
+		expectedCall       AuditEventCall
+	}{
+		{
+			name:        "login",
+			handler:     func(s *Server) http.HandlerFunc { return s.getAuthToken },
+			method:      http.MethodPost,
+			path:        paths.PathAuthToken,
+			requestBody: `{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`,
+
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       AuditEventCall{Event: store.AuditEvent{UserId: 0, DeviceId: "dev-1", Type: store.AuditEventLogin}},
+		},
+		{
+			name:        "login failed",
+			handler:     func(s *Server) http.HandlerFunc { return s.getAuthToken },
+			method:      http.MethodPost,
+			path:        paths.PathAuthToken,
+			requestBody: `{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`,
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrWrongCredentials},
+
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedCall:       AuditEventCall{Email: "abc@example.com", Event: store.AuditEvent{DeviceId: "dev-1", Type: store.AuditEventLoginFailed}},
+		},
+		{
+			name:        "wallet update",
+			handler:     func(s *Server) http.HandlerFunc { return s.postWallet },
+			method:      http.MethodPost,
+			path:        paths.PathWallet,
+			requestBody: `{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`,
+
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       AuditEventCall{Event: store.AuditEvent{UserId: 5, DeviceId: "dev-2", Type: store.AuditEventWalletUpdate}},
+		},
+		{
+			name:    "account verified",
+			handler: func(s *Server) http.HandlerFunc { return s.verify },
+			method:  http.MethodGet,
+			path:    paths.PathVerify + "?verifyToken=abcd1234abcd1234abcd1234abcd1234",
+
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       AuditEventCall{Event: store.AuditEvent{UserId: 5, Type: store.AuditEventAccountVerified}},
+		},
+		{
+			// Still succeeds if the audit log can't be written
+			name:        "error recording",
+			handler:     func(s *Server) http.HandlerFunc { return s.postWallet },
+			method:      http.MethodPost,
+			path:        paths.PathWallet,
+			requestBody: `{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`,
+			storeErrors: TestStoreFunctionsErrors{AddAuditEvent: fmt.Errorf("Some random DB Error!")},
+
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       AuditEventCall{Event: store.AuditEvent{UserId: 5, DeviceId: "dev-2", Type: store.AuditEventWalletUpdate}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", UserId: 5, DeviceId: "dev-2", Scope: auth.ScopeFull},
+				TestUserId:    5,
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{TestNewAuthTokenString: "seekrit"}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(tc.method, tc.path, bytes.NewBuffer([]byte(tc.requestBody)))
+			req.Header.Set("User-Agent", "Some Client/1.0")
+			w := httptest.NewRecorder()
+
+			tc.handler(s)(w, req)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+
+			tc.expectedCall.Event.IP = "192.0.2.1" // httptest's RemoteAddr
+			tc.expectedCall.Event.UserAgent = "Some Client/1.0"
+			if want, got := []AuditEventCall{tc.expectedCall}, testStore.Called.AuditEvents; !reflect.DeepEqual(want, got) {
+				t.Errorf("Expected audit events %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestServerAuditEventRequestInfo(t *testing.T) {
+	testStore := TestStore{}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{map[string]string{"RATE_LIMIT_TRUST_PROXY": "true"}}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	req.Header.Set("User-Agent", strings.Repeat("a", maxAuditUserAgentLength+10))
+
+	event := s.newAuditEvent(req, store.AuditEventLogin, 5, "dev-1")
+
+	if event.IP != "2.2.2.2" {
+		t.Errorf("Expected the IP the proxy gave us, got %s", event.IP)
+	}
+	if len(event.UserAgent) != maxAuditUserAgentLength {
+		t.Errorf("Expected the user agent to be truncated to %d, got %d", maxAuditUserAgentLength, len(event.UserAgent))
+	}
+}
+
+func TestServerGetAuditEvents(t *testing.T) {
+	created := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{Token: "seekrit", UserId: 5, Scope: auth.ScopeFull},
+		TestAuditEvents: []store.AuditEvent{
+			{UserId: 5, DeviceId: "dev-1", Type: store.AuditEventLogin, IP: "1.2.3.4", UserAgent: "Some Client/1.0", Created: created},
+			{UserId: 5, Type: store.AuditEventPasswordChangeFailed, IP: "5.6.7.8", UserAgent: "Other", Created: created},
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathAuditEvents+"?token=seekrit", nil)
+	w := httptest.NewRecorder()
+
+	s.getAuditEvents(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+
+	expected := `{"events":[` +
+		`{"type":"login","deviceId":"dev-1","ip":"1.2.3.4","userAgent":"Some Client/1.0","created":"2022-07-01T12:00:00Z"},` +
+		`{"type":"password-change-failed","ip":"5.6.7.8","userAgent":"Other","created":"2022-07-01T12:00:00Z"}` +
+		`]}`
+	if string(body) != expected {
+		t.Errorf("Expected response %s, got %s", expected, body)
+	}
+	if testStore.Called.GetAuditEvents != 5 {
+		t.Errorf("Expected Store.GetAuditEvents to be called with the token's user id, got %d", testStore.Called.GetAuditEvents)
+	}
+}
+
+func TestServerGetAuditEventsErrors(t *testing.T) {
+	tt := []struct {
+		name string
+
+		path                string
+		storeErrors         TestStoreFunctionsErrors
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:                "missing token",
+			path:                paths.PathAuditEvents,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing token parameter",
+		},
+		{
+			name:                "auth error",
+			path:                paths.PathAuditEvents + "?token=seekrit",
+			storeErrors:         TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+		},
+		{
+			name:                "db error",
+			path:                paths.PathAuditEvents + "?token=seekrit",
+			storeErrors:         TestStoreFunctionsErrors{GetAuditEvents: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", UserId: 5, Scope: auth.ScopeFull},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			s.getAuditEvents(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+		})
+	}
+}
+
+func TestServerExportAuditEvents(t *testing.T) {
+	created := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	testStore := TestStore{
+		TestAuditEvents: []store.AuditEvent{
+			{UserId: 5, DeviceId: "dev-1", Type: store.AuditEventLogin, IP: "1.2.3.4", UserAgent: "Some Client/1.0", Created: created},
+			{Type: store.AuditEventLoginFailed, IP: "5.6.7.8", UserAgent: "Other", Created: created},
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{map[string]string{"ADMIN_TOKEN": testAdminToken}}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathAdminAuditEvents+"?since=2022-06-01T00:00:00Z", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+
+	s.exportAuditEvents(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+
+	expected := `{"userId":5,"type":"login","deviceId":"dev-1","ip":"1.2.3.4","userAgent":"Some Client/1.0","created":"2022-07-01T12:00:00Z"}` + "\n" +
+		`{"type":"login-failed","ip":"5.6.7.8","userAgent":"Other","created":"2022-07-01T12:00:00Z"}` + "\n"
+	if string(body) != expected {
+		t.Errorf("Expected response %s, got %s", expected, body)
+	}
+	if since := testStore.Called.ExportAuditEvents; since == nil || !since.Equal(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected Store.ExportAuditEvents to be called with the since param, got %v", since)
+	}
+}
+
+func TestServerExportAuditEventsErrors(t *testing.T) {
+	tt := []struct {
+		name string
+
+		adminToken          string
+		authorization       string
+		query               string
+		storeErrors         TestStoreFunctionsErrors
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:                "admin endpoints off",
+			authorization:       "Bearer " + testAdminToken,
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Unknown Endpoint",
+		},
+		{
+			name:                "missing token",
+			adminToken:          testAdminToken,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized),
+		},
+		{
+			name:                "wrong token",
+			adminToken:          testAdminToken,
+			authorization:       "Bearer " + strings.Repeat("x", len(testAdminToken)),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized),
+		},
+		{
+			name:                "bad since",
+			adminToken:          testAdminToken,
+			authorization:       "Bearer " + testAdminToken,
+			query:               "?since=yesterday",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid 'since' parameter. Should be RFC 3339, i.e. 2006-01-02T15:04:05Z",
+		},
+		{
+			name:                "db error",
+			adminToken:          testAdminToken,
+			authorization:       "Bearer " + testAdminToken,
+			storeErrors:         TestStoreFunctionsErrors{ExportAuditEvents: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{map[string]string{"ADMIN_TOKEN": tc.adminToken}}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathAdminAuditEvents+tc.query, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			s.exportAuditEvents(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+		})
+	}
+}
+
+// Make sure the export is valid JSON per line, and doesn't leak anything that
+// isn't in the event
+func TestServerExportAuditEventsLines(t *testing.T) {
+	testStore := TestStore{
+		TestAuditEvents: []store.AuditEvent{
+			{UserId: 5, Type: store.AuditEventRegister, IP: "1.2.3.4"},
+			{UserId: 6, Type: store.AuditEventRegister, IP: "1.2.3.4"},
+			{UserId: 7, Type: store.AuditEventRegister, IP: "1.2.3.4"},
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{map[string]string{"ADMIN_TOKEN": testAdminToken}}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathAdminAuditEvents, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+
+	s.exportAuditEvents(w, req)
+
+	if contentType := w.Result().Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Expected newline-delimited JSON, got Content-Type %s", contentType)
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d: %s", len(lines), w.Body.String())
+	}
+	for i, line := range lines {
+		var result map[string]any
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("Error decoding line %d: %s: %+v", i, line, err)
+		}
+		if result["userId"] != float64(5+i) {
+			t.Errorf("Expected line %d to have userId %d, got %v", i, 5+i, result["userId"])
+		}
+	}
+}
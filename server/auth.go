@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/store"
 )
 
@@ -38,36 +39,59 @@ func (s *Server) getAuthToken(w http.ResponseWriter, req *http.Request) {
 
 	userId, err := s.store.GetUserId(authRequest.Email, authRequest.Password)
 	if err == store.ErrWrongCredentials {
+		s.recordAuditEventForEmail(req, store.AuditEventLoginFailed, authRequest.Email, authRequest.DeviceId)
 		errorJson(w, http.StatusUnauthorized, "No match for email and/or password")
 		return
 	}
 	if err == store.ErrNotVerified {
+		s.recordAuditEventForEmail(req, store.AuditEventLoginFailed, authRequest.Email, authRequest.DeviceId)
 		errorJson(w, http.StatusUnauthorized, "Account is not verified")
 		return
 	}
+	if err == store.ErrAccountMigrated {
+		migratedTo, err := s.store.GetMigratedTo(authRequest.Email)
+		if err != nil {
+			internalServiceErrorJson(w, req, err, "Error getting where account migrated to")
+			return
+		}
+		accountMigratedJson(w, migratedTo)
+		return
+	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting User Id")
+		internalServiceErrorJson(w, req, err, "Error getting User Id")
 		return
 	}
 
 	authToken, err := s.auth.NewAuthToken(userId, authRequest.DeviceId, auth.ScopeFull)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating auth token")
+		internalServiceErrorJson(w, req, err, "Error generating auth token")
 		return
 	}
 
 	response, err := json.Marshal(&authToken)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating auth token")
+		internalServiceErrorJson(w, req, err, "Error generating auth token")
 		return
 	}
 
 	if err := s.store.SaveToken(authToken); err != nil {
-		internalServiceErrorJson(w, err, "Error saving auth token")
+		internalServiceErrorJson(w, req, err, "Error saving auth token")
 		return
 	}
 
+	// Has to be before recording this login. Not worth failing the login over.
+	newDevice, err := s.store.IsNewDevice(userId, authRequest.DeviceId)
+	if err != nil {
+		logging.FromContext(req.Context()).Warn("Error checking for a new device", logging.Err(err))
+	}
+	s.recordAuditEvent(req, store.AuditEventLogin, userId, authRequest.DeviceId)
+	if newDevice {
+		s.notify(req, userId, func(email auth.Email, locale auth.Locale) error {
+			return s.mail.SendNewDeviceNotification(email, authRequest.DeviceId, locale)
+		})
+	}
+
 	fmt.Fprintf(w, string(response))
 }
@@ -122,6 +122,38 @@ func TestServerAuthHandlerErrors(t *testing.T) {
 	}
 }
 
+func TestServerAuthHandlerAccountMigrated(t *testing.T) {
+	testStore := TestStore{
+		Errors:         TestStoreFunctionsErrors{GetUserId: store.ErrAccountMigrated},
+		TestMigratedTo: "https://other.example.com/",
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	requestBody := `{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`
+	req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer([]byte(requestBody)))
+	w := httptest.NewRecorder()
+
+	s.getAuthToken(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusPermanentRedirect)
+	expectErrorString(t, body, http.StatusText(http.StatusPermanentRedirect)+": Account has moved to another server")
+
+	if want, got := "https://other.example.com"+paths.PathAuthToken, w.Result().Header.Get("Location"); want != got {
+		t.Errorf("Expected Location %s, got %s", want, got)
+	}
+	var migratedResponse AccountMigratedResponse
+	if err := json.Unmarshal(body, &migratedResponse); err != nil || migratedResponse.MigratedTo != "https://other.example.com/" {
+		t.Errorf("Expected migratedTo in the response, got %s %+v", body, err)
+	}
+	if testStore.Called.GetMigratedTo != "abc@example.com" {
+		t.Errorf("Expected Store.GetMigratedTo to be called with the email, got %s", testStore.Called.GetMigratedTo)
+	}
+	if testStore.Called.SaveToken != "" {
+		t.Errorf("Expected no token to be saved")
+	}
+}
+
 func TestServerValidateAuthRequest(t *testing.T) {
 	authRequest := AuthRequest{DeviceId: "dId", Email: "joe@example.com", Password: "12345678"}
 	if authRequest.validate() != nil {
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/env"
+)
+
+// Below this, compressing a response isn't worth the trouble
+const minCompressSize = 1024
+
+var errDecompressedBodyTooLarge = fmt.Errorf("Decompressed request body too large")
+
+type bodyLimitContextKey struct{}
+
+// Sets the largest request body (after decompression) the endpoint will
+// accept. getPostData enforces it.
+func withBodyLimit(limit int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), bodyLimitContextKey{}, limit)))
+		})
+	}
+}
+
+// Handlers called without the middleware (i.e. in tests) get the default
+func bodyLimit(req *http.Request) int64 {
+	if limit, ok := req.Context().Value(bodyLimitContextKey{}).(int64); ok {
+		return limit
+	}
+	return env.DefaultMaxBodySize
+}
+
+// Like http.MaxBytesReader, but for what comes out of the decompressor. A
+// tiny compressed body can decompress to something enormous.
+type decompressedLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *decompressedLimitReader) Read(p []byte) (int, error) {
+	// Read one more than we allow, so we know if there's too much
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		return n, err
+	}
+	n = int(l.remaining)
+	l.remaining = 0
+	return n, errDecompressedBodyTooLarge
+}
+
+// The request body, decompressed according to Content-Encoding, limited to
+// `limit` bytes both before and after decompression. Returns
+// compression.ErrUnsupportedEncoding for encodings we don't take.
+func requestBody(w http.ResponseWriter, req *http.Request, limit int64) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(w, req.Body, limit)
+
+	encoding, err := compression.ParseEncoding(req.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	if encoding == compression.Identity {
+		return body, nil
+	}
+
+	decompressed, err := compression.NewReader(encoding, body)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&decompressedLimitReader{decompressed, limit}, decompressed}, nil
+}
+
+// Write a JSON response, compressed if the client accepts it and it's big
+// enough to be worth it.
+func writeCompressibleJson(w http.ResponseWriter, req *http.Request, response []byte) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := compression.Negotiate(req.Header.Get("Accept-Encoding"))
+	if len(response) < minCompressSize || encoding == compression.Identity {
+		_, err := w.Write(response)
+		return err
+	}
+
+	compressed, err := compression.Compress(encoding, response)
+	if err != nil {
+		// Nothing's written yet, so the client can still have it uncompressed
+		w.Write(response)
+		return err
+	}
+
+	// A strong ETag promises the same bytes, which a different encoding isn't
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
+	w.Header().Set("Content-Encoding", string(encoding))
+	_, err = w.Write(compressed)
+	return err
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func compressed(t *testing.T, encoding compression.Encoding, body string) []byte {
+	data, err := compression.Compress(encoding, []byte(body))
+	if err != nil {
+		t.Fatalf("Error compressing test body: %+v", err)
+	}
+	return data
+}
+
+func TestServerGetPostDataCompressed(t *testing.T) {
+	// Valid JSON for TestReqStruct, which doesn't take any fields
+	bigBody := "{" + strings.Repeat(" ", 200000) + "}"
+	tt := []struct {
+		name            string
+		contentEncoding string
+		requestBody     []byte
+		limit           int64
+
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:               "gzip",
+			contentEncoding:    "gzip",
+			requestBody:        compressed(t, compression.Gzip, `{}`),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "zstd",
+			contentEncoding:    "zstd",
+			requestBody:        compressed(t, compression.Zstd, `{}`),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "unsupported encoding",
+			contentEncoding:     "br",
+			requestBody:         []byte(`{}`),
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedErrorString: http.StatusText(http.StatusUnsupportedMediaType) + ": Content-Encoding should be gzip or zstd, or none",
+		},
+		{
+			name:                "not actually gzip",
+			contentEncoding:     "gzip",
+			requestBody:         []byte(`{}`),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Error decompressing request body",
+		},
+		{
+			// Small when compressed, but not once it's decompressed
+			name:                "decompressed body too large",
+			contentEncoding:     "zstd",
+			requestBody:         compressed(t, compression.Zstd, bigBody),
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge),
+		},
+		{
+			name:               "decompressed body within a bigger limit",
+			contentEncoding:    "zstd",
+			requestBody:        compressed(t, compression.Zstd, bigBody),
+			limit:              300000,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "body too large for a smaller limit",
+			requestBody:         []byte(`{                    }`),
+			limit:               10,
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if getPostData(w, req, &TestReqStruct{key: "hi"}) {
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			if tc.limit != 0 {
+				handler = withBodyLimit(tc.limit)(handler)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(tc.requestBody))
+			if tc.contentEncoding != "" {
+				req.Header.Set("Content-Encoding", tc.contentEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+		})
+	}
+}
+
+func TestServerGetWalletCompressed(t *testing.T) {
+	bigWallet := wallet.EncryptedWallet(strings.Repeat("my-encrypted-wallet", 100))
+	tt := []struct {
+		name            string
+		acceptEncoding  string
+		encryptedWallet wallet.EncryptedWallet
+
+		expectedEncoding compression.Encoding
+	}{
+		{
+			name:             "zstd",
+			acceptEncoding:   "gzip, zstd",
+			encryptedWallet:  bigWallet,
+			expectedEncoding: compression.Zstd,
+		},
+		{
+			name:             "gzip",
+			acceptEncoding:   "gzip",
+			encryptedWallet:  bigWallet,
+			expectedEncoding: compression.Gzip,
+		},
+		{
+			name:             "not accepted",
+			acceptEncoding:   "",
+			encryptedWallet:  bigWallet,
+			expectedEncoding: compression.Identity,
+		},
+		{
+			name:             "too small to bother",
+			acceptEncoding:   "gzip, zstd",
+			encryptedWallet:  "my-encrypted-wallet",
+			expectedEncoding: compression.Identity,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken:       auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				TestEncryptedWallet: tc.encryptedWallet,
+				TestSequence:        wallet.Sequence(2),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			w := httptest.NewRecorder()
+
+			s.getWallet(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, http.StatusOK)
+
+			header := w.Result().Header
+			if encoding := compression.Encoding(header.Get("Content-Encoding")); encoding != tc.expectedEncoding {
+				t.Fatalf("Expected Content-Encoding %q, got %q", tc.expectedEncoding, encoding)
+			}
+			if vary := header.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Expected Vary: Accept-Encoding, got %s", vary)
+			}
+
+			// Weak if compressed, strong if not
+			etag := walletETag(wallet.Sequence(2), wallet.WalletHmac("my-hmac"))
+			if tc.expectedEncoding != compression.Identity {
+				etag = "W/" + etag
+			}
+			if got := header.Get("ETag"); got != etag {
+				t.Errorf("Expected ETag %s, got %s", etag, got)
+			}
+
+			decompressed, err := compression.Decompress(tc.expectedEncoding, body)
+			if err != nil {
+				t.Fatalf("Error decompressing response: %+v", err)
+			}
+			if !strings.Contains(string(decompressed), string(tc.encryptedWallet)) {
+				t.Errorf("Expected the response to contain the wallet, got %s", decompressed)
+			}
+		})
+	}
+}
+
+func TestServerHandlerBodyLimits(t *testing.T) {
+	testStore := TestStore{TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull}}
+	env := map[string]string{"MAX_BODY_SIZE": "1000", "MAX_BODY_SIZES": "wallet=5000"}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &TestMail{}, TestPort)
+	handler := s.Handler()
+
+	walletBody := fmt.Sprintf(`{"token": "seekrit", "encryptedWallet": "%s", "sequence": 2, "hmac": "my-hmac"}`, strings.Repeat("a", 2000))
+
+	// Within the wallet endpoint's own limit
+	req := httptest.NewRequest(http.MethodPost, paths.PathWallet, strings.NewReader(walletBody))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	expectStatusCode(t, w, http.StatusOK)
+
+	// Over the default
+	req = httptest.NewRequest(http.MethodPost, paths.PathAuthToken, strings.NewReader(fmt.Sprintf(`{"deviceId": "%s", "email": "abc@example.com", "password": "12345678"}`, strings.Repeat("a", 2000))))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	expectStatusCode(t, w, http.StatusRequestEntityTooLarge)
+}
@@ -70,7 +70,7 @@ func (s *Server) getClientSaltSeed(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting client salt seed")
+		internalServiceErrorJson(w, req, err, "Error getting client salt seed")
 		return
 	}
 
@@ -81,7 +81,7 @@ func (s *Server) getClientSaltSeed(w http.ResponseWriter, req *http.Request) {
 	response, err := json.Marshal(clientSaltSeedResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating client salt seed response")
+		internalServiceErrorJson(w, req, err, "Error generating client salt seed response")
 		return
 	}
 
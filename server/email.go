@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+)
+
+// The client salt is made from the email, so changing the email changes the
+// password the client derives and the key the wallets are encrypted with.
+// Along with the new email, the client sends the new password, a client salt
+// seed and every wallet re-encrypted, as for a password change. (Only as
+// `wallets`; there are no clients from before named wallets that know about
+// email changes.)
+type ChangeEmailRequest struct {
+	Token          auth.AuthTokenString   `json:"token"`
+	Password       auth.Password          `json:"password"`
+	NewEmail       auth.Email             `json:"newEmail"`
+	NewPassword    auth.Password          `json:"newPassword"`
+	ClientSaltSeed auth.ClientSaltSeed    `json:"clientSaltSeed"`
+	Wallets        []ChangePasswordWallet `json:"wallets"`
+}
+
+func (r *ChangeEmailRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	if !r.NewEmail.Validate() {
+		return fmt.Errorf("Invalid or missing 'newEmail'")
+	}
+	if !r.NewPassword.Validate() {
+		return fmt.Errorf("Invalid or missing 'newPassword'")
+	}
+	if !r.ClientSaltSeed.Validate() {
+		return fmt.Errorf("Invalid or missing 'clientSaltSeed'")
+	}
+	return validateChangePasswordWallets(r.Wallets)
+}
+
+// Start an email change. Nothing changes until the user clicks the link sent
+// to the new address (see verifyEmailChange). The old address is told about
+// it.
+//
+// Response Code:
+//
+//	200: Confirmation email sent
+//	401: Wrong password
+//	403: The server isn't set up to send email
+//	409: Another account has the new email
+//	500: Email change not started for unanticipated reasons
+func (s *Server) changeEmail(w http.ResponseWriter, req *http.Request) {
+	verificationMode, err := env.GetAccountVerificationMode(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting account verification mode")
+		return
+	}
+	// The user has to prove they have the new address, which takes email
+	if verificationMode != env.AccountVerificationModeEmailVerify {
+		errorJson(w, http.StatusForbidden, "Account verification mode is not set to EmailVerify")
+		return
+	}
+
+	var changeEmailRequest ChangeEmailRequest
+	if !getPostData(w, req, &changeEmailRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, changeEmailRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	token, err := s.auth.NewVerifyTokenString()
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating verify token string")
+		return
+	}
+
+	oldEmail, locale, err := s.store.StartEmailChange(
+		authToken.UserId,
+		changeEmailRequest.Password,
+		changeEmailRequest.NewEmail,
+		changeEmailRequest.NewPassword,
+		changeEmailRequest.ClientSaltSeed,
+		changePasswordWalletUpdates(changeEmailRequest.Wallets),
+		token,
+	)
+	if err == store.ErrWrongCredentials {
+		errorJson(w, http.StatusUnauthorized, "No match for password")
+		return
+	}
+	if err == store.ErrDuplicateEmail {
+		errorJson(w, http.StatusConflict, "Email is already in use")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error starting email change")
+		return
+	}
+	s.recordAuditEvent(req, store.AuditEventEmailChangeRequest, authToken.UserId, authToken.DeviceId)
+
+	if err = s.mail.SendEmailChangeVerification(changeEmailRequest.NewEmail, token, locale); err != nil {
+		internalServiceErrorJson(w, req, err, "Error sending email change verification")
+		return
+	}
+	if err = s.mail.SendEmailChangeNotification(oldEmail, changeEmailRequest.NewEmail, locale); err != nil {
+		internalServiceErrorJson(w, req, err, "Error sending email change notification")
+		return
+	}
+
+	var changeEmailResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(changeEmailResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating change email response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	logging.FromContext(req.Context()).Info("User has started an email change", logging.F("user_id", authToken.UserId))
+}
+
+// Where the link in the email to the new address goes. Like verify, it's for
+// a browser, so it responds with plain text.
+func (s *Server) verifyEmailChange(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getVerifyParams(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		http.Error(w, "There seems to be a problem with this URL: "+paramsErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId, _, _, err := s.store.ConfirmEmailChange(token)
+
+	if err == store.ErrNoTokenForUser {
+		http.Error(w, "The confirmation token was not found, already used, or expired. If you want to try again, change your email again from your app.", http.StatusForbidden)
+		return
+	} else if err == store.ErrDuplicateEmail {
+		http.Error(w, "Another account is using this email now. Your email has not been changed.", http.StatusConflict)
+		return
+	} else if err == store.ErrWrongSequence || err == store.ErrMissingWallet || err == store.ErrUnexpectedWallet {
+		http.Error(w, "Your wallet changed since you asked to change your email. Your email has not been changed. Change your email again from your app.", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Something went wrong trying to change your email.", http.StatusInternalServerError)
+		logging.FromContext(req.Context()).Error("Error confirming email change", logging.Err(err))
+		return
+	}
+	s.recordAuditEvent(req, store.AuditEventEmailChange, userId, "")
+
+	// Every auth token is gone, so boot the websockets too. See changePassword
+	// for the races this leaves.
+	timeout := time.NewTicker(100 * time.Millisecond)
+	select {
+	case s.shardFor(userId).userRemove <- wsClientForUser{userId, nil}:
+	case <-timeout.C:
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-user-remove"}).Inc()
+	}
+	timeout.Stop()
+
+	fmt.Fprintf(w, "Your email has been changed. Log in with it again on each of your devices.")
+	logging.FromContext(req.Context()).Info("User has changed their email", logging.F("user_id", userId))
+}
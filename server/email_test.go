@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerChangeEmail(t *testing.T) {
+	emailVerifyEnv := map[string]string{"ACCOUNT_VERIFICATION_MODE": "EmailVerify"}
+	const seed = "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	requestBody := `{
+		"token": "seekrit",
+		"password": "12345678",
+		"newEmail": "new@example.com",
+		"newPassword": "87654321",
+		"clientSaltSeed": "` + seed + `",
+		"wallets": [{"walletId": "default_wallet", "encryptedWallet": "my-enc-wallet", "sequence": 3, "hmac": "my-hmac"}]
+	}`
+	expectedCall := &StartEmailChangeCall{
+		UserId:         5,
+		Password:       "12345678",
+		NewEmail:       "new@example.com",
+		NewPassword:    "87654321",
+		ClientSaltSeed: seed,
+		Wallets: []store.WalletUpdate{
+			{WalletId: "default_wallet", EncryptedWallet: "my-enc-wallet", Sequence: 3, Hmac: "my-hmac"},
+		},
+		Token: "my-verify-token",
+	}
+
+	tt := []struct {
+		name        string
+		env         map[string]string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+		mailError   error
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *StartEmailChangeCall
+		expectedMail        bool
+	}{
+		{
+			name:               "success",
+			env:                emailVerifyEnv,
+			requestBody:        requestBody,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       expectedCall,
+			expectedMail:       true,
+		},
+		{
+			name:                "wrong account verification mode",
+			env:                 map[string]string{"ACCOUNT_VERIFICATION_MODE": "AllowAll"},
+			requestBody:         requestBody,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Account verification mode is not set to EmailVerify",
+		},
+		{
+			name:                "validation error",
+			env:                 emailVerifyEnv,
+			requestBody:         strings.Replace(requestBody, "new@example.com", "new", 1),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'newEmail'",
+		},
+		{
+			name:                "wrong password",
+			env:                 emailVerifyEnv,
+			requestBody:         requestBody,
+			storeErrors:         TestStoreFunctionsErrors{StartEmailChange: store.ErrWrongCredentials},
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for password",
+			expectedCall:        expectedCall,
+		},
+		{
+			name:                "email in use",
+			env:                 emailVerifyEnv,
+			requestBody:         requestBody,
+			storeErrors:         TestStoreFunctionsErrors{StartEmailChange: store.ErrDuplicateEmail},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Email is already in use",
+			expectedCall:        expectedCall,
+		},
+		{
+			name:                "db error",
+			env:                 emailVerifyEnv,
+			requestBody:         requestBody,
+			storeErrors:         TestStoreFunctionsErrors{StartEmailChange: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        expectedCall,
+		},
+		{
+			name:                "mail error",
+			env:                 emailVerifyEnv,
+			requestBody:         requestBody,
+			mailError:           fmt.Errorf("TestEmail.SendEmailChangeVerification fail"),
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        expectedCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+				TestEmail:     "old@example.com",
+				TestLocale:    "pt-BR",
+				Errors:        tc.storeErrors,
+			}
+			testMail := TestMail{SendEmailChangeVerificationError: tc.mailError}
+			testAuth := TestAuth{TestNewVerifyTokenString: "my-verify-token"}
+			s := Init(&testAuth, &testStore, &TestEnv{tc.env}, &testMail, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathEmail, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.changeEmail(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.StartEmailChange) {
+				t.Errorf("Expected Store.StartEmailChange to be called with %+v, got %+v", tc.expectedCall, testStore.Called.StartEmailChange)
+			}
+			if !tc.expectedMail {
+				return
+			}
+
+			if want, got := (&SendVerificationEmailCall{"new@example.com", "my-verify-token", "pt-BR"}), testMail.SendEmailChangeVerificationCall; !reflect.DeepEqual(want, got) {
+				t.Errorf("Expected a verification email %+v, got %+v", want, got)
+			}
+			if want, got := (&SendEmailChangeNotificationCall{"old@example.com", "new@example.com", "pt-BR"}), testMail.SendEmailChangeNotificationCall; !reflect.DeepEqual(want, got) {
+				t.Errorf("Expected a notification email %+v, got %+v", want, got)
+			}
+			if string(body) != "{}" {
+				t.Errorf("Expected empty response, got %s", body)
+			}
+			if len(testStore.Called.AuditEvents) != 1 || testStore.Called.AuditEvents[0].Event.Type != store.AuditEventEmailChangeRequest {
+				t.Errorf("Expected an email change request audit event, got %+v", testStore.Called.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestServerVerifyEmailChange(t *testing.T) {
+	tt := []struct {
+		name        string
+		token       string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "success",
+			token:              "abcd1234abcd1234abcd1234abcd1234",
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "Your email has been changed. Log in with it again on each of your devices.",
+		},
+		{
+			name:               "missing token",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "There seems to be a problem with this URL: Missing verifyToken parameter",
+		},
+		{
+			name:               "token not found", // including expired
+			token:              "abcd1234abcd1234abcd1234abcd1234",
+			storeErrors:        TestStoreFunctionsErrors{ConfirmEmailChange: store.ErrNoTokenForUser},
+			expectedStatusCode: http.StatusForbidden,
+			expectedBody:       "The confirmation token was not found, already used, or expired. If you want to try again, change your email again from your app.",
+		},
+		{
+			name:               "email taken",
+			token:              "abcd1234abcd1234abcd1234abcd1234",
+			storeErrors:        TestStoreFunctionsErrors{ConfirmEmailChange: store.ErrDuplicateEmail},
+			expectedStatusCode: http.StatusConflict,
+			expectedBody:       "Another account is using this email now. Your email has not been changed.",
+		},
+		{
+			name:               "wallet changed",
+			token:              "abcd1234abcd1234abcd1234abcd1234",
+			storeErrors:        TestStoreFunctionsErrors{ConfirmEmailChange: store.ErrWrongSequence},
+			expectedStatusCode: http.StatusConflict,
+			expectedBody:       "Your wallet changed since you asked to change your email. Your email has not been changed. Change your email again from your app.",
+		},
+		{
+			name:               "assorted db error",
+			token:              "abcd1234abcd1234abcd1234abcd1234",
+			storeErrors:        TestStoreFunctionsErrors{ConfirmEmailChange: fmt.Errorf("TestStore.ConfirmEmailChange fail")},
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedBody:       "Something went wrong trying to change your email.",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestUserId: 5, Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathEmailVerify, nil)
+			q := req.URL.Query()
+			q.Add("verifyToken", tc.token)
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			s.verifyEmailChange(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if want, got := tc.expectedBody, strings.TrimSpace(string(body)); want != got {
+				t.Errorf("Body: expected `%s`, got `%s`", want, got)
+			}
+			if want, got := auth.VerifyTokenString(tc.token), testStore.Called.ConfirmEmailChange; want != got {
+				t.Errorf("Expected Store.ConfirmEmailChange to be called with %q, got %q", want, got)
+			}
+		})
+	}
+}
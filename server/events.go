@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Fallbacks for clients that can't use websockets, usually because some proxy
+// in the middle breaks the upgrade. Both of these register with the socket
+// manager just like a websocket does, so they get the same wallet updates, and
+// they get cut off the same way when the user changes their password.
+
+// Comment lines sent over the event stream just to keep proxies from deciding
+// that the connection is idle and closing it.
+const sseKeepAliveInterval = 30 * time.Second
+
+const defaultPollTimeout = 30 * time.Second
+
+// Keep it under the timeouts that proxies tend to have
+const maxPollTimeout = 60 * time.Second
+
+type WalletPollResponse struct {
+	Sequence wallet.Sequence `json:"sequence"`
+}
+
+// Given a wsClientNotifyMsg of type wsClientNotifyUpdate, turn it into an
+// appropriate message to the client to be sent over an event stream. As with
+// websockets, the default wallet's message is the same as it always was.
+func walletUpdateSSEMessage(msg wsClientNotifyMsg) []byte {
+	if msg.walletId == wallet.DefaultWalletId {
+		return []byte(fmt.Sprintf("event: wallet-update\ndata: %d\n\n", msg.sequence))
+	}
+	return []byte(fmt.Sprintf("event: wallet-update\ndata: %s:%d\n\n", msg.walletId, msg.sequence))
+}
+
+// Tells the client to reconnect, hopefully to a server that isn't shutting down
+func serverRestartSSEMessage() []byte {
+	return []byte(fmt.Sprintf("event: server-restart\ndata: %s\n\n", serverRestartingReason))
+}
+
+// Register a non-websocket client with the socket manager. If it's added, the
+// caller should pass it to removeNotifyClient when it's done. If it's not, this
+// responds to the request with the reason.
+func (s *Server) addNotifyClient(w http.ResponseWriter, authToken *auth.AuthToken) *wsClient {
+	client := wsClient{
+		deviceId: authToken.DeviceId,
+		notify:   make(chan wsClientNotifyMsg, notifyChanBuffer),
+	}
+	if result := s.addClient(authToken.UserId, &client); result != wsClientAdded {
+		errorJson(w, result.httpStatus(), result.reason())
+		return nil
+	}
+	return &client
+}
+
+func (s *Server) removeNotifyClient(userId auth.UserId, client *wsClient) {
+	s.shardFor(userId).clientRemove <- wsClientForUser{userId, client}
+}
+
+// Server-Sent Events. Sends the same wallet-update notifications as the
+// websocket for as long as the client stays connected.
+func (s *Server) walletEvents(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+
+	if authToken == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalServiceErrorJson(w, req, fmt.Errorf("ResponseWriter does not support flushing"), "Error starting event stream")
+		return
+	}
+
+	client := s.addNotifyClient(w, authToken)
+	if client == nil {
+		return
+	}
+	defer s.removeNotifyClient(authToken.UserId, client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx-style proxies not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case notifyMsg, ok := <-client.notify:
+			if !ok {
+				// The socket manager is done with us (i.e. password change)
+				return
+			}
+			if notifyMsg.notifyType != wsClientNotifyUpdate {
+				debugLog("walletEvents: Got an unknown message type! %+v", notifyMsg)
+				continue
+			}
+			if _, err := w.Write(walletUpdateSSEMessage(notifyMsg)); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-s.serverShutdown:
+			w.Write(serverRestartSSEMessage())
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// TODO - There's probably a struct-based solution here like with POST/PUT.
+func getWalletPollParams(req *http.Request) (token auth.AuthTokenString, walletId wallet.WalletId, sequence wallet.Sequence, timeout time.Duration, err error) {
+	token, err = getTokenParam(req)
+	if err != nil {
+		return
+	}
+
+	walletId, err = getWalletIdParam(req)
+	if err != nil {
+		return
+	}
+
+	sequenceStr := req.URL.Query().Get("sequence")
+	if sequenceStr == "" {
+		err = fmt.Errorf("Missing sequence parameter")
+		return
+	}
+	sequenceInt, parseErr := strconv.ParseUint(sequenceStr, 10, 32)
+	if parseErr != nil {
+		err = fmt.Errorf("Invalid sequence parameter")
+		return
+	}
+	sequence = wallet.Sequence(sequenceInt)
+
+	timeout = defaultPollTimeout
+	if timeoutStr := req.URL.Query().Get("timeout"); timeoutStr != "" {
+		timeoutSeconds, parseErr := strconv.ParseUint(timeoutStr, 10, 32)
+		if parseErr != nil || timeoutSeconds == 0 {
+			err = fmt.Errorf("Invalid timeout parameter")
+			return
+		}
+		timeout = time.Duration(timeoutSeconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	return
+}
+
+// Long-poll. Waits until the wallet's sequence is greater than the `sequence`
+// param, or until `timeout` seconds pass. The wallet is the one named by the
+// optional `walletId` param, or the default wallet. Either way it responds with the
+// latest sequence it knows of, so the client should compare it to the one it
+// sent to see whether there's anything new to download.
+func (s *Server) walletPoll(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, walletId, sequence, timeout, paramsErr := getWalletPollParams(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+
+	if authToken == nil {
+		return
+	}
+
+	// Register before checking the db so that we don't miss an update that
+	// comes in between the two.
+	client := s.addNotifyClient(w, authToken)
+	if client == nil {
+		return
+	}
+	defer s.removeNotifyClient(authToken.UserId, client)
+
+	_, latestSequence, _, err := s.store.GetWallet(authToken.UserId, walletId)
+	if err == store.ErrNoWallet {
+		latestSequence = 0
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error retrieving wallet")
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+wait:
+	for latestSequence <= sequence {
+		select {
+		case notifyMsg, ok := <-client.notify:
+			if !ok {
+				// The socket manager is done with us. This happens when the user
+				// changes their password, at which point this token is gone.
+				errorJson(w, http.StatusUnauthorized, "Token Not Found")
+				return
+			}
+			if notifyMsg.notifyType == wsClientNotifyUpdate && notifyMsg.walletId == walletId && notifyMsg.sequence > latestSequence {
+				latestSequence = notifyMsg.sequence
+			}
+		case <-timer.C:
+			break wait
+		case <-req.Context().Done():
+			return
+		case <-s.serverShutdown:
+			break wait
+		}
+	}
+
+	response, err := json.Marshal(WalletPollResponse{Sequence: latestSequence})
+
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating wallet poll response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
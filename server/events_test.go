@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Keep sending the message until the handler is done. The handler registers
+// with the socket manager at some point after it starts, and we don't know
+// exactly when, so a single message could show up too early and get dropped.
+func sendUntilDone(t *testing.T, done chan bool, send func()) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.NewTimer(5 * time.Second)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			send()
+		case <-timeout.C:
+			t.Fatal("Handler should be done by now")
+		}
+	}
+}
+
+func TestServerWalletPoll(t *testing.T) {
+	const userId = auth.UserId(37)
+
+	tt := []struct {
+		name string
+
+		storeSequence  wallet.Sequence
+		sequenceParam  string
+		timeoutParam   string
+		updateSequence wallet.Sequence
+		removeUser     bool
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedSequence    wallet.Sequence
+	}{
+		{
+			name:               "already newer",
+			storeSequence:      5,
+			sequenceParam:      "4",
+			expectedStatusCode: http.StatusOK,
+			expectedSequence:   5,
+		},
+		{
+			name:               "wallet update",
+			storeSequence:      4,
+			sequenceParam:      "4",
+			updateSequence:     5,
+			expectedStatusCode: http.StatusOK,
+			expectedSequence:   5,
+		},
+		{
+			name:               "timeout",
+			storeSequence:      4,
+			sequenceParam:      "4",
+			timeoutParam:       "1",
+			expectedStatusCode: http.StatusOK,
+			expectedSequence:   4,
+		},
+		{
+			name:                "password change",
+			storeSequence:       4,
+			sequenceParam:       "4",
+			removeUser:          true,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+		},
+		{
+			name:                "missing sequence",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing sequence parameter",
+		},
+		{
+			name:                "invalid timeout",
+			sequenceParam:       "4",
+			timeoutParam:        "banana",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid timeout parameter",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: userId,
+				},
+				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:        tc.storeSequence,
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			socketsDone := make(chan bool)
+			socketsFinish := make(chan bool)
+			go s.manageSockets(socketsDone, socketsFinish)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWalletPoll, nil)
+			q := req.URL.Query()
+			q.Add("token", string(testStore.TestAuthToken.Token))
+			if tc.sequenceParam != "" {
+				q.Add("sequence", tc.sequenceParam)
+			}
+			if tc.timeoutParam != "" {
+				q.Add("timeout", tc.timeoutParam)
+			}
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			handlerDone := make(chan bool)
+			go func() {
+				s.walletPoll(w, req)
+				close(handlerDone)
+			}()
+
+			sendUntilDone(t, handlerDone, func() {
+				if tc.updateSequence != 0 {
+					s.shardFor(userId).walletUpdates <- walletUpdateMsg{userId, wallet.DefaultWalletId, tc.updateSequence}
+				}
+				if tc.removeUser {
+					s.shardFor(userId).userRemove <- wsClientForUser{userId, nil}
+				}
+			})
+
+			socketsFinish <- true
+			<-socketsDone
+
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedErrorString != "" {
+				return // The rest of the test does not apply
+			}
+
+			var result WalletPollResponse
+			err := json.Unmarshal(body, &result)
+			if err != nil || result.Sequence != tc.expectedSequence {
+				t.Errorf("Expected wallet poll response to have sequence %d: result: %+v err: %+v", tc.expectedSequence, string(body), err)
+			}
+		})
+	}
+}
+
+func TestServerWalletEvents(t *testing.T) {
+	const userId = auth.UserId(37)
+
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{
+			Token:  auth.AuthTokenString("seekrit"),
+			Scope:  auth.ScopeFull,
+			UserId: userId,
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	socketsDone := make(chan bool)
+	socketsFinish := make(chan bool)
+	go s.manageSockets(socketsDone, socketsFinish)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.walletEvents))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + paths.PathWalletEvents + "?token=seekrit")
+	if err != nil {
+		t.Fatalf("Error opening event stream: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	if want, got := http.StatusOK, resp.StatusCode; want != got {
+		t.Fatalf("StatusCode: expected %d, got %d", want, got)
+	}
+	if want, got := "text/event-stream", resp.Header.Get("Content-Type"); want != got {
+		t.Errorf("Content-Type: expected %s, got %s", want, got)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	gotEvent := make(chan bool)
+	go func() {
+		for line := range lines {
+			if line == "data: 5" {
+				close(gotEvent)
+				break
+			}
+		}
+	}()
+	sendUntilDone(t, gotEvent, func() {
+		s.shardFor(userId).walletUpdates <- walletUpdateMsg{userId, wallet.DefaultWalletId, 5}
+	})
+
+	// A password change should end the stream
+	streamDone := make(chan bool)
+	go func() {
+		for range lines {
+		}
+		close(streamDone)
+	}()
+	sendUntilDone(t, streamDone, func() {
+		s.shardFor(userId).userRemove <- wsClientForUser{userId, nil}
+	})
+
+	socketsFinish <- true
+	<-socketsDone
+}
+
+func TestServerWalletEventsServerShutdown(t *testing.T) {
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{
+			Token:  auth.AuthTokenString("seekrit"),
+			Scope:  auth.ScopeFull,
+			UserId: auth.UserId(37),
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	socketsDone := make(chan bool)
+	socketsFinish := make(chan bool)
+	go s.manageSockets(socketsDone, socketsFinish)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.walletEvents))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + paths.PathWalletEvents + "?token=seekrit")
+	if err != nil {
+		t.Fatalf("Error opening event stream: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	close(s.serverShutdown)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "event: server-restart\n") {
+		t.Errorf("Expected a server-restart event, got: %q", body)
+	}
+
+	socketsFinish <- true
+	<-socketsDone
+}
+
+func TestServerWalletEventsMessage(t *testing.T) {
+	msg := string(walletUpdateSSEMessage(wsClientNotifyMsg{wsClientNotifyUpdate, wallet.DefaultWalletId, 12}))
+	if !strings.HasPrefix(msg, "event: wallet-update\n") || !strings.HasSuffix(msg, "data: 12\n\n") {
+		t.Errorf("Unexpected event stream message: %q", msg)
+	}
+}
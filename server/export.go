@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Far more than anybody should have, but we don't want one request reading
+// the whole table
+const maxAuditEventsExported = 10000
+
+type DataExportAccount struct {
+	Email          auth.Email          `json:"email"`
+	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
+	Verified       bool                `json:"verified"`
+	Created        time.Time           `json:"created"`
+	Updated        time.Time           `json:"updated"`
+
+	NotificationsOff bool `json:"notificationsOff"`
+}
+
+type DataExportWallet struct {
+	WalletId        wallet.WalletId        `json:"walletId"`
+	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
+	Sequence        wallet.Sequence        `json:"sequence"`
+	Hmac            wallet.WalletHmac      `json:"hmac"`
+	Updated         time.Time              `json:"updated"`
+}
+
+// Tokens themselves are left out. They'd be of no use to the user, and an
+// export is the kind of file that gets left lying around.
+type DataExportDevice struct {
+	DeviceId   auth.DeviceId  `json:"deviceId"`
+	Scope      auth.AuthScope `json:"scope"`
+	Expiration time.Time      `json:"expiration"`
+}
+
+type DataExportResponse struct {
+	Exported    time.Time            `json:"exported"`
+	Account     DataExportAccount    `json:"account"`
+	Wallets     []DataExportWallet   `json:"wallets"`
+	Devices     []DataExportDevice   `json:"devices"`
+	AuditEvents []AuditEventResponse `json:"auditEvents"`
+}
+
+// Response Code:
+//
+//	200: Everything we have about the user, as a JSON download
+//	429: The user has already exported DATA_EXPORTS_PER_DAY times today
+//	500: Export not made for unanticipated reasons
+func (s *Server) getDataExport(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	rateLimitKey := strconv.FormatInt(int64(authToken.UserId), 10)
+	allowed, retryAfter := s.dataExportLimiter.allow(rateLimitKey)
+	if !allowed {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "data-export-rate-limited"}).Inc()
+		// Round up, so the client doesn't come back too early
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		errorJson(w, http.StatusTooManyRequests, "Too many data exports. Try again later.")
+		return
+	}
+	// Only exports that the user gets count against their limit. If we fail to
+	// make one, they shouldn't have to wait a day to try again.
+	sent := false
+	defer func() {
+		if !sent {
+			s.dataExportLimiter.refund(rateLimitKey)
+		}
+	}()
+
+	export, err := s.store.GetDataExport(authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting data export")
+		return
+	}
+
+	events, err := s.store.GetAuditEvents(authToken.UserId, maxAuditEventsExported)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting audit events")
+		return
+	}
+
+	exportResponse := DataExportResponse{
+		Exported: time.Now().UTC(),
+		Account: DataExportAccount{
+			Email:          export.Info.Email,
+			ClientSaltSeed: export.Info.ClientSaltSeed,
+			Verified:       export.Info.Verified,
+			Created:        export.Info.Created,
+			Updated:        export.Info.Updated,
+
+			NotificationsOff: export.Info.NotificationsOff,
+		},
+		Wallets:     []DataExportWallet{},
+		Devices:     []DataExportDevice{},
+		AuditEvents: []AuditEventResponse{},
+	}
+	for _, w := range export.Wallets {
+		exportResponse.Wallets = append(exportResponse.Wallets, DataExportWallet{
+			WalletId:        w.WalletId,
+			EncryptedWallet: w.EncryptedWallet,
+			Sequence:        w.Sequence,
+			Hmac:            w.Hmac,
+			Updated:         w.Updated,
+		})
+	}
+	for _, device := range export.Devices {
+		exportResponse.Devices = append(exportResponse.Devices, DataExportDevice{
+			DeviceId:   device.DeviceId,
+			Scope:      device.Scope,
+			Expiration: device.Expiration,
+		})
+	}
+	for _, event := range events {
+		exportResponse.AuditEvents = append(exportResponse.AuditEvents, auditEventResponse(event))
+	}
+
+	response, err := json.Marshal(exportResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating data export response")
+		return
+	}
+
+	// Counts even if writing fails. That's likely the client going away, and
+	// we did the work.
+	sent = true
+	w.Header().Set("Content-Disposition", `attachment; filename="wallet-sync-export.json"`)
+	if err := writeCompressibleJson(w, req, response); err != nil {
+		// Probably the client went away, and anyway too late to respond
+		logging.FromContext(req.Context()).Warn("Error writing data export response", logging.Err(err))
+		return
+	}
+
+	s.recordAuditEvent(req, store.AuditEventDataExport, authToken.UserId, authToken.DeviceId)
+	logging.FromContext(req.Context()).Info("Data exported", logging.F("user_id", authToken.UserId))
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerGetDataExport(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	tt := []struct {
+		name        string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "data export error",
+			storeErrors:         TestStoreFunctionsErrors{GetDataExport: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+		{
+			name:                "audit events error",
+			storeErrors:         TestStoreFunctionsErrors{GetAuditEvents: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5, DeviceId: "dev-1"},
+				TestDataExport: store.DataExport{
+					Info: store.AccountInfo{
+						Email:          "abc@example.com",
+						ClientSaltSeed: "abcd1234abcd1234",
+						Verified:       true,
+						Created:        created,
+						Updated:        updated,
+					},
+					Wallets: []store.ExportedWallet{
+						{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 3, Hmac: "my-hmac", Updated: updated},
+					},
+					Devices: []store.Device{
+						{DeviceId: "dev-1", Scope: auth.ScopeFull, Expiration: updated},
+					},
+				},
+				TestAuditEvents: []store.AuditEvent{
+					{UserId: 5, DeviceId: "dev-1", Type: store.AuditEventLogin, IP: "192.0.2.1", UserAgent: "my-client", Created: created},
+				},
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathDataExport+"?token=seekrit", nil)
+			w := httptest.NewRecorder()
+
+			s.getDataExport(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			var exportResponse DataExportResponse
+			if err := json.Unmarshal(body, &exportResponse); err != nil {
+				t.Fatalf("Error decoding response body %s: %+v", body, err)
+			}
+			exportResponse.Exported = time.Time{}
+			expectedResponse := DataExportResponse{
+				Account: DataExportAccount{
+					Email:          "abc@example.com",
+					ClientSaltSeed: "abcd1234abcd1234",
+					Verified:       true,
+					Created:        created,
+					Updated:        updated,
+				},
+				Wallets: []DataExportWallet{
+					{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 3, Hmac: "my-hmac", Updated: updated},
+				},
+				Devices: []DataExportDevice{
+					{DeviceId: "dev-1", Scope: auth.ScopeFull, Expiration: updated},
+				},
+				AuditEvents: []AuditEventResponse{
+					{Type: store.AuditEventLogin, DeviceId: "dev-1", IP: "192.0.2.1", UserAgent: "my-client", Created: created},
+				},
+			}
+			if !reflect.DeepEqual(expectedResponse, exportResponse) {
+				t.Errorf("Expected export %+v, got %+v", expectedResponse, exportResponse)
+			}
+
+			if strings.Contains(string(body), "seekrit") {
+				t.Errorf("Expected the export to leave out auth tokens")
+			}
+			if !strings.HasPrefix(w.Result().Header.Get("Content-Disposition"), "attachment") {
+				t.Errorf("Expected the export to be a download")
+			}
+			if testStore.Called.ExportAccount != nil {
+				t.Errorf("Expected Store.ExportAccount not to be called")
+			}
+			if len(testStore.Called.AuditEvents) != 1 || testStore.Called.AuditEvents[0].Event.Type != store.AuditEventDataExport {
+				t.Errorf("Expected a data export audit event, got %+v", testStore.Called.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestServerGetDataExportRateLimited(t *testing.T) {
+	testStore := TestStore{TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5}}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{map[string]string{"DATA_EXPORTS_PER_DAY": "1"}}, &TestMail{}, TestPort)
+
+	export := func(userId auth.UserId) *httptest.ResponseRecorder {
+		testStore.TestAuthToken.UserId = userId
+		req := httptest.NewRequest(http.MethodGet, paths.PathDataExport+"?token=seekrit", nil)
+		w := httptest.NewRecorder()
+		s.getDataExport(w, req)
+		return w
+	}
+
+	expectStatusCode(t, export(5), http.StatusOK)
+
+	w := export(5)
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusTooManyRequests)
+	expectErrorString(t, body, http.StatusText(http.StatusTooManyRequests)+": Too many data exports. Try again later.")
+	if w.Result().Header.Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	// Someone else isn't held up by it
+	expectStatusCode(t, export(6), http.StatusOK)
+
+	// An export that fails on our end doesn't count
+	testStore.Errors.GetDataExport = fmt.Errorf("Some random DB Error!")
+	expectStatusCode(t, export(7), http.StatusInternalServerError)
+	testStore.Errors.GetDataExport = nil
+	expectStatusCode(t, export(7), http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/store"
+)
+
+const healthCheckOk = "ok"
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// Each check is "ok" or a short description of what's wrong. Nothing in here
+// should be secret, but we still don't put raw errors in here since this
+// endpoint isn't authenticated. Those go to the log.
+type ReadyResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// The process is up and serving requests. That's all.
+func (s *Server) healthz(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	response, err := json.Marshal(HealthResponse{Status: healthCheckOk})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating health response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+func (s *Server) checkDatabase() string {
+	if err := s.store.Ping(); err != nil {
+		logging.Error("Health check: error pinging database", logging.Err(err))
+		return "unreachable"
+	}
+	return healthCheckOk
+}
+
+func (s *Server) checkMigrations() string {
+	version, err := s.store.SchemaVersion()
+	if err != nil {
+		logging.Error("Health check: error getting schema version", logging.Err(err))
+		return "error getting schema version"
+	}
+	if expected := store.ExpectedSchemaVersion(); version != expected {
+		return fmt.Sprintf("schema version is %d, expected %d", version, expected)
+	}
+	return healthCheckOk
+}
+
+// Only EmailVerify and AdminApproval modes send email. For everything else
+// there's nothing to configure.
+func (s *Server) checkMail() string {
+	verificationMode, err := env.GetAccountVerificationMode(s.env)
+	if err != nil {
+		logging.Error("Health check: error getting account verification mode", logging.Err(err))
+		return "invalid account verification mode"
+	}
+	backend, err := env.GetMailBackend(s.env, verificationMode)
+	if err != nil {
+		logging.Error("Health check: error getting mail backend", logging.Err(err))
+		return "mail is not configured correctly"
+	}
+	if _, _, _, _, err := env.GetMailgunConfigs(s.env, verificationMode, backend); err != nil {
+		logging.Error("Health check: error getting mailgun configs", logging.Err(err))
+		return "mail is not configured correctly"
+	}
+	if _, _, err := env.GetMailOutboxConfigs(s.env, backend); err != nil {
+		logging.Error("Health check: error getting mail outbox configs", logging.Err(err))
+		return "mail is not configured correctly"
+	}
+	return healthCheckOk
+}
+
+func (s *Server) checkSockets() string {
+	if atomic.LoadInt32(&s.socketsRunning) != 1 {
+		return "socket manager is not running"
+	}
+	return healthCheckOk
+}
+
+func (s *Server) checkDraining() string {
+	if s.isDraining() {
+		return "shutting down"
+	}
+	return healthCheckOk
+}
+
+// Whether we should be getting requests. Responds 503 if any check fails, so
+// load balancers can just look at the status code.
+func (s *Server) readyz(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	readyResponse := ReadyResponse{
+		Ready: true,
+		Checks: map[string]string{
+			"database":   s.checkDatabase(),
+			"migrations": s.checkMigrations(),
+			"mail":       s.checkMail(),
+			"sockets":    s.checkSockets(),
+			"draining":   s.checkDraining(),
+		},
+	}
+	for _, result := range readyResponse.Checks {
+		if result != healthCheckOk {
+			readyResponse.Ready = false
+		}
+	}
+
+	response, err := json.Marshal(readyResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating ready response")
+		return
+	}
+
+	if !readyResponse.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, string(response))
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerHealthz(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+	w := httptest.NewRecorder()
+
+	s.healthz(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusOK)
+
+	var result HealthResponse
+	if err := json.Unmarshal(body, &result); err != nil || result.Status != "ok" {
+		t.Errorf("Expected status ok: result: %+v err: %+v", string(body), err)
+	}
+}
+
+func TestServerReadyz(t *testing.T) {
+	allOk := map[string]string{
+		"database":   "ok",
+		"migrations": "ok",
+		"mail":       "ok",
+		"sockets":    "ok",
+		"draining":   "ok",
+	}
+	withCheck := func(name string, result string) map[string]string {
+		checks := map[string]string{}
+		for k, v := range allOk {
+			checks[k] = v
+		}
+		checks[name] = result
+		return checks
+	}
+
+	tt := []struct {
+		name string
+
+		env            map[string]string
+		schemaVersion  int
+		storeErrors    TestStoreFunctionsErrors
+		socketsStopped bool
+		draining       bool
+
+		expectedStatusCode int
+		expectedChecks     map[string]string
+	}{
+		{
+			name:               "ready",
+			schemaVersion:      store.ExpectedSchemaVersion(),
+			expectedStatusCode: http.StatusOK,
+			expectedChecks:     allOk,
+		},
+		{
+			name:               "database unreachable",
+			schemaVersion:      store.ExpectedSchemaVersion(),
+			storeErrors:        TestStoreFunctionsErrors{Ping: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     withCheck("database", "unreachable"),
+		},
+		{
+			name:               "old schema",
+			schemaVersion:      store.ExpectedSchemaVersion() - 1,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     withCheck("migrations", fmt.Sprintf("schema version is %d, expected %d", store.ExpectedSchemaVersion()-1, store.ExpectedSchemaVersion())),
+		},
+		{
+			name:               "mail not configured",
+			env:                map[string]string{"ACCOUNT_VERIFICATION_MODE": "EmailVerify"},
+			schemaVersion:      store.ExpectedSchemaVersion(),
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     withCheck("mail", "mail is not configured correctly"),
+		},
+		{
+			name:               "socket manager not running",
+			schemaVersion:      store.ExpectedSchemaVersion(),
+			socketsStopped:     true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     withCheck("sockets", "socket manager is not running"),
+		},
+		{
+			name:               "draining",
+			schemaVersion:      store.ExpectedSchemaVersion(),
+			draining:           true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedChecks:     withCheck("draining", "shutting down"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestSchemaVersion: tc.schemaVersion, Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &TestMail{}, TestPort)
+			if !tc.socketsStopped {
+				// Not actually running it. We're just testing the check.
+				atomic.StoreInt32(&s.socketsRunning, 1)
+			}
+			if tc.draining {
+				s.setDraining()
+			}
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathReadyz, nil)
+			w := httptest.NewRecorder()
+
+			s.readyz(w, req)
+
+			body, _ := ioutil.ReadAll(w.Body)
+			expectStatusCode(t, w, tc.expectedStatusCode)
+
+			var result ReadyResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding ready response: %+v: %s", err, body)
+			}
+			if result.Ready != (tc.expectedStatusCode == http.StatusOK) {
+				t.Errorf("Unexpected ready value: %+v", result)
+			}
+			if !reflect.DeepEqual(result.Checks, tc.expectedChecks) {
+				t.Errorf("Expected checks %+v, got %+v", tc.expectedChecks, result.Checks)
+			}
+		})
+	}
+}
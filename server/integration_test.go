@@ -6,15 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime/quotedprintable"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/mail"
 	"lbryio/wallet-sync-server/server/paths"
 	"lbryio/wallet-sync-server/store"
 	"lbryio/wallet-sync-server/wallet"
@@ -682,3 +686,85 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 		t.Fatalf("Unexpected response Scope. want: %+v got: %+v", auth.ScopeFull, authToken.Scope)
 	}
 }
+
+// With the real mail, writing to an outbox, follow the link in the email like
+// a user would.
+func TestIntegrationVerifyAccountOutbox(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	outboxDir := t.TempDir()
+	env := &TestEnv{map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
+		"MAIL_BACKEND":              "outbox",
+		"MAIL_OUTBOX_DIR":           outboxDir,
+		"MAILGUN_SENDING_DOMAIN":    "sending.example.com",
+		"MAILGUN_SERVER_DOMAIN":     "server.example.com",
+	}}
+	s := Init(&auth.Auth{}, &st, env, &mail.Mail{Env: env}, TestPort)
+
+	////////////////////
+	t.Log("Request: Register email address")
+	////////////////////
+
+	var registerResponse struct{}
+	responseBody, statusCode := request(
+		t,
+		http.MethodPost,
+		s.register,
+		paths.PathRegister,
+		&registerResponse,
+		`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd"}`,
+	)
+
+	checkStatusCode(t, statusCode, responseBody, http.StatusCreated)
+
+	////////////////////
+	t.Log("Find the link in the outbox")
+	////////////////////
+
+	emls, err := filepath.Glob(filepath.Join(outboxDir, "*.eml"))
+	if err != nil || len(emls) != 1 {
+		t.Fatalf("Expected one email in the outbox, got %+v %+v", emls, err)
+	}
+	eml, err := os.ReadFile(emls[0])
+	if err != nil {
+		t.Fatalf("Error reading email: %+v", err)
+	}
+	// The link is long enough that quoted-printable wraps it
+	text, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(eml)))
+	if err != nil {
+		t.Fatalf("Error decoding email: %+v", err)
+	}
+	link := regexp.MustCompile(`https://server\.example\.com(/\S+)`).FindSubmatch(text)
+	if link == nil {
+		t.Fatalf("Expected a verify link in the email, got %s", text)
+	}
+
+	////////////////////
+	t.Log("Request: Verify account")
+	////////////////////
+
+	responseBody, statusCode = request(t, http.MethodGet, s.verify, string(link[1]), nil, ``)
+
+	checkStatusCode(t, statusCode, responseBody)
+	if strings.TrimSpace(string(responseBody)) != "Your account has been verified." {
+		t.Fatalf("Unexpected resonse from verify account endpoint. Got: '" + string(responseBody) + "'")
+	}
+
+	////////////////////
+	t.Log("Request: Get auth token")
+	////////////////////
+
+	var authToken auth.AuthToken
+	responseBody, statusCode = request(
+		t,
+		http.MethodPost,
+		s.getAuthToken,
+		paths.PathAuthToken,
+		&authToken,
+		`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`,
+	)
+
+	checkStatusCode(t, statusCode, responseBody)
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/store"
+)
+
+// Within reason. It's for the server operator to invite a whole community with
+// one code, not for making a code nobody can use up.
+const maxInviteCodeUses = 10000
+
+type InviteCodeRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+
+	// How many accounts can sign up with the code. Defaults to 1.
+	MaxUses int `json:"maxUses"`
+}
+
+func (r *InviteCodeRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	return validateInviteCodeMaxUses(r.MaxUses)
+}
+
+// For the admin endpoint, which authenticates with the admin token instead
+type AdminInviteCodeRequest struct {
+	MaxUses int `json:"maxUses"`
+}
+
+func (r *AdminInviteCodeRequest) validate() error {
+	return validateInviteCodeMaxUses(r.MaxUses)
+}
+
+func validateInviteCodeMaxUses(maxUses int) error {
+	if maxUses < 0 || maxUses > maxInviteCodeUses {
+		return fmt.Errorf("Invalid 'maxUses'. Should be between 1 and %d, or left out for 1", maxInviteCodeUses)
+	}
+	return nil
+}
+
+type InviteCodeResponse struct {
+	Code    auth.InviteCode `json:"code"`
+	MaxUses int             `json:"maxUses"`
+	Uses    int             `json:"uses"`
+	Created time.Time       `json:"created"`
+
+	// Only for the admin endpoint. Absent for codes the server operator made.
+	CreatedBy auth.UserId `json:"createdBy,omitempty"`
+}
+
+type InviteCodesResponse struct {
+	InviteCodes []InviteCodeResponse `json:"inviteCodes"`
+}
+
+func inviteCodeResponse(code store.InviteCode) InviteCodeResponse {
+	return InviteCodeResponse{
+		Code:    code.Code,
+		MaxUses: code.MaxUses,
+		Uses:    code.Uses,
+		Created: code.Created,
+	}
+}
+
+// Invite codes only mean anything in InviteCode mode. If it's not set, this
+// responds to the request.
+func (s *Server) checkInviteCodeMode(w http.ResponseWriter, req *http.Request) bool {
+	verificationMode, err := env.GetAccountVerificationMode(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting account verification mode")
+		return false
+	}
+	if verificationMode != env.AccountVerificationModeInviteCode {
+		errorJson(w, http.StatusForbidden, "Account verification mode is not set to InviteCode")
+		return false
+	}
+	return true
+}
+
+// Make a code, and respond with it
+func (s *Server) createInviteCode(w http.ResponseWriter, req *http.Request, maxUses int, createdBy auth.UserId, quota int) {
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	code, err := s.auth.NewInviteCode()
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating invite code")
+		return
+	}
+
+	invite, err := s.store.CreateInviteCode(code, maxUses, createdBy, quota)
+	if err == store.ErrInviteQuota {
+		errorJson(w, http.StatusForbidden, "No invites left")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error creating invite code")
+		return
+	}
+
+	response, err := json.Marshal(inviteCodeResponse(invite))
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating invite code response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	logging.FromContext(req.Context()).Info("Invite code created", logging.F("user_id", createdBy), logging.F("max_uses", maxUses))
+}
+
+func (s *Server) handleInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.getInviteCodes(w, req)
+	} else if req.Method == http.MethodPost {
+		s.postInviteCodes(w, req)
+	} else {
+		errorJson(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// The codes the user made, and how much they've been used
+func (s *Server) getInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	codes, err := s.store.GetInviteCodes(authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting invite codes")
+		return
+	}
+
+	inviteCodesResponse := InviteCodesResponse{InviteCodes: []InviteCodeResponse{}}
+	for _, code := range codes {
+		inviteCodesResponse.InviteCodes = append(inviteCodesResponse.InviteCodes, inviteCodeResponse(code))
+	}
+
+	response, err := json.Marshal(inviteCodesResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating invite codes response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// A user inviting someone. Users get INVITES_PER_USER invites in total, spread
+// across as many codes as they like.
+//
+// Response Code:
+//
+//	200: Invite code created
+//	403: Not InviteCode mode, users can't invite on this server, or the user
+//	     has no invites left
+//	500: Invite code not created for unanticipated reasons
+func (s *Server) postInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if !s.checkInviteCodeMode(w, req) {
+		return
+	}
+
+	var inviteCodeRequest InviteCodeRequest
+	if !getPostData(w, req, &inviteCodeRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, inviteCodeRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	verificationMode, err := env.GetAccountVerificationMode(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting account verification mode")
+		return
+	}
+	invitesPerUser, err := env.GetInvitesPerUser(s.env, verificationMode)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting invites per user")
+		return
+	}
+	if invitesPerUser == 0 {
+		errorJson(w, http.StatusForbidden, "Only the server operator can make invite codes")
+		return
+	}
+
+	s.createInviteCode(w, req, inviteCodeRequest.MaxUses, authToken.UserId, invitesPerUser)
+}
+
+func (s *Server) handleAdminInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.getAdminInviteCodes(w, req)
+	} else if req.Method == http.MethodPost {
+		s.postAdminInviteCodes(w, req)
+	} else {
+		errorJson(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// Every code, whoever made it
+func (s *Server) getAdminInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	codes, err := s.store.GetInviteCodes(0)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting invite codes")
+		return
+	}
+
+	inviteCodesResponse := InviteCodesResponse{InviteCodes: []InviteCodeResponse{}}
+	for _, code := range codes {
+		codeResponse := inviteCodeResponse(code)
+		codeResponse.CreatedBy = code.CreatedBy
+		inviteCodesResponse.InviteCodes = append(inviteCodesResponse.InviteCodes, codeResponse)
+	}
+
+	response, err := json.Marshal(inviteCodesResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating invite codes response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// The server operator inviting people, with no limit
+//
+// Response Code:
+//
+//	200: Invite code created
+//	401: Wrong admin token
+//	403: Not InviteCode mode
+//	500: Invite code not created for unanticipated reasons
+func (s *Server) postAdminInviteCodes(w http.ResponseWriter, req *http.Request) {
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	if !s.checkInviteCodeMode(w, req) {
+		return
+	}
+
+	var inviteCodeRequest AdminInviteCodeRequest
+	if !getPostData(w, req, &inviteCodeRequest) {
+		return
+	}
+
+	s.createInviteCode(w, req, inviteCodeRequest.MaxUses, 0, 0)
+}
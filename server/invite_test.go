@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerRegisterInviteCode(t *testing.T) {
+	const seed = "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+	requestBody := `{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "` + seed + `", "inviteCode": "my-invite-code"}`
+	expectedCall := &CreateAccountWithInviteCodeCall{
+		Email:          "abc@example.com",
+		Password:       "12345678",
+		ClientSaltSeed: seed,
+		InviteCode:     "my-invite-code",
+	}
+
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *CreateAccountWithInviteCodeCall
+	}{
+		{
+			name:               "success",
+			requestBody:        requestBody,
+			expectedStatusCode: http.StatusCreated,
+			expectedCall:       expectedCall,
+		},
+		{
+			name:                "missing invite code",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "` + seed + `"}`,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Invite code required",
+		},
+		{
+			name:                "invalid invite code", // including used up
+			requestBody:         requestBody,
+			storeErrors:         TestStoreFunctionsErrors{CreateAccountWithInviteCode: store.ErrInvalidInviteCode},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Invalid invite code",
+			expectedCall:        expectedCall,
+		},
+		{
+			name:                "existing account",
+			requestBody:         requestBody,
+			storeErrors:         TestStoreFunctionsErrors{CreateAccountWithInviteCode: store.ErrDuplicateAccount},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Error registering",
+			expectedCall:        expectedCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors}
+			testMail := TestMail{}
+			env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "InviteCode"}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathRegister, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.register(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.CreateAccountWithInviteCode) {
+				t.Errorf("Expected Store.CreateAccountWithInviteCode to be called with %+v, got %+v", tc.expectedCall, testStore.Called.CreateAccountWithInviteCode)
+			}
+			if testStore.Called.CreateAccount != nil {
+				t.Errorf("Expected Store.CreateAccount not to be called")
+			}
+			if testMail.SendVerificationEmailCall != nil {
+				t.Errorf("Expected no verification email")
+			}
+			if tc.expectedErrorString == "" && string(body) != `{"verified":true}` {
+				t.Errorf("Unexpected response %s", body)
+			}
+		})
+	}
+}
+
+func TestServerPostInviteCodes(t *testing.T) {
+	inviteCodeEnv := map[string]string{"ACCOUNT_VERIFICATION_MODE": "InviteCode", "INVITES_PER_USER": "5"}
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tt := []struct {
+		name        string
+		env         map[string]string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *CreateInviteCodeCall
+	}{
+		{
+			name:               "success",
+			env:                inviteCodeEnv,
+			requestBody:        `{"token": "seekrit", "maxUses": 2}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &CreateInviteCodeCall{"my-invite-code", 2, 5, 5},
+		},
+		{
+			name:               "single use by default",
+			env:                inviteCodeEnv,
+			requestBody:        `{"token": "seekrit"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &CreateInviteCodeCall{"my-invite-code", 1, 5, 5},
+		},
+		{
+			name:                "wrong account verification mode",
+			env:                 map[string]string{"ACCOUNT_VERIFICATION_MODE": "AllowAll"},
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Account verification mode is not set to InviteCode",
+		},
+		{
+			name:                "users can't invite",
+			env:                 map[string]string{"ACCOUNT_VERIFICATION_MODE": "InviteCode"},
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Only the server operator can make invite codes",
+		},
+		{
+			name:                "validation error",
+			env:                 inviteCodeEnv,
+			requestBody:         `{"token": "seekrit", "maxUses": -1}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'maxUses'. Should be between 1 and 10000, or left out for 1",
+		},
+		{
+			name:                "no invites left",
+			env:                 inviteCodeEnv,
+			requestBody:         `{"token": "seekrit"}`,
+			storeErrors:         TestStoreFunctionsErrors{CreateInviteCode: store.ErrInviteQuota},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": No invites left",
+			expectedCall:        &CreateInviteCodeCall{"my-invite-code", 1, 5, 5},
+		},
+		{
+			name:                "db error",
+			env:                 inviteCodeEnv,
+			requestBody:         `{"token": "seekrit"}`,
+			storeErrors:         TestStoreFunctionsErrors{CreateInviteCode: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        &CreateInviteCodeCall{"my-invite-code", 1, 5, 5},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken:         auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+				TestInviteCodeCreated: created,
+				Errors:                tc.storeErrors,
+			}
+			testAuth := TestAuth{TestNewInviteCode: "my-invite-code"}
+			s := Init(&testAuth, &testStore, &TestEnv{tc.env}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathInviteCodes, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.handleInviteCodes(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.CreateInviteCode) {
+				t.Errorf("Expected Store.CreateInviteCode to be called with %+v, got %+v", tc.expectedCall, testStore.Called.CreateInviteCode)
+			}
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			// As the store saved it
+			var result InviteCodeResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Code != "my-invite-code" || result.MaxUses != tc.expectedCall.MaxUses || !result.Created.Equal(created) {
+				t.Errorf("Unexpected response %s %+v", body, err)
+			}
+		})
+	}
+}
+
+func TestServerGetInviteCodes(t *testing.T) {
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+		TestInviteCodes: []store.InviteCode{
+			{Code: "my-invite-code", CreatedBy: 5, MaxUses: 2, Uses: 1, Created: created},
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathInviteCodes+"?token=seekrit", nil)
+	w := httptest.NewRecorder()
+
+	s.handleInviteCodes(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+	if testStore.Called.GetInviteCodes == nil || *testStore.Called.GetInviteCodes != 5 {
+		t.Errorf("Expected Store.GetInviteCodes to be called for user 5, got %v", testStore.Called.GetInviteCodes)
+	}
+	// No createdBy; it's the user themselves
+	expected := `{"inviteCodes":[{"code":"my-invite-code","maxUses":2,"uses":1,"created":"2022-01-02T03:04:05Z"}]}`
+	if string(body) != expected {
+		t.Errorf("Expected %s, got %s", expected, body)
+	}
+}
+
+func TestServerAdminInviteCodes(t *testing.T) {
+	env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "InviteCode", "ADMIN_TOKEN": testAdminToken}
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tt := []struct {
+		name          string
+		method        string
+		authorization string
+		requestBody   string
+
+		expectedStatusCode int
+		expectedBody       string
+		expectedCall       *CreateInviteCodeCall
+	}{
+		{
+			name:               "create",
+			method:             http.MethodPost,
+			authorization:      "Bearer " + testAdminToken,
+			requestBody:        `{"maxUses": 100}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &CreateInviteCodeCall{"my-invite-code", 100, 0, 0},
+		},
+		{
+			name:               "list",
+			method:             http.MethodGet,
+			authorization:      "Bearer " + testAdminToken,
+			expectedStatusCode: http.StatusOK,
+			expectedBody: `{"inviteCodes":[` +
+				`{"code":"admin-code","maxUses":100,"uses":3,"created":"2022-01-02T03:04:05Z"},` +
+				`{"code":"user-code","maxUses":1,"uses":0,"created":"2022-01-02T03:04:05Z","createdBy":5}]}`,
+		},
+		{
+			name:               "wrong admin token",
+			method:             http.MethodPost,
+			authorization:      "Bearer nope",
+			requestBody:        `{"maxUses": 100}`,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestInviteCodes: []store.InviteCode{
+					{Code: "admin-code", MaxUses: 100, Uses: 3, Created: created},
+					{Code: "user-code", CreatedBy: 5, MaxUses: 1, Created: created},
+				},
+			}
+			testAuth := TestAuth{TestNewInviteCode: "my-invite-code"}
+			s := Init(&testAuth, &testStore, &TestEnv{env}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(tc.method, paths.PathAdminInviteCodes, bytes.NewBuffer([]byte(tc.requestBody)))
+			req.Header.Set("Authorization", tc.authorization)
+			w := httptest.NewRecorder()
+
+			s.handleAdminInviteCodes(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.CreateInviteCode) {
+				t.Errorf("Expected Store.CreateInviteCode to be called with %+v, got %+v", tc.expectedCall, testStore.Called.CreateInviteCode)
+			}
+			if tc.expectedBody != "" && string(body) != tc.expectedBody {
+				t.Errorf("Expected %s, got %s", tc.expectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+)
+
+// Wraps a handler with some cross-cutting behavior (logging, metrics, etc)
+type middleware func(http.Handler) http.Handler
+
+// The first middleware is the outermost, i.e. it sees the request first and
+// the response last.
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Keeps track of what the handler did with the response, for the benefit of
+// logging and metrics. Handlers type-assert the ResponseWriter for streaming
+// (event streams) and hijacking (websockets), so we pass those through.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// If it's already wrapped, use the existing one so that every middleware sees
+// the same status.
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+	}
+	// The websocket library writes the handshake response straight to the
+	// connection, so this is the best we know.
+	rw.status = http.StatusSwitchingProtocols
+	rw.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+const requestIdHeader = "X-Request-Id"
+
+// If a proxy in front of us already assigned a request id, we use it so that
+// log lines can be matched up. Since it ends up in our logs, we're picky about
+// what it looks like.
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Not worth failing a request over
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, req.WithContext(logging.ContextWithRequestId(req.Context(), requestId)))
+	})
+}
+
+// Only the path. The query string can have tokens in it.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := wrapResponseWriter(w)
+		start := time.Now()
+		next.ServeHTTP(rw, req)
+		logging.FromContext(req.Context()).Info("Request",
+			logging.F("method", req.Method),
+			logging.F("path", req.URL.Path),
+			logging.F("status", rw.status),
+			logging.F("duration", time.Since(start)),
+		)
+	})
+}
+
+// A bug in one handler shouldn't take down the whole server (net/http would
+// recover anyway, but it'd just drop the connection).
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := wrapResponseWriter(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http's way of deliberately aborting a response
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			metrics.ErrorsCount.With(prometheus.Labels{"error_type": "panic"}).Inc()
+			logging.FromContext(req.Context()).Error("Panic handling request",
+				logging.F("method", req.Method),
+				logging.F("path", req.URL.Path),
+				logging.F("panic", fmt.Sprint(err)),
+				logging.F("stack", string(debug.Stack())),
+			)
+			if !rw.wroteHeader {
+				errorJson(rw, http.StatusInternalServerError, "")
+			}
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Anybody can send any method, so we lump the unexpected ones together to keep
+// the number of metrics down.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodOptions:
+		return method
+	default:
+		return "other"
+	}
+}
+
+func withMetrics(endpoint string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			method := methodLabel(req.Method)
+			metrics.RequestsCount.With(prometheus.Labels{"method": method, "endpoint": endpoint}).Inc()
+
+			rw := wrapResponseWriter(w)
+			start := time.Now()
+			next.ServeHTTP(rw, req)
+
+			metrics.RequestDuration.With(prometheus.Labels{"method": method, "endpoint": endpoint}).Observe(time.Since(start).Seconds())
+			metrics.ResponsesCount.With(prometheus.Labels{"method": method, "endpoint": endpoint, "status": strconv.Itoa(rw.status)}).Inc()
+		})
+	}
+}
+
+func withRateLimit(limiter *rateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			allowed, retryAfter := limiter.allow(limiter.clientIP(req))
+			if !allowed {
+				metrics.ErrorsCount.With(prometheus.Labels{"error_type": "rate-limited"}).Inc()
+				// Round up, so the client doesn't come back too early
+				w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+				errorJson(w, http.StatusTooManyRequests, "")
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+const corsAllowedMethods = "GET, POST"
+const corsAllowedHeaders = "Content-Type, Authorization"
+const corsMaxAge = "600"
+
+// For clients running in a browser on a different origin, i.e. a web wallet.
+// Requests from other origins get no CORS headers, which the browser takes to
+// mean no.
+func withCORS(allowedOrigins []string) middleware {
+	allowAny := false
+	allowed := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAny = true
+		}
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !(allowAny || allowed[strings.TrimSuffix(origin, "/")]) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			// Preflight. Answer it here rather than bothering the handler.
+			if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
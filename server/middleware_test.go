@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func TestServerHandlerMultipleInstances(t *testing.T) {
+	// Registering on the global mux would panic the second time around
+	s1 := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	s2 := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+
+	for _, s := range []*Server{s1, s2} {
+		req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		expectStatusCode(t, w, http.StatusOK)
+	}
+}
+
+func TestServerHandlerUnknownEndpoint(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathPrefix+"/banana", nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusNotFound)
+	expectErrorString(t, body, http.StatusText(http.StatusNotFound)+": Unknown Endpoint")
+}
+
+func TestMiddlewareRequestId(t *testing.T) {
+	var handlerRequestId string
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlerRequestId = logging.RequestIdFromContext(req.Context())
+	}), withRequestId)
+
+	tt := []struct {
+		name string
+
+		incomingRequestId string
+		expectIncoming    bool
+	}{
+		{name: "generated"},
+		{name: "from proxy", incomingRequestId: "abc-123", expectIncoming: true},
+		{name: "invalid from proxy", incomingRequestId: "abc\n123"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+			if tc.incomingRequestId != "" {
+				req.Header.Set(requestIdHeader, tc.incomingRequestId)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			requestId := w.Result().Header.Get(requestIdHeader)
+			if requestId == "" || requestId != handlerRequestId {
+				t.Errorf("Expected response header request id %s to match handler's %s", requestId, handlerRequestId)
+			}
+			if tc.expectIncoming != (requestId == tc.incomingRequestId) {
+				t.Errorf("Unexpected request id %s for incoming %s", requestId, tc.incomingRequestId)
+			}
+		})
+	}
+}
+
+func TestMiddlewareRecovery(t *testing.T) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}), withRequestId, withLogging, withRecovery)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusInternalServerError)
+	expectErrorString(t, body, http.StatusText(http.StatusInternalServerError))
+}
+
+func TestMiddlewareResponseWriterPassthrough(t *testing.T) {
+	var isFlusher, isHijacker bool
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, isHijacker = w.(http.Hijacker)
+	}), withLogging)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !isFlusher || !isHijacker {
+		t.Errorf("Expected wrapped ResponseWriter to be a Flusher and a Hijacker, got %v %v", isFlusher, isHijacker)
+	}
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	limiter := newRateLimiter(60, 2, false)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), withRateLimit(limiter))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Use up the burst
+	expectStatusCode(t, request("1.2.3.4:1000"), http.StatusOK)
+	expectStatusCode(t, request("1.2.3.4:1001"), http.StatusOK)
+
+	w := request("1.2.3.4:1002")
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusTooManyRequests)
+	expectErrorString(t, body, http.StatusText(http.StatusTooManyRequests))
+	if want, got := "1", w.Result().Header.Get("Retry-After"); want != got {
+		t.Errorf("Retry-After: expected %s, got %s", want, got)
+	}
+
+	// Other clients are unaffected
+	expectStatusCode(t, request("5.6.7.8:1000"), http.StatusOK)
+
+	// One refills every second
+	now = now.Add(time.Second)
+	expectStatusCode(t, request("1.2.3.4:1003"), http.StatusOK)
+	expectStatusCode(t, request("1.2.3.4:1004"), http.StatusTooManyRequests)
+
+	// Full buckets get swept
+	now = now.Add(2 * rateLimitSweepInterval)
+	request("9.9.9.9:1000")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected only the newest bucket to be left, got %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	tt := []struct {
+		name string
+
+		trustProxy   bool
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{name: "direct", remoteAddr: "1.2.3.4:1000", expectedIP: "1.2.3.4"},
+		{name: "ignore untrusted proxy header", remoteAddr: "1.2.3.4:1000", forwardedFor: "5.6.7.8", expectedIP: "1.2.3.4"},
+		{name: "trusted proxy", trustProxy: true, remoteAddr: "127.0.0.1:1000", forwardedFor: "9.9.9.9, 5.6.7.8", expectedIP: "5.6.7.8"},
+		{name: "trusted proxy no header", trustProxy: true, remoteAddr: "127.0.0.1:1000", expectedIP: "127.0.0.1"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := newRateLimiter(60, 60, tc.trustProxy)
+			req := httptest.NewRequest(http.MethodGet, paths.PathHealthz, nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			if ip := limiter.clientIP(req); ip != tc.expectedIP {
+				t.Errorf("Expected IP %s, got %s", tc.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCORS(t *testing.T) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), withCORS([]string{"https://example.com"}))
+
+	tt := []struct {
+		name string
+
+		method          string
+		origin          string
+		preflightMethod string
+
+		expectedStatusCode  int
+		expectedAllowOrigin string
+	}{
+		{
+			name:               "same origin",
+			method:             http.MethodGet,
+			expectedStatusCode: http.StatusTeapot,
+		},
+		{
+			name:                "allowed origin",
+			method:              http.MethodGet,
+			origin:              "https://example.com",
+			expectedStatusCode:  http.StatusTeapot,
+			expectedAllowOrigin: "https://example.com",
+		},
+		{
+			name:               "disallowed origin",
+			method:             http.MethodGet,
+			origin:             "https://evil.example.com",
+			expectedStatusCode: http.StatusTeapot,
+		},
+		{
+			name:                "preflight",
+			method:              http.MethodOptions,
+			origin:              "https://example.com",
+			preflightMethod:     http.MethodPost,
+			expectedStatusCode:  http.StatusNoContent,
+			expectedAllowOrigin: "https://example.com",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, paths.PathWallet, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.preflightMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tc.preflightMethod)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if want, got := tc.expectedAllowOrigin, w.Result().Header.Get("Access-Control-Allow-Origin"); want != got {
+				t.Errorf("Access-Control-Allow-Origin: expected %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMetrics(t *testing.T) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}), withMetrics("test-endpoint"), withRecovery)
+
+	durationCount := func() uint64 {
+		var metric dto.Metric
+		histogram := metrics.RequestDuration.With(prometheus.Labels{"method": http.MethodPost, "endpoint": "test-endpoint"}).(prometheus.Histogram)
+		if err := histogram.Write(&metric); err != nil {
+			t.Fatalf("Error reading histogram: %+v", err)
+		}
+		return metric.Histogram.GetSampleCount()
+	}
+	responsesCount := func() float64 {
+		return testutil.ToFloat64(metrics.ResponsesCount.With(prometheus.Labels{"method": http.MethodPost, "endpoint": "test-endpoint", "status": "500"}))
+	}
+
+	durationsBefore, responsesBefore := durationCount(), responsesCount()
+
+	req := httptest.NewRequest(http.MethodPost, paths.PathWallet, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if after := responsesCount(); after != responsesBefore+1 {
+		t.Errorf("Expected responses count for status 500 to go up by one, went from %f to %f", responsesBefore, after)
+	}
+	if after := durationCount(); after != durationsBefore+1 {
+		t.Errorf("Expected one more request duration, went from %d to %d", durationsBefore, after)
+	}
+}
+
+func TestMiddlewareMethodLabel(t *testing.T) {
+	if label := methodLabel("BANANA"); label != "other" {
+		t.Errorf("Expected unknown method to be labelled other, got %s", label)
+	}
+	if label := methodLabel(http.MethodGet); label != http.MethodGet {
+		t.Errorf("Expected GET to be labelled GET, got %s", label)
+	}
+}
+
+func TestMiddlewareLoggingNoQueryString(t *testing.T) {
+	var buf bytes.Buffer
+	oldDefault := logging.Default()
+	logging.SetDefault(logging.New(&buf, logging.LevelInfo, logging.FormatText))
+	defer logging.SetDefault(oldDefault)
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), withRequestId, withLogging)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+	req.Header.Set(requestIdHeader, "abc123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	if strings.Contains(line, "seekrit") {
+		t.Errorf("Expected token not to be logged: %s", line)
+	}
+	for _, expected := range []string{"request_id=abc123", "path=" + paths.PathWallet, "status=418"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected log line to contain %s: %s", expected, line)
+		}
+	}
+}
+
+// The store doesn't log. Its errors are logged by the handler, which should
+// tag them with the request id.
+func TestMiddlewareStoreErrorHasRequestId(t *testing.T) {
+	var buf bytes.Buffer
+	oldDefault := logging.Default()
+	logging.SetDefault(logging.New(&buf, logging.LevelInfo, logging.FormatText))
+	defer logging.SetDefault(oldDefault)
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		internalServiceErrorJson(w, req, fmt.Errorf("Some random DB Error!"), "Error getting wallet")
+	}), withRequestId)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
+	req.Header.Set(requestIdHeader, "abc123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, expected := range []string{"Error getting wallet", "Some random DB Error!", "request_id=abc123"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected log line to contain %s: %s", expected, line)
+		}
+	}
+}
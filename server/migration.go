@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/migration"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+type MigrationExportRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+
+	// The URL of the server the account is going to. The bundle can only be
+	// imported there. Unless Copy is set, the account is marked as moved, and
+	// clients that log in here get sent there.
+	MigrateTo string `json:"migrateTo"`
+
+	// Leave the account as it is here, i.e. the bundle is just a copy
+	Copy bool `json:"copy"`
+
+	// Required unless Copy is set, since moving the account locks its owner out
+	// of here. A stolen auth token shouldn't be enough for that.
+	Password auth.Password `json:"password"`
+}
+
+func (r *MigrationExportRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	migrateTo, err := url.Parse(r.MigrateTo)
+	if err != nil || (migrateTo.Scheme != "https" && migrateTo.Scheme != "http") || migrateTo.Host == "" {
+		return fmt.Errorf("Invalid or missing 'migrateTo'")
+	}
+	if !r.Copy && !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	return nil
+}
+
+type MigrationImportRequest struct {
+	Bundle migration.Bundle `json:"bundle"`
+
+	// The same password the client logs in with. It has to match the password
+	// hash sealed in the bundle.
+	Password auth.Password `json:"password"`
+}
+
+func (r *MigrationImportRequest) validate() error {
+	if r.Bundle.Account == "" || r.Bundle.Signature == "" {
+		return fmt.Errorf("Missing 'bundle'")
+	}
+	if !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	return nil
+}
+
+// The account's auth tokens were deleted when it was marked as moved, so this
+// goes by email and password, like logging in.
+type MigrationCancelRequest struct {
+	Email    auth.Email    `json:"email"`
+	Password auth.Password `json:"password"`
+}
+
+func (r *MigrationCancelRequest) validate() error {
+	if !r.Email.Validate() {
+		return fmt.Errorf("Invalid 'email'")
+	}
+	if !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	return nil
+}
+
+// Given with a 308 when logging in to an account that has moved. The client
+// should log in there instead, and remember it.
+type AccountMigratedResponse struct {
+	Error      string `json:"error"`
+	MigratedTo string `json:"migratedTo"`
+}
+
+func accountMigratedJson(w http.ResponseWriter, migratedTo string) {
+	w.Header().Set("Location", strings.TrimSuffix(migratedTo, "/")+paths.PathAuthToken)
+	migratedResponse := AccountMigratedResponse{
+		Error:      http.StatusText(http.StatusPermanentRedirect) + ": Account has moved to another server",
+		MigratedTo: migratedTo,
+	}
+	response, err := json.Marshal(migratedResponse)
+	if err != nil {
+		// In case something really stupid happens
+		http.Error(w, `{"error": "error when JSON-encoding error message"}`, http.StatusPermanentRedirect)
+		return
+	}
+	http.Error(w, string(response), http.StatusPermanentRedirect)
+}
+
+// The bundle was signed by a server we trust, but we still don't take its
+// contents for granted
+func validateMigrationAccount(account migration.Account) error {
+	if !account.Email.Validate() {
+		return fmt.Errorf("Invalid 'email'")
+	}
+	if !account.ClientSaltSeed.Validate() {
+		return fmt.Errorf("Invalid 'clientSaltSeed'")
+	}
+	if account.Credential == "" {
+		return fmt.Errorf("Missing 'credential'")
+	}
+	if len(account.Wallets) > store.MaxWalletsPerUser {
+		return fmt.Errorf("Too many wallets. The limit is %d.", store.MaxWalletsPerUser)
+	}
+	seen := map[wallet.WalletId]bool{}
+	for _, w := range account.Wallets {
+		if !w.WalletId.Validate() || w.EncryptedWallet == "" || w.Hmac == "" || w.Sequence < store.InitialWalletSequence {
+			return fmt.Errorf("Each of 'wallets' needs a valid 'walletId', 'encryptedWallet', 'hmac' and 'sequence'")
+		}
+		if seen[w.WalletId] {
+			return fmt.Errorf("Wallet id %s is in 'wallets' more than once", w.WalletId)
+		}
+		seen[w.WalletId] = true
+	}
+	return nil
+}
+
+// Response Code:
+//
+//	200: The signed bundle, for the client to take to the other server
+//	401: Wrong password (when moving)
+//	403: 'migrateTo' isn't in the servers this server moves accounts to
+//	404: This server doesn't have a signing key
+//	500: Bundle not made (and account not marked as moved) for unanticipated
+//	     reasons
+func (s *Server) postMigrationExport(w http.ResponseWriter, req *http.Request) {
+	signingKey, err := env.GetMigrationSigningKey(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting migration signing key")
+		return
+	}
+	if signingKey == nil {
+		errorJson(w, http.StatusNotFound, "Account migration export is not enabled on this server")
+		return
+	}
+
+	var exportRequest MigrationExportRequest
+	if !getPostData(w, req, &exportRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, exportRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	destinations, err := env.GetMigrationDestinations(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting migration destinations")
+		return
+	}
+	destinationKey, ok := destinations[strings.TrimSuffix(exportRequest.MigrateTo, "/")]
+	if !ok {
+		errorJson(w, http.StatusForbidden, "This server doesn't move accounts to 'migrateTo'")
+		return
+	}
+
+	migratedTo := exportRequest.MigrateTo
+	if exportRequest.Copy {
+		migratedTo = ""
+	}
+	email, seed, key, salt, wallets, err := s.store.ExportAccount(authToken.UserId, exportRequest.Password, migratedTo)
+	if err == store.ErrWrongCredentials {
+		errorJson(w, http.StatusUnauthorized, "No match for password")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error exporting account")
+		return
+	}
+
+	credential, err := migration.SealCredential(key, salt, destinationKey)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error sealing migration credential")
+		return
+	}
+
+	account := migration.Account{
+		Email:          email,
+		ClientSaltSeed: seed,
+		Credential:     credential,
+		Wallets:        []migration.Wallet{},
+	}
+	for _, w := range wallets {
+		account.Wallets = append(account.Wallets, migration.Wallet{
+			WalletId:        w.WalletId,
+			EncryptedWallet: w.EncryptedWallet,
+			Sequence:        w.Sequence,
+			Hmac:            w.Hmac,
+		})
+	}
+
+	bundle, err := migration.Sign(account, signingKey, time.Now())
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error signing migration bundle")
+		return
+	}
+
+	response, err := json.Marshal(bundle)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating migration export response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+
+	s.recordAuditEvent(req, store.AuditEventAccountExport, authToken.UserId, authToken.DeviceId)
+	logging.FromContext(req.Context()).Info("Account exported", logging.F("user_id", authToken.UserId), logging.F("migrate_to", exportRequest.MigrateTo), logging.F("copy", exportRequest.Copy))
+
+	if exportRequest.Copy {
+		return
+	}
+
+	// The account's auth tokens are gone, so boot its clients off of here too.
+	// See the caveats in changePassword.
+	timeout := time.NewTicker(100 * time.Millisecond)
+	select {
+	case s.shardFor(authToken.UserId).userRemove <- wsClientForUser{authToken.UserId, nil}:
+	case <-timeout.C:
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-user-remove"}).Inc()
+	}
+	timeout.Stop()
+}
+
+// Response Code:
+//
+//	200: Account created, already verified, with the bundle's wallets
+//	400: Bundle is malformed, expired, or has contents that fail validation
+//	401: Password doesn't match the one on the other server
+//	403: Bundle isn't signed by a server we trust, or is for another server
+//	404: This server doesn't have any trusted keys or an encryption key
+//	409: An account with this email already exists
+//	500: Account not created for unanticipated reasons
+func (s *Server) postMigrationImport(w http.ResponseWriter, req *http.Request) {
+	trustedKeys, err := env.GetMigrationTrustedKeys(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting migration trusted keys")
+		return
+	}
+	encryptionKey, err := env.GetMigrationEncryptionKey(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting migration encryption key")
+		return
+	}
+	if len(trustedKeys) == 0 || encryptionKey == nil {
+		errorJson(w, http.StatusNotFound, "Account migration import is not enabled on this server")
+		return
+	}
+
+	var importRequest MigrationImportRequest
+	if !getPostData(w, req, &importRequest) {
+		return
+	}
+
+	account, err := migration.Open(importRequest.Bundle, trustedKeys, time.Now())
+	if err == migration.ErrUntrustedBundle {
+		errorJson(w, http.StatusForbidden, "Bundle is not signed by a server we trust")
+		return
+	} else if err == migration.ErrExpiredBundle {
+		errorJson(w, http.StatusBadRequest, "Bundle has expired")
+		return
+	} else if err == migration.ErrMalformedBundle || err == migration.ErrUnsupportedVersion {
+		errorJson(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error opening migration bundle")
+		return
+	}
+
+	if err := validateMigrationAccount(account); err != nil {
+		errorJson(w, http.StatusBadRequest, "Bundle failed validation: "+err.Error())
+		return
+	}
+
+	key, salt, err := migration.OpenCredential(account.Credential, encryptionKey)
+	if err == migration.ErrWrongDestination {
+		errorJson(w, http.StatusForbidden, "Bundle is for a different server")
+		return
+	} else if err != nil {
+		errorJson(w, http.StatusBadRequest, "Bundle failed validation: Invalid 'credential'")
+		return
+	}
+
+	match, err := importRequest.Password.Check(key, salt)
+	if err != nil {
+		errorJson(w, http.StatusBadRequest, "Bundle failed validation: Invalid 'credential'")
+		return
+	}
+	if !match {
+		errorJson(w, http.StatusUnauthorized, "Wrong password")
+		return
+	}
+
+	wallets := []store.WalletUpdate{}
+	for _, w := range account.Wallets {
+		wallets = append(wallets, store.WalletUpdate{
+			WalletId:        w.WalletId,
+			EncryptedWallet: w.EncryptedWallet,
+			Sequence:        w.Sequence,
+			Hmac:            w.Hmac,
+		})
+	}
+
+	userId, err := s.store.ImportAccount(account.Email, importRequest.Password, account.ClientSaltSeed, wallets)
+	if err == store.ErrDuplicateAccount {
+		errorJson(w, http.StatusConflict, "Account already exists")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error importing account")
+		return
+	}
+
+	var importResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(importResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating migration import response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+
+	s.recordAuditEvent(req, store.AuditEventAccountImport, userId, "")
+	logging.FromContext(req.Context()).Info("Account imported", logging.F("user_id", userId), logging.F("wallets", len(wallets)))
+}
+
+// Take back an account that was exported with migrateTo, i.e. if the import on
+// the other server failed or never happened. The user can log in here again.
+// Not gated on MIGRATION_SIGNING_KEY, so that users can still get their
+// accounts back if export gets turned off.
+//
+// Response Code:
+//
+//	200: Account is no longer marked as moved
+//	401: Wrong email and/or password
+//	409: Account isn't marked as moved
+//	500: Account still marked as moved for unanticipated reasons
+func (s *Server) postMigrationCancel(w http.ResponseWriter, req *http.Request) {
+	var cancelRequest MigrationCancelRequest
+	if !getPostData(w, req, &cancelRequest) {
+		return
+	}
+
+	userId, err := s.store.CancelMigration(cancelRequest.Email, cancelRequest.Password)
+	if err == store.ErrWrongCredentials {
+		s.recordAuditEventForEmail(req, store.AuditEventLoginFailed, cancelRequest.Email, "")
+		errorJson(w, http.StatusUnauthorized, "No match for email and/or password")
+		return
+	} else if err == store.ErrNotMigrated {
+		errorJson(w, http.StatusConflict, "Account has not moved to another server")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error cancelling migration")
+		return
+	}
+
+	var cancelResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(cancelResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating migration cancel response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+
+	s.recordAuditEvent(req, store.AuditEventMigrationCancel, userId, "")
+	logging.FromContext(req.Context()).Info("Account migration cancelled", logging.F("user_id", userId))
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/migration"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+const testMigrationSigningKey = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+func testMigrationKeys(t *testing.T) (ed25519.PrivateKey, string) {
+	key, err := migration.ParseSigningKey(testMigrationSigningKey)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing signing key: %+v", err)
+	}
+	return key, migration.PublicKeyString(key)
+}
+
+const testMigrationEncryptionKey = "HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE="
+
+// The destination server's encryption key, and the public key that goes in the
+// source server's MIGRATION_DESTINATIONS
+func testMigrationEncryptionKeys(t *testing.T) (*[32]byte, string) {
+	key, err := migration.ParseEncryptionKey(testMigrationEncryptionKey)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing encryption key: %+v", err)
+	}
+	return key, migration.EncryptionPublicKeyString(key)
+}
+
+// The password hash that goes in test bundles, for the password "12345678"
+var testMigrationKey, testMigrationSalt, _ = auth.Password("12345678").Create()
+
+// With the password hash sealed to destinationKey
+func testMigrationAccount(t *testing.T, destinationKey string) migration.Account {
+	key, err := migration.ParseDestinationKey(destinationKey)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing destination key: %+v", err)
+	}
+	credential, err := migration.SealCredential(testMigrationKey, testMigrationSalt, key)
+	if err != nil {
+		t.Fatalf("Unexpected error sealing credential: %+v", err)
+	}
+	return migration.Account{
+		Email:          "abc@example.com",
+		ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+		Credential:     credential,
+		Wallets: []migration.Wallet{
+			{WalletId: "default_wallet", EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+			{WalletId: "savings", EncryptedWallet: "my-other-enc-wallet", Sequence: 2, Hmac: "my-other-hmac"},
+		},
+	}
+}
+
+func TestServerMigrationExport(t *testing.T) {
+	_, publicKey := testMigrationKeys(t)
+	encryptionKey, encryptionPublicKey := testMigrationEncryptionKeys(t)
+	enabledEnv := map[string]string{
+		"MIGRATION_SIGNING_KEY":  testMigrationSigningKey,
+		"MIGRATION_DESTINATIONS": "https://other.example.com=" + encryptionPublicKey,
+	}
+
+	tt := []struct {
+		name        string
+		env         map[string]string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedMigrateTo   *string
+	}{
+		{
+			name:               "copy",
+			env:                enabledEnv,
+			requestBody:        `{"token": "seekrit", "migrateTo": "https://other.example.com", "copy": true}`,
+			expectedStatusCode: http.StatusOK,
+			expectedMigrateTo:  new(string),
+		},
+		{
+			name:               "move",
+			env:                enabledEnv,
+			requestBody:        `{"token": "seekrit", "migrateTo": "https://other.example.com", "password": "12345678"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedMigrateTo:  func() *string { s := "https://other.example.com"; return &s }(),
+		},
+		{
+			name:                "move with wrong password",
+			env:                 enabledEnv,
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://other.example.com", "password": "87654321"}`,
+			storeErrors:         TestStoreFunctionsErrors{ExportAccount: store.ErrWrongCredentials},
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for password",
+			expectedMigrateTo:   func() *string { s := "https://other.example.com"; return &s }(),
+		},
+		{
+			name:                "move without password",
+			env:                 enabledEnv,
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://other.example.com"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'password'",
+		},
+		{
+			name:                "move to server not allowed",
+			env:                 enabledEnv,
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://evil.example.com", "password": "12345678"}`,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": This server doesn't move accounts to 'migrateTo'",
+		},
+		{
+			name:                "no servers allowed",
+			env:                 map[string]string{"MIGRATION_SIGNING_KEY": testMigrationSigningKey},
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://other.example.com", "copy": true}`,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": This server doesn't move accounts to 'migrateTo'",
+		},
+		{
+			name:                "not enabled",
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://other.example.com", "copy": true}`,
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Account migration export is not enabled on this server",
+		},
+		{
+			name:                "validation error",
+			env:                 enabledEnv,
+			requestBody:         `{"token": "seekrit", "migrateTo": "other.example.com", "copy": true}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'migrateTo'",
+		},
+		{
+			name:                "db error",
+			env:                 enabledEnv,
+			requestBody:         `{"token": "seekrit", "migrateTo": "https://other.example.com", "copy": true}`,
+			storeErrors:         TestStoreFunctionsErrors{ExportAccount: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedMigrateTo:   new(string),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken:      auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+				TestEmail:          "abc@example.com",
+				TestClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				TestKey:            testMigrationKey,
+				TestServerSalt:     testMigrationSalt,
+				TestWalletUpdates: []store.WalletUpdate{
+					{WalletId: "default_wallet", EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+					{WalletId: "savings", EncryptedWallet: "my-other-enc-wallet", Sequence: 2, Hmac: "my-other-hmac"},
+				},
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathMigrationExport, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.postMigrationExport(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedMigrateTo, testStore.Called.ExportAccount) {
+				t.Errorf("Expected Store.ExportAccount to be called with %v, got %v", tc.expectedMigrateTo, testStore.Called.ExportAccount)
+			}
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			var bundle migration.Bundle
+			if err := json.Unmarshal(body, &bundle); err != nil {
+				t.Fatalf("Error decoding response body %s: %+v", body, err)
+			}
+			trustedKey, _ := migration.ParseTrustedKey(publicKey)
+			account, err := migration.Open(bundle, []ed25519.PublicKey{trustedKey}, time.Now())
+			if err != nil {
+				t.Fatalf("Unexpected error opening bundle: %+v", err)
+			}
+			// Only the destination can read the password hash
+			key, salt, err := migration.OpenCredential(account.Credential, encryptionKey)
+			if err != nil || key != testMigrationKey || salt != testMigrationSalt {
+				t.Errorf("Expected the credential to open to the password hash, got %s %s %+v", key, salt, err)
+			}
+
+			expected := testMigrationAccount(t, encryptionPublicKey)
+			expected.Version, expected.Expiration, expected.Credential = account.Version, account.Expiration, account.Credential
+			if !reflect.DeepEqual(expected, account) {
+				t.Errorf("Expected account %+v, got %+v", expected, account)
+			}
+
+			if len(testStore.Called.AuditEvents) != 1 || testStore.Called.AuditEvents[0].Event.Type != store.AuditEventAccountExport {
+				t.Errorf("Expected an account export audit event, got %+v", testStore.Called.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestServerMigrationImport(t *testing.T) {
+	key, publicKey := testMigrationKeys(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	_, encryptionPublicKey := testMigrationEncryptionKeys(t)
+	enabledEnv := map[string]string{
+		"MIGRATION_TRUSTED_KEYS":   publicKey,
+		"MIGRATION_ENCRYPTION_KEY": testMigrationEncryptionKey,
+	}
+
+	requestBodyWithPassword := func(signingKey ed25519.PrivateKey, account migration.Account, signed time.Time, password string) string {
+		bundle, err := migration.Sign(account, signingKey, signed)
+		if err != nil {
+			t.Fatalf("Unexpected error signing: %+v", err)
+		}
+		bundleJson, _ := json.Marshal(bundle)
+		return fmt.Sprintf(`{"bundle": %s, "password": "%s"}`, bundleJson, password)
+	}
+	requestBody := func(signingKey ed25519.PrivateKey, account migration.Account, signed time.Time) string {
+		return requestBodyWithPassword(signingKey, account, signed, "12345678")
+	}
+
+	testAccount := testMigrationAccount(t, encryptionPublicKey)
+	duplicateWallets := testMigrationAccount(t, encryptionPublicKey)
+	duplicateWallets.Wallets[1].WalletId = duplicateWallets.Wallets[0].WalletId
+	noCredential := testMigrationAccount(t, encryptionPublicKey)
+	noCredential.Credential = ""
+	// Sealed to the signing key instead, i.e. for some other server
+	otherDestination := testMigrationAccount(t, testMigrationSigningKey)
+
+	expectedCall := &ImportAccountCall{
+		Email:          "abc@example.com",
+		Password:       "12345678",
+		ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+		Wallets: []store.WalletUpdate{
+			{WalletId: "default_wallet", EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+			{WalletId: "savings", EncryptedWallet: "my-other-enc-wallet", Sequence: 2, Hmac: "my-other-hmac"},
+		},
+	}
+
+	tt := []struct {
+		name        string
+		env         map[string]string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *ImportAccountCall
+	}{
+		{
+			name:               "success",
+			env:                enabledEnv,
+			requestBody:        requestBody(key, testAccount, time.Now()),
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       expectedCall,
+		},
+		{
+			name:                "not enabled",
+			requestBody:         requestBody(key, testAccount, time.Now()),
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Account migration import is not enabled on this server",
+		},
+		{
+			name:                "no encryption key",
+			env:                 map[string]string{"MIGRATION_TRUSTED_KEYS": publicKey},
+			requestBody:         requestBody(key, testAccount, time.Now()),
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Account migration import is not enabled on this server",
+		},
+		{
+			name:                "validation error",
+			env:                 enabledEnv,
+			requestBody:         `{"password": "12345678"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'bundle'",
+		},
+		{
+			name:                "untrusted",
+			env:                 enabledEnv,
+			requestBody:         requestBody(otherKey, testAccount, time.Now()),
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Bundle is not signed by a server we trust",
+		},
+		{
+			name:                "expired",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, testAccount, time.Now().Add(-migration.BundleLifespan-time.Minute)),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Bundle has expired",
+		},
+		{
+			name:                "bad contents",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, duplicateWallets, time.Now()),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Bundle failed validation: Wallet id default_wallet is in 'wallets' more than once",
+		},
+		{
+			name:                "no credential",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, noCredential, time.Now()),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Bundle failed validation: Missing 'credential'",
+		},
+		{
+			name:                "for another server",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, otherDestination, time.Now()),
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Bundle is for a different server",
+		},
+		{
+			name:                "wrong password",
+			env:                 enabledEnv,
+			requestBody:         requestBodyWithPassword(key, testAccount, time.Now(), "87654321"),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Wrong password",
+		},
+		{
+			name:                "account exists",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, testAccount, time.Now()),
+			storeErrors:         TestStoreFunctionsErrors{ImportAccount: store.ErrDuplicateAccount},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Account already exists",
+			expectedCall:        expectedCall,
+		},
+		{
+			name:                "db error",
+			env:                 enabledEnv,
+			requestBody:         requestBody(key, testAccount, time.Now()),
+			storeErrors:         TestStoreFunctionsErrors{ImportAccount: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        expectedCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestUserId: 5, Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathMigrationImport, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.postMigrationImport(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.ImportAccount) {
+				t.Errorf("Expected Store.ImportAccount to be called with %+v, got %+v", tc.expectedCall, testStore.Called.ImportAccount)
+			}
+			if tc.expectedErrorString == "" && string(body) != "{}" {
+				t.Errorf("Expected empty response, got %s", body)
+			}
+		})
+	}
+}
+
+func TestServerMigrationCancel(t *testing.T) {
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        auth.Email
+		expectedAuditEvent  store.AuditEventType
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"email": "abc@example.com", "password": "12345678"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       "abc@example.com",
+			expectedAuditEvent: store.AuditEventMigrationCancel,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"email": "abc@example.com"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'password'",
+		},
+		{
+			name:                "wrong credentials",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			storeErrors:         TestStoreFunctionsErrors{CancelMigration: store.ErrWrongCredentials},
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for email and/or password",
+			expectedCall:        "abc@example.com",
+			expectedAuditEvent:  store.AuditEventLoginFailed,
+		},
+		{
+			name:                "not migrated",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			storeErrors:         TestStoreFunctionsErrors{CancelMigration: store.ErrNotMigrated},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Account has not moved to another server",
+			expectedCall:        "abc@example.com",
+		},
+		{
+			name:                "db error",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			storeErrors:         TestStoreFunctionsErrors{CancelMigration: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        "abc@example.com",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestUserId: 5, Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathMigrationCancel, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.postMigrationCancel(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.CancelMigration != tc.expectedCall {
+				t.Errorf("Expected Store.CancelMigration to be called with %s, got %s", tc.expectedCall, testStore.Called.CancelMigration)
+			}
+			if tc.expectedAuditEvent == "" {
+				if len(testStore.Called.AuditEvents) != 0 {
+					t.Errorf("Expected no audit events, got %+v", testStore.Called.AuditEvents)
+				}
+			} else if len(testStore.Called.AuditEvents) != 1 || testStore.Called.AuditEvents[0].Event.Type != tc.expectedAuditEvent {
+				t.Errorf("Expected a %s audit event, got %+v", tc.expectedAuditEvent, testStore.Called.AuditEvents)
+			}
+			if tc.expectedErrorString == "" && string(body) != "{}" {
+				t.Errorf("Expected empty response, got %s", body)
+			}
+		})
+	}
+}
+
+func TestServerValidateMigrationExportRequest(t *testing.T) {
+	tt := []struct {
+		name      string
+		request   MigrationExportRequest
+		expectErr bool
+	}{
+		{"move", MigrationExportRequest{Token: "seekrit", MigrateTo: "https://other.example.com", Password: "12345678"}, false},
+		{"copy", MigrationExportRequest{Token: "seekrit", MigrateTo: "http://localhost:8090", Copy: true}, false},
+		{"no token", MigrationExportRequest{MigrateTo: "https://other.example.com", Copy: true}, true},
+		{"no migrateTo", MigrationExportRequest{Token: "seekrit", Copy: true}, true},
+		{"no scheme", MigrationExportRequest{Token: "seekrit", MigrateTo: "other.example.com", Copy: true}, true},
+		{"not http", MigrationExportRequest{Token: "seekrit", MigrateTo: "ftp://other.example.com", Copy: true}, true},
+		{"no host", MigrationExportRequest{Token: "seekrit", MigrateTo: "https://", Copy: true}, true},
+		{"move without password", MigrationExportRequest{Token: "seekrit", MigrateTo: "https://other.example.com"}, true},
+	}
+	for _, tc := range tt {
+		err := tc.request.validate()
+		if tc.expectErr != (err != nil) {
+			t.Errorf("%s: expected error: %v, got %+v", tc.name, tc.expectErr, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+)
+
+type NotificationsRequest struct {
+	Token   auth.AuthTokenString `json:"token"`
+	Enabled *bool                `json:"enabled"`
+}
+
+func (r *NotificationsRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if r.Enabled == nil {
+		return fmt.Errorf("Missing 'enabled'")
+	}
+	return nil
+}
+
+type NotificationsResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Tell the user about something that happened to their account, unless they
+// turned these emails off. It already happened, so if we can't tell them, we
+// log it rather than failing the request.
+//
+// The email goes out in the background, so a slow mail provider doesn't hold
+// up the request. Serve waits for these before exiting.
+func (s *Server) notify(req *http.Request, userId auth.UserId, send func(auth.Email, auth.Locale) error) {
+	mailEnabled, err := env.GetMailEnabled(s.env)
+	if err != nil || !mailEnabled {
+		return
+	}
+
+	logger := logging.FromContext(req.Context())
+
+	info, err := s.store.GetAccountInfo(userId)
+	if err == nil && info.NotificationsOff {
+		return
+	}
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "notification-email"}).Inc()
+		logger.Warn("Error sending notification email", logging.Err(err))
+		return
+	}
+
+	s.notifications.Add(1)
+	go func() {
+		defer s.notifications.Done()
+		if err := send(info.Email, info.Locale); err != nil {
+			metrics.ErrorsCount.With(prometheus.Labels{"error_type": "notification-email"}).Inc()
+			logger.Warn("Error sending notification email", logging.Err(err))
+		}
+	}()
+}
+
+func (s *Server) handleNotifications(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.getNotifications(w, req)
+	} else if req.Method == http.MethodPost {
+		s.postNotifications(w, req)
+	} else {
+		errorJson(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// Whether the user gets emails about their account
+func (s *Server) getNotifications(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	info, err := s.store.GetAccountInfo(authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting account info")
+		return
+	}
+
+	response, err := json.Marshal(NotificationsResponse{Enabled: !info.NotificationsOff})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating notifications response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Turn emails about the account on or off
+//
+// Response Code:
+//
+//	200: Set
+//	500: Not set for unanticipated reasons
+func (s *Server) postNotifications(w http.ResponseWriter, req *http.Request) {
+	var notificationsRequest NotificationsRequest
+	if !getPostData(w, req, &notificationsRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, notificationsRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	enabled := *notificationsRequest.Enabled
+	if err := s.store.SetNotificationsOff(authToken.UserId, !enabled); err != nil {
+		internalServiceErrorJson(w, req, err, "Error setting notifications")
+		return
+	}
+
+	response, err := json.Marshal(NotificationsResponse{Enabled: enabled})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating notifications response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	logging.FromContext(req.Context()).Info("User has set notifications", logging.F("user_id", authToken.UserId), logging.F("enabled", enabled))
+}
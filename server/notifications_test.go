@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerNotify(t *testing.T) {
+	emailVerifyEnv := map[string]string{"ACCOUNT_VERIFICATION_MODE": "EmailVerify"}
+
+	tt := []struct {
+		name             string
+		env              map[string]string
+		notificationsOff bool
+		storeErrors      TestStoreFunctionsErrors
+
+		expectedSent bool
+	}{
+		{
+			name:         "sent",
+			env:          emailVerifyEnv,
+			expectedSent: true,
+		},
+		{
+			name:             "opted out",
+			env:              emailVerifyEnv,
+			notificationsOff: true,
+		},
+		{
+			name: "no mail set up",
+			env:  map[string]string{"ACCOUNT_VERIFICATION_MODE": "AllowAll"},
+		},
+		{
+			name:        "db error",
+			env:         emailVerifyEnv,
+			storeErrors: TestStoreFunctionsErrors{GetAccountInfo: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAccountInfo: store.AccountInfo{Email: "abc@example.com", NotificationsOff: tc.notificationsOff},
+				Errors:          tc.storeErrors,
+			}
+			testMail := TestMail{}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &testMail, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathPassword, nil)
+			s.notify(req, 5, testMail.SendPasswordChangedNotification)
+			s.notifications.Wait()
+
+			if sent := testMail.SendPasswordChangedNotificationCall != nil; sent != tc.expectedSent {
+				t.Fatalf("Expected notification sent: %v, got %v", tc.expectedSent, sent)
+			}
+			if tc.expectedSent && *testMail.SendPasswordChangedNotificationCall != "abc@example.com" {
+				t.Errorf("Expected notification to abc@example.com, got %s", *testMail.SendPasswordChangedNotificationCall)
+			}
+		})
+	}
+}
+
+func TestServerNotificationsNewDevice(t *testing.T) {
+	for _, newDevice := range []bool{true, false} {
+		testAuth := TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}
+		testStore := TestStore{
+			TestUserId:      5,
+			TestNewDevice:   newDevice,
+			TestAccountInfo: store.AccountInfo{Email: "abc@example.com", Locale: "pt-BR"},
+		}
+		testMail := TestMail{}
+		env := map[string]string{"ACCOUNT_VERIFICATION_MODE": "EmailVerify"}
+		s := Init(&testAuth, &testStore, &TestEnv{env}, &testMail, TestPort)
+
+		requestBody := []byte(`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`)
+		req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer(requestBody))
+		w := httptest.NewRecorder()
+
+		s.getAuthToken(w, req)
+		s.notifications.Wait()
+
+		expectStatusCode(t, w, http.StatusOK)
+		if testStore.Called.IsNewDevice != "dev-1" {
+			t.Errorf("Expected Store.IsNewDevice to be called for dev-1, got %q", testStore.Called.IsNewDevice)
+		}
+
+		var expectedCall *SendNewDeviceNotificationCall
+		if newDevice {
+			expectedCall = &SendNewDeviceNotificationCall{"abc@example.com", "dev-1", "pt-BR"}
+		}
+		if !reflect.DeepEqual(expectedCall, testMail.SendNewDeviceNotificationCall) {
+			t.Errorf("New device %v: expected notification %+v, got %+v", newDevice, expectedCall, testMail.SendNewDeviceNotificationCall)
+		}
+	}
+}
+
+func TestServerGetNotifications(t *testing.T) {
+	for _, off := range []bool{true, false} {
+		testStore := TestStore{
+			TestAuthToken:   auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+			TestAccountInfo: store.AccountInfo{NotificationsOff: off},
+		}
+		s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+		req := httptest.NewRequest(http.MethodGet, paths.PathNotifications+"?token=seekrit", nil)
+		w := httptest.NewRecorder()
+
+		s.handleNotifications(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+
+		expectStatusCode(t, w, http.StatusOK)
+		if want, got := fmt.Sprintf(`{"enabled":%v}`, !off), string(body); want != got {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestServerPostNotifications(t *testing.T) {
+	off := true
+
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *bool
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"token": "seekrit", "enabled": false}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &off,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'enabled'",
+		},
+		{
+			name:                "db error",
+			requestBody:         `{"token": "seekrit", "enabled": false}`,
+			storeErrors:         TestStoreFunctionsErrors{SetNotificationsOff: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        &off,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: 5},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathNotifications, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.handleNotifications(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(tc.expectedCall, testStore.Called.SetNotificationsOff) {
+				t.Errorf("Expected Store.SetNotificationsOff to be called with %v, got %v", tc.expectedCall, testStore.Called.SetNotificationsOff)
+			}
+			if tc.expectedErrorString == "" && string(body) != `{"enabled":false}` {
+				t.Errorf("Unexpected response %s", body)
+			}
+		})
+	}
+}
@@ -3,11 +3,11 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/store"
 	"lbryio/wallet-sync-server/wallet"
@@ -15,14 +15,64 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// One of the user's wallets, re-encrypted with the new password (or, for an
+// email change, with the key made from the new email)
+type ChangePasswordWallet struct {
+	WalletId        wallet.WalletId        `json:"walletId"`
+	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
+	Sequence        wallet.Sequence        `json:"sequence"`
+	Hmac            wallet.WalletHmac      `json:"hmac"`
+}
+
 type ChangePasswordRequest struct {
+	// The default wallet, for clients that don't know about named wallets
 	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
 	Sequence        wallet.Sequence        `json:"sequence"`
 	Hmac            wallet.WalletHmac      `json:"hmac"`
-	Email           auth.Email             `json:"email"`
-	OldPassword     auth.Password          `json:"oldPassword"`
-	NewPassword     auth.Password          `json:"newPassword"`
-	ClientSaltSeed  auth.ClientSaltSeed    `json:"clientSaltSeed"`
+
+	// Every one of the user's wallets, for clients that do
+	Wallets []ChangePasswordWallet `json:"wallets"`
+
+	Email          auth.Email          `json:"email"`
+	OldPassword    auth.Password       `json:"oldPassword"`
+	NewPassword    auth.Password       `json:"newPassword"`
+	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
+}
+
+// A wallet that held up the password change. The client should get the
+// latest of each (or drop the ones that don't exist), re-encrypt, and try
+// again.
+type WalletConflictResponse struct {
+	WalletId wallet.WalletId `json:"walletId"`
+	Sequence wallet.Sequence `json:"sequence"` // 0 if the wallet doesn't exist
+	Missing  bool            `json:"missing"`  // exists, but wasn't in the request
+}
+
+// Same as an ErrorResponse, with the details of every conflicting wallet
+type ChangePasswordConflictResponse struct {
+	Error     string                   `json:"error"`
+	Conflicts []WalletConflictResponse `json:"conflicts"`
+}
+
+func changePasswordConflictJson(w http.ResponseWriter, extra string, conflicts []store.WalletConflict) {
+	conflictResponse := ChangePasswordConflictResponse{
+		Error:     http.StatusText(http.StatusConflict) + ": " + extra,
+		Conflicts: []WalletConflictResponse{},
+	}
+	for _, conflict := range conflicts {
+		conflictResponse.Conflicts = append(conflictResponse.Conflicts, WalletConflictResponse{
+			WalletId: conflict.WalletId,
+			Sequence: conflict.Sequence,
+			Missing:  conflict.Missing,
+		})
+	}
+	response, err := json.Marshal(conflictResponse)
+	if err != nil {
+		// In case something really stupid happens
+		http.Error(w, `{"error": "error when JSON-encoding error message"}`, http.StatusConflict)
+		return
+	}
+	http.Error(w, string(response), http.StatusConflict)
 }
 
 func (r *ChangePasswordRequest) validate() error {
@@ -49,9 +99,54 @@ func (r *ChangePasswordRequest) validate() error {
 	if !walletPresent && !walletAbsent {
 		return fmt.Errorf("Fields 'encryptedWallet', 'sequence', and 'hmac' should be all non-empty and non-zero, or all omitted")
 	}
+	if walletPresent && len(r.Wallets) > 0 {
+		return fmt.Errorf("Send either 'wallets', or 'encryptedWallet', 'sequence', and 'hmac', not both")
+	}
+	return validateChangePasswordWallets(r.Wallets)
+}
+
+func validateChangePasswordWallets(wallets []ChangePasswordWallet) error {
+	walletIds := map[wallet.WalletId]bool{}
+	for _, w := range wallets {
+		if !w.WalletId.Validate() {
+			return fmt.Errorf("Invalid or missing 'walletId' in 'wallets'")
+		}
+		if walletIds[w.WalletId] {
+			return fmt.Errorf("Wallet '%s' is in 'wallets' more than once", w.WalletId)
+		}
+		walletIds[w.WalletId] = true
+		if w.EncryptedWallet == "" || w.Hmac == "" || w.Sequence == 0 {
+			return fmt.Errorf("Fields 'encryptedWallet', 'sequence', and 'hmac' should be non-empty and non-zero for each of 'wallets'")
+		}
+	}
 	return nil
 }
 
+// The wallets to update, whichever way the client sent them
+func (r *ChangePasswordRequest) walletUpdates() (updates []store.WalletUpdate) {
+	if r.EncryptedWallet != "" {
+		return []store.WalletUpdate{{
+			WalletId:        wallet.DefaultWalletId,
+			EncryptedWallet: r.EncryptedWallet,
+			Sequence:        r.Sequence,
+			Hmac:            r.Hmac,
+		}}
+	}
+	return changePasswordWalletUpdates(r.Wallets)
+}
+
+func changePasswordWalletUpdates(wallets []ChangePasswordWallet) (updates []store.WalletUpdate) {
+	for _, w := range wallets {
+		updates = append(updates, store.WalletUpdate{
+			WalletId:        w.WalletId,
+			EncryptedWallet: w.EncryptedWallet,
+			Sequence:        w.Sequence,
+			Hmac:            w.Hmac,
+		})
+	}
+	return
+}
+
 func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 	var changePasswordRequest ChangePasswordRequest
 	if !getPostData(w, req, &changePasswordRequest) {
@@ -75,17 +170,20 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 
 	var err error
 	var userId auth.UserId
-	if changePasswordRequest.EncryptedWallet != "" {
-		userId, err = s.store.ChangePasswordWithWallet(
+	if walletUpdates := changePasswordRequest.walletUpdates(); len(walletUpdates) > 0 {
+		var conflicts []store.WalletConflict
+		userId, conflicts, err = s.store.ChangePasswordWithWallet(
 			changePasswordRequest.Email,
 			changePasswordRequest.OldPassword,
 			changePasswordRequest.NewPassword,
 			changePasswordRequest.ClientSaltSeed,
-			changePasswordRequest.EncryptedWallet,
-			changePasswordRequest.Sequence,
-			changePasswordRequest.Hmac)
+			walletUpdates)
 		if err == store.ErrWrongSequence {
-			errorJson(w, http.StatusConflict, "Bad sequence number or wallet does not exist")
+			changePasswordConflictJson(w, "Bad sequence number or wallet does not exist", conflicts)
+			return
+		}
+		if err == store.ErrMissingWallet {
+			changePasswordConflictJson(w, "Another wallet exists; need all wallets updated when changing password", conflicts)
 			return
 		}
 	} else {
@@ -101,6 +199,7 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 	if err == store.ErrWrongCredentials {
+		s.recordAuditEventForEmail(req, store.AuditEventPasswordChangeFailed, changePasswordRequest.Email, "")
 		errorJson(w, http.StatusUnauthorized, "No match for email and/or password")
 		return
 	}
@@ -109,9 +208,11 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error changing password")
+		internalServiceErrorJson(w, req, err, "Error changing password")
 		return
 	}
+	s.recordAuditEvent(req, store.AuditEventPasswordChange, userId, "")
+	s.notify(req, userId, s.mail.SendPasswordChangedNotification)
 
 	// TODO - A socket connection request using an old auth token could still
 	// succeed in a race condition:
@@ -142,7 +243,7 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 
 	timeout := time.NewTicker(100 * time.Millisecond)
 	select {
-	case s.userRemove <- wsClientForUser{userId, nil}:
+	case s.shardFor(userId).userRemove <- wsClientForUser{userId, nil}:
 	case <-timeout.C:
 		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-user-remove"}).Inc()
 		return
@@ -154,11 +255,11 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 	response, err = json.Marshal(changePasswordResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating change password response")
+		internalServiceErrorJson(w, req, err, "Error generating change password response")
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, string(response))
-	log.Printf("User %s has changed their password", changePasswordRequest.Email)
+	logging.FromContext(req.Context()).Info("User has changed their password", logging.F("email", changePasswordRequest.Email))
 }
@@ -2,10 +2,12 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -224,15 +226,19 @@ func TestServerChangePassword(t *testing.T) {
 			if tc.expectChangePasswordCall {
 				if withWallet {
 					// Called ChangePasswordWithWallet with the expected parameters
+					// The legacy wallet fields are the default wallet
 					if want, got := (ChangePasswordWithWalletCall{
-						EncryptedWallet: tc.newEncryptedWallet,
-						Sequence:        tc.newSequence,
-						Hmac:            tc.newHmac,
-						Email:           tc.email,
-						OldPassword:     oldPassword,
-						NewPassword:     newPassword,
-						ClientSaltSeed:  clientSaltSeed,
-					}), testStore.Called.ChangePasswordWithWallet; want != got {
+						Wallets: []store.WalletUpdate{{
+							WalletId:        wallet.DefaultWalletId,
+							EncryptedWallet: tc.newEncryptedWallet,
+							Sequence:        tc.newSequence,
+							Hmac:            tc.newHmac,
+						}},
+						Email:          tc.email,
+						OldPassword:    oldPassword,
+						NewPassword:    newPassword,
+						ClientSaltSeed: clientSaltSeed,
+					}), testStore.Called.ChangePasswordWithWallet; !reflect.DeepEqual(want, got) {
 						t.Errorf("Store.ChangePasswordWithWallet called with: expected %+v, got %+v", want, got)
 					}
 
@@ -252,12 +258,12 @@ func TestServerChangePassword(t *testing.T) {
 					}
 
 					// Did *not* call ChangePasswordWithWallet
-					if want, got := (ChangePasswordWithWalletCall{}), testStore.Called.ChangePasswordWithWallet; want != got {
+					if want, got := (ChangePasswordWithWalletCall{}), testStore.Called.ChangePasswordWithWallet; !reflect.DeepEqual(want, got) {
 						t.Errorf("Store.ChangePasswordWithWallet unexpectly called with: %+v", got)
 					}
 				}
 			} else {
-				if want, got := (ChangePasswordWithWalletCall{}), testStore.Called.ChangePasswordWithWallet; want != got {
+				if want, got := (ChangePasswordWithWalletCall{}), testStore.Called.ChangePasswordWithWallet; !reflect.DeepEqual(want, got) {
 					t.Errorf("Store.ChangePasswordWithWallet unexpectly called with: %+v", got)
 				}
 				if want, got := (ChangePasswordNoWalletCall{}), testStore.Called.ChangePasswordNoWallet; want != got {
@@ -438,6 +444,42 @@ func TestServerValidateChangePasswordRequest(t *testing.T) {
 			},
 			"should not be the same",
 			"Expected ChangePasswordRequest with password that does not change to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				EncryptedWallet: "my-encrypted-wallet",
+				Hmac:            "my-hmac",
+				Sequence:        2,
+				Wallets:         []ChangePasswordWallet{{WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"}},
+				Email:           "abc@example.com",
+				OldPassword:     "12345678",
+				NewPassword:     "45678901",
+				ClientSaltSeed:  "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+			},
+			"not both",
+			"Expected ChangePasswordRequest with both 'wallets' and the single wallet fields to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Wallets: []ChangePasswordWallet{
+					{WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"},
+					{WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Sequence: 3, Hmac: "my-hmac"},
+				},
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+			},
+			"more than once",
+			"Expected ChangePasswordRequest with the same wallet twice to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Wallets:        []ChangePasswordWallet{{WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"}},
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+			},
+			"each of 'wallets'",
+			"Expected ChangePasswordRequest with a wallet missing its sequence to return an appropriate error",
 		},
 	}
 	for _, tc := range tt {
@@ -447,3 +489,89 @@ func TestServerValidateChangePasswordRequest(t *testing.T) {
 		}
 	}
 }
+
+// Clients that know about named wallets send all of them
+func TestServerChangePasswordMultipleWallets(t *testing.T) {
+	requestBody := `{
+    "wallets": [
+      {"walletId": "default_wallet", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"},
+      {"walletId": "savings", "encryptedWallet": "my-encrypted-savings", "sequence": 5, "hmac": "my-hmac-savings"}
+    ],
+    "email":          "abc@example.com",
+    "oldPassword":    "old password",
+    "newPassword":    "new password",
+    "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+  }`
+	expectedWallets := []store.WalletUpdate{
+		{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"},
+		{WalletId: "savings", EncryptedWallet: "my-encrypted-savings", Sequence: 5, Hmac: "my-hmac-savings"},
+	}
+
+	tt := []struct {
+		name                string
+		storeErrors         TestStoreFunctionsErrors
+		storeConflicts      []store.WalletConflict
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedConflicts   []WalletConflictResponse
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		}, {
+			name:                "missing wallet",
+			storeErrors:         TestStoreFunctionsErrors{ChangePasswordWithWallet: store.ErrMissingWallet},
+			storeConflicts:      []store.WalletConflict{{WalletId: "checking", Sequence: 3, Missing: true}},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Another wallet exists; need all wallets updated when changing password",
+			expectedConflicts:   []WalletConflictResponse{{WalletId: "checking", Sequence: 3, Missing: true}},
+		}, {
+			name:        "stale wallets",
+			storeErrors: TestStoreFunctionsErrors{ChangePasswordWithWallet: store.ErrWrongSequence},
+			storeConflicts: []store.WalletConflict{
+				{WalletId: wallet.DefaultWalletId, Sequence: 2},
+				{WalletId: "savings", Sequence: 0},
+				{WalletId: "checking", Sequence: 3, Missing: true},
+			},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number or wallet does not exist",
+			expectedConflicts: []WalletConflictResponse{
+				{WalletId: wallet.DefaultWalletId, Sequence: 2},
+				{WalletId: "savings", Sequence: 0},
+				{WalletId: "checking", Sequence: 3, Missing: true},
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors, TestUserId: 37, TestWalletConflicts: tc.storeConflicts}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathPassword, bytes.NewBuffer([]byte(requestBody)))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.changePassword(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if want, got := expectedWallets, testStore.Called.ChangePasswordWithWallet.Wallets; !reflect.DeepEqual(want, got) {
+				t.Errorf("Store.ChangePasswordWithWallet called with wallets: expected %+v, got %+v", want, got)
+			}
+
+			if tc.expectedConflicts != nil {
+				var conflictResponse ChangePasswordConflictResponse
+				if err := json.Unmarshal(body, &conflictResponse); err != nil {
+					t.Fatalf("Error decoding conflict response %s: %+v", body, err)
+				}
+				if !reflect.DeepEqual(tc.expectedConflicts, conflictResponse.Conflicts) {
+					t.Errorf("Expected conflicts %+v, got %+v", tc.expectedConflicts, conflictResponse.Conflicts)
+				}
+			}
+		})
+	}
+}
@@ -5,17 +5,73 @@ const PathPrefix = "/api/" + ApiVersion
 
 const PathAuthToken = PathPrefix + "/auth/full"
 const PathWallet = PathPrefix + "/wallet"
+
+// Sequence, hmac and update time, without the wallet itself
+const PathWalletHead = PathPrefix + "/wallet/head"
+
+// For wallets too big for one request. Start an upload (or check on one),
+// send it in parts, then commit it as the new wallet.
+const PathWalletUpload = PathPrefix + "/wallet/upload"
+const PathWalletUploadPart = PathPrefix + "/wallet/upload/part"
+const PathWalletUploadCommit = PathPrefix + "/wallet/upload/commit"
+
+// A user's named wallets. List them or create one, and delete one.
+const PathWallets = PathPrefix + "/wallets"
+const PathWalletsDelete = PathPrefix + "/wallets/delete"
+
 const PathRegister = PathPrefix + "/signup"
 const PathPassword = PathPrefix + "/password"
 const PathVerify = PathPrefix + "/verify"
 const PathResendVerify = PathPrefix + "/verify/resend"
 const PathClientSaltSeed = PathPrefix + "/client-salt-seed"
 
+// Changing the account's email. The request goes to the first, and the link
+// in the email to the new address goes to the second.
+const PathEmail = PathPrefix + "/email"
+const PathEmailVerify = PathPrefix + "/email/verify"
+
+// Whether the user gets emails about their account, i.e. password changes
+const PathNotifications = PathPrefix + "/notifications"
+
 // Using such a generic name since, as I understand, we can do a bunch of
 // different stuff over this one websocket.
 const PathWebsocket = PathPrefix + "/websocket"
 
+// Fallbacks for clients whose proxies break websocket upgrades. They get the
+// same wallet update notifications as the websocket.
+const PathWalletEvents = PathPrefix + "/wallet/events"
+const PathWalletPoll = PathPrefix + "/wallet/poll"
+
+// Everything the server has about the user, for them to download
+const PathDataExport = PathPrefix + "/data-export"
+
+// Moving an account between servers. Export on the old server gives a signed
+// bundle, which import on the new server turns back into the account. Cancel
+// on the old server takes the account back if the import didn't work out.
+const PathMigrationExport = PathPrefix + "/migration/export"
+const PathMigrationImport = PathPrefix + "/migration/import"
+const PathMigrationCancel = PathPrefix + "/migration/cancel"
+
+// A user's own recent security events
+const PathAuditEvents = PathPrefix + "/audit-events"
+
+// Invite codes a user made, for InviteCode mode
+const PathInviteCodes = PathPrefix + "/invite-codes"
+
 const PathUnknownEndpoint = PathPrefix + "/"
 const PathWrongApiVersion = "/api/"
 
 const PathPrometheus = "/metrics"
+
+// For the server operator, not for clients, so also outside of the versioned
+// API. Needs ADMIN_TOKEN.
+const PathAdminAuditEvents = "/admin/audit-events"
+const PathAdminInviteCodes = "/admin/invite-codes"
+const PathAdminPendingAccounts = "/admin/pending-accounts"
+const PathAdminPendingAccountsApprove = "/admin/pending-accounts/approve"
+const PathAdminPendingAccountsReject = "/admin/pending-accounts/reject"
+
+// For load balancers and such. Outside of the versioned API since they have
+// nothing to do with the API version.
+const PathHealthz = "/healthz"
+const PathReadyz = "/readyz"
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often we throw out buckets for clients we haven't heard from in a while
+const rateLimitSweepInterval = time.Minute
+
+// Token bucket per client IP. Each client starts with `burst` tokens, each
+// request takes one, and they refill at `rate` per `per` up to `burst`.
+//
+// The key doesn't have to be an IP. See newAccountRateLimiter.
+type rateLimiter struct {
+	rate       int
+	per        time.Duration
+	burst      int
+	trustProxy bool
+
+	// For tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+}
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(perMinute int, burst int, trustProxy bool) *rateLimiter {
+	return &rateLimiter{
+		rate:       perMinute,
+		per:        time.Minute,
+		burst:      burst,
+		trustProxy: trustProxy,
+		now:        time.Now,
+		buckets:    make(map[string]*rateLimitBucket),
+		lastSweep:  time.Now(),
+	}
+}
+
+// For limits on things a user does rarely, keyed by user id rather than IP.
+// The bucket holds `perDay` tokens.
+func newAccountRateLimiter(perDay int) *rateLimiter {
+	return &rateLimiter{
+		rate:      perDay,
+		per:       time.Hour * 24,
+		burst:     perDay,
+		now:       time.Now,
+		buckets:   make(map[string]*rateLimitBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *rateLimiter) clientIP(req *http.Request) string {
+	return clientIP(req, l.trustProxy)
+}
+
+// The IP the request came from. Behind a reverse proxy that's the proxy, so if
+// we trust it, we take the last address in X-Forwarded-For, which is the one
+// the proxy added. (Any earlier ones came from the client, who could put
+// anything there.)
+func clientIP(req *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			addresses := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// i.e. a unix socket
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (l *rateLimiter) refillRate() float64 {
+	return float64(l.rate) / float64(l.per)
+}
+
+// Refill based on how long it's been since we last looked
+func (l *rateLimiter) refill(bucket *rateLimitBucket, now time.Time) {
+	bucket.tokens += float64(now.Sub(bucket.updated)) * l.refillRate()
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.updated = now
+}
+
+// If not allowed, also returns how long until the client can try again
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = bucket
+	}
+	l.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.refillRate())
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Give back the token that allow took, for a request that failed on our end
+// and so shouldn't count against the client
+func (l *rateLimiter) refund(key string) {
+	if l.rate == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		// Swept, so it's full anyway
+		return
+	}
+	bucket.tokens++
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+}
+
+// A full bucket is the same as no bucket, so we don't need to remember it.
+// Call with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -4,43 +4,68 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
 	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/mail"
 	"lbryio/wallet-sync-server/server/paths"
 	"lbryio/wallet-sync-server/store"
 	"lbryio/wallet-sync-server/wallet"
 )
 
-const maxBodySize = 100000
-
 // Message sent from the wallet POST request handler to the websocket manager,
 // indicating that a user's client should receive a (different) message that
 // their wallet has an update on the server.
 type walletUpdateMsg struct {
 	userId   auth.UserId
+	walletId wallet.WalletId
 	sequence wallet.Sequence
 }
 
 type Server struct {
+	// Number of clients connected across all socket manager shards. Accessed
+	// atomically. Kept first in the struct so it's 64-bit aligned on 32-bit
+	// platforms.
+	numClients int64
+
 	auth  auth.AuthInterface
 	store store.StoreInterface
 	env   env.EnvInterface
 	mail  mail.MailInterface
 	port  int
 
-	clientAdd     chan wsClientForUser
-	clientRemove  chan wsClientForUser
-	userRemove    chan wsClientForUser
-	walletUpdates chan walletUpdateMsg
+	shards []*socketShard
+
+	// Per user, not per IP. Lives as long as the server, unlike the per IP
+	// limiter made in Handler.
+	dataExportLimiter *rateLimiter
+
+	// Closed when the http server starts shutting down. Long-lived requests
+	// (event streams, long-polls) watch this so that they don't hold up
+	// server.Shutdown.
+	serverShutdown chan bool
+
+	// Set (atomically) to 1 once we've gotten a signal to shut down
+	draining int32
+
+	// Set (atomically) to 1 while the socket manager is running
+	socketsRunning int32
+
+	// Notification emails still being sent (see notify)
+	notifications sync.WaitGroup
 }
 
 func Init(
@@ -50,6 +75,13 @@ func Init(
 	mailInterface mail.MailInterface,
 	port int,
 ) *Server {
+	// Config errors are reported on startup, so this shouldn't happen
+	dataExportsPerDay, err := env.GetDataExportsPerDay(envInterface)
+	if err != nil {
+		logging.Error("Error getting data export limit, not limiting", logging.Err(err))
+		dataExportsPerDay = 0
+	}
+
 	return &Server{
 		auth:  authInterface,
 		store: storeInterface,
@@ -57,14 +89,11 @@ func Init(
 		mail:  mailInterface,
 		port:  port,
 
-		// Anything that could get backed up by a lot of requests, let's just
-		// give it a buffer. Starting small until we start to see dashboard
-		// stats on this. I want a sense of how this grows with the number of
-		// users or whatnot.
-		clientAdd:     make(chan wsClientForUser),
-		clientRemove:  make(chan wsClientForUser),
-		userRemove:    make(chan wsClientForUser, 5),
-		walletUpdates: make(chan walletUpdateMsg, 5),
+		shards: newSocketShards(socketManagerShards),
+
+		dataExportLimiter: newAccountRateLimiter(dataExportsPerDay),
+
+		serverShutdown: make(chan bool),
 	}
 }
 
@@ -87,17 +116,18 @@ func errorJson(w http.ResponseWriter, code int, extra string) {
 }
 
 // Don't report any details to the user. Log it instead.
-func internalServiceErrorJson(w http.ResponseWriter, serverErr error, errContext string) {
+func internalServiceErrorJson(w http.ResponseWriter, req *http.Request, serverErr error, errContext string) {
+	logger := logging.FromContext(req.Context())
 	errorStr := http.StatusText(http.StatusInternalServerError)
 	authErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr})
 	if err != nil {
 		// In case something really stupid happens
 		http.Error(w, `{"error": "error when JSON-encoding error message"}`, http.StatusInternalServerError)
-		log.Printf("error when JSON-encoding error message")
+		logger.Error("error when JSON-encoding error message")
 		return
 	}
 	http.Error(w, string(authErrorJson), http.StatusInternalServerError)
-	log.Printf("%s: %+v\n", errContext, serverErr)
+	logger.Error(errContext, logging.Err(serverErr))
 
 	return
 }
@@ -130,17 +160,23 @@ func getPostData(w http.ResponseWriter, req *http.Request, reqStruct PostRequest
 		return false
 	}
 
-	// Make the limit 100k. Increase from there as needed. I'd rather block some
-	// people's large wallets and increase the limit than OOM for everybody and
-	// decrease the limit.
-	req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
-	decoder := json.NewDecoder(req.Body)
+	body, err := requestBody(w, req, bodyLimit(req))
+	if err == compression.ErrUnsupportedEncoding {
+		errorJson(w, http.StatusUnsupportedMediaType, "Content-Encoding should be gzip or zstd, or none")
+		return false
+	} else if err != nil {
+		errorJson(w, http.StatusBadRequest, "Error decompressing request body")
+		return false
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
 	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&reqStruct)
+	err = decoder.Decode(&reqStruct)
 	switch {
 	case err == nil:
 		break
-	case err.Error() == "http: request body too large":
+	case err.Error() == "http: request body too large", err == errDecompressedBodyTooLarge:
 		errorJson(w, http.StatusRequestEntityTooLarge, "")
 		return false
 	case strings.HasPrefix(err.Error(), "json: unknown field"):
@@ -175,6 +211,7 @@ func getGetData(w http.ResponseWriter, req *http.Request) bool {
 // deviceId.
 func (s *Server) checkAuth(
 	w http.ResponseWriter,
+	req *http.Request,
 	token auth.AuthTokenString,
 	scope auth.AuthScope,
 ) *auth.AuthToken {
@@ -184,7 +221,7 @@ func (s *Server) checkAuth(
 		return nil
 	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting Token")
+		internalServiceErrorJson(w, req, err, "Error getting Token")
 		return nil
 	}
 
@@ -212,6 +249,19 @@ func getTokenParam(req *http.Request) (token auth.AuthTokenString, err error) {
 	return
 }
 
+// Optional. Clients that don't name a wallet get the default one.
+func getWalletIdParam(req *http.Request) (walletId wallet.WalletId, err error) {
+	walletIdStr := req.URL.Query().Get("walletId")
+	if walletIdStr == "" {
+		return wallet.DefaultWalletId, nil
+	}
+	walletId = wallet.WalletId(walletIdStr)
+	if !walletId.Validate() {
+		err = fmt.Errorf("Invalid walletId parameter")
+	}
+	return
+}
+
 // TODO - both wallet and token requests should be PUT, not POST.
 // PUT = "...creates a new resource or replaces a representation of the target resource with the request payload."
 
@@ -225,30 +275,177 @@ func (s *Server) wrongApiVersion(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func serve(server *http.Server, done chan bool) {
-	log.Print("Server start")
-	server.ListenAndServe()
-	log.Print("Server finish")
+// Set right before the server starts shutting down, so that health checks can
+// tell load balancers to stop sending us requests, and so that new sockets can
+// be told to go somewhere else.
+func (s *Server) setDraining() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func serve(server *http.Server, listener net.Listener, done chan bool) {
+	logging.Info("Server start", logging.F("network", listener.Addr().Network()), logging.F("address", listener.Addr().String()))
+	if server.TLSConfig != nil {
+		// Certificates come from TLSConfig
+		server.ServeTLS(listener, "", "")
+	} else {
+		server.Serve(listener)
+	}
+	logging.Info("Server finish", logging.F("network", listener.Addr().Network()), logging.F("address", listener.Addr().String()))
 
 	done <- true
 }
 
-func (s *Server) Serve() {
-	http.HandleFunc(paths.PathAuthToken, s.getAuthToken)
-	http.HandleFunc(paths.PathWallet, s.handleWallet)
-	http.HandleFunc(paths.PathRegister, s.register)
-	http.HandleFunc(paths.PathPassword, s.changePassword)
-	http.HandleFunc(paths.PathVerify, s.verify)
-	http.HandleFunc(paths.PathResendVerify, s.resendVerifyEmail)
-	http.HandleFunc(paths.PathClientSaltSeed, s.getClientSaltSeed)
-	http.HandleFunc(paths.PathWebsocket, s.websocket)
+// Reload the TLS certificate whenever we get SIGHUP
+func reloadCertsOnHangup(reloader *certReloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloader.reload(); err != nil {
+			logging.Error("Keeping the old TLS certificate", logging.Err(err))
+		} else {
+			logging.Info("Reloaded TLS certificate")
+		}
+	}
+}
+
+type route struct {
+	path    string
+	handler http.Handler
+
+	// For metrics
+	name string
+
+	// Health checks and metrics scraping come from our own infrastructure, so
+	// we don't rate limit them.
+	rateLimited bool
+}
+
+func (s *Server) routes() []route {
+	return []route{
+		{paths.PathAuthToken, http.HandlerFunc(s.getAuthToken), "auth-token", true},
+		{paths.PathWallet, http.HandlerFunc(s.handleWallet), "wallet", true},
+		{paths.PathWalletHead, http.HandlerFunc(s.getWalletHead), "wallet-head", true},
+		{paths.PathWalletUpload, http.HandlerFunc(s.handleWalletUpload), "wallet-upload", true},
+		{paths.PathWalletUploadPart, http.HandlerFunc(s.postWalletUploadPart), "wallet-upload-part", true},
+		{paths.PathWalletUploadCommit, http.HandlerFunc(s.postWalletUploadCommit), "wallet-upload-commit", true},
+		{paths.PathWallets, http.HandlerFunc(s.handleWallets), "wallets", true},
+		{paths.PathWalletsDelete, http.HandlerFunc(s.postWalletsDelete), "wallets-delete", true},
+		{paths.PathRegister, http.HandlerFunc(s.register), "register", true},
+		{paths.PathPassword, http.HandlerFunc(s.changePassword), "password", true},
+		{paths.PathVerify, http.HandlerFunc(s.verify), "verify", true},
+		{paths.PathResendVerify, http.HandlerFunc(s.resendVerifyEmail), "resend-verify", true},
+		{paths.PathClientSaltSeed, http.HandlerFunc(s.getClientSaltSeed), "client-salt-seed", true},
+		{paths.PathEmail, http.HandlerFunc(s.changeEmail), "email", true},
+		{paths.PathEmailVerify, http.HandlerFunc(s.verifyEmailChange), "email-verify", true},
+		{paths.PathNotifications, http.HandlerFunc(s.handleNotifications), "notifications", true},
+		{paths.PathWebsocket, http.HandlerFunc(s.websocket), "websocket", true},
+		{paths.PathWalletEvents, http.HandlerFunc(s.walletEvents), "wallet-events", true},
+		{paths.PathWalletPoll, http.HandlerFunc(s.walletPoll), "wallet-poll", true},
+		{paths.PathAuditEvents, http.HandlerFunc(s.getAuditEvents), "audit-events", true},
+		{paths.PathInviteCodes, http.HandlerFunc(s.handleInviteCodes), "invite-codes", true},
+		{paths.PathDataExport, http.HandlerFunc(s.getDataExport), "data-export", true},
+		{paths.PathMigrationExport, http.HandlerFunc(s.postMigrationExport), "migration-export", true},
+		{paths.PathMigrationImport, http.HandlerFunc(s.postMigrationImport), "migration-import", true},
+		{paths.PathMigrationCancel, http.HandlerFunc(s.postMigrationCancel), "migration-cancel", true},
+
+		{paths.PathUnknownEndpoint, http.HandlerFunc(s.unknownEndpoint), "unknown-endpoint", true},
+		{paths.PathWrongApiVersion, http.HandlerFunc(s.wrongApiVersion), "wrong-api-version", true},
+
+		{paths.PathPrometheus, promhttp.Handler(), "prometheus", false},
+
+		// Rate limited to slow down anyone guessing the admin token
+		{paths.PathAdminAuditEvents, http.HandlerFunc(s.exportAuditEvents), "admin-audit-events", true},
+		{paths.PathAdminInviteCodes, http.HandlerFunc(s.handleAdminInviteCodes), "admin-invite-codes", true},
+		{paths.PathAdminPendingAccounts, http.HandlerFunc(s.getPendingAccounts), "admin-pending-accounts", true},
+		{paths.PathAdminPendingAccountsApprove, http.HandlerFunc(s.approveAccount), "admin-pending-accounts-approve", true},
+		{paths.PathAdminPendingAccountsReject, http.HandlerFunc(s.rejectAccount), "admin-pending-accounts-reject", true},
+
+		{paths.PathHealthz, http.HandlerFunc(s.healthz), "healthz", false},
+		{paths.PathReadyz, http.HandlerFunc(s.readyz), "readyz", false},
+	}
+}
 
-	http.HandleFunc(paths.PathUnknownEndpoint, s.unknownEndpoint)
-	http.HandleFunc(paths.PathWrongApiVersion, s.wrongApiVersion)
+// Every endpoint, behind the middleware. Each call makes a fresh mux (and rate
+// limiter), so tests can have as many as they like.
+func (s *Server) Handler() http.Handler {
+	// Config errors are reported on startup, so these shouldn't happen. But if
+	// they do, we'd rather serve without rate limits or CORS than not at all.
+	perMinute, burst, trustProxy, err := env.GetRateLimitConfigs(s.env)
+	if err != nil {
+		logging.Error("Error getting rate limit configs, not rate limiting", logging.Err(err))
+		perMinute = 0
+	}
+	limiter := newRateLimiter(perMinute, burst, trustProxy)
+
+	allowedOrigins, err := env.GetCORSAllowedOrigins(s.env)
+	if err != nil {
+		logging.Error("Error getting CORS allowed origins, not allowing any", logging.Err(err))
+		allowedOrigins = []string{}
+	}
+
+	defaultBodyLimit, bodyLimits, err := env.GetMaxBodySizes(s.env)
+	if err != nil {
+		logging.Error("Error getting max body sizes, using the default", logging.Err(err))
+		defaultBodyLimit, bodyLimits = env.DefaultMaxBodySize, map[string]int64{}
+	}
 
-	http.Handle(paths.PathPrometheus, promhttp.Handler())
+	mux := http.NewServeMux()
+	for _, r := range s.routes() {
+		limit, ok := bodyLimits[r.name]
+		if !ok {
+			limit = defaultBodyLimit
+		}
+		delete(bodyLimits, r.name)
+
+		middlewares := []middleware{
+			withRequestId,
+			withLogging,
+			withMetrics(r.name),
+			withRecovery,
+			withCORS(allowedOrigins),
+			withBodyLimit(limit),
+		}
+		if r.rateLimited {
+			middlewares = append(middlewares, withRateLimit(limiter))
+		}
+		mux.Handle(r.path, chain(r.handler, middlewares...))
+	}
 
-	log.Printf("Serving at localhost:%d\n", s.port)
+	// Whatever's left didn't match an endpoint. Probably a typo.
+	for name := range bodyLimits {
+		logging.Warn("Max body size given for an unknown endpoint", logging.F("endpoint", name))
+	}
+	return mux
+}
+
+func (s *Server) Serve() {
+	// Config errors are reported on startup, so this shouldn't happen.
+	addresses, err := env.GetListenAddresses(s.env, s.port)
+	if err != nil {
+		logging.Fatal("Error getting listen addresses", logging.Err(err))
+	}
+	tlsConfig, certReloader, err := tlsConfig(s.env)
+	if err != nil {
+		logging.Fatal("Error setting up TLS", logging.Err(err))
+	}
+	if certReloader != nil {
+		go reloadCertsOnHangup(certReloader)
+	}
+
+	// Listen on everything before we start serving anything, so that a bad
+	// address doesn't leave us half up.
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listen(address)
+		if err != nil {
+			logging.Fatal("Error listening", logging.Err(err))
+		}
+		listeners = append(listeners, listener)
+	}
 
 	// Signal *to* socket manager that it should finish (we use server.Shutdown
 	// to tell the server to finish)
@@ -260,21 +457,61 @@ func (s *Server) Serve() {
 
 	go s.manageSockets(socketsDone, socketsFinish)
 
-	server := http.Server{Addr: fmt.Sprintf("localhost:%d", s.port)}
-	go serve(&server, serverDone)
+	statsFinish := make(chan bool)
+	statsDone := make(chan bool)
+	go s.collectStats(statsDone, statsFinish)
+
+	garbageFinish := make(chan bool)
+	garbageDone := make(chan bool)
+	go s.collectGarbage(garbageDone, garbageFinish)
+
+	server := http.Server{Handler: s.Handler(), TLSConfig: tlsConfig, ErrorLog: logging.NewStdLogger(logging.LevelWarn)}
 
-	// Make sure that both the server and the websocket manager close properly on interrupt
+	// Unlike websockets, which are hijacked and thus ignored by Shutdown, event
+	// streams and long-polls are regular requests. Shutdown would wait on them
+	// forever, so we tell them to wrap up.
+	server.RegisterOnShutdown(func() { close(s.serverShutdown) })
+	for _, listener := range listeners {
+		go serve(&server, listener, serverDone)
+	}
+
+	// Config errors are reported on startup, so this shouldn't happen. But if it
+	// does, the defaults are better than not shutting down properly.
+	readinessDelay, drainTimeout, err := env.GetShutdownConfigs(s.env)
+	if err != nil {
+		logging.Error("Error getting shutdown configs, using defaults", logging.Err(err))
+		readinessDelay, drainTimeout = 0, env.DefaultShutdownDrainTimeout
+	}
+
+	// Make sure that both the server and the websocket manager close properly
+	// on interrupt, or on SIGTERM (which is what systemd sends)
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	// Wait for the interrupt signal
-	<-interrupt
+	sig := <-interrupt
+	logging.Info("Got signal", logging.F("signal", sig))
+
+	s.setDraining()
+	if readinessDelay > 0 {
+		logging.Info("Reporting not ready before draining", logging.F("delay", readinessDelay))
+		time.Sleep(readinessDelay)
+	}
 
 	// Tell the server to finish and wait for it to do so. We want it to finish
 	// to guarantee no more incoming sockets before we turn off the socket
-	// manager.
-	server.Shutdown(context.Background())
-	<-serverDone
+	// manager. If requests are still going after the drain timeout, cut them
+	// off.
+	logging.Info("Draining requests", logging.F("timeout", drainTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Warn("Requests did not drain in time, closing them", logging.Err(err))
+		server.Close()
+	}
+	for range listeners {
+		<-serverDone
+	}
 
 	// The socket manager's cleanup procedure assumes that there will be no new
 	// socket connections. Now that the server is done, no new socket
@@ -282,5 +519,14 @@ func (s *Server) Serve() {
 	socketsFinish <- true
 	<-socketsDone
 
-	log.Printf("All done")
+	statsFinish <- true
+	<-statsDone
+
+	garbageFinish <- true
+	<-garbageDone
+
+	// Mailgun sends time out, so this doesn't take long
+	s.notifications.Wait()
+
+	logging.Info("All done")
 }
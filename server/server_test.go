@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -22,20 +23,70 @@ const TestPort = 8090
 // Implementing interfaces for stubbed out packages
 
 type SendVerificationEmailCall struct {
-	Email auth.Email
-	Token auth.VerifyTokenString
+	Email  auth.Email
+	Token  auth.VerifyTokenString
+	Locale auth.Locale
+}
+
+type SendEmailChangeNotificationCall struct {
+	OldEmail auth.Email
+	NewEmail auth.Email
+	Locale   auth.Locale
+}
+
+type SendNewDeviceNotificationCall struct {
+	Email    auth.Email
+	DeviceId auth.DeviceId
+	Locale   auth.Locale
 }
 
 type TestMail struct {
 	SendVerificationEmailError error
 	SendVerificationEmailCall  *SendVerificationEmailCall
+
+	SendEmailChangeVerificationError error
+	SendEmailChangeVerificationCall  *SendVerificationEmailCall
+
+	SendEmailChangeNotificationError error
+	SendEmailChangeNotificationCall  *SendEmailChangeNotificationCall
+
+	// Who each notification went to
+	SendPasswordChangedNotificationCall *auth.Email
+	SendNewDeviceNotificationCall       *SendNewDeviceNotificationCall
+	SendAccountApprovedNotificationCall *auth.Email
+	SendNotificationError               error
 }
 
-func (m *TestMail) SendVerificationEmail(email auth.Email, token auth.VerifyTokenString) error {
-	m.SendVerificationEmailCall = &SendVerificationEmailCall{email, token}
+func (m *TestMail) SendVerificationEmail(email auth.Email, token auth.VerifyTokenString, locale auth.Locale) error {
+	m.SendVerificationEmailCall = &SendVerificationEmailCall{email, token, locale}
 	return m.SendVerificationEmailError
 }
 
+func (m *TestMail) SendEmailChangeVerification(newEmail auth.Email, token auth.VerifyTokenString, locale auth.Locale) error {
+	m.SendEmailChangeVerificationCall = &SendVerificationEmailCall{newEmail, token, locale}
+	return m.SendEmailChangeVerificationError
+}
+
+func (m *TestMail) SendEmailChangeNotification(oldEmail auth.Email, newEmail auth.Email, locale auth.Locale) error {
+	m.SendEmailChangeNotificationCall = &SendEmailChangeNotificationCall{oldEmail, newEmail, locale}
+	return m.SendEmailChangeNotificationError
+}
+
+func (m *TestMail) SendPasswordChangedNotification(email auth.Email, locale auth.Locale) error {
+	m.SendPasswordChangedNotificationCall = &email
+	return m.SendNotificationError
+}
+
+func (m *TestMail) SendNewDeviceNotification(email auth.Email, deviceId auth.DeviceId, locale auth.Locale) error {
+	m.SendNewDeviceNotificationCall = &SendNewDeviceNotificationCall{email, deviceId, locale}
+	return m.SendNotificationError
+}
+
+func (m *TestMail) SendAccountApprovedNotification(email auth.Email, locale auth.Locale) error {
+	m.SendAccountApprovedNotificationCall = &email
+	return m.SendNotificationError
+}
+
 type TestEnv struct {
 	env map[string]string
 }
@@ -47,6 +98,7 @@ func (e *TestEnv) Getenv(key string) string {
 type TestAuth struct {
 	TestNewAuthTokenString   auth.AuthTokenString
 	TestNewVerifyTokenString auth.VerifyTokenString
+	TestNewInviteCode        auth.InviteCode
 	FailGenToken             bool
 }
 
@@ -64,12 +116,53 @@ func (a *TestAuth) NewVerifyTokenString() (auth.VerifyTokenString, error) {
 	return a.TestNewVerifyTokenString, nil
 }
 
+func (a *TestAuth) NewInviteCode() (auth.InviteCode, error) {
+	if a.FailGenToken {
+		return "", fmt.Errorf("Test error: fail to generate token")
+	}
+	return a.TestNewInviteCode, nil
+}
+
 type SetWalletCall struct {
+	WalletId        wallet.WalletId
 	EncryptedWallet wallet.EncryptedWallet
 	Sequence        wallet.Sequence
 	Hmac            wallet.WalletHmac
 }
 
+type CreateAccountWithInviteCodeCall struct {
+	Email          auth.Email
+	Password       auth.Password
+	ClientSaltSeed auth.ClientSaltSeed
+	Locale         auth.Locale
+	InviteCode     auth.InviteCode
+}
+
+type CreateInviteCodeCall struct {
+	Code      auth.InviteCode
+	MaxUses   int
+	CreatedBy auth.UserId
+	Quota     int
+}
+
+type CreatePendingAccountCall struct {
+	Email          auth.Email
+	Password       auth.Password
+	ClientSaltSeed auth.ClientSaltSeed
+	VerifyToken    auth.VerifyTokenString
+	Locale         auth.Locale
+}
+
+type StartEmailChangeCall struct {
+	UserId         auth.UserId
+	Password       auth.Password
+	NewEmail       auth.Email
+	NewPassword    auth.Password
+	ClientSaltSeed auth.ClientSaltSeed
+	Wallets        []store.WalletUpdate
+	Token          auth.VerifyTokenString
+}
+
 type ChangePasswordNoWalletCall struct {
 	Email          auth.Email
 	OldPassword    auth.Password
@@ -78,13 +171,22 @@ type ChangePasswordNoWalletCall struct {
 }
 
 type ChangePasswordWithWalletCall struct {
+	Wallets        []store.WalletUpdate
+	Email          auth.Email
+	OldPassword    auth.Password
+	NewPassword    auth.Password
+	ClientSaltSeed auth.ClientSaltSeed
+}
+
+type CreateWalletCall struct {
+	WalletId        wallet.WalletId
 	EncryptedWallet wallet.EncryptedWallet
-	Sequence        wallet.Sequence
 	Hmac            wallet.WalletHmac
-	Email           auth.Email
-	OldPassword     auth.Password
-	NewPassword     auth.Password
-	ClientSaltSeed  auth.ClientSaltSeed
+}
+
+type DeleteWalletCall struct {
+	WalletId wallet.WalletId
+	Sequence wallet.Sequence
 }
 
 type CreateAccountCall struct {
@@ -92,35 +194,128 @@ type CreateAccountCall struct {
 	Password       auth.Password
 	ClientSaltSeed auth.ClientSaltSeed
 	VerifyToken    *auth.VerifyTokenString
+	Locale         auth.Locale
+}
+
+type SaveUploadPartCall struct {
+	UploadId store.UploadId
+	Part     int
+	Data     string
+	MaxSize  int64
+}
+
+type CommitUploadCall struct {
+	UploadId store.UploadId
+	NumParts int
+	WalletId wallet.WalletId
+	Sequence wallet.Sequence
+	Hmac     wallet.WalletHmac
+}
+
+type ImportAccountCall struct {
+	Email          auth.Email
+	Password       auth.Password
+	ClientSaltSeed auth.ClientSaltSeed
+	Wallets        []store.WalletUpdate
+}
+
+// Email is only set for AddAuditEventForEmail
+type AuditEventCall struct {
+	Email auth.Email
+	Event store.AuditEvent
 }
 
 // Whether functions are called, and sometimes what they're called with
 type TestStoreFunctionsCalled struct {
-	SaveToken                auth.AuthTokenString
-	GetToken                 auth.AuthTokenString
-	GetUserId                bool
-	CreateAccount            *CreateAccountCall
-	UpdateVerifyTokenString  bool
-	VerifyAccount            bool
-	SetWallet                SetWalletCall
-	GetWallet                bool
-	ChangePasswordWithWallet ChangePasswordWithWalletCall
-	ChangePasswordNoWallet   ChangePasswordNoWalletCall
-	GetClientSaltSeed        auth.Email
+	SaveToken                   auth.AuthTokenString
+	GetToken                    auth.AuthTokenString
+	GetUserId                   bool
+	CreateAccount               *CreateAccountCall
+	UpdateVerifyTokenString     bool
+	VerifyAccount               bool
+	SetWallet                   SetWalletCall
+	GetWallet                   wallet.WalletId
+	GetWalletHead               wallet.WalletId
+	ListWallets                 bool
+	CreateWallet                *CreateWalletCall
+	DeleteWallet                *DeleteWalletCall
+	ChangePasswordWithWallet    ChangePasswordWithWalletCall
+	ChangePasswordNoWallet      ChangePasswordNoWalletCall
+	GetClientSaltSeed           auth.Email
+	StartEmailChange            *StartEmailChangeCall
+	ConfirmEmailChange          auth.VerifyTokenString
+	AuditEvents                 []AuditEventCall
+	GetAuditEvents              auth.UserId
+	ExportAuditEvents           *time.Time
+	CreateUpload                bool
+	SaveUploadPart              *SaveUploadPartCall
+	GetUploadParts              store.UploadId
+	CommitUpload                *CommitUploadCall
+	DeleteExpiredUploads        bool
+	DeleteUnreferencedBlobs     bool
+	ExportAccount               *string
+	ImportAccount               *ImportAccountCall
+	GetMigratedTo               auth.Email
+	CancelMigration             auth.Email
+	GetAccountInfo              bool
+	GetDataExport               bool
+	IsNewDevice                 auth.DeviceId
+	SetNotificationsOff         *bool
+	CreateAccountWithInviteCode *CreateAccountWithInviteCodeCall
+	CreateInviteCode            *CreateInviteCodeCall
+	GetInviteCodes              *auth.UserId
+	CreatePendingAccount        *CreatePendingAccountCall
+	GetPendingAccounts          bool
+	ApproveAccount              auth.UserId
+	RejectAccount               auth.UserId
 }
 
 type TestStoreFunctionsErrors struct {
-	SaveToken                error
-	GetToken                 error
-	GetUserId                error
-	CreateAccount            error
-	UpdateVerifyTokenString  error
-	VerifyAccount            error
-	SetWallet                error
-	GetWallet                error
-	ChangePasswordWithWallet error
-	ChangePasswordNoWallet   error
-	GetClientSaltSeed        error
+	SaveToken                   error
+	GetToken                    error
+	GetUserId                   error
+	CreateAccount               error
+	UpdateVerifyTokenString     error
+	VerifyAccount               error
+	SetWallet                   error
+	GetWallet                   error
+	GetWalletHead               error
+	ListWallets                 error
+	CreateWallet                error
+	DeleteWallet                error
+	ChangePasswordWithWallet    error
+	ChangePasswordNoWallet      error
+	GetClientSaltSeed           error
+	StartEmailChange            error
+	ConfirmEmailChange          error
+	Ping                        error
+	SchemaVersion               error
+	GetStats                    error
+	AddAuditEvent               error
+	AddAuditEventForEmail       error
+	GetAuditEvents              error
+	ExportAuditEvents           error
+	CreateUpload                error
+	SaveUploadPart              error
+	GetUploadParts              error
+	CommitUpload                error
+	DeleteExpiredUploads        error
+	DeleteUnreferencedBlobs     error
+	ExportAccount               error
+	ImportAccount               error
+	GetMigratedTo               error
+	CancelMigration             error
+	GetAccountInfo              error
+	GetDataExport               error
+	IsNewDevice                 error
+	SetNotificationsOff         error
+	CreateAccountWithInviteCode error
+	CreateInviteCode            error
+	GetInviteCodes              error
+	CreatePendingAccount        error
+	GetPendingAccounts          error
+	ApproveAccount              error
+	RejectAccount               error
 }
 
 type TestStore struct {
@@ -137,8 +332,38 @@ type TestStore struct {
 	TestEncryptedWallet wallet.EncryptedWallet
 	TestSequence        wallet.Sequence
 	TestHmac            wallet.WalletHmac
+	TestUpdated         time.Time
+
+	TestWalletHeads     []store.WalletHead
+	TestWalletConflicts []store.WalletConflict
 
 	TestClientSaltSeed auth.ClientSaltSeed
+	TestKey            auth.KDFKey
+	TestServerSalt     auth.ServerSalt
+
+	TestSchemaVersion int
+
+	TestStats store.Stats
+
+	TestAuditEvents []store.AuditEvent
+
+	TestUploadId         store.UploadId
+	TestUploadExpiration time.Time
+	TestUploadParts      []int
+
+	TestEmail         auth.Email
+	TestLocale        auth.Locale
+	TestWalletUpdates []store.WalletUpdate
+	TestMigratedTo    string
+
+	TestAccountInfo store.AccountInfo
+	TestDataExport  store.DataExport
+	TestNewDevice   bool
+
+	TestInviteCodes       []store.InviteCode
+	TestInviteCodeCreated time.Time
+
+	TestPendingAccounts []store.PendingAccount
 }
 
 func (s *TestStore) SaveToken(authToken *auth.AuthToken) error {
@@ -156,38 +381,40 @@ func (s *TestStore) GetUserId(auth.Email, auth.Password) (auth.UserId, error) {
 	return 0, s.Errors.GetUserId
 }
 
-func (s *TestStore) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) error {
+func (s *TestStore) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString, locale auth.Locale) error {
 	s.Called.CreateAccount = &CreateAccountCall{
 		Email:          email,
 		Password:       password,
 		ClientSaltSeed: seed,
 		VerifyToken:    verifyToken,
+		Locale:         locale,
 	}
 	return s.Errors.CreateAccount
 }
 
-func (s *TestStore) UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) (err error) {
+func (s *TestStore) UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) (auth.Locale, error) {
 	s.Called.UpdateVerifyTokenString = true
-	return s.Errors.UpdateVerifyTokenString
+	return s.TestLocale, s.Errors.UpdateVerifyTokenString
 }
 
-func (s *TestStore) VerifyAccount(auth.VerifyTokenString) (err error) {
+func (s *TestStore) VerifyAccount(auth.VerifyTokenString) (auth.UserId, error) {
 	s.Called.VerifyAccount = true
-	return s.Errors.VerifyAccount
+	return s.TestUserId, s.Errors.VerifyAccount
 }
 
 func (s *TestStore) SetWallet(
 	UserId auth.UserId,
+	walletId wallet.WalletId,
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
 ) (err error) {
-	s.Called.SetWallet = SetWalletCall{encryptedWallet, sequence, hmac}
+	s.Called.SetWallet = SetWalletCall{walletId, encryptedWallet, sequence, hmac}
 	return s.Errors.SetWallet
 }
 
-func (s *TestStore) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
-	s.Called.GetWallet = true
+func (s *TestStore) GetWallet(userId auth.UserId, walletId wallet.WalletId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+	s.Called.GetWallet = walletId
 	err = s.Errors.GetWallet
 	if err == nil {
 		encryptedWallet = s.TestEncryptedWallet
@@ -197,25 +424,47 @@ func (s *TestStore) GetWallet(userId auth.UserId) (encryptedWallet wallet.Encryp
 	return
 }
 
+func (s *TestStore) GetWalletHead(userId auth.UserId, walletId wallet.WalletId) (sequence wallet.Sequence, hmac wallet.WalletHmac, updated time.Time, err error) {
+	s.Called.GetWalletHead = walletId
+	err = s.Errors.GetWalletHead
+	if err == nil {
+		sequence = s.TestSequence
+		hmac = s.TestHmac
+		updated = s.TestUpdated
+	}
+	return
+}
+
+func (s *TestStore) ListWallets(userId auth.UserId) ([]store.WalletHead, error) {
+	s.Called.ListWallets = true
+	return s.TestWalletHeads, s.Errors.ListWallets
+}
+
+func (s *TestStore) CreateWallet(userId auth.UserId, walletId wallet.WalletId, encryptedWallet wallet.EncryptedWallet, hmac wallet.WalletHmac) error {
+	s.Called.CreateWallet = &CreateWalletCall{walletId, encryptedWallet, hmac}
+	return s.Errors.CreateWallet
+}
+
+func (s *TestStore) DeleteWallet(userId auth.UserId, walletId wallet.WalletId, sequence wallet.Sequence) error {
+	s.Called.DeleteWallet = &DeleteWalletCall{walletId, sequence}
+	return s.Errors.DeleteWallet
+}
+
 func (s *TestStore) ChangePasswordWithWallet(
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
-	encryptedWallet wallet.EncryptedWallet,
-	sequence wallet.Sequence,
-	hmac wallet.WalletHmac,
-) (auth.UserId, error) {
+	wallets []store.WalletUpdate,
+) (auth.UserId, []store.WalletConflict, error) {
 	s.Called.ChangePasswordWithWallet = ChangePasswordWithWalletCall{
-		EncryptedWallet: encryptedWallet,
-		Sequence:        sequence,
-		Hmac:            hmac,
-		Email:           email,
-		OldPassword:     oldPassword,
-		NewPassword:     newPassword,
-		ClientSaltSeed:  clientSaltSeed,
+		Wallets:        wallets,
+		Email:          email,
+		OldPassword:    oldPassword,
+		NewPassword:    newPassword,
+		ClientSaltSeed: clientSaltSeed,
 	}
-	return s.TestUserId, s.Errors.ChangePasswordWithWallet
+	return s.TestUserId, s.TestWalletConflicts, s.Errors.ChangePasswordWithWallet
 }
 
 func (s *TestStore) ChangePasswordNoWallet(
@@ -242,6 +491,198 @@ func (s *TestStore) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSee
 	return
 }
 
+func (s *TestStore) StartEmailChange(
+	userId auth.UserId,
+	password auth.Password,
+	newEmail auth.Email,
+	newPassword auth.Password,
+	clientSaltSeed auth.ClientSaltSeed,
+	wallets []store.WalletUpdate,
+	token auth.VerifyTokenString,
+) (oldEmail auth.Email, locale auth.Locale, err error) {
+	s.Called.StartEmailChange = &StartEmailChangeCall{
+		UserId:         userId,
+		Password:       password,
+		NewEmail:       newEmail,
+		NewPassword:    newPassword,
+		ClientSaltSeed: clientSaltSeed,
+		Wallets:        wallets,
+		Token:          token,
+	}
+	err = s.Errors.StartEmailChange
+	if err == nil {
+		oldEmail, locale = s.TestEmail, s.TestLocale
+	}
+	return
+}
+
+func (s *TestStore) ConfirmEmailChange(token auth.VerifyTokenString) (userId auth.UserId, oldEmail auth.Email, newEmail auth.Email, err error) {
+	s.Called.ConfirmEmailChange = token
+	err = s.Errors.ConfirmEmailChange
+	if err == nil {
+		userId, oldEmail = s.TestUserId, s.TestEmail
+	}
+	return
+}
+
+func (s *TestStore) Ping() error {
+	return s.Errors.Ping
+}
+
+func (s *TestStore) SchemaVersion() (int, error) {
+	return s.TestSchemaVersion, s.Errors.SchemaVersion
+}
+
+func (s *TestStore) GetStats() (store.Stats, error) {
+	return s.TestStats, s.Errors.GetStats
+}
+
+func (s *TestStore) AddAuditEvent(event store.AuditEvent) error {
+	s.Called.AuditEvents = append(s.Called.AuditEvents, AuditEventCall{Event: event})
+	return s.Errors.AddAuditEvent
+}
+
+func (s *TestStore) AddAuditEventForEmail(email auth.Email, event store.AuditEvent) error {
+	s.Called.AuditEvents = append(s.Called.AuditEvents, AuditEventCall{Email: email, Event: event})
+	return s.Errors.AddAuditEventForEmail
+}
+
+func (s *TestStore) GetAuditEvents(userId auth.UserId, limit int) ([]store.AuditEvent, error) {
+	s.Called.GetAuditEvents = userId
+	return s.TestAuditEvents, s.Errors.GetAuditEvents
+}
+
+func (s *TestStore) ExportAuditEvents(since time.Time, fn func(store.AuditEvent) error) error {
+	s.Called.ExportAuditEvents = &since
+	if s.Errors.ExportAuditEvents != nil {
+		return s.Errors.ExportAuditEvents
+	}
+	for _, event := range s.TestAuditEvents {
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TestStore) CreateUpload(userId auth.UserId) (store.UploadId, time.Time, error) {
+	s.Called.CreateUpload = true
+	return s.TestUploadId, s.TestUploadExpiration, s.Errors.CreateUpload
+}
+
+func (s *TestStore) SaveUploadPart(userId auth.UserId, uploadId store.UploadId, part int, data string, maxSize int64) error {
+	s.Called.SaveUploadPart = &SaveUploadPartCall{uploadId, part, data, maxSize}
+	return s.Errors.SaveUploadPart
+}
+
+func (s *TestStore) GetUploadParts(userId auth.UserId, uploadId store.UploadId) ([]int, time.Time, error) {
+	s.Called.GetUploadParts = uploadId
+	return s.TestUploadParts, s.TestUploadExpiration, s.Errors.GetUploadParts
+}
+
+func (s *TestStore) CommitUpload(userId auth.UserId, uploadId store.UploadId, numParts int, walletId wallet.WalletId, sequence wallet.Sequence, hmac wallet.WalletHmac) error {
+	s.Called.CommitUpload = &CommitUploadCall{uploadId, numParts, walletId, sequence, hmac}
+	return s.Errors.CommitUpload
+}
+
+func (s *TestStore) DeleteExpiredUploads() (int64, error) {
+	s.Called.DeleteExpiredUploads = true
+	return 0, s.Errors.DeleteExpiredUploads
+}
+
+func (s *TestStore) DeleteUnreferencedBlobs() (int64, error) {
+	s.Called.DeleteUnreferencedBlobs = true
+	return 0, s.Errors.DeleteUnreferencedBlobs
+}
+
+func (s *TestStore) ExportAccount(userId auth.UserId, password auth.Password, migratedTo string) (auth.Email, auth.ClientSaltSeed, auth.KDFKey, auth.ServerSalt, []store.WalletUpdate, error) {
+	s.Called.ExportAccount = &migratedTo
+	return s.TestEmail, s.TestClientSaltSeed, s.TestKey, s.TestServerSalt, s.TestWalletUpdates, s.Errors.ExportAccount
+}
+
+func (s *TestStore) ImportAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, wallets []store.WalletUpdate) (auth.UserId, error) {
+	s.Called.ImportAccount = &ImportAccountCall{email, password, seed, wallets}
+	return s.TestUserId, s.Errors.ImportAccount
+}
+
+func (s *TestStore) GetMigratedTo(email auth.Email) (string, error) {
+	s.Called.GetMigratedTo = email
+	return s.TestMigratedTo, s.Errors.GetMigratedTo
+}
+
+func (s *TestStore) CancelMigration(email auth.Email, password auth.Password) (auth.UserId, error) {
+	s.Called.CancelMigration = email
+	return s.TestUserId, s.Errors.CancelMigration
+}
+
+func (s *TestStore) GetAccountInfo(userId auth.UserId) (store.AccountInfo, error) {
+	s.Called.GetAccountInfo = true
+	return s.TestAccountInfo, s.Errors.GetAccountInfo
+}
+
+func (s *TestStore) GetDataExport(userId auth.UserId) (store.DataExport, error) {
+	s.Called.GetDataExport = true
+	return s.TestDataExport, s.Errors.GetDataExport
+}
+
+func (s *TestStore) IsNewDevice(userId auth.UserId, deviceId auth.DeviceId) (bool, error) {
+	s.Called.IsNewDevice = deviceId
+	return s.TestNewDevice, s.Errors.IsNewDevice
+}
+
+func (s *TestStore) SetNotificationsOff(userId auth.UserId, off bool) error {
+	s.Called.SetNotificationsOff = &off
+	return s.Errors.SetNotificationsOff
+}
+
+func (s *TestStore) CreateAccountWithInviteCode(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, locale auth.Locale, code auth.InviteCode) error {
+	s.Called.CreateAccountWithInviteCode = &CreateAccountWithInviteCodeCall{
+		Email:          email,
+		Password:       password,
+		ClientSaltSeed: seed,
+		Locale:         locale,
+		InviteCode:     code,
+	}
+	return s.Errors.CreateAccountWithInviteCode
+}
+
+func (s *TestStore) CreateInviteCode(code auth.InviteCode, maxUses int, createdBy auth.UserId, quota int) (store.InviteCode, error) {
+	s.Called.CreateInviteCode = &CreateInviteCodeCall{code, maxUses, createdBy, quota}
+	invite := store.InviteCode{Code: code, CreatedBy: createdBy, MaxUses: maxUses, Created: s.TestInviteCodeCreated}
+	return invite, s.Errors.CreateInviteCode
+}
+
+func (s *TestStore) GetInviteCodes(createdBy auth.UserId) ([]store.InviteCode, error) {
+	s.Called.GetInviteCodes = &createdBy
+	return s.TestInviteCodes, s.Errors.GetInviteCodes
+}
+
+func (s *TestStore) CreatePendingAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken auth.VerifyTokenString, locale auth.Locale) error {
+	s.Called.CreatePendingAccount = &CreatePendingAccountCall{
+		Email:          email,
+		Password:       password,
+		ClientSaltSeed: seed,
+		VerifyToken:    verifyToken,
+		Locale:         locale,
+	}
+	return s.Errors.CreatePendingAccount
+}
+
+func (s *TestStore) GetPendingAccounts() ([]store.PendingAccount, error) {
+	s.Called.GetPendingAccounts = true
+	return s.TestPendingAccounts, s.Errors.GetPendingAccounts
+}
+
+func (s *TestStore) ApproveAccount(userId auth.UserId) (auth.Email, auth.Locale, error) {
+	s.Called.ApproveAccount = userId
+	return s.TestEmail, s.TestLocale, s.Errors.ApproveAccount
+}
+
+func (s *TestStore) RejectAccount(userId auth.UserId) (auth.Email, error) {
+	s.Called.RejectAccount = userId
+	return s.TestEmail, s.Errors.RejectAccount
+}
+
 // expectStatusCode: A helper to call in functions that test that request
 // handlers responded with a certain status code. Cuts down on noise.
 func expectStatusCode(t *testing.T, w *httptest.ResponseRecorder, expectedStatusCode int) {
@@ -275,27 +716,49 @@ type wsMockManager struct {
 	s    *Server
 	done chan bool
 
-	addedClientUserId   auth.UserId
-	removedClientUserId auth.UserId
-	removedUserId       auth.UserId
-	walletUpdateUserId  auth.UserId
-	noMessage           bool
+	addedClientUserId    auth.UserId
+	removedClientUserId  auth.UserId
+	removedUserId        auth.UserId
+	walletUpdateUserId   auth.UserId
+	walletUpdateWalletId wallet.WalletId
+	noMessage            bool
 }
 
+// We don't know which shard the message will go to, so listen to all of them.
+// Each case gets its own handler, so we know which channel a message came in
+// on without working it out from where the case is in the list.
 func (m *wsMockManager) getOneMessage(timeout time.Duration) {
-	t := time.NewTicker(timeout)
-	select {
-	case msg := <-m.s.clientAdd:
-		m.addedClientUserId = msg.userId
-	case msg := <-m.s.clientRemove:
-		m.removedClientUserId = msg.userId
-	case msg := <-m.s.userRemove:
-		m.removedUserId = msg.userId
-	case msg := <-m.s.walletUpdates:
-		m.walletUpdateUserId = msg.userId
-	case <-t.C:
+	t := time.NewTimer(timeout)
+
+	var cases []reflect.SelectCase
+	var handlers []func(reflect.Value)
+	listen := func(ch interface{}, handle func(reflect.Value)) {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+		handlers = append(handlers, handle)
+	}
+
+	listen(t.C, func(reflect.Value) {
 		m.noMessage = true
+	})
+	for _, shard := range m.s.shards {
+		listen(shard.clientAdd, func(recv reflect.Value) {
+			m.addedClientUserId = recv.Interface().(wsClientAddMsg).userId
+		})
+		listen(shard.clientRemove, func(recv reflect.Value) {
+			m.removedClientUserId = recv.Interface().(wsClientForUser).userId
+		})
+		listen(shard.userRemove, func(recv reflect.Value) {
+			m.removedUserId = recv.Interface().(wsClientForUser).userId
+		})
+		listen(shard.walletUpdates, func(recv reflect.Value) {
+			msg := recv.Interface().(walletUpdateMsg)
+			m.walletUpdateUserId = msg.userId
+			m.walletUpdateWalletId = msg.walletId
+		})
 	}
+
+	chosen, recv, _ := reflect.Select(cases)
+	handlers[chosen](recv)
 	t.Stop()
 	m.done <- true
 }
@@ -357,8 +820,9 @@ func TestServerHelperCheckAuth(t *testing.T) {
 			}
 			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
 
+			req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
 			w := httptest.NewRecorder()
-			authToken := s.checkAuth(w, testStore.TestAuthToken.Token, tc.requiredScope)
+			authToken := s.checkAuth(w, req, testStore.TestAuthToken.Token, tc.requiredScope)
 			if tc.tokenExpected && (*authToken != testStore.TestAuthToken) {
 				t.Errorf("Expected checkAuth to return a valid AuthToken")
 			}
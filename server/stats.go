@@ -0,0 +1,64 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+)
+
+func (s *Server) updateStatsMetrics() {
+	stats, err := s.store.GetStats()
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "stats"}).Inc()
+		logging.Error("Error getting stats for metrics", logging.Err(err))
+		return
+	}
+
+	metrics.Accounts.Set(float64(stats.Accounts))
+	metrics.VerifiedAccounts.Set(float64(stats.VerifiedAccounts))
+	metrics.Wallets.Set(float64(stats.Wallets))
+	metrics.AccountsWithWallets.Set(float64(stats.AccountsWithWallets))
+	metrics.AuthTokens.Set(float64(stats.AuthTokens))
+
+	for i, bucket := range store.WalletSizeBuckets {
+		metrics.WalletsBySize.With(prometheus.Labels{"le": strconv.Itoa(bucket)}).Set(float64(stats.WalletsBySize[i]))
+	}
+	metrics.WalletsBySize.With(prometheus.Labels{"le": "+Inf"}).Set(float64(stats.Wallets))
+}
+
+// Periodically update the stats gauges until told to finish. Same done/finish
+// arrangement as the socket manager.
+func (s *Server) collectStats(done chan bool, finish chan bool) {
+	defer func() { done <- true }()
+
+	// Config errors are reported on startup, so this shouldn't happen.
+	interval, err := env.GetStatsInterval(s.env)
+	if err != nil {
+		logging.Error("Error getting stats interval, not collecting stats", logging.Err(err))
+		interval = 0
+	}
+	if interval == 0 {
+		<-finish
+		return
+	}
+
+	// Right away, so the dashboard doesn't have to wait for the first tick
+	s.updateStatsMetrics()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.updateStatsMetrics()
+		case <-finish:
+			return
+		}
+	}
+}
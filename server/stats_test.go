@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerUpdateStatsMetrics(t *testing.T) {
+	testStore := TestStore{
+		TestStats: store.Stats{
+			Accounts:            10,
+			VerifiedAccounts:    8,
+			Wallets:             7,
+			AccountsWithWallets: 5,
+			AuthTokens:          12,
+			WalletsBySize:       []int{1, 3, 6, 7},
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+	s.updateStatsMetrics()
+
+	expectGauge := func(name string, gauge prometheus.Collector, expected float64) {
+		if got := testutil.ToFloat64(gauge); got != expected {
+			t.Errorf("%s: expected %f, got %f", name, expected, got)
+		}
+	}
+	expectGauge("accounts", metrics.Accounts, 10)
+	expectGauge("verified accounts", metrics.VerifiedAccounts, 8)
+	expectGauge("wallets", metrics.Wallets, 7)
+	expectGauge("accounts with wallets", metrics.AccountsWithWallets, 5)
+	expectGauge("auth tokens", metrics.AuthTokens, 12)
+	expectGauge("wallets up to 10000 bytes", metrics.WalletsBySize.With(prometheus.Labels{"le": "10000"}), 3)
+	expectGauge("wallets of any size", metrics.WalletsBySize.With(prometheus.Labels{"le": "+Inf"}), 7)
+
+	// On error, leave the last values in place
+	testStore.TestStats = store.Stats{}
+	testStore.Errors.GetStats = fmt.Errorf("Some random DB Error!")
+	errorsBefore := testutil.ToFloat64(metrics.ErrorsCount.With(prometheus.Labels{"error_type": "stats"}))
+	s.updateStatsMetrics()
+
+	expectGauge("accounts after error", metrics.Accounts, 10)
+	expectGauge("stats errors", metrics.ErrorsCount.With(prometheus.Labels{"error_type": "stats"}), errorsBefore+1)
+}
+
+func TestServerCollectStatsDisabled(t *testing.T) {
+	testStore := TestStore{Errors: TestStoreFunctionsErrors{GetStats: fmt.Errorf("Should not be called")}}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{env: map[string]string{"STATS_INTERVAL": "0s"}}, &TestMail{}, TestPort)
+
+	errorsBefore := testutil.ToFloat64(metrics.ErrorsCount.With(prometheus.Labels{"error_type": "stats"}))
+
+	done := make(chan bool)
+	finish := make(chan bool)
+	go s.collectStats(done, finish)
+	finish <- true
+	<-done
+
+	if errorsAfter := testutil.ToFloat64(metrics.ErrorsCount.With(prometheus.Labels{"error_type": "stats"})); errorsAfter != errorsBefore {
+		t.Errorf("Expected stats not to be collected")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"lbryio/wallet-sync-server/env"
+)
+
+// Holds the certificate we serve, so that it can be swapped out (on SIGHUP)
+// without restarting the server. Renewed certificates (i.e. Let's Encrypt)
+// only need a reload.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return &reloader, nil
+}
+
+// If the new certificate doesn't load, we keep serving the old one.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate: %+v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// For tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// A throwaway certificate for localhost, for dev purposes. Clients will need to
+// skip verification, or trust it some other way.
+func selfSignedCertificatePEM() (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"wallet-sync-server dev"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+// Returns nil (and no error) if we're not serving TLS. If certificates come
+// from files, also returns the reloader so that we can reload on SIGHUP.
+func tlsConfig(e env.EnvInterface) (*tls.Config, *certReloader, error) {
+	certFile, keyFile, selfSigned, err := env.GetTLSConfigs(e)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case selfSigned:
+		certPEM, keyPEM, err := selfSignedCertificatePEM()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error generating self-signed certificate: %+v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error loading self-signed certificate: %+v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil, nil
+	case certFile != "":
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}, reloader, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// Open a listener for the given address. A leftover unix socket file from a
+// previous run would make the listen fail, so we remove it first. We only
+// remove sockets though, in case somebody points us at a regular file by
+// mistake.
+func listen(address env.ListenAddress) (net.Listener, error) {
+	if address.Network == "unix" {
+		if info, err := os.Stat(address.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address.Address); err != nil {
+				return nil, fmt.Errorf("Error removing old socket file %s: %+v", address.Address, err)
+			}
+		}
+	}
+	listener, err := net.Listen(address.Network, address.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening on %s %s: %+v", address.Network, address.Address, err)
+	}
+	return listener, nil
+}
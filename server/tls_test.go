@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func writeSelfSignedCert(t *testing.T, certFile string, keyFile string) {
+	certPEM, keyPEM, err := selfSignedCertificatePEM()
+	if err != nil {
+		t.Fatalf("Error generating certificate: %+v", err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Error writing certificate: %+v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key: %+v", err)
+	}
+}
+
+// Connect and get the serial number of the certificate the server presents.
+// httptest puts its own certificate in tls.Config.Certificates, which is used
+// instead of GetCertificate unless we send a server name.
+func servedCertSerial(t *testing.T, ts *httptest.Server) string {
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Error connecting: %+v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func TestServerTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile)
+
+	e := TestEnv{env: map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}}
+	config, reloader, err := tlsConfig(&e)
+	if err != nil {
+		t.Fatalf("Error setting up TLS: %+v", err)
+	}
+	if reloader == nil {
+		t.Fatalf("Expected a cert reloader")
+	}
+
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.healthz))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	oldSerial := servedCertSerial(t, ts)
+
+	// A bad certificate shouldn't replace the good one
+	if err := ioutil.WriteFile(certFile, []byte("not a cert"), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %+v", err)
+	}
+	if err := reloader.reload(); err == nil {
+		t.Errorf("Expected an error reloading a bad certificate")
+	}
+	if serial := servedCertSerial(t, ts); serial != oldSerial {
+		t.Errorf("Expected to still serve the old certificate")
+	}
+
+	writeSelfSignedCert(t, certFile, keyFile)
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("Error reloading certificate: %+v", err)
+	}
+	if serial := servedCertSerial(t, ts); serial == oldSerial {
+		t.Errorf("Expected to serve the new certificate")
+	}
+}
+
+func TestServerTLSSelfSigned(t *testing.T) {
+	e := TestEnv{env: map[string]string{"TLS_SELF_SIGNED": "true"}}
+	config, reloader, err := tlsConfig(&e)
+	if err != nil {
+		t.Fatalf("Error setting up TLS: %+v", err)
+	}
+	if reloader != nil {
+		t.Errorf("Did not expect a cert reloader")
+	}
+
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.healthz))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting: %+v", err)
+	}
+	defer conn.Close()
+	if err := conn.ConnectionState().PeerCertificates[0].VerifyHostname("localhost"); err != nil {
+		t.Errorf("Expected certificate to be for localhost: %+v", err)
+	}
+}
+
+func TestServerTLSNone(t *testing.T) {
+	config, reloader, err := tlsConfig(&TestEnv{})
+	if config != nil || reloader != nil || err != nil {
+		t.Errorf("Expected no TLS: %+v %+v %+v", config, reloader, err)
+	}
+}
+
+func TestServerListenUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "server.sock")
+
+	// Leftover from a previous run. listen should clean it up.
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error creating stale socket: %+v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen(env.ListenAddress{Network: "unix", Address: socketPath})
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	server := http.Server{Handler: http.HandlerFunc(s.healthz)}
+	done := make(chan bool)
+	go serve(&server, listener, done)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://unix" + paths.PathHealthz)
+	if err != nil {
+		t.Fatalf("Error getting health over unix socket: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	server.Close()
+	<-done
+}
+
+func TestServerListenNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := ioutil.WriteFile(path, []byte("important"), 0600); err != nil {
+		t.Fatalf("Error writing file: %+v", err)
+	}
+
+	if _, err := listen(env.ListenAddress{Network: "unix", Address: path}); err == nil {
+		t.Errorf("Expected an error listening on a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected regular file to be left alone: %+v", err)
+	}
+}
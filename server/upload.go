@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// How often to delete uploads that expired without being committed, and blobs
+// no wallet refers to
+const garbageInterval = 10 * time.Minute
+
+type UploadStartRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+}
+
+func (r *UploadStartRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	return nil
+}
+
+type UploadPartRequest struct {
+	Token    auth.AuthTokenString `json:"token"`
+	UploadId store.UploadId       `json:"uploadId"`
+	Part     int                  `json:"part"`
+	Data     string               `json:"data"`
+}
+
+func (r *UploadPartRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if r.UploadId == 0 {
+		return fmt.Errorf("Missing 'uploadId'")
+	}
+	if r.Part < 0 {
+		return fmt.Errorf("'part' should not be negative")
+	}
+	if r.Data == "" {
+		return fmt.Errorf("Missing 'data'")
+	}
+	return nil
+}
+
+type UploadCommitRequest struct {
+	Token    auth.AuthTokenString `json:"token"`
+	UploadId store.UploadId       `json:"uploadId"`
+	Parts    int                  `json:"parts"`
+	WalletId wallet.WalletId      `json:"walletId"` // optional, default wallet if empty
+	Sequence wallet.Sequence      `json:"sequence"`
+	Hmac     wallet.WalletHmac    `json:"hmac"`
+}
+
+func (r *UploadCommitRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if r.UploadId == 0 {
+		return fmt.Errorf("Missing 'uploadId'")
+	}
+	if r.Parts < 1 {
+		return fmt.Errorf("Missing or zero-value 'parts'")
+	}
+	if r.WalletId != "" && !r.WalletId.Validate() {
+		return fmt.Errorf("Invalid 'walletId'")
+	}
+	if r.Hmac == "" {
+		return fmt.Errorf("Missing 'hmac'")
+	}
+	if r.Sequence < store.InitialWalletSequence {
+		return fmt.Errorf("Missing or zero-value 'sequence'")
+	}
+	return nil
+}
+
+type UploadResponse struct {
+	UploadId   store.UploadId `json:"uploadId"`
+	Expiration time.Time      `json:"expiration"`
+}
+
+// Parts that have been received so far, so a client that lost its connection
+// knows what to send again
+type UploadStatusResponse struct {
+	UploadId   store.UploadId `json:"uploadId"`
+	Parts      []int          `json:"parts"`
+	Expiration time.Time      `json:"expiration"`
+}
+
+func (s *Server) handleWalletUpload(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.getWalletUpload(w, req)
+	} else if req.Method == http.MethodPost {
+		s.postWalletUpload(w, req)
+	} else {
+		errorJson(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// Start an upload
+func (s *Server) postWalletUpload(w http.ResponseWriter, req *http.Request) {
+	var uploadRequest UploadStartRequest
+	if !getPostData(w, req, &uploadRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, uploadRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	uploadId, expiration, err := s.store.CreateUpload(authToken.UserId)
+	if err == store.ErrTooManyUploads {
+		errorJson(w, http.StatusTooManyRequests, "Too many uploads in progress. Finish one, or wait for it to expire.")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error creating upload")
+		return
+	}
+
+	response, err := json.Marshal(UploadResponse{UploadId: uploadId, Expiration: expiration})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating upload response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Which parts of an upload have been received
+func (s *Server) getWalletUpload(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	uploadIdInt, err := strconv.ParseInt(req.URL.Query().Get("uploadId"), 10, 64)
+	if err != nil || uploadIdInt <= 0 {
+		errorJson(w, http.StatusBadRequest, "Missing or invalid uploadId parameter")
+		return
+	}
+	uploadId := store.UploadId(uploadIdInt)
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	parts, expiration, err := s.store.GetUploadParts(authToken.UserId, uploadId)
+	if err == store.ErrNoUpload {
+		errorJson(w, http.StatusNotFound, "No upload")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting upload parts")
+		return
+	}
+
+	response, err := json.Marshal(UploadStatusResponse{UploadId: uploadId, Parts: parts, Expiration: expiration})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating upload status response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Response Code:
+//
+//	200: Part saved (or replaced, if it was sent before)
+//	404: No such upload for this user, or it expired
+//	413: The parts together would be bigger than MAX_WALLET_UPLOAD_SIZE
+//	500: Part not saved for unanticipated reasons
+func (s *Server) postWalletUploadPart(w http.ResponseWriter, req *http.Request) {
+	var partRequest UploadPartRequest
+	if !getPostData(w, req, &partRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, partRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	// Config errors are reported on startup, so this shouldn't happen.
+	maxSize, err := env.GetMaxWalletUploadSize(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error getting max wallet upload size")
+		return
+	}
+
+	err = s.store.SaveUploadPart(authToken.UserId, partRequest.UploadId, partRequest.Part, partRequest.Data, maxSize)
+	if err == store.ErrNoUpload {
+		errorJson(w, http.StatusNotFound, "No upload")
+		return
+	} else if err == store.ErrUploadTooLarge {
+		errorJson(w, http.StatusRequestEntityTooLarge, "Wallet too large")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error saving upload part")
+		return
+	}
+
+	var partResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(partResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating upload part response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Response Code:
+//
+//	200: The parts were put together and saved as the wallet
+//	400: The upload doesn't have exactly the parts 0 through parts-1
+//	404: No such upload for this user, or it expired
+//	409: Same as posting a wallet: the sequence isn't 1 + the current
+//	  wallet's sequence. The upload is kept until it expires.
+//	429: A new named wallet, but the user already has MaxWalletsPerUser
+//	500: Wallet not saved for unanticipated reasons
+func (s *Server) postWalletUploadCommit(w http.ResponseWriter, req *http.Request) {
+	var commitRequest UploadCommitRequest
+	if !getPostData(w, req, &commitRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, commitRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	walletId := walletIdOrDefault(commitRequest.WalletId)
+	err := s.store.CommitUpload(authToken.UserId, commitRequest.UploadId, commitRequest.Parts, walletId, commitRequest.Sequence, commitRequest.Hmac)
+	if err == store.ErrNoUpload {
+		errorJson(w, http.StatusNotFound, "No upload")
+		return
+	} else if err == store.ErrIncompleteUpload {
+		errorJson(w, http.StatusBadRequest, "Upload is missing parts, or has more than expected")
+		return
+	} else if err == store.ErrWrongSequence {
+		errorJson(w, http.StatusConflict, "Bad sequence number")
+		return
+	} else if err == store.ErrTooManyWallets {
+		errorJson(w, http.StatusTooManyRequests, tooManyWalletsMessage)
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error committing upload")
+		return
+	}
+
+	var commitResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(commitResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating upload commit response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	s.walletSaved(req, authToken, walletId, commitRequest.Sequence)
+}
+
+func (s *Server) deleteExpiredUploads() {
+	numDeleted, err := s.store.DeleteExpiredUploads()
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "upload-garbage"}).Inc()
+		logging.Error("Error deleting expired uploads", logging.Err(err))
+		return
+	}
+	if numDeleted > 0 {
+		logging.Info("Deleted expired uploads", logging.F("count", numDeleted))
+	}
+}
+
+func (s *Server) deleteUnreferencedBlobs() {
+	numDeleted, err := s.store.DeleteUnreferencedBlobs()
+	if err != nil {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "blob-garbage"}).Inc()
+		logging.Error("Error deleting unreferenced blobs", logging.Err(err))
+		return
+	}
+	if numDeleted > 0 {
+		logging.Info("Deleted unreferenced blobs", logging.F("count", numDeleted))
+	}
+}
+
+// Periodically delete expired uploads and unreferenced blobs until told to
+// finish. Same done/finish arrangement as the socket manager.
+func (s *Server) collectGarbage(done chan bool, finish chan bool) {
+	defer func() { done <- true }()
+
+	ticker := time.NewTicker(garbageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.deleteExpiredUploads()
+			s.deleteUnreferencedBlobs()
+		case <-finish:
+			return
+		}
+	}
+}
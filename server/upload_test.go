@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerStartWalletUpload(t *testing.T) {
+	tt := []struct {
+		name        string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "too many uploads",
+			storeErrors:         TestStoreFunctionsErrors{CreateUpload: store.ErrTooManyUploads},
+			expectedStatusCode:  http.StatusTooManyRequests,
+			expectedErrorString: http.StatusText(http.StatusTooManyRequests) + ": Too many uploads in progress. Finish one, or wait for it to expire.",
+		},
+		{
+			name:                "db error",
+			storeErrors:         TestStoreFunctionsErrors{CreateUpload: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expiration := time.Now().UTC().Add(store.UploadLifespan).Truncate(time.Second)
+			testStore := TestStore{
+				TestAuthToken:        auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				TestUploadId:         store.UploadId(5),
+				TestUploadExpiration: expiration,
+				Errors:               tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletUpload, bytes.NewBuffer([]byte(`{"token": "seekrit"}`)))
+			w := httptest.NewRecorder()
+
+			// test handleWalletUpload while we're at it, which is a dispatch for get
+			// and post
+			s.handleWalletUpload(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !testStore.Called.CreateUpload {
+				t.Errorf("Expected CreateUpload to be called")
+			}
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			var result UploadResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding upload response: %+v", err)
+			}
+			if result.UploadId != 5 || !result.Expiration.Equal(expiration) {
+				t.Errorf("Unexpected upload response: %+v", result)
+			}
+		})
+	}
+}
+
+func TestServerGetWalletUpload(t *testing.T) {
+	tt := []struct {
+		name        string
+		query       string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedUploadId    store.UploadId
+	}{
+		{
+			name:               "success",
+			query:              "?token=seekrit&uploadId=5",
+			expectedStatusCode: http.StatusOK,
+			expectedUploadId:   5,
+		},
+		{
+			name:                "missing upload id",
+			query:               "?token=seekrit",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing or invalid uploadId parameter",
+		},
+		{
+			name:                "invalid upload id",
+			query:               "?token=seekrit&uploadId=five",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing or invalid uploadId parameter",
+		},
+		{
+			name:                "no upload",
+			query:               "?token=seekrit&uploadId=5",
+			storeErrors:         TestStoreFunctionsErrors{GetUploadParts: store.ErrNoUpload},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No upload",
+			expectedUploadId:    5,
+		},
+		{
+			name:                "db error",
+			query:               "?token=seekrit&uploadId=5",
+			storeErrors:         TestStoreFunctionsErrors{GetUploadParts: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedUploadId:    5,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken:   auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				TestUploadParts: []int{0, 2},
+				Errors:          tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWalletUpload+tc.query, nil)
+			w := httptest.NewRecorder()
+
+			s.handleWalletUpload(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.GetUploadParts != tc.expectedUploadId {
+				t.Errorf("Expected GetUploadParts to be called with %d, got %d", tc.expectedUploadId, testStore.Called.GetUploadParts)
+			}
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			var result UploadStatusResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding upload status response: %+v", err)
+			}
+			if result.UploadId != 5 || !reflect.DeepEqual(result.Parts, []int{0, 2}) {
+				t.Errorf("Unexpected upload status response: %+v", result)
+			}
+		})
+	}
+}
+
+func TestServerPostWalletUploadPart(t *testing.T) {
+	tt := []struct {
+		name        string
+		requestBody string
+		env         map[string]string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *SaveUploadPartCall
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"token": "seekrit", "uploadId": 5, "part": 1, "data": "my-enc"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &SaveUploadPartCall{UploadId: 5, Part: 1, Data: "my-enc", MaxSize: 10000000},
+		},
+		{
+			name:               "configured max size",
+			requestBody:        `{"token": "seekrit", "uploadId": 5, "part": 1, "data": "my-enc"}`,
+			env:                map[string]string{"MAX_WALLET_UPLOAD_SIZE": "2000"},
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       &SaveUploadPartCall{UploadId: 5, Part: 1, Data: "my-enc", MaxSize: 2000},
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit", "uploadId": 5, "part": -1, "data": "my-enc"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: 'part' should not be negative",
+		},
+		{
+			name:                "no upload",
+			requestBody:         `{"token": "seekrit", "uploadId": 5, "part": 1, "data": "my-enc"}`,
+			storeErrors:         TestStoreFunctionsErrors{SaveUploadPart: store.ErrNoUpload},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No upload",
+			expectedCall:        &SaveUploadPartCall{UploadId: 5, Part: 1, Data: "my-enc", MaxSize: 10000000},
+		},
+		{
+			name:                "too large",
+			requestBody:         `{"token": "seekrit", "uploadId": 5, "part": 1, "data": "my-enc"}`,
+			storeErrors:         TestStoreFunctionsErrors{SaveUploadPart: store.ErrUploadTooLarge},
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge) + ": Wallet too large",
+			expectedCall:        &SaveUploadPartCall{UploadId: 5, Part: 1, Data: "my-enc", MaxSize: 10000000},
+		},
+		{
+			name:                "db error",
+			requestBody:         `{"token": "seekrit", "uploadId": 5, "part": 1, "data": "my-enc"}`,
+			storeErrors:         TestStoreFunctionsErrors{SaveUploadPart: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        &SaveUploadPartCall{UploadId: 5, Part: 1, Data: "my-enc", MaxSize: 10000000},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletUploadPart, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.postWalletUploadPart(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(testStore.Called.SaveUploadPart, tc.expectedCall) {
+				t.Errorf("Expected SaveUploadPart call %+v, got %+v", tc.expectedCall, testStore.Called.SaveUploadPart)
+			}
+			if tc.expectedErrorString == "" && string(body) != "{}" {
+				t.Errorf("Expected upload part response to be \"{}\": result: %+v", string(body))
+			}
+		})
+	}
+}
+
+func TestServerPostWalletUploadCommit(t *testing.T) {
+	validBody := `{"token": "seekrit", "uploadId": 5, "parts": 3, "sequence": 2, "hmac": "my-hmac"}`
+	validCall := &CommitUploadCall{UploadId: 5, NumParts: 3, WalletId: wallet.DefaultWalletId, Sequence: 2, Hmac: "my-hmac"}
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *CommitUploadCall
+		expectWsMsg         bool
+	}{
+		{
+			name:               "success",
+			requestBody:        validBody,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       validCall,
+			expectWsMsg:        true,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit", "uploadId": 5, "sequence": 2, "hmac": "my-hmac"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing or zero-value 'parts'",
+		},
+		{
+			name:                "no upload",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CommitUpload: store.ErrNoUpload},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No upload",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "incomplete",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CommitUpload: store.ErrIncompleteUpload},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Upload is missing parts, or has more than expected",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "conflict",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CommitUpload: store.ErrWrongSequence},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "db error",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CommitUpload: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        validCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: auth.UserId(37)},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletUploadCommit, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWalletUploadCommit(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(testStore.Called.CommitUpload, tc.expectedCall) {
+				t.Errorf("Expected CommitUpload call %+v, got %+v", tc.expectedCall, testStore.Called.CommitUpload)
+			}
+
+			// Same aftermath as posting a wallet
+			if tc.expectWsMsg && wsmm.walletUpdateUserId != testStore.TestAuthToken.UserId {
+				t.Error("Expected websocket message to update wallet")
+			}
+			if !tc.expectWsMsg && wsmm.walletUpdateUserId == testStore.TestAuthToken.UserId {
+				t.Error("Expected no websocket message to update wallet")
+			}
+			auditedUpdate := len(testStore.Called.AuditEvents) == 1 && testStore.Called.AuditEvents[0].Event.Type == store.AuditEventWalletUpdate
+			if tc.expectWsMsg != auditedUpdate {
+				t.Errorf("Expected a wallet-update audit event only on success, got %+v", testStore.Called.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestServerValidateUploadCommitRequest(t *testing.T) {
+	commitRequest := UploadCommitRequest{Token: "seekrit", UploadId: 5, Parts: 3, Sequence: 2, Hmac: "my-hmac"}
+	if commitRequest.validate() != nil {
+		t.Errorf("Expected valid UploadCommitRequest to successfully validate")
+	}
+
+	tt := []struct {
+		commitRequest      UploadCommitRequest
+		failureDescription string
+	}{
+		{UploadCommitRequest{UploadId: 5, Parts: 3, Sequence: 2, Hmac: "my-hmac"}, "Expected UploadCommitRequest with missing token to not successfully validate"},
+		{UploadCommitRequest{Token: "seekrit", Parts: 3, Sequence: 2, Hmac: "my-hmac"}, "Expected UploadCommitRequest with missing upload id to not successfully validate"},
+		{UploadCommitRequest{Token: "seekrit", UploadId: 5, Sequence: 2, Hmac: "my-hmac"}, "Expected UploadCommitRequest with missing parts to not successfully validate"},
+		{UploadCommitRequest{Token: "seekrit", UploadId: 5, Parts: 3, Hmac: "my-hmac"}, "Expected UploadCommitRequest with sequence < 1 to not successfully validate"},
+		{UploadCommitRequest{Token: "seekrit", UploadId: 5, Parts: 3, Sequence: 2}, "Expected UploadCommitRequest with missing hmac to not successfully validate"},
+	}
+	for _, tc := range tt {
+		if tc.commitRequest.validate() == nil {
+			t.Errorf(tc.failureDescription)
+		}
+	}
+}
+
+func TestServerCollectGarbage(t *testing.T) {
+	testStore := TestStore{}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+	done := make(chan bool)
+	finish := make(chan bool)
+	go s.collectGarbage(done, finish)
+	finish <- true
+	<-done
+
+	s.deleteExpiredUploads()
+	if !testStore.Called.DeleteExpiredUploads {
+		t.Errorf("Expected DeleteExpiredUploads to be called")
+	}
+	s.deleteUnreferencedBlobs()
+	if !testStore.Called.DeleteUnreferencedBlobs {
+		t.Errorf("Expected DeleteUnreferencedBlobs to be called")
+	}
+}
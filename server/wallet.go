@@ -1,22 +1,23 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-
 	"lbryio/wallet-sync-server/auth"
-	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/logging"
 	"lbryio/wallet-sync-server/store"
 	"lbryio/wallet-sync-server/wallet"
 )
 
 type WalletRequest struct {
 	Token           auth.AuthTokenString   `json:"token"`
+	WalletId        wallet.WalletId        `json:"walletId"` // optional, default wallet if empty
 	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
 	Sequence        wallet.Sequence        `json:"sequence"`
 	Hmac            wallet.WalletHmac      `json:"hmac"`
@@ -26,6 +27,9 @@ func (r *WalletRequest) validate() error {
 	if r.Token == "" {
 		return fmt.Errorf("Missing 'token'")
 	}
+	if r.WalletId != "" && !r.WalletId.Validate() {
+		return fmt.Errorf("Invalid 'walletId'")
+	}
 	if r.EncryptedWallet == "" {
 		return fmt.Errorf("Missing 'encryptedWallet'")
 	}
@@ -44,6 +48,45 @@ type WalletResponse struct {
 	Hmac            wallet.WalletHmac      `json:"hmac"`
 }
 
+type WalletHeadResponse struct {
+	Sequence wallet.Sequence   `json:"sequence"`
+	Hmac     wallet.WalletHmac `json:"hmac"`
+	Updated  time.Time         `json:"updated"`
+}
+
+// For requests where the wallet id is optional. Assumes it's been validated.
+func walletIdOrDefault(walletId wallet.WalletId) wallet.WalletId {
+	if walletId == "" {
+		return wallet.DefaultWalletId
+	}
+	return walletId
+}
+
+// Identifies a version of the wallet. The sequence changes with every update
+// and the hmac covers the contents, so between them that's everything.
+func walletETag(sequence wallet.Sequence, hmac wallet.WalletHmac) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", sequence, hmac)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// If-None-Match can be a list, and uses weak comparison, so W/"x" matches "x"
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// The client can keep it, but should check with us before using it again. And
+// proxies shouldn't keep it at all, since it's per user.
+func setWalletCacheHeaders(w http.ResponseWriter, sequence wallet.Sequence, hmac wallet.WalletHmac) {
+	w.Header().Set("ETag", walletETag(sequence, hmac))
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
 func (s *Server) handleWallet(w http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodGet {
 		s.getWallet(w, req)
@@ -55,13 +98,15 @@ func (s *Server) handleWallet(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
-	metrics.RequestsCount.With(prometheus.Labels{"method": "GET", "endpoint": "wallet"}).Inc()
-
 	if !getGetData(w, req) {
 		return
 	}
 
 	token, paramsErr := getTokenParam(req)
+	var walletId wallet.WalletId
+	if paramsErr == nil {
+		walletId, paramsErr = getWalletIdParam(req)
+	}
 
 	if paramsErr != nil {
 		// In this specific case, the error is limited to values that are safe to
@@ -70,19 +115,38 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	authToken := s.checkAuth(w, token, auth.ScopeFull)
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
 
 	if authToken == nil {
 		return
 	}
 
-	latestEncryptedWallet, latestSequence, latestHmac, err := s.store.GetWallet(authToken.UserId)
+	// If the client already has the latest, we don't even need to read the
+	// wallet out of the database
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		sequence, hmac, _, err := s.store.GetWalletHead(authToken.UserId, walletId)
+		if err == store.ErrNoWallet {
+			errorJson(w, http.StatusNotFound, "No wallet")
+			return
+		} else if err != nil {
+			internalServiceErrorJson(w, req, err, "Error retrieving wallet head")
+			return
+		}
+		if etagMatches(ifNoneMatch, walletETag(sequence, hmac)) {
+			setWalletCacheHeaders(w, sequence, hmac)
+			w.Header().Add("Vary", "Accept-Encoding")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	latestEncryptedWallet, latestSequence, latestHmac, err := s.store.GetWallet(authToken.UserId, walletId)
 
 	if err == store.ErrNoWallet {
 		errorJson(w, http.StatusNotFound, "No wallet")
 		return
 	} else if err != nil {
-		internalServiceErrorJson(w, err, "Error retrieving wallet")
+		internalServiceErrorJson(w, req, err, "Error retrieving wallet")
 		return
 	}
 
@@ -96,10 +160,61 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 	response, err = json.Marshal(walletResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating wallet response")
+		internalServiceErrorJson(w, req, err, "Error generating wallet response")
+		return
+	}
+
+	setWalletCacheHeaders(w, latestSequence, latestHmac)
+	if err := writeCompressibleJson(w, req, response); err != nil {
+		// Probably the client went away, and anyway too late to respond
+		logging.FromContext(req.Context()).Warn("Error writing wallet response", logging.Err(err))
+	}
+}
+
+// Just enough for a client to decide whether to download the wallet
+func (s *Server) getWalletHead(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
 		return
 	}
 
+	token, paramsErr := getTokenParam(req)
+	var walletId wallet.WalletId
+	if paramsErr == nil {
+		walletId, paramsErr = getWalletIdParam(req)
+	}
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	sequence, hmac, updated, err := s.store.GetWalletHead(authToken.UserId, walletId)
+	if err == store.ErrNoWallet {
+		errorJson(w, http.StatusNotFound, "No wallet")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error retrieving wallet head")
+		return
+	}
+
+	response, err := json.Marshal(WalletHeadResponse{
+		Sequence: sequence,
+		Hmac:     hmac,
+		Updated:  updated,
+	})
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating wallet head response")
+		return
+	}
+
+	setWalletCacheHeaders(w, sequence, hmac)
 	fmt.Fprintf(w, string(response))
 }
 
@@ -107,28 +222,31 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 //   200: Update successful
 //   409: Update unsuccessful due to new wallet's sequence not being 1 +
 //     current wallet's sequence
+//   429: A new named wallet, but the user already has MaxWalletsPerUser
 //   500: Update unsuccessful for unanticipated reasons
 func (s *Server) postWallet(w http.ResponseWriter, req *http.Request) {
-	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "wallet"}).Inc()
-
 	var walletRequest WalletRequest
 	if !getPostData(w, req, &walletRequest) {
 		return
 	}
 
-	authToken := s.checkAuth(w, walletRequest.Token, auth.ScopeFull)
+	authToken := s.checkAuth(w, req, walletRequest.Token, auth.ScopeFull)
 	if authToken == nil {
 		return
 	}
 
-	err := s.store.SetWallet(authToken.UserId, walletRequest.EncryptedWallet, walletRequest.Sequence, walletRequest.Hmac)
+	walletId := walletIdOrDefault(walletRequest.WalletId)
+	err := s.store.SetWallet(authToken.UserId, walletId, walletRequest.EncryptedWallet, walletRequest.Sequence, walletRequest.Hmac)
 
 	if err == store.ErrWrongSequence {
 		errorJson(w, http.StatusConflict, "Bad sequence number")
 		return
+	} else if err == store.ErrTooManyWallets {
+		errorJson(w, http.StatusTooManyRequests, tooManyWalletsMessage)
+		return
 	} else if err != nil {
 		// Something other than sequence error
-		internalServiceErrorJson(w, err, "Error saving or getting wallet")
+		internalServiceErrorJson(w, req, err, "Error saving or getting wallet")
 		return
 	}
 
@@ -137,25 +255,22 @@ func (s *Server) postWallet(w http.ResponseWriter, req *http.Request) {
 	response, err = json.Marshal(walletResponse)
 
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error generating walletResponse")
+		internalServiceErrorJson(w, req, err, "Error generating walletResponse")
 		return
 	}
 
 	fmt.Fprintf(w, string(response))
-	if walletRequest.Sequence == store.InitialWalletSequence {
-		log.Printf("Initial wallet created for user id %d", authToken.UserId)
-	}
-
-	// Inform the other clients over websockets. If we can't do it within 100
-	// milliseconds, don't bother. It's a nice-to-have, not mission critical.
-	// But, count the misses on the dashboard. If it happens a lot we should
-	// probably increase the buffer on the notify chans for the clients. Those
-	// will be a bottleneck within the socket manager.
-	timeout := time.NewTicker(100 * time.Millisecond)
-	select {
-	case s.walletUpdates <- walletUpdateMsg{authToken.UserId, walletRequest.Sequence}:
-	case <-timeout.C:
-		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-client-notify"}).Inc()
-	}
-	timeout.Stop()
+	s.walletSaved(req, authToken, walletId, walletRequest.Sequence)
+}
+
+// Everything that follows a new wallet being saved, however it got here
+func (s *Server) walletSaved(req *http.Request, authToken *auth.AuthToken, walletId wallet.WalletId, sequence wallet.Sequence) {
+	s.recordAuditEvent(req, store.AuditEventWalletUpdate, authToken.UserId, authToken.DeviceId)
+
+	if sequence == store.InitialWalletSequence {
+		logging.FromContext(req.Context()).Info("Initial wallet created", logging.F("user_id", authToken.UserId), logging.F("wallet_id", walletId))
+	}
+
+	// Inform the other clients over websockets
+	s.notifyWalletUpdate(authToken.UserId, walletId, sequence)
 }
@@ -122,8 +122,201 @@ func TestServerGetWallet(t *testing.T) {
 				t.Errorf("Expected wallet response to have the test wallet values: result: %+v err: %+v", string(body), err)
 			}
 
-			if !testStore.Called.GetWallet {
-				t.Errorf("Expected Store.GetWallet to be called")
+			if want, got := wallet.DefaultWalletId, testStore.Called.GetWallet; want != got {
+				t.Errorf("Expected Store.GetWallet to be called with %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestServerGetWalletIfNoneMatch(t *testing.T) {
+	currentETag := walletETag(wallet.Sequence(2), wallet.WalletHmac("my-hmac"))
+	tt := []struct {
+		name        string
+		ifNoneMatch string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectGetWallet     bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "not modified",
+			ifNoneMatch:        currentETag,
+			expectedStatusCode: http.StatusNotModified,
+		},
+		{
+			name:               "not modified, weak and in a list",
+			ifNoneMatch:        `"something-else", W/` + currentETag,
+			expectedStatusCode: http.StatusNotModified,
+		},
+		{
+			name:               "modified",
+			ifNoneMatch:        walletETag(wallet.Sequence(1), wallet.WalletHmac("my-old-hmac")),
+			expectedStatusCode: http.StatusOK,
+			expectGetWallet:    true,
+		},
+		{
+			name:                "no wallet",
+			ifNoneMatch:         currentETag,
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletHead: store.ErrNoWallet},
+		},
+		{
+			name:                "db error getting wallet head",
+			ifNoneMatch:         currentETag,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletHead: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(2),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			w := httptest.NewRecorder()
+
+			s.getWallet(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if calledGetWallet := testStore.Called.GetWallet != ""; calledGetWallet != tc.expectGetWallet {
+				t.Errorf("Expected Store.GetWallet called: %t, got %t", tc.expectGetWallet, calledGetWallet)
+			}
+			if tc.expectedErrorString == "" {
+				if etag := w.Result().Header.Get("ETag"); etag != currentETag {
+					t.Errorf("Expected ETag %s, got %s", currentETag, etag)
+				}
+			}
+			if tc.expectedStatusCode == http.StatusNotModified && len(body) != 0 {
+				t.Errorf("Expected no body for Not Modified, got %s", body)
+			}
+		})
+	}
+}
+
+func TestServerWalletETag(t *testing.T) {
+	etag := walletETag(wallet.Sequence(2), wallet.WalletHmac("my-hmac"))
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Errorf("Expected a quoted ETag, got %s", etag)
+	}
+	if etag == walletETag(wallet.Sequence(3), wallet.WalletHmac("my-hmac")) {
+		t.Errorf("Expected the ETag to change with the sequence")
+	}
+	if etag == walletETag(wallet.Sequence(2), wallet.WalletHmac("my-other-hmac")) {
+		t.Errorf("Expected the ETag to change with the hmac")
+	}
+	if !etagMatches("*", etag) {
+		t.Errorf("Expected * to match any ETag")
+	}
+}
+
+func TestServerGetWalletHead(t *testing.T) {
+	tt := []struct {
+		name string
+		path string
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			path:               paths.PathWalletHead + "?token=seekrit",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "validation error",
+			path:                paths.PathWalletHead,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing token parameter",
+		},
+		{
+			name:                "auth error",
+			path:                paths.PathWalletHead + "?token=seekrit",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:                "no wallet",
+			path:                paths.PathWalletHead + "?token=seekrit",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletHead: store.ErrNoWallet},
+		},
+		{
+			name:                "db error getting wallet head",
+			path:                paths.PathWalletHead + "?token=seekrit",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletHead: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestSequence: wallet.Sequence(2),
+				TestHmac:     wallet.WalletHmac("my-hmac"),
+				TestUpdated:  time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC),
+
+				Errors: tc.storeErrors,
+			}
+
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			s.getWalletHead(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedErrorString != "" {
+				return
+			}
+
+			expected := `{"sequence":2,"hmac":"my-hmac","updated":"2022-07-01T12:00:00Z"}`
+			if string(body) != expected {
+				t.Errorf("Expected response %s, got %s", expected, body)
+			}
+			if want, got := walletETag(wallet.Sequence(2), wallet.WalletHmac("my-hmac")), w.Result().Header.Get("ETag"); want != got {
+				t.Errorf("Expected ETag %s, got %s", want, got)
+			}
+			if testStore.Called.GetWallet != "" {
+				t.Errorf("Expected the wallet head endpoint not to get the whole wallet")
 			}
 		})
 	}
@@ -281,7 +474,7 @@ func TestServerPostWallet(t *testing.T) {
 				t.Errorf("Expected post wallet response to be \"{}\": result: %+v", string(body))
 			}
 
-			if want, got := (SetWalletCall{tc.newEncryptedWallet, tc.newSequence, tc.newHmac}), testStore.Called.SetWallet; tc.expectSetWalletCall && want != got {
+			if want, got := (SetWalletCall{wallet.DefaultWalletId, tc.newEncryptedWallet, tc.newSequence, tc.newHmac}), testStore.Called.SetWallet; tc.expectSetWalletCall && want != got {
 				t.Errorf("Store.SetWallet called with: expected %+v, got %+v", want, got)
 			}
 		})
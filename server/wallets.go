@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+var tooManyWalletsMessage = fmt.Sprintf("Too many wallets. The limit is %d.", store.MaxWalletsPerUser)
+
+type WalletCreateRequest struct {
+	Token           auth.AuthTokenString   `json:"token"`
+	WalletId        wallet.WalletId        `json:"walletId"`
+	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
+	Hmac            wallet.WalletHmac      `json:"hmac"`
+}
+
+func (r *WalletCreateRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if r.WalletId == "" {
+		return fmt.Errorf("Missing 'walletId'")
+	}
+	if !r.WalletId.Validate() {
+		return fmt.Errorf("Invalid 'walletId'")
+	}
+	if r.EncryptedWallet == "" {
+		return fmt.Errorf("Missing 'encryptedWallet'")
+	}
+	if r.Hmac == "" {
+		return fmt.Errorf("Missing 'hmac'")
+	}
+	return nil
+}
+
+type WalletDeleteRequest struct {
+	Token    auth.AuthTokenString `json:"token"`
+	WalletId wallet.WalletId      `json:"walletId"`
+	Sequence wallet.Sequence      `json:"sequence"`
+}
+
+func (r *WalletDeleteRequest) validate() error {
+	if r.Token == "" {
+		return fmt.Errorf("Missing 'token'")
+	}
+	if r.WalletId == "" {
+		return fmt.Errorf("Missing 'walletId'")
+	}
+	if !r.WalletId.Validate() {
+		return fmt.Errorf("Invalid 'walletId'")
+	}
+	if r.Sequence < store.InitialWalletSequence {
+		return fmt.Errorf("Missing or zero-value 'sequence'")
+	}
+	return nil
+}
+
+type WalletListItem struct {
+	WalletId wallet.WalletId   `json:"walletId"`
+	Sequence wallet.Sequence   `json:"sequence"`
+	Hmac     wallet.WalletHmac `json:"hmac"`
+	Updated  time.Time         `json:"updated"`
+}
+
+type WalletListResponse struct {
+	Wallets []WalletListItem `json:"wallets"`
+}
+
+func (s *Server) handleWallets(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		s.getWallets(w, req)
+	} else if req.Method == http.MethodPost {
+		s.postWallets(w, req)
+	} else {
+		errorJson(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// The heads of all of a user's wallets, so a client can tell which ones it
+// needs to download
+func (s *Server) getWallets(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token, paramsErr := getTokenParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	heads, err := s.store.ListWallets(authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error listing wallets")
+		return
+	}
+
+	listResponse := WalletListResponse{Wallets: []WalletListItem{}}
+	for _, head := range heads {
+		listResponse.Wallets = append(listResponse.Wallets, WalletListItem{
+			WalletId: head.WalletId,
+			Sequence: head.Sequence,
+			Hmac:     head.Hmac,
+			Updated:  head.Updated,
+		})
+	}
+
+	response, err := json.Marshal(listResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating wallet list response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Response Code:
+//
+//	200: Wallet created, with sequence InitialWalletSequence
+//	409: The user already has a wallet with this id
+//	429: The user already has MaxWalletsPerUser wallets
+//	500: Wallet not created for unanticipated reasons
+func (s *Server) postWallets(w http.ResponseWriter, req *http.Request) {
+	var createRequest WalletCreateRequest
+	if !getPostData(w, req, &createRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, createRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.CreateWallet(authToken.UserId, createRequest.WalletId, createRequest.EncryptedWallet, createRequest.Hmac)
+	if err == store.ErrDuplicateWallet {
+		errorJson(w, http.StatusConflict, "Wallet already exists")
+		return
+	} else if err == store.ErrTooManyWallets {
+		errorJson(w, http.StatusTooManyRequests, tooManyWalletsMessage)
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error creating wallet")
+		return
+	}
+
+	var createResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(createResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating wallet create response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	s.walletSaved(req, authToken, createRequest.WalletId, store.InitialWalletSequence)
+}
+
+// Response Code:
+//
+//	200: Wallet deleted
+//	404: The user has no wallet with this id
+//	409: The sequence isn't the wallet's current sequence
+//	500: Wallet not deleted for unanticipated reasons
+func (s *Server) postWalletsDelete(w http.ResponseWriter, req *http.Request) {
+	var deleteRequest WalletDeleteRequest
+	if !getPostData(w, req, &deleteRequest) {
+		return
+	}
+
+	authToken := s.checkAuth(w, req, deleteRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.DeleteWallet(authToken.UserId, deleteRequest.WalletId, deleteRequest.Sequence)
+	if err == store.ErrNoWallet {
+		errorJson(w, http.StatusNotFound, "No wallet")
+		return
+	} else if err == store.ErrWrongSequence {
+		errorJson(w, http.StatusConflict, "Bad sequence number")
+		return
+	} else if err != nil {
+		internalServiceErrorJson(w, req, err, "Error deleting wallet")
+		return
+	}
+
+	var deleteResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(deleteResponse)
+	if err != nil {
+		internalServiceErrorJson(w, req, err, "Error generating wallet delete response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+
+	s.recordAuditEvent(req, store.AuditEventWalletDelete, authToken.UserId, authToken.DeviceId)
+	logging.FromContext(req.Context()).Info("Wallet deleted", logging.F("user_id", authToken.UserId), logging.F("wallet_id", deleteRequest.WalletId))
+}
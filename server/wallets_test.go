@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerGetWallets(t *testing.T) {
+	updated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tt := []struct {
+		name        string
+		heads       []store.WalletHead
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedBody        string
+	}{
+		{
+			name:               "no wallets",
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       `{"wallets":[]}`,
+		},
+		{
+			name: "wallets",
+			heads: []store.WalletHead{
+				{WalletId: wallet.DefaultWalletId, Sequence: 3, Hmac: "my-hmac-a", Updated: updated},
+				{WalletId: "savings", Sequence: 1, Hmac: "my-hmac-b", Updated: updated},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody: `{"wallets":[` +
+				`{"walletId":"default_wallet","sequence":3,"hmac":"my-hmac-a","updated":"2026-01-02T03:04:05Z"},` +
+				`{"walletId":"savings","sequence":1,"hmac":"my-hmac-b","updated":"2026-01-02T03:04:05Z"}]}`,
+		},
+		{
+			name:                "db error",
+			storeErrors:         TestStoreFunctionsErrors{ListWallets: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken:   auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				TestWalletHeads: tc.heads,
+				Errors:          tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWallets+"?token=seekrit", nil)
+			w := httptest.NewRecorder()
+
+			s.handleWallets(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedErrorString == "" && string(body) != tc.expectedBody {
+				t.Errorf("Expected response %s, got %s", tc.expectedBody, body)
+			}
+			if !testStore.Called.ListWallets {
+				t.Errorf("Expected Store.ListWallets to be called")
+			}
+		})
+	}
+}
+
+func TestServerPostWallets(t *testing.T) {
+	validBody := `{"token": "seekrit", "walletId": "savings", "encryptedWallet": "my-encrypted-wallet", "hmac": "my-hmac"}`
+	validCall := &CreateWalletCall{WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"}
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *CreateWalletCall
+		expectWsMsg         bool
+	}{
+		{
+			name:               "success",
+			requestBody:        validBody,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       validCall,
+			expectWsMsg:        true,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit", "walletId": "my savings", "encryptedWallet": "my-encrypted-wallet", "hmac": "my-hmac"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'walletId'",
+		},
+		{
+			name:                "already exists",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CreateWallet: store.ErrDuplicateWallet},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Wallet already exists",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "too many wallets",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CreateWallet: store.ErrTooManyWallets},
+			expectedStatusCode:  http.StatusTooManyRequests,
+			expectedErrorString: http.StatusText(http.StatusTooManyRequests) + ": " + tooManyWalletsMessage,
+			expectedCall:        validCall,
+		},
+		{
+			name:                "db error",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{CreateWallet: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        validCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: auth.UserId(37)},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallets, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.handleWallets(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(testStore.Called.CreateWallet, tc.expectedCall) {
+				t.Errorf("Expected CreateWallet call %+v, got %+v", tc.expectedCall, testStore.Called.CreateWallet)
+			}
+			if tc.expectedErrorString == "" && string(body) != "{}" {
+				t.Errorf("Expected create wallet response to be \"{}\": result: %+v", string(body))
+			}
+
+			if tc.expectWsMsg && (wsmm.walletUpdateUserId != testStore.TestAuthToken.UserId || wsmm.walletUpdateWalletId != "savings") {
+				t.Errorf("Expected websocket message to update wallet savings, got user %d wallet %s", wsmm.walletUpdateUserId, wsmm.walletUpdateWalletId)
+			}
+			if !tc.expectWsMsg && wsmm.walletUpdateUserId == testStore.TestAuthToken.UserId {
+				t.Error("Expected no websocket message to update wallet")
+			}
+		})
+	}
+}
+
+func TestServerPostWalletsDelete(t *testing.T) {
+	validBody := `{"token": "seekrit", "walletId": "savings", "sequence": 4}`
+	validCall := &DeleteWalletCall{WalletId: "savings", Sequence: 4}
+	tt := []struct {
+		name        string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedCall        *DeleteWalletCall
+	}{
+		{
+			name:               "success",
+			requestBody:        validBody,
+			expectedStatusCode: http.StatusOK,
+			expectedCall:       validCall,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit", "sequence": 4}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'walletId'",
+		},
+		{
+			name:                "no wallet",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{DeleteWallet: store.ErrNoWallet},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "conflict",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{DeleteWallet: store.ErrWrongSequence},
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectedCall:        validCall,
+		},
+		{
+			name:                "db error",
+			requestBody:         validBody,
+			storeErrors:         TestStoreFunctionsErrors{DeleteWallet: fmt.Errorf("Some random DB Error!")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedCall:        validCall,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull, UserId: auth.UserId(37)},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletsDelete, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.postWalletsDelete(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !reflect.DeepEqual(testStore.Called.DeleteWallet, tc.expectedCall) {
+				t.Errorf("Expected DeleteWallet call %+v, got %+v", tc.expectedCall, testStore.Called.DeleteWallet)
+			}
+
+			success := tc.expectedErrorString == ""
+			if success && string(body) != "{}" {
+				t.Errorf("Expected delete wallet response to be \"{}\": result: %+v", string(body))
+			}
+			auditedDelete := len(testStore.Called.AuditEvents) == 1 && testStore.Called.AuditEvents[0].Event.Type == store.AuditEventWalletDelete
+			if success != auditedDelete {
+				t.Errorf("Expected a wallet-delete audit event only on success, got %+v", testStore.Called.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestServerValidateWalletCreateRequest(t *testing.T) {
+	createRequest := WalletCreateRequest{Token: "seekrit", WalletId: "savings", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"}
+	if createRequest.validate() != nil {
+		t.Errorf("Expected valid WalletCreateRequest to successfully validate")
+	}
+
+	tt := []struct {
+		createRequest       WalletCreateRequest
+		expectedErrorSubstr string
+		failureDescription  string
+	}{
+		{
+			WalletCreateRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"},
+			"walletId",
+			"Expected WalletCreateRequest with missing wallet id to not successfully validate",
+		}, {
+			WalletCreateRequest{Token: "seekrit", WalletId: wallet.WalletId(strings.Repeat("a", 65)), EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"},
+			"walletId",
+			"Expected WalletCreateRequest with too long a wallet id to not successfully validate",
+		}, {
+			WalletCreateRequest{Token: "seekrit", WalletId: "savings", Hmac: "my-hmac"},
+			"encryptedWallet",
+			"Expected WalletCreateRequest with missing encrypted wallet to not successfully validate",
+		}, {
+			WalletCreateRequest{Token: "seekrit", WalletId: "savings", EncryptedWallet: "my-encrypted-wallet"},
+			"hmac",
+			"Expected WalletCreateRequest with missing hmac to not successfully validate",
+		},
+	}
+	for _, tc := range tt {
+		err := tc.createRequest.validate()
+		if err == nil || !strings.Contains(err.Error(), tc.expectedErrorSubstr) {
+			t.Errorf(tc.failureDescription)
+		}
+	}
+}
+
+func TestServerWalletUpdateMessages(t *testing.T) {
+	defaultMsg := wsClientNotifyMsg{wsClientNotifyUpdate, wallet.DefaultWalletId, 12}
+	namedMsg := wsClientNotifyMsg{wsClientNotifyUpdate, "savings", 3}
+
+	// Unchanged for the default wallet, so older clients still understand it
+	if want, got := "wallet-update:12", string(walletUpdateWSMessage(defaultMsg)); want != got {
+		t.Errorf("Expected websocket message %q, got %q", want, got)
+	}
+	if want, got := "wallet-update:savings:3", string(walletUpdateWSMessage(namedMsg)); want != got {
+		t.Errorf("Expected websocket message %q, got %q", want, got)
+	}
+	if want, got := "event: wallet-update\ndata: savings:3\n\n", string(walletUpdateSSEMessage(namedMsg)); want != got {
+		t.Errorf("Expected event stream message %q, got %q", want, got)
+	}
+}
+
+func TestServerWalletIdParam(t *testing.T) {
+	tt := []struct {
+		query            string
+		expectedWalletId wallet.WalletId
+		expectError      bool
+	}{
+		{"", wallet.DefaultWalletId, false},
+		{"walletId=savings", "savings", false},
+		{"walletId=my%20savings", "", true},
+	}
+	for _, tc := range tt {
+		req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?"+tc.query, nil)
+		walletId, err := getWalletIdParam(req)
+		if (err != nil) != tc.expectError || (!tc.expectError && walletId != tc.expectedWalletId) {
+			t.Errorf("Query %q: expected wallet id %q (error: %t), got %q, %+v", tc.query, tc.expectedWalletId, tc.expectError, walletId, err)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package server
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/wallet"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Using this as a guide:
@@ -38,30 +42,41 @@ const (
 // wsClientNotifyMsg is sent over wsClient.notify by the websocket manager
 type wsClientNotifyMsg struct {
 	notifyType wsClientNotifyType
+	walletId   wallet.WalletId
 	sequence   wallet.Sequence
 }
 
 const notifyChanBuffer = 5 // Each client shouldn't be getting a lot of concurrent messages
 
+// Sent to clients when we disconnect them because the server is shutting down
+const serverRestartingReason = "Server restarting, reconnect"
+
 // Given a wsClientNotifyMsg of type wsClientNotifyUpdate, turn it into an
-// appropriate message to the client to be sent over websocket
+// appropriate message to the client to be sent over websocket. The default
+// wallet's message is left as it was before there were named wallets, so that
+// older clients still understand it.
 func walletUpdateWSMessage(msg wsClientNotifyMsg) []byte {
-	return []byte(fmt.Sprintf("wallet-update:%d", msg.sequence))
+	if msg.walletId == wallet.DefaultWalletId {
+		return []byte(fmt.Sprintf("wallet-update:%d", msg.sequence))
+	}
+	return []byte(fmt.Sprintf("wallet-update:%s:%d", msg.walletId, msg.sequence))
 }
 
-// Poor man's debug log
-const debugWebsockets = false
-
+// Socket manager internals. Only formatted if we're logging at debug level,
+// since some of these are on busy paths.
 func debugLog(format string, v ...any) {
-	if debugWebsockets {
-		log.Printf(format, v...)
+	if logging.Default().Enabled(logging.LevelDebug) {
+		logging.Debug(fmt.Sprintf(format, v...))
 	}
 }
 
-// Represents a connection to a client.
+// Represents a connection to a client. For clients that are not on a websocket
+// (event streams and long-polls), socket is nil and the request handler itself
+// reads from notify.
 type wsClient struct {
-	socket *websocket.Conn
-	notify chan wsClientNotifyMsg
+	socket   *websocket.Conn
+	deviceId auth.DeviceId
+	notify   chan wsClientNotifyMsg
 }
 
 // Each user with at least one actively connected client will have one of these
@@ -75,6 +90,92 @@ type wsClientForUser struct {
 	client *wsClient
 }
 
+// Sent back by the websocket manager in response to a request to add a
+// client, saying whether it was added or which connection limit it ran into.
+type wsClientAddResult int
+
+const (
+	wsClientAdded = wsClientAddResult(iota)
+	wsClientOverUserLimit
+	wsClientOverDeviceLimit
+	wsClientOverTotalLimit
+
+	// The server is shutting down
+	wsClientServerDraining
+)
+
+// For metrics labels
+func (r wsClientAddResult) limitName() string {
+	switch r {
+	case wsClientOverUserLimit:
+		return "user"
+	case wsClientOverDeviceLimit:
+		return "device"
+	case wsClientOverTotalLimit:
+		return "total"
+	case wsClientServerDraining:
+		return "draining"
+	}
+	return ""
+}
+
+// Safe to give to the client
+func (r wsClientAddResult) reason() string {
+	switch r {
+	case wsClientOverUserLimit:
+		return "Too many connections for this user"
+	case wsClientOverDeviceLimit:
+		return "Too many connections for this device"
+	case wsClientOverTotalLimit:
+		return "Too many connections to the server"
+	case wsClientServerDraining:
+		return serverRestartingReason
+	}
+	return ""
+}
+
+// Going over a user or device limit means the client is misbehaving (or there
+// are too many clients), so trying again won't help. Going over the total
+// limit is on us, so they can try again later.
+func (r wsClientAddResult) closeCode() int {
+	switch r {
+	case wsClientOverTotalLimit:
+		return websocket.CloseTryAgainLater
+	case wsClientServerDraining:
+		return websocket.CloseServiceRestart
+	}
+	return websocket.ClosePolicyViolation
+}
+
+// Same idea as closeCode, for clients that aren't websockets
+func (r wsClientAddResult) httpStatus() int {
+	if r == wsClientOverTotalLimit || r == wsClientServerDraining {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// A message sent over a channel to ask the manager to add a client. The
+// manager responds over `result`.
+type wsClientAddMsg struct {
+	wsClientForUser
+	result chan wsClientAddResult
+}
+
+// Ask the manager to add a client, and wait to find out whether it did.
+func (s *Server) addClient(userId auth.UserId, client *wsClient) wsClientAddResult {
+	// No sense in adding a client that we're about to disconnect. Tell it to go
+	// reconnect (hopefully to another server) now.
+	if s.isDraining() {
+		return wsClientServerDraining
+	}
+
+	// Buffered so the manager never waits on us
+	result := make(chan wsClientAddResult, 1)
+	s.shardFor(userId).clientAdd <- wsClientAddMsg{wsClientForUser{userId, client}, result}
+	return <-result
+}
+
 var upgrader = websocket.Upgrader{} // use default options
 
 // Just handle ping/pong
@@ -82,7 +183,7 @@ func (s *Server) wsReader(userId auth.UserId, client *wsClient) {
 	defer func() {
 		// Since wsWriter is waiting on the notify channel, tell the manager to
 		// close it. This will make wsWriter stop (if it hasn't already).
-		s.clientRemove <- wsClientForUser{userId, client}
+		s.shardFor(userId).clientRemove <- wsClientForUser{userId, client}
 		client.socket.Close()
 
 		debugLog("Done with wsReader %+v", client)
@@ -112,7 +213,7 @@ func (s *Server) wsWriter(userId auth.UserId, client *wsClient) {
 
 	for notifyMsg := range client.notify {
 		if notifyMsg.notifyType != wsClientNotifyUpdate {
-			log.Printf("wsWriter: Got an unknown message type! %+v", notifyMsg)
+			logging.Error("wsWriter: Got an unknown message type!", logging.F("message", notifyMsg))
 			continue
 		}
 		debugLog("wsWriter: notify update")
@@ -143,7 +244,7 @@ func (s *Server) websocket(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	authToken := s.checkAuth(w, token, auth.ScopeFull)
+	authToken := s.checkAuth(w, req, token, auth.ScopeFull)
 
 	if authToken == nil {
 		return
@@ -153,22 +254,140 @@ func (s *Server) websocket(w http.ResponseWriter, req *http.Request) {
 
 	ws, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Println(err)
+		logging.FromContext(req.Context()).Warn("Error upgrading to websocket", logging.Err(err))
 		return
 	}
 
-	client := wsClient{ws, make(chan wsClientNotifyMsg, notifyChanBuffer)}
-	newClient := wsClientForUser{authToken.UserId, &client}
-	s.clientAdd <- newClient
+	client := wsClient{
+		socket:   ws,
+		deviceId: authToken.DeviceId,
+		notify:   make(chan wsClientNotifyMsg, notifyChanBuffer),
+	}
+	if result := s.addClient(authToken.UserId, &client); result != wsClientAdded {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(result.closeCode(), result.reason()), time.Now().Add(writeWait))
+		ws.Close()
+		return
+	}
 
 	go s.wsReader(authToken.UserId, &client)
 	go s.wsWriter(authToken.UserId, &client)
 
-	log.Println("Client Connected")
+	logging.FromContext(req.Context()).Debug("Client Connected", logging.F("user_id", authToken.UserId))
+}
+
+// The socket manager is split into shards, each running in its own goroutine
+// with its own channels, so that one busy goroutine doesn't hold up
+// notifications for everybody. All of a given user's clients live in the same
+// shard (picked by user id), so the shards don't need to know about each
+// other, except for the total connection count.
+const socketManagerShards = 16
+
+type socketShard struct {
+	clientAdd     chan wsClientAddMsg
+	clientRemove  chan wsClientForUser
+	userRemove    chan wsClientForUser
+	walletUpdates chan walletUpdateMsg
+}
+
+func newSocketShards(numShards int) []*socketShard {
+	shards := make([]*socketShard, numShards)
+	for i := range shards {
+		// Anything that could get backed up by a lot of requests, let's just
+		// give it a buffer. Starting small until we start to see dashboard
+		// stats on this. I want a sense of how this grows with the number of
+		// users or whatnot.
+		shards[i] = &socketShard{
+			clientAdd:     make(chan wsClientAddMsg, 5),
+			clientRemove:  make(chan wsClientForUser, 5),
+			userRemove:    make(chan wsClientForUser, 5),
+			walletUpdates: make(chan walletUpdateMsg, 5),
+		}
+	}
+	return shards
+}
+
+func (s *Server) shardFor(userId auth.UserId) *socketShard {
+	return s.shards[uint32(userId)%uint32(len(s.shards))]
+}
+
+// Inform the user's other clients that there's a new wallet. If we can't do it
+// within 100 milliseconds, don't bother. It's a nice-to-have, not mission
+// critical. But, count the misses on the dashboard. If it happens a lot we
+// should probably increase the buffer on the shard's walletUpdates chan, or
+// the number of shards.
+//
+// Returns whether the notification was handed off to the manager.
+func (s *Server) notifyWalletUpdate(userId auth.UserId, walletId wallet.WalletId, sequence wallet.Sequence) bool {
+	timeout := time.NewTicker(100 * time.Millisecond)
+	defer timeout.Stop()
+	select {
+	case s.shardFor(userId).walletUpdates <- walletUpdateMsg{userId, walletId, sequence}:
+		return true
+	case <-timeout.C:
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-client-notify"}).Inc()
+		return false
+	}
+}
+
+type socketLimits struct {
+	perUser   int
+	perDevice int
+	total     int
 }
 
 func (s *Server) manageSockets(done chan bool, finish chan bool) {
-	log.Println("Socket manager start")
+	logging.Info("Socket manager start")
+	atomic.StoreInt32(&s.socketsRunning, 1)
+	defer atomic.StoreInt32(&s.socketsRunning, 0)
+
+	// Config errors are reported on startup, so this shouldn't happen. But if it
+	// does, it's better to keep running without limits than not at all.
+	var limits socketLimits
+	var err error
+	limits.perUser, limits.perDevice, limits.total, err = env.GetSocketLimits(s.env)
+	if err != nil {
+		logging.Error("Error getting socket limits, running without them", logging.Err(err))
+	}
+
+	// Buffered so that shards that finish after we give up on them don't get
+	// stuck.
+	shardsDone := make(chan bool, len(s.shards))
+	shardsFinish := make([]chan bool, len(s.shards))
+	for i, shard := range s.shards {
+		shardsFinish[i] = make(chan bool)
+		go s.manageSocketShard(shard, limits, shardsDone, shardsFinish[i])
+	}
+
+	<-finish
+
+	logging.Info("Cleaning up sockets")
+
+	for _, shardFinish := range shardsFinish {
+		shardFinish <- true
+	}
+
+	// If it takes more than 10 seconds for whatever reason, just bail.
+	timeout := time.NewTimer(10 * time.Second)
+	defer timeout.Stop()
+	for range s.shards {
+		select {
+		case <-shardsDone:
+		case <-timeout.C:
+			logging.Warn("Giving up on closing remaining sockets cleanly.")
+
+			// This will signal to main to exit, which will end the program
+			done <- true
+
+			logging.Warn("Socket manager impolite finish")
+			return
+		}
+	}
+
+	done <- true
+	logging.Info("Socket manager finish")
+}
+
+func (s *Server) manageSocketShard(shard *socketShard, limits socketLimits, done chan bool, finish chan bool) {
 	clientsByUser := make(map[auth.UserId]wsClientSet)
 
 	removeClient := func(userId auth.UserId, client *wsClient) {
@@ -182,9 +401,12 @@ func (s *Server) manageSockets(done chan bool, finish chan bool) {
 
 		close(client.notify)
 		delete(clientsByUser[userId], client)
+		atomic.AddInt64(&s.numClients, -1)
+		metrics.ConnectedSockets.Dec()
 
 		if len(clientsByUser[userId]) == 0 {
 			delete(clientsByUser, userId)
+			metrics.ConnectedUsers.Dec()
 		}
 	}
 
@@ -196,79 +418,105 @@ func (s *Server) manageSockets(done chan bool, finish chan bool) {
 		}
 	}
 
-	addClient := func(userId auth.UserId, client *wsClient) {
+	checkLimits := func(userId auth.UserId, client *wsClient) wsClientAddResult {
+		if limits.perUser > 0 && len(clientsByUser[userId]) >= limits.perUser {
+			return wsClientOverUserLimit
+		}
+		if limits.perDevice > 0 {
+			deviceClients := 0
+			for userClient := range clientsByUser[userId] {
+				if userClient.deviceId == client.deviceId {
+					deviceClients++
+				}
+			}
+			if deviceClients >= limits.perDevice {
+				return wsClientOverDeviceLimit
+			}
+		}
+		// The total is shared between shards. Claim a spot, and give it back if
+		// it turns out there wasn't one.
+		numClients := atomic.AddInt64(&s.numClients, 1)
+		if limits.total > 0 && numClients > int64(limits.total) {
+			atomic.AddInt64(&s.numClients, -1)
+			return wsClientOverTotalLimit
+		}
+		return wsClientAdded
+	}
+
+	addClient := func(userId auth.UserId, client *wsClient) wsClientAddResult {
 		debugLog("addClient %+v", client)
+		if result := checkLimits(userId, client); result != wsClientAdded {
+			metrics.RejectedSocketsCount.With(prometheus.Labels{"limit": result.limitName()}).Inc()
+			return result
+		}
 		if _, ok := clientsByUser[userId]; !ok {
 			clientsByUser[userId] = make(wsClientSet)
+			metrics.ConnectedUsers.Inc()
 		}
 		clientsByUser[userId][client] = true
+		metrics.ConnectedSockets.Inc()
+		return wsClientAdded
 	}
 
 manage:
 	for {
 		select {
-		case msg := <-s.walletUpdates:
+		case msg := <-shard.walletUpdates:
 			for client := range clientsByUser[msg.userId] {
 				select {
-				case client.notify <- wsClientNotifyMsg{wsClientNotifyUpdate, msg.sequence}:
+				case client.notify <- wsClientNotifyMsg{wsClientNotifyUpdate, msg.walletId, msg.sequence}:
 				default:
-					log.Println("This is a bug: Channel was somehow closed but the manager has not (yet) received a clientRemove message.")
+					logging.Error("This is a bug: Channel was somehow closed but the manager has not (yet) received a clientRemove message.")
 
 					// The example program had this, but I don't see why.
 					removeClient(msg.userId, client)
 				}
 			}
-		case removedUser := <-s.userRemove:
+		case removedUser := <-shard.userRemove:
 			removeUser(removedUser.userId)
-		case retiredClient := <-s.clientRemove:
+		case retiredClient := <-shard.clientRemove:
 			removeClient(retiredClient.userId, retiredClient.client)
-		case newClient := <-s.clientAdd:
-			addClient(newClient.userId, newClient.client)
+		case newClient := <-shard.clientAdd:
+			newClient.result <- addClient(newClient.userId, newClient.client)
 		case <-finish:
 			break manage
 		}
 	}
 
-	log.Println("Cleaning up sockets")
-
 	debugLog("Running any addClient messages that snuck in...")
 
 	// By the time the `finish` channel has triggered, the web server has shut
 	// down, so we won't have any clientAdd events _triggered_ by this point.
-	// However, one (or more, if we add a buffer later) may be in the queue, so
+	// However, some may be in the queue (it has a buffer), so
 	// let's keep track of them here so we can close them. But we close the
 	// clientAdd channel first so we can break out of this loop.
 
 	// We assume that the server is done writing at this point, thus it's safe
 	// to close this channel here.
-	close(s.clientAdd)
-	for newClient := range s.clientAdd {
-		addClient(newClient.userId, newClient.client)
+	close(shard.clientAdd)
+	for newClient := range shard.clientAdd {
+		newClient.result <- addClient(newClient.userId, newClient.client)
 	}
 
 	// Now that we know about every running client, just close all of the sockets
-	// (double-closing seems to be safe, so we don't care about races here). But
-	// if it takes more than 10 seconds for whatever reason, just bail.
-
-	ticker := time.NewTicker(10 * time.Second)
-	go func() {
-		select {
-		case <-ticker.C:
-			log.Println("Giving up on closing remaining sockets cleanly.")
-
-			// This will signal to main to exit, which will end the program
-			done <- true
-
-			log.Println("Socket manager impolite finish")
-		}
-	}()
+	// (double-closing seems to be safe, so we don't care about races here).
 
 	debugLog("Closing sockets...")
 	for _, userClients := range clientsByUser {
 		for client := range userClients {
+			if client.socket == nil {
+				// Not a websocket. The request handler has been told to finish by the
+				// server shutting down.
+				continue
+			}
 			debugLog("Closing socket for %+v", client)
-			client.socket.SetWriteDeadline(time.Now().Add(writeWait))
-			client.socket.WriteMessage(websocket.CloseMessage, []byte{})
+			// WriteControl, unlike WriteMessage, is safe to call while wsWriter may
+			// be writing to the same socket.
+			client.socket.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, serverRestartingReason),
+				time.Now().Add(writeWait),
+			)
 			// TODO - wait for receiving the CloseMessage?
 			client.socket.Close()
 			debugLog("Closed socket for %+v", client)
@@ -281,5 +529,4 @@ manage:
 	// place? (Probably doesn't automatically send the Close message at least.)
 
 	done <- true
-	log.Println("Socket manager finish")
 }
@@ -1,8 +1,19 @@
 package server
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func TestWebsocketManagerQuits(t *testing.T) {
@@ -33,3 +44,187 @@ func TestWebsocketManagerQuits(t *testing.T) {
 // with websockets here, is a real pain in the ass, and it's probably not the
 // highest priority right now. If websockets become higher profile we can work
 // on it again.
+
+func TestWebsocketManagerLimits(t *testing.T) {
+	env := map[string]string{
+		"MAX_SOCKETS_PER_USER":   "3",
+		"MAX_SOCKETS_PER_DEVICE": "2",
+		"MAX_SOCKETS_TOTAL":      "4",
+	}
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{env}, &TestMail{}, TestPort)
+	done := make(chan bool)
+	finish := make(chan bool)
+
+	go s.manageSockets(done, finish)
+
+	newClient := func(deviceId auth.DeviceId) *wsClient {
+		return &wsClient{deviceId: deviceId, notify: make(chan wsClientNotifyMsg, notifyChanBuffer)}
+	}
+
+	tt := []struct {
+		userId         auth.UserId
+		deviceId       auth.DeviceId
+		expectedResult wsClientAddResult
+	}{
+		{1, "dev-1", wsClientAdded},
+		{1, "dev-1", wsClientAdded},
+		{1, "dev-1", wsClientOverDeviceLimit},
+		{1, "dev-2", wsClientAdded},
+		{1, "dev-3", wsClientOverUserLimit},
+		{2, "dev-1", wsClientAdded},
+		{3, "dev-1", wsClientOverTotalLimit},
+	}
+	var lastClient *wsClient
+	for i, tc := range tt {
+		client := newClient(tc.deviceId)
+		if want, got := tc.expectedResult, s.addClient(tc.userId, client); want != got {
+			t.Errorf("Client %d: expected add result %d, got %d", i, want, got)
+		}
+		if tc.expectedResult == wsClientAdded {
+			lastClient = client
+		}
+	}
+
+	// Make room and try again
+	s.shardFor(2).clientRemove <- wsClientForUser{2, lastClient}
+	// The notify channel gets closed once it's removed. User 3 is in a different
+	// shard, so we need to wait for this before trying.
+	<-lastClient.notify
+	if want, got := wsClientAdded, s.addClient(3, newClient("dev-1")); want != got {
+		t.Errorf("Expected add result %d after removing a client, got %d", want, got)
+	}
+
+	finish <- true
+	<-done
+}
+
+// Simulates lots of connected clients and reports how many wallet update
+// notifications get dropped by notifyWalletUpdate. The clients don't have real
+// sockets (like event stream and long-poll clients), so this measures the
+// socket manager rather than the network.
+func BenchmarkSocketManagerWalletUpdates(b *testing.B) {
+	const numUsers = 20000
+	const clientsPerUser = 2
+
+	for _, numShards := range []int{1, socketManagerShards} {
+		b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+			s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+			s.shards = newSocketShards(numShards)
+			done := make(chan bool)
+			finish := make(chan bool)
+			go s.manageSockets(done, finish)
+
+			var received int64
+			var clientsDone sync.WaitGroup
+			for userId := auth.UserId(1); userId <= numUsers; userId++ {
+				for i := 0; i < clientsPerUser; i++ {
+					client := &wsClient{deviceId: auth.DeviceId(fmt.Sprintf("dev-%d", i)), notify: make(chan wsClientNotifyMsg, notifyChanBuffer)}
+					if s.addClient(userId, client) != wsClientAdded {
+						b.Fatal("Unexpected failure to add client")
+					}
+					clientsDone.Add(1)
+					go func() {
+						for range client.notify {
+							atomic.AddInt64(&received, 1)
+						}
+						clientsDone.Done()
+					}()
+				}
+			}
+
+			var dropped int64
+			var nextUserId int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					userId := auth.UserId(atomic.AddInt64(&nextUserId, 1)%numUsers + 1)
+					if !s.notifyWalletUpdate(userId, wallet.DefaultWalletId, 2) {
+						atomic.AddInt64(&dropped, 1)
+					}
+				}
+			})
+			b.StopTimer()
+
+			// Close out all of the clients so their goroutines finish
+			for userId := auth.UserId(1); userId <= numUsers; userId++ {
+				s.shardFor(userId).userRemove <- wsClientForUser{userId, nil}
+			}
+			clientsDone.Wait()
+			finish <- true
+			<-done
+
+			b.ReportMetric(float64(dropped)/float64(b.N), "dropped/op")
+			b.ReportMetric(float64(received)/float64(b.N), "received/op")
+		})
+	}
+}
+
+func TestWebsocketManagerDraining(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	s.setDraining()
+
+	// No manager running. If addClient tried to talk to it, it would get stuck.
+	client := &wsClient{notify: make(chan wsClientNotifyMsg, notifyChanBuffer)}
+	if want, got := wsClientServerDraining, s.addClient(1, client); want != got {
+		t.Errorf("Expected add result %d while draining, got %d", want, got)
+	}
+}
+
+func TestWebsocketServerRestartCloseCode(t *testing.T) {
+	const userId = auth.UserId(37)
+
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{
+			Token:  auth.AuthTokenString("seekrit"),
+			Scope:  auth.ScopeFull,
+			UserId: userId,
+		},
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+	done := make(chan bool)
+	finish := make(chan bool)
+	go s.manageSockets(done, finish)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.websocket))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?token=seekrit", nil)
+	if err != nil {
+		t.Fatalf("Error connecting to websocket: %+v", err)
+	}
+	defer conn.Close()
+
+	// Once we get a wallet update, we know the manager has the client
+	gotMessage := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-gotMessage:
+				return
+			case <-ticker.C:
+				s.notifyWalletUpdate(userId, wallet.DefaultWalletId, 5)
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	close(gotMessage)
+	if err != nil || string(msg) != "wallet-update:5" {
+		t.Fatalf("Expected wallet update message, got %s err: %+v", msg, err)
+	}
+
+	finish <- true
+	<-done
+
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Errorf("Expected close code %d, got %+v", websocket.CloseServiceRestart, err)
+	}
+}
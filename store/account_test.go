@@ -9,6 +9,8 @@ import (
 	"github.com/mattn/go-sqlite3"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func expectAccountMatch(
@@ -136,7 +138,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Create an account. Make it verified (i.e. no token) for the usual
 	// case. We'll test unverified (with token) separately.
-	if err := s.CreateAccount(email, password, seed, nil); err != nil {
+	if err := s.CreateAccount(email, password, seed, nil, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -147,7 +149,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Try to create a new account with the same email and different password,
 	// fail because email already exists
-	if err := s.CreateAccount(email, newPassword, seed, nil); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(email, newPassword, seed, nil, ""); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -155,7 +157,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Try to create a new account with the same email different capitalization.
 	// fail because email already exists
-	if err := s.CreateAccount(differentCaseEmail, password, seed, nil); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(differentCaseEmail, password, seed, nil, ""); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err (for case insensitivity check): wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -178,11 +180,11 @@ func TestStoreCreateAccountTwoVerifiedSucceed(t *testing.T) {
 	// Create a couple accounts. Don't care if they have the same password.
 	// Make them verified (i.e. no token) for the usual
 	// case. We'll test unverified (with token) separately.
-	if err := s.CreateAccount(email1, password1, seed1, nil); err != nil {
+	if err := s.CreateAccount(email1, password1, seed1, nil, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
-	if err := s.CreateAccount(email2, password2, seed2, nil); err != nil {
+	if err := s.CreateAccount(email2, password2, seed2, nil, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -207,12 +209,12 @@ func TestStoreCreateAccountTwoSameVerfiyTokenFail(t *testing.T) {
 	verifyToken2 := auth.VerifyTokenString("00001234abcd1234abcd123400000000")
 
 	// Create the first account
-	if err := s.CreateAccount(email1, password1, seed1, &verifyToken1); err != nil {
+	if err := s.CreateAccount(email1, password1, seed1, &verifyToken1, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
 	// Try to create the second account with the same verify token, fail
-	if err := s.CreateAccount(email2, password2, seed2, &verifyToken1); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(email2, password2, seed2, &verifyToken1, ""); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -220,7 +222,7 @@ func TestStoreCreateAccountTwoSameVerfiyTokenFail(t *testing.T) {
 	expectAccountNotExists(t, &s, normEmail2)
 
 	// Create the second account with a different verify token
-	if err := s.CreateAccount(email2, password2, seed2, &verifyToken2); err != nil {
+	if err := s.CreateAccount(email2, password2, seed2, &verifyToken2, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -240,7 +242,7 @@ func TestStoreCreateAccountUnverified(t *testing.T) {
 
 	// Create an account
 	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
-	if err := s.CreateAccount(email, password, seed, &verifyToken); err != nil {
+	if err := s.CreateAccount(email, password, seed, &verifyToken, ""); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -249,6 +251,29 @@ func TestStoreCreateAccountUnverified(t *testing.T) {
 	expectAccountMatch(t, &s, normEmail, email, password, seed, &verifyToken, &approxVerifyExpiration, time.Now().UTC(), time.Now().UTC())
 }
 
+func TestStoreCreateAccountLocale(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+	if err := s.CreateAccount("abc@example.com", "123", "abcd1234abcd1234", &verifyToken, "pt-BR"); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+
+	locale, err := s.UpdateVerifyTokenString("abc@example.com", "00001234abcd1234abcd123400000000")
+	if err != nil || locale != "pt-BR" {
+		t.Errorf("Expected UpdateVerifyTokenString to give the locale, got %q %+v", locale, err)
+	}
+
+	userId, err := s.VerifyAccount("00001234abcd1234abcd123400000000")
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyAccount: %+v", err)
+	}
+	if info, err := s.GetAccountInfo(userId); err != nil || info.Locale != "pt-BR" {
+		t.Errorf("Expected GetAccountInfo to give the locale, got %+v %+v", info, err)
+	}
+}
+
 // Test GetUserId for nonexisting email
 func TestStoreGetUserIdAccountNotExists(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
@@ -303,6 +328,120 @@ func TestStoreGetUserIdAccountUnverified(t *testing.T) {
 	}
 }
 
+func TestStoreGetAccountInfo(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+	verifyExpiration := time.Now().Add(time.Hour)
+	userId, email, _, seed := makeTestUser(t, &s, &verifyToken, &verifyExpiration)
+
+	info, err := s.GetAccountInfo(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetAccountInfo: %+v", err)
+	}
+	if info.Email != email || info.ClientSaltSeed != seed || info.Verified {
+		t.Errorf("Unexpected account info: %+v", info)
+	}
+	if time.Since(info.Created) > time.Minute || time.Since(info.Updated) > time.Minute {
+		t.Errorf("Expected created and updated to be about now, got %+v", info)
+	}
+
+	if _, err := s.VerifyAccount(verifyToken); err != nil {
+		t.Fatalf("Unexpected error in VerifyAccount: %+v", err)
+	}
+	if info, err = s.GetAccountInfo(userId); err != nil || !info.Verified {
+		t.Errorf("Expected a verified account, got %+v %+v", info, err)
+	}
+
+	if _, err := s.GetAccountInfo(userId + 1); err != ErrWrongCredentials {
+		t.Errorf(`GetAccountInfo error for nonexistant account: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
+func TestStoreGetDataExport(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, seed := makeTestUser(t, &s, nil, nil)
+
+	export, err := s.GetDataExport(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetDataExport: %+v", err)
+	}
+	if export.Info.Email != email || export.Info.ClientSaltSeed != seed || !export.Info.Verified {
+		t.Errorf("Unexpected account info: %+v", export.Info)
+	}
+	if export.Wallets == nil || len(export.Wallets) != 0 || export.Devices == nil || len(export.Devices) != 0 {
+		t.Errorf("Expected no wallets or devices, got %+v %+v", export.Wallets, export.Devices)
+	}
+
+	if err := s.SetWallet(userId, "other", wallet.EncryptedWallet("my-other-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-other-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	// Compressed, to make sure it comes out the way it went in
+	s.WalletCompression = compression.Gzip
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	authToken := auth.AuthToken{Token: "my-token", DeviceId: "my-device", UserId: userId, Scope: auth.ScopeFull}
+	if err := s.SaveToken(&authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	export, err = s.GetDataExport(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetDataExport: %+v", err)
+	}
+	if len(export.Wallets) != 2 {
+		t.Fatalf("Expected two wallets, got %+v", export.Wallets)
+	}
+	for i, expected := range []WalletUpdate{
+		{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 1, Hmac: "my-hmac"},
+		{WalletId: "other", EncryptedWallet: "my-other-enc-wallet", Sequence: 1, Hmac: "my-other-hmac"},
+	} {
+		got := export.Wallets[i]
+		if got.WalletId != expected.WalletId || got.EncryptedWallet != expected.EncryptedWallet || got.Sequence != expected.Sequence || got.Hmac != expected.Hmac {
+			t.Errorf("Expected wallet %+v, got %+v", expected, got)
+		}
+		if time.Since(got.Updated) > time.Minute {
+			t.Errorf("Expected updated to be about now, got %+v", got)
+		}
+	}
+	if len(export.Devices) != 1 || export.Devices[0].DeviceId != "my-device" {
+		t.Errorf("Expected one device, got %+v", export.Devices)
+	}
+
+	if _, err := s.GetDataExport(userId + 1); err != ErrWrongCredentials {
+		t.Errorf(`GetDataExport error for nonexistant account: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
+func TestStoreSetNotificationsOff(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// On unless the user turns them off
+	if info, err := s.GetAccountInfo(userId); err != nil || info.NotificationsOff {
+		t.Fatalf("Expected notifications on, got %+v %+v", info, err)
+	}
+
+	for _, off := range []bool{true, false} {
+		if err := s.SetNotificationsOff(userId, off); err != nil {
+			t.Fatalf("Unexpected error in SetNotificationsOff: %+v", err)
+		}
+		if info, err := s.GetAccountInfo(userId); err != nil || info.NotificationsOff != off {
+			t.Errorf("Expected NotificationsOff %v, got %+v %+v", off, info, err)
+		}
+	}
+
+	if err := s.SetNotificationsOff(userId+1, true); err != ErrWrongCredentials {
+		t.Errorf(`SetNotificationsOff error for nonexistant account: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
 func TestStoreAccountEmptyFields(t *testing.T) {
 	// Make sure expiration doesn't get set if sanitization fails
 	tt := []struct {
@@ -334,7 +473,7 @@ func TestStoreAccountEmptyFields(t *testing.T) {
 
 			var sqliteErr sqlite3.Error
 
-			err := s.CreateAccount(tc.email, tc.password, tc.clientSaltSeed, nil)
+			err := s.CreateAccount(tc.email, tc.password, tc.clientSaltSeed, nil, "")
 			if errors.As(err, &sqliteErr) {
 				if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintCheck) {
 					return // We got the error we expected
@@ -399,12 +538,12 @@ func TestUpdateVerifyTokenStringSuccess(t *testing.T) {
 	verifyTokenString3 := auth.VerifyTokenString("ef095678ef095678ef095678ef095678")
 	approxVerifyExpiration := time.Now().Add(time.Hour * 24 * 2).UTC()
 
-	if err := s.UpdateVerifyTokenString(lowerEmail, verifyTokenString2); err != nil {
+	if _, err := s.UpdateVerifyTokenString(lowerEmail, verifyTokenString2); err != nil {
 		t.Fatalf("Unexpected error in UpdateVerifyTokenString: err: %+v", err)
 	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, &verifyTokenString2, &approxVerifyExpiration, time.Now().UTC(), time.Now().UTC())
 
-	if err := s.UpdateVerifyTokenString(upperEmail, verifyTokenString3); err != nil {
+	if _, err := s.UpdateVerifyTokenString(upperEmail, verifyTokenString3); err != nil {
 		t.Fatalf("Unexpected error in UpdateVerifyTokenString: err: %+v", err)
 	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, &verifyTokenString3, &approxVerifyExpiration, time.Now().UTC(), time.Now().UTC())
@@ -417,7 +556,7 @@ func TestStoreUpdateVerifyTokenStringAccountNotExists(t *testing.T) {
 
 	email := auth.Email("abc@example.com")
 
-	if err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrWrongCredentials {
+	if _, err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrWrongCredentials {
 		t.Fatalf(`UpdateVerifyTokenString error for nonexistant account: wanted "%+v", got "%+v."`, ErrWrongCredentials, err)
 	}
 }
@@ -429,7 +568,7 @@ func TestStoreUpdateVerifyTokenStringAccountVerified(t *testing.T) {
 
 	_, email, _, _ := makeTestUser(t, &s, nil, nil)
 
-	if err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
+	if _, err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
 		t.Fatalf(`UpdateVerifyTokenString error for already verified account: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 }
@@ -442,14 +581,18 @@ func TestUpdateVerifyAccountSuccess(t *testing.T) {
 	verifyTokenString := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
 	verifyExpiration := time.Now().Add(time.Second * 10).UTC() // expires in one second
 
-	_, email, password, createdSeed := makeTestUser(t, &s, &verifyTokenString, &verifyExpiration)
+	createdUserId, email, password, createdSeed := makeTestUser(t, &s, &verifyTokenString, &verifyExpiration)
 
 	// we're not testing normalization features so we'll just use this here
 	normEmail := email.Normalize()
 
-	if err := s.VerifyAccount(verifyTokenString); err != nil {
+	userId, err := s.VerifyAccount(verifyTokenString)
+	if err != nil {
 		t.Fatalf("Unexpected error in VerifyAccount: err: %+v", err)
 	}
+	if userId != createdUserId {
+		t.Errorf("Expected VerifyAccount to return the user id %d, got %d", createdUserId, userId)
+	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
 }
 
@@ -458,7 +601,7 @@ func TestStoreVerifyAccountTokenNotExists(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
 
-	if err := s.VerifyAccount("abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
+	if _, err := s.VerifyAccount("abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
 		t.Fatalf(`VerifyAccount error for nonexistant token: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 }
@@ -476,7 +619,7 @@ func TestUpdateVerifyAccountTokenExpired(t *testing.T) {
 	// we're not testing normalization features so we'll just use this here
 	normEmail := email.Normalize()
 
-	if err := s.VerifyAccount(verifyTokenString); err != ErrNoTokenForUser {
+	if _, err := s.VerifyAccount(verifyTokenString); err != ErrNoTokenForUser {
 		t.Fatalf(`VerifyAccount error for expired token: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+// Created is set by the store, so compare everything but that
+func expectAuditEvents(t *testing.T, expected []AuditEvent, got []AuditEvent) {
+	t.Helper()
+	if len(expected) != len(got) {
+		t.Fatalf("Expected %d audit events, got %d: %+v", len(expected), len(got), got)
+	}
+	for i := range got {
+		if got[i].Created.IsZero() || time.Since(got[i].Created) > time.Minute {
+			t.Errorf("Expected a recent Created time for audit event %d, got %v", i, got[i].Created)
+		}
+		got[i].Created = time.Time{}
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected audit events %+v, got %+v", expected, got)
+	}
+}
+
+func TestStoreAuditEvents(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+
+	login := AuditEvent{UserId: userId, DeviceId: "dev-1", Type: AuditEventLogin, IP: "1.2.3.4", UserAgent: "Some Client/1.0"}
+	if err := s.AddAuditEvent(login); err != nil {
+		t.Fatalf("Unexpected error in AddAuditEvent: %+v", err)
+	}
+
+	// Different case, to make sure it's normalized. UserId is ignored.
+	failed := AuditEvent{UserId: 12345, Type: AuditEventLoginFailed, IP: "5.6.7.8", UserAgent: "Other"}
+	if err := s.AddAuditEventForEmail(auth.Email(email.Normalize()), failed); err != nil {
+		t.Fatalf("Unexpected error in AddAuditEventForEmail: %+v", err)
+	}
+	failed.UserId = userId
+
+	// Nobody has this email
+	nobody := AuditEvent{Type: AuditEventLoginFailed, IP: "9.9.9.9", UserAgent: "Other"}
+	if err := s.AddAuditEventForEmail("nobody@example.com", nobody); err != nil {
+		t.Fatalf("Unexpected error in AddAuditEventForEmail: %+v", err)
+	}
+
+	// Newest first
+	events, err := s.GetAuditEvents(userId, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetAuditEvents: %+v", err)
+	}
+	expectAuditEvents(t, []AuditEvent{failed, login}, events)
+
+	events, err = s.GetAuditEvents(userId, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetAuditEvents: %+v", err)
+	}
+	expectAuditEvents(t, []AuditEvent{failed}, events)
+
+	// Oldest first, everybody
+	events = []AuditEvent{}
+	err = s.ExportAuditEvents(time.Now().Add(-time.Minute), func(event AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in ExportAuditEvents: %+v", err)
+	}
+	expectAuditEvents(t, []AuditEvent{login, failed, nobody}, events)
+
+	// Nothing in the future
+	err = s.ExportAuditEvents(time.Now().Add(time.Minute), func(event AuditEvent) error {
+		t.Errorf("Expected no events, got %+v", event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in ExportAuditEvents: %+v", err)
+	}
+
+	// An error from the callback stops the export
+	calls := 0
+	stop := fmt.Errorf("stop")
+	err = s.ExportAuditEvents(time.Time{}, func(event AuditEvent) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Expected the export to stop after the first error, got err %+v after %d calls", err, calls)
+	}
+}
+
+func TestStoreExportAuditEventsPaged(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	oldPageSize := auditEventExportPageSize
+	auditEventExportPageSize = 2
+	defer func() { auditEventExportPageSize = oldPageSize }()
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	expected := []AuditEvent{}
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		event := AuditEvent{UserId: userId, Type: AuditEventLogin, IP: ip}
+		if err := s.AddAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error in AddAuditEvent: %+v", err)
+		}
+		expected = append(expected, event)
+	}
+
+	// Writing while the export is going shouldn't be blocked by it. The new
+	// event is after the ones already there, so it's exported too.
+	late := AuditEvent{UserId: userId, Type: AuditEventLogin, IP: "5.5.5.5"}
+	events := []AuditEvent{}
+	err := s.ExportAuditEvents(time.Time{}, func(event AuditEvent) error {
+		if len(events) == 0 {
+			if err := s.AddAuditEvent(late); err != nil {
+				t.Fatalf("Unexpected error in AddAuditEvent during export: %+v", err)
+			}
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in ExportAuditEvents: %+v", err)
+	}
+	expectAuditEvents(t, append(expected, late), events)
+}
+
+func TestStoreAuditEventsAppendOnly(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	if err := s.AddAuditEvent(AuditEvent{UserId: userId, Type: AuditEventLogin, IP: "1.2.3.4"}); err != nil {
+		t.Fatalf("Unexpected error in AddAuditEvent: %+v", err)
+	}
+
+	if _, err := s.db.Exec("UPDATE audit_events SET ip='5.6.7.8'"); err == nil {
+		t.Errorf("Expected an error updating audit_events")
+	}
+	if _, err := s.db.Exec("DELETE FROM audit_events"); err == nil {
+		t.Errorf("Expected an error deleting from audit_events")
+	}
+
+	events, err := s.GetAuditEvents(userId, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetAuditEvents: %+v", err)
+	}
+	expectAuditEvents(t, []AuditEvent{{UserId: userId, Type: AuditEventLogin, IP: "1.2.3.4"}}, events)
+}
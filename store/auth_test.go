@@ -323,6 +323,69 @@ func TestStoreGetToken(t *testing.T) {
 }
 
 // Make sure we're saving in UTC. Make sure we have no weird timezone issues.
+func TestStoreListDevices(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if devices, err := s.ListDevices(userId); err != nil || devices == nil || len(devices) != 0 {
+		t.Fatalf("Expected no devices, got %+v %+v", devices, err)
+	}
+
+	for _, deviceId := range []auth.DeviceId{"dev-2", "dev-1"} {
+		authToken := auth.AuthToken{Token: auth.AuthTokenString("seekrit-" + deviceId), DeviceId: deviceId, UserId: userId, Scope: auth.ScopeFull}
+		if err := s.SaveToken(&authToken); err != nil {
+			t.Fatalf("Unexpected error in SaveToken: %+v", err)
+		}
+	}
+
+	devices, err := s.ListDevices(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in ListDevices: %+v", err)
+	}
+	if len(devices) != 2 || devices[0].DeviceId != "dev-1" || devices[1].DeviceId != "dev-2" {
+		t.Fatalf("Expected two devices in order, got %+v", devices)
+	}
+	if devices[0].Scope != auth.ScopeFull || devices[0].Expiration.Before(time.Now()) {
+		t.Errorf("Unexpected device: %+v", devices[0])
+	}
+}
+
+func TestStoreIsNewDevice(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expectNewDevice := func(deviceId auth.DeviceId, expected bool) {
+		t.Helper()
+		if newDevice, err := s.IsNewDevice(userId, deviceId); err != nil || newDevice != expected {
+			t.Errorf("Expected IsNewDevice for %s to be %v, got %v %+v", deviceId, expected, newDevice, err)
+		}
+	}
+	login := func(eventType AuditEventType, deviceId auth.DeviceId) {
+		t.Helper()
+		event := AuditEvent{UserId: userId, DeviceId: deviceId, Type: eventType, IP: "192.0.2.1", Created: time.Now().UTC()}
+		if err := s.AddAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error in AddAuditEvent: %+v", err)
+		}
+	}
+
+	// Nothing to compare the first login to
+	expectNewDevice("dev-1", false)
+	login(AuditEventLogin, "dev-1")
+
+	expectNewDevice("dev-1", false)
+	expectNewDevice("dev-2", true)
+
+	// Only successful logins count
+	login(AuditEventLoginFailed, "dev-2")
+	expectNewDevice("dev-2", true)
+	login(AuditEventLogin, "dev-2")
+	expectNewDevice("dev-2", false)
+}
+
 func TestStoreTokenUTC(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
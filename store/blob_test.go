@@ -0,0 +1,197 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blobstore"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func blobStoreTestInit(t *testing.T, s *Store) string {
+	dir := t.TempDir()
+	blobs, err := blobstore.NewFS(dir)
+	if err != nil {
+		t.Fatalf("Blob store setup failure: %+v", err)
+	}
+	s.Blobs = blobs
+	return dir
+}
+
+func expectBlobs(t *testing.T, s *Store, expected int) []blobstore.Ref {
+	t.Helper()
+	var refs []blobstore.Ref
+	s.Blobs.List(func(info blobstore.BlobInfo) error {
+		refs = append(refs, info.Ref)
+		return nil
+	})
+	if len(refs) != expected {
+		t.Errorf("Expected %d blobs, got %d", expected, len(refs))
+	}
+	return refs
+}
+
+// expectWalletExists looks at the encrypted_wallet column, which is empty for
+// these
+func expectGetWallet(t *testing.T, s *Store, userId auth.UserId, walletId wallet.WalletId, expectedEncryptedWallet wallet.EncryptedWallet, expectedSequence wallet.Sequence, expectedHmac wallet.WalletHmac) {
+	t.Helper()
+	encryptedWallet, sequence, hmac, err := s.GetWallet(userId, walletId)
+	if err != nil || encryptedWallet != expectedEncryptedWallet || sequence != expectedSequence || hmac != expectedHmac {
+		t.Fatalf("Unexpected values for wallet: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
+	}
+}
+
+// Wallets go in the blob store, and only the reference goes in the database
+func TestStoreWalletBlobs(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Saved before there was a blob store
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	blobStoreTestInit(t, &s)
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"))
+
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	refs := expectBlobs(t, &s, 1)
+	if refs[0] != blobstore.RefFor([]byte("my-enc-wallet-b")) {
+		t.Errorf("Expected the blob to be the wallet")
+	}
+
+	var stored string
+	var blobRef *blobstore.Ref
+	var blobSize *int
+	if err := s.db.QueryRow("SELECT encrypted_wallet, blob_ref, blob_size FROM wallets WHERE user_id=?", userId).Scan(&stored, &blobRef, &blobSize); err != nil {
+		t.Fatalf("Unexpected error getting stored wallet: %+v", err)
+	}
+	if stored != "" || blobRef == nil || *blobRef != refs[0] || blobSize == nil || *blobSize != len("my-enc-wallet-b") {
+		t.Errorf("Expected only a blob reference in the database, got %q %v %v", stored, blobRef, blobSize)
+	}
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"))
+
+	// Compressed, then put in the blob store
+	s.WalletCompression = compression.Zstd
+	if _, _, err := s.ChangePasswordWithWallet(
+		"abc@example.com", "123", "456", "abcd1234abcd1234",
+		defaultWalletUpdate(wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")),
+	); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordWithWallet: %+v", err)
+	}
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"))
+	expectBlobs(t, &s, 2)
+
+	stats, err := s.GetStats()
+	if err != nil {
+		t.Fatalf("Unexpected error in GetStats: %+v", err)
+	}
+	if stats.Wallets != 1 || stats.WalletsBySize[0] != 1 {
+		t.Errorf("Expected the blob wallet to be counted by its size, got %+v", stats)
+	}
+
+	// Without the blob store, the wallet is unreadable
+	s.Blobs = nil
+	if _, _, _, err := s.GetWallet(userId, wallet.DefaultWalletId); err == nil {
+		t.Errorf("Expected an error getting a blob wallet with no blob store")
+	}
+}
+
+func TestStoreDeleteUnreferencedBlobs(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// Nothing to do without a blob store
+	if numDeleted, err := s.DeleteUnreferencedBlobs(); numDeleted != 0 || err != nil {
+		t.Fatalf("Expected nothing to happen without a blob store, got %d, %+v", numDeleted, err)
+	}
+
+	dir := blobStoreTestInit(t, &s)
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	// Put in the blob store, but never saved
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-c")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectBlobs(t, &s, 3)
+
+	// Too recent to be deleted
+	if numDeleted, err := s.DeleteUnreferencedBlobs(); numDeleted != 0 || err != nil {
+		t.Fatalf("Expected recent blobs to be left alone, got %d, %+v", numDeleted, err)
+	}
+
+	old := time.Now().Add(-BlobGracePeriod - time.Minute)
+	for _, contents := range []string{"my-enc-wallet-a", "my-enc-wallet-b", "my-enc-wallet-c"} {
+		ref := string(blobstore.RefFor([]byte(contents)))
+		if err := os.Chtimes(dir+"/"+ref[:2]+"/"+ref, old, old); err != nil {
+			t.Fatalf("Error aging blob: %+v", err)
+		}
+	}
+
+	numDeleted, err := s.DeleteUnreferencedBlobs()
+	if err != nil {
+		t.Fatalf("Unexpected error in DeleteUnreferencedBlobs: %+v", err)
+	}
+	if numDeleted != 2 {
+		t.Errorf("Expected to delete 2 blobs, deleted %d", numDeleted)
+	}
+	expectBlobs(t, &s, 1)
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"))
+}
+
+// Puts a blob again right after listing, i.e. a client saving the same
+// encrypted wallet while DeleteUnreferencedBlobs is between listing and
+// deleting
+type putAfterListBlobs struct {
+	blobstore.BlobStore
+	data []byte
+}
+
+func (b *putAfterListBlobs) List(fn func(blobstore.BlobInfo) error) error {
+	if err := b.BlobStore.List(fn); err != nil {
+		return err
+	}
+	_, err := b.BlobStore.Put(b.data)
+	return err
+}
+
+func TestStoreDeleteUnreferencedBlobsPutAgain(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	dir := blobStoreTestInit(t, &s)
+	data := []byte("my-enc-wallet")
+	ref, err := s.Blobs.Put(data)
+	if err != nil {
+		t.Fatalf("Unexpected error in Put: %+v", err)
+	}
+	old := time.Now().Add(-BlobGracePeriod - time.Minute)
+	if err := os.Chtimes(dir+"/"+string(ref[:2])+"/"+string(ref), old, old); err != nil {
+		t.Fatalf("Error aging blob: %+v", err)
+	}
+
+	s.Blobs = &putAfterListBlobs{BlobStore: s.Blobs, data: data}
+	numDeleted, err := s.DeleteUnreferencedBlobs()
+	if err != nil {
+		t.Fatalf("Unexpected error in DeleteUnreferencedBlobs: %+v", err)
+	}
+	if numDeleted != 0 {
+		t.Errorf("Expected the blob that was put again to be left alone, deleted %d", numDeleted)
+	}
+	if _, err := s.Blobs.Get(ref); err != nil {
+		t.Errorf("Expected the blob to still be there, got %+v", err)
+	}
+}
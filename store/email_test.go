@@ -0,0 +1,159 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestStoreEmailChange(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	for sequence := wallet.Sequence(1); sequence <= 2; sequence++ {
+		if err := s.SetWallet(userId, wallet.DefaultWalletId, "my-enc-wallet", sequence, "my-hmac"); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+	authToken := auth.AuthToken{Token: "my-token", DeviceId: "my-device", UserId: userId, Scope: auth.ScopeFull}
+	if err := s.SaveToken(&authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	newEmail := auth.Email("New@Example.Com")
+	newPassword := auth.Password("456")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+	token := auth.VerifyTokenString("my-email-token")
+
+	oldEmail, _, err := s.StartEmailChange(userId, password, newEmail, newPassword, newSeed, defaultWalletUpdate("my-enc-wallet-2", 3, "my-hmac-2"), token)
+	if err != nil {
+		t.Fatalf("Unexpected error in StartEmailChange: %+v", err)
+	}
+	if oldEmail != email {
+		t.Errorf("Expected old email %s, got %s", email, oldEmail)
+	}
+
+	// Nothing has changed yet
+	if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+		t.Errorf("Expected to still log in with the old email, got %d %+v", gotUserId, err)
+	}
+	expectTokenExists(t, &s, authToken)
+
+	gotUserId, gotOldEmail, gotNewEmail, err := s.ConfirmEmailChange(token)
+	if err != nil {
+		t.Fatalf("Unexpected error in ConfirmEmailChange: %+v", err)
+	}
+	if gotUserId != userId || gotOldEmail != email || gotNewEmail != newEmail {
+		t.Errorf("Unexpected values from ConfirmEmailChange: %d %s %s", gotUserId, gotOldEmail, gotNewEmail)
+	}
+
+	expectAccountMatch(t, &s, newEmail.Normalize(), newEmail, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, "my-enc-wallet-2", 3, "my-hmac-2")
+	expectTokenNotExists(t, &s, authToken.Token)
+	if _, err := s.GetUserId(email, password); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for the old email, got %+v", err)
+	}
+
+	// Only once
+	if _, _, _, err := s.ConfirmEmailChange(token); err != ErrNoTokenForUser {
+		t.Errorf("Expected ErrNoTokenForUser confirming again, got %+v", err)
+	}
+}
+
+func TestStoreStartEmailChangeErrors(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, password, _ := makeTestUser(t, &s, nil, nil)
+	seed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+
+	if _, _, err := s.StartEmailChange(userId, password+"_wrong", "new@example.com", "456", seed, nil, "my-email-token"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for the wrong password, got %+v", err)
+	}
+	if _, _, err := s.StartEmailChange(userId+1, password, "new@example.com", "456", seed, nil, "my-email-token"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for a missing user, got %+v", err)
+	}
+
+	if err := s.CreateAccount("Taken@Example.Com", "789", seed, nil, ""); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	if _, _, err := s.StartEmailChange(userId, password, "taken@example.com", "456", seed, nil, "my-email-token"); err != ErrDuplicateEmail {
+		t.Errorf("Expected ErrDuplicateEmail for an email in use, got %+v", err)
+	}
+
+	// Just the capitalization of its own email is fine
+	if _, _, err := s.StartEmailChange(userId, password, "abc@example.com", "456", seed, nil, "my-email-token"); err != nil {
+		t.Errorf("Unexpected error changing the capitalization: %+v", err)
+	}
+}
+
+func TestStoreConfirmEmailChangeErrors(t *testing.T) {
+	tt := []struct {
+		name string
+
+		// Things that happen between starting and confirming
+		walletUpdate  bool
+		takeEmail     bool
+		expire        bool
+		passwordReset bool
+
+		expectedError error
+	}{
+		{name: "wallet changed", walletUpdate: true, expectedError: ErrWrongSequence},
+		{name: "email taken", takeEmail: true, expectedError: ErrDuplicateEmail},
+		{name: "expired", expire: true, expectedError: ErrNoTokenForUser},
+		{name: "password changed", passwordReset: true, expectedError: ErrNoTokenForUser},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+
+			userId, email, password, seed := makeTestUser(t, &s, nil, nil)
+			if err := s.SetWallet(userId, wallet.DefaultWalletId, "my-enc-wallet", 1, "my-hmac"); err != nil {
+				t.Fatalf("Unexpected error in SetWallet: %+v", err)
+			}
+
+			token := auth.VerifyTokenString("my-email-token")
+			_, _, err := s.StartEmailChange(userId, password, "new@example.com", "456", seed, defaultWalletUpdate("my-enc-wallet-2", 2, "my-hmac-2"), token)
+			if err != nil {
+				t.Fatalf("Unexpected error in StartEmailChange: %+v", err)
+			}
+
+			if tc.walletUpdate {
+				if err := s.SetWallet(userId, wallet.DefaultWalletId, "my-enc-wallet-3", 2, "my-hmac-3"); err != nil {
+					t.Fatalf("Unexpected error in SetWallet: %+v", err)
+				}
+			}
+			if tc.takeEmail {
+				if err := s.CreateAccount("new@example.com", "789", seed, nil, ""); err != nil {
+					t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+				}
+			}
+			if tc.expire {
+				if _, err := s.db.Exec("UPDATE email_changes SET expiration=?", time.Now().UTC().Add(-time.Minute)); err != nil {
+					t.Fatalf("Error expiring email change: %+v", err)
+				}
+			}
+			if tc.passwordReset {
+				if _, _, err := s.ChangePasswordWithWallet(email, password, "123_new", seed, defaultWalletUpdate("my-enc-wallet-4", 2, "my-hmac-4")); err != nil {
+					t.Fatalf("Unexpected error in ChangePasswordWithWallet: %+v", err)
+				}
+				password = "123_new"
+			}
+
+			if _, _, _, err := s.ConfirmEmailChange(token); err != tc.expectedError {
+				t.Errorf("Expected %+v, got %+v", tc.expectedError, err)
+			}
+
+			// The account is as it was
+			if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+				t.Errorf("Expected to still log in with the old email, got %d %+v", gotUserId, err)
+			}
+		})
+	}
+}
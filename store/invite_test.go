@@ -0,0 +1,140 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+func expectInviteCodeUses(t *testing.T, s *Store, code auth.InviteCode, expectedUses int, expectedUsers int) {
+	var uses int
+	if err := s.db.QueryRow("SELECT uses FROM invite_codes WHERE code=?", code).Scan(&uses); err != nil {
+		t.Fatalf("Error getting invite code uses: %+v", err)
+	}
+	if uses != expectedUses {
+		t.Errorf("Expected %d uses of %s, got %d", expectedUses, code, uses)
+	}
+
+	var users int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM invite_code_uses WHERE code=?", code).Scan(&users); err != nil {
+		t.Fatalf("Error counting invite code users: %+v", err)
+	}
+	if users != expectedUsers {
+		t.Errorf("Expected %d users of %s, got %d", expectedUsers, code, users)
+	}
+}
+
+func TestStoreCreateAccountWithInviteCode(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	const seed = auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	const code = auth.InviteCode("my-invite-code")
+
+	if _, err := s.CreateInviteCode(code, 2, 0, 0); err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+
+	if err := s.CreateAccountWithInviteCode("Abc@Example.Com", "123", seed, "pt-BR", code); err != nil {
+		t.Fatalf("Unexpected error in CreateAccountWithInviteCode: %+v", err)
+	}
+	// Verified from the start
+	expectAccountMatch(t, &s, "abc@example.com", "Abc@Example.Com", "123", seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectInviteCodeUses(t, &s, code, 1, 1)
+
+	// The email is taken, so the use isn't used up
+	if err := s.CreateAccountWithInviteCode("abc@example.com", "123", seed, "", code); err != ErrDuplicateAccount {
+		t.Errorf("Expected ErrDuplicateAccount, got %+v", err)
+	}
+	expectInviteCodeUses(t, &s, code, 1, 1)
+
+	if err := s.CreateAccountWithInviteCode("def@example.com", "123", seed, "", code); err != nil {
+		t.Fatalf("Unexpected error in CreateAccountWithInviteCode: %+v", err)
+	}
+	expectInviteCodeUses(t, &s, code, 2, 2)
+
+	// Used up
+	if err := s.CreateAccountWithInviteCode("ghi@example.com", "123", seed, "", code); err != ErrInvalidInviteCode {
+		t.Errorf("Expected ErrInvalidInviteCode for a used up code, got %+v", err)
+	}
+	if err := s.CreateAccountWithInviteCode("ghi@example.com", "123", seed, "", "not-a-code"); err != ErrInvalidInviteCode {
+		t.Errorf("Expected ErrInvalidInviteCode for a code that doesn't exist, got %+v", err)
+	}
+	if _, err := s.GetClientSaltSeed("ghi@example.com"); err != ErrWrongCredentials {
+		t.Errorf("Expected no account without a valid invite code, got %+v", err)
+	}
+}
+
+func TestStoreCreateInviteCode(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	invite, err := s.CreateInviteCode("code-1", 2, userId, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+	if invite.Code != "code-1" || invite.CreatedBy != userId || invite.MaxUses != 2 || invite.Uses != 0 || time.Since(invite.Created) > time.Minute {
+		t.Errorf("Unexpected invite code: %+v", invite)
+	}
+	if codes, err := s.GetInviteCodes(userId); err != nil || len(codes) != 1 || !codes[0].Created.Equal(invite.Created) {
+		t.Errorf("Expected the created time to be the one that was saved, got %+v %+v", codes, err)
+	}
+	if _, err := s.CreateInviteCode("code-2", 2, userId, 3); err != ErrInviteQuota {
+		t.Errorf("Expected ErrInviteQuota going over the quota, got %+v", err)
+	}
+	if _, err := s.CreateInviteCode("code-2", 1, userId, 3); err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+	if _, err := s.CreateInviteCode("code-3", 1, userId, 3); err != ErrInviteQuota {
+		t.Errorf("Expected ErrInviteQuota at the quota, got %+v", err)
+	}
+
+	// No quota for the server operator
+	if _, err := s.CreateInviteCode("code-3", 1000, 0, 0); err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+
+	if _, err := s.CreateInviteCode("code-3", 1, 0, 0); err != ErrDuplicateInvite {
+		t.Errorf("Expected ErrDuplicateInvite, got %+v", err)
+	}
+}
+
+func TestStoreGetInviteCodes(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if codes, err := s.GetInviteCodes(userId); err != nil || len(codes) != 0 {
+		t.Errorf("Expected no invite codes, got %+v %+v", codes, err)
+	}
+
+	if _, err := s.CreateInviteCode("user-code", 2, userId, 10); err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+	if _, err := s.CreateInviteCode("admin-code", 1, 0, 0); err != nil {
+		t.Fatalf("Unexpected error in CreateInviteCode: %+v", err)
+	}
+
+	codes, err := s.GetInviteCodes(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetInviteCodes: %+v", err)
+	}
+	if len(codes) != 1 || codes[0].Code != "user-code" || codes[0].CreatedBy != userId || codes[0].MaxUses != 2 || codes[0].Uses != 0 {
+		t.Errorf("Unexpected invite codes for the user: %+v", codes)
+	}
+	if time.Since(codes[0].Created) > time.Minute {
+		t.Errorf("Unexpected created time: %v", codes[0].Created)
+	}
+
+	codes, err = s.GetInviteCodes(0)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetInviteCodes: %+v", err)
+	}
+	if len(codes) != 2 || codes[0].Code != "user-code" || codes[1].Code != "admin-code" || codes[1].CreatedBy != 0 {
+		t.Errorf("Unexpected invite codes for the server operator: %+v", codes)
+	}
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestStoreExportAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, seed := makeTestUser(t, &s, nil, nil)
+
+	if err := s.SetWallet(userId, "other", wallet.EncryptedWallet("my-other-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-other-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	// Compressed, to make sure it comes out the way it went in
+	s.WalletCompression = compression.Gzip
+	for sequence := wallet.Sequence(1); sequence <= 3; sequence++ {
+		if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet"), sequence, wallet.WalletHmac("my-hmac")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	authToken := auth.AuthToken{Token: "my-token", DeviceId: "my-device", UserId: userId, Scope: auth.ScopeFull}
+	if err := s.SaveToken(&authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	expectedWallets := []WalletUpdate{
+		{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 3, Hmac: "my-hmac"},
+		{WalletId: "other", EncryptedWallet: "my-other-enc-wallet", Sequence: 1, Hmac: "my-other-hmac"},
+	}
+
+	// A copy. The account stays as it is.
+	gotEmail, gotSeed, gotKey, gotSalt, gotWallets, err := s.ExportAccount(userId, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error in ExportAccount: %+v", err)
+	}
+	if gotEmail != email || gotSeed != seed || !reflect.DeepEqual(expectedWallets, gotWallets) {
+		t.Errorf("Unexpected export: %s %s %+v", gotEmail, gotSeed, gotWallets)
+	}
+	// The password hash, for the other server to check the password against
+	if match, err := password.Check(gotKey, gotSalt); err != nil || !match {
+		t.Errorf("Expected the exported key and salt to match the password, got %v %+v", match, err)
+	}
+	if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+		t.Errorf("Expected to still log in after a copy, got %d %+v", gotUserId, err)
+	}
+	expectTokenExists(t, &s, authToken)
+
+	// Moving it takes the password
+	if _, _, _, _, _, err := s.ExportAccount(userId, "wrong", "https://other.example.com"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials moving with the wrong password, got %+v", err)
+	}
+	if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+		t.Errorf("Expected to still log in after a failed move, got %d %+v", gotUserId, err)
+	}
+	expectTokenExists(t, &s, authToken)
+
+	_, _, _, _, gotWallets, err = s.ExportAccount(userId, password, "https://other.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error in ExportAccount: %+v", err)
+	}
+	if !reflect.DeepEqual(expectedWallets, gotWallets) {
+		t.Errorf("Unexpected wallets: %+v", gotWallets)
+	}
+	if gotUserId, err := s.GetUserId(email, password); err != ErrAccountMigrated || gotUserId != 0 {
+		t.Errorf("Expected ErrAccountMigrated logging in to a moved account, got %d %+v", gotUserId, err)
+	}
+	if _, err := s.GetUserId(email, "wrong"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials with the wrong password, got %+v", err)
+	}
+	expectTokenNotExists(t, &s, authToken.Token)
+
+	if migratedTo, err := s.GetMigratedTo(email); err != nil || migratedTo != "https://other.example.com" {
+		t.Errorf("Unexpected migrated to: %s %+v", migratedTo, err)
+	}
+}
+
+func TestStoreExportAccountNoWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+
+	_, _, _, _, wallets, err := s.ExportAccount(userId, "", "")
+	if err != nil || wallets == nil || len(wallets) != 0 {
+		t.Errorf("Expected no wallets, got %+v %+v", wallets, err)
+	}
+
+	if _, err := s.GetMigratedTo(email); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for an account that hasn't moved, got %+v", err)
+	}
+	if _, _, _, _, _, err := s.ExportAccount(userId+1, "", ""); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for a user that doesn't exist, got %+v", err)
+	}
+}
+
+func TestStoreCancelMigration(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	if _, err := s.CancelMigration(email, password); err != ErrNotMigrated {
+		t.Errorf("Expected ErrNotMigrated for an account that hasn't moved, got %+v", err)
+	}
+
+	if _, _, _, _, _, err := s.ExportAccount(userId, password, "https://other.example.com"); err != nil {
+		t.Fatalf("Unexpected error in ExportAccount: %+v", err)
+	}
+
+	if gotUserId, err := s.CancelMigration(email, "wrong"); err != ErrWrongCredentials || gotUserId != 0 {
+		t.Errorf("Expected ErrWrongCredentials with the wrong password, got %d %+v", gotUserId, err)
+	}
+	if _, err := s.CancelMigration("nobody@example.com", password); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials for an account that doesn't exist, got %+v", err)
+	}
+	if _, err := s.GetMigratedTo(email); err != nil {
+		t.Errorf("Expected the account to still be marked as moved after failed cancels, got %+v", err)
+	}
+
+	gotUserId, err := s.CancelMigration(email, password)
+	if err != nil || gotUserId != userId {
+		t.Fatalf("Unexpected result from CancelMigration: %d %+v", gotUserId, err)
+	}
+	if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+		t.Errorf("Expected to log in again after cancelling, got %d %+v", gotUserId, err)
+	}
+	if _, err := s.GetMigratedTo(email); err != ErrWrongCredentials {
+		t.Errorf("Expected the account not to be marked as moved, got %+v", err)
+	}
+}
+
+func TestStoreImportAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	email, password, seed := auth.Email("Abc@Example.Com"), auth.Password("123"), auth.ClientSaltSeed("abcd1234abcd1234")
+	wallets := []WalletUpdate{
+		{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+		{WalletId: "other", EncryptedWallet: "my-other-enc-wallet", Sequence: 2, Hmac: "my-other-hmac"},
+	}
+
+	userId, err := s.ImportAccount(email, password, seed, wallets)
+	if err != nil {
+		t.Fatalf("Unexpected error in ImportAccount: %+v", err)
+	}
+
+	// Verified, so they can log in right away
+	if gotUserId, err := s.GetUserId(email, password); err != nil || gotUserId != userId {
+		t.Errorf("Expected to log in to the imported account, got %d %+v", gotUserId, err)
+	}
+	expectAccountMatch(t, &s, email.Normalize(), email, password, seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, "my-enc-wallet", 7, "my-hmac")
+	expectGetWallet(t, &s, userId, "other", "my-other-enc-wallet", 2, "my-other-hmac")
+
+	// Clients carry on from the sequence they were on
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, "my-enc-wallet-2", 8, "my-hmac-2"); err != nil {
+		t.Errorf("Unexpected error in SetWallet after import: %+v", err)
+	}
+
+	if _, err := s.ImportAccount("abc@example.com", password, seed, nil); err != ErrDuplicateAccount {
+		t.Errorf("Expected ErrDuplicateAccount importing an account that exists, got %+v", err)
+	}
+}
+
+// One bad wallet and nothing is imported
+func TestStoreImportAccountRollback(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	email := auth.Email("abc@example.com")
+	wallets := []WalletUpdate{
+		{WalletId: wallet.DefaultWalletId, EncryptedWallet: "my-enc-wallet", Sequence: 7, Hmac: "my-hmac"},
+		{WalletId: "other", EncryptedWallet: "my-other-enc-wallet", Sequence: 0, Hmac: "my-other-hmac"},
+	}
+	if _, err := s.ImportAccount(email, "123", "abcd1234abcd1234", wallets); err == nil {
+		t.Fatalf("Expected an error importing a wallet with sequence 0")
+	}
+	expectAccountNotExists(t, &s, email.Normalize())
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM wallets").Scan(&count); err != nil || count != 0 {
+		t.Errorf("Expected no wallets, got %d %+v", count, err)
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +13,11 @@ import (
 // It involves both wallet and account tables. Should it go in wallet_test.go
 // or account_test.go? Decided to just make it its own file.
 
+// For the common case of a user with only the default wallet
+func defaultWalletUpdate(encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac) []WalletUpdate {
+	return []WalletUpdate{{wallet.DefaultWalletId, encryptedWallet, sequence, hmac}}
+}
+
 func TestStoreChangePasswordSuccess(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
@@ -43,7 +49,7 @@ func TestStoreChangePasswordSuccess(t *testing.T) {
 
 	lowerEmail := auth.Email(strings.ToLower(string(email)))
 
-	pwUserId, err := s.ChangePasswordWithWallet(lowerEmail, oldPassword, newPassword, newSeed, encryptedWallet, sequence, hmac)
+	pwUserId, _, err := s.ChangePasswordWithWallet(lowerEmail, oldPassword, newPassword, newSeed, defaultWalletUpdate(encryptedWallet, sequence, hmac))
 	if err != nil {
 		t.Errorf("ChangePasswordWithWallet (lower case email): unexpected error: %+v", err)
 	}
@@ -63,7 +69,7 @@ func TestStoreChangePasswordSuccess(t *testing.T) {
 
 	upperEmail := auth.Email(strings.ToUpper(string(email)))
 
-	pwUserId, err = s.ChangePasswordWithWallet(upperEmail, newPassword, newNewPassword, newNewSeed, newEncryptedWallet, newSequence, newHmac)
+	pwUserId, _, err = s.ChangePasswordWithWallet(upperEmail, newPassword, newNewPassword, newNewSeed, defaultWalletUpdate(newEncryptedWallet, newSequence, newHmac))
 	if err != nil {
 		t.Errorf("ChangePasswordWithWallet (upper case email): unexpected error: %+v", err)
 	}
@@ -173,7 +179,7 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 			newPassword := oldPassword + auth.Password("_new")         // Make the new password different (as it should be)
 			newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
 
-			if _, err := s.ChangePasswordWithWallet(submittedEmail, submittedOldPassword, newPassword, newSeed, newEncryptedWallet, tc.sequence, newHmac); err != tc.expectedError {
+			if _, _, err := s.ChangePasswordWithWallet(submittedEmail, submittedOldPassword, newPassword, newSeed, defaultWalletUpdate(newEncryptedWallet, tc.sequence, newHmac)); err != tc.expectedError {
 				t.Errorf("ChangePasswordWithWallet: unexpected value for err. want: %+v, got: %+v", tc.expectedError, err)
 			}
 
@@ -192,6 +198,58 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 	}
 }
 
+// Every one of the user's wallets is re-encrypted together, or none of them
+func TestStoreChangePasswordMultipleWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, oldPassword, oldSeed := makeTestUser(t, &s, nil, nil)
+	for _, walletId := range []wallet.WalletId{wallet.DefaultWalletId, "savings"} {
+		if err := s.SetWallet(userId, walletId, wallet.EncryptedWallet("my-enc-wallet-old"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-old")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	newPassword := oldPassword + auth.Password("_new")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+	defaultUpdate := WalletUpdate{wallet.DefaultWalletId, "my-enc-wallet-new", 2, "my-hmac-new"}
+	savingsUpdate := WalletUpdate{"savings", "my-enc-savings-new", 2, "my-hmac-savings-new"}
+
+	// Leaving one out
+	_, conflicts, err := s.ChangePasswordWithWallet(email, oldPassword, newPassword, newSeed, []WalletUpdate{defaultUpdate})
+	if err != ErrMissingWallet {
+		t.Fatalf(`ChangePasswordWithWallet err: wanted "%+v", got "%+v"`, ErrMissingWallet, err)
+	}
+	if want := []WalletConflict{{WalletId: "savings", Sequence: 1, Missing: true}}; !reflect.DeepEqual(want, conflicts) {
+		t.Errorf("Expected conflicts %+v, got %+v", want, conflicts)
+	}
+
+	// One with the wrong sequence, and one that doesn't exist. They're all
+	// reported, not just the first.
+	badSavingsUpdate := savingsUpdate
+	badSavingsUpdate.Sequence = 3
+	checkingUpdate := WalletUpdate{"checking", "my-enc-checking-new", 2, "my-hmac-checking-new"}
+	_, conflicts, err = s.ChangePasswordWithWallet(email, oldPassword, newPassword, newSeed, []WalletUpdate{badSavingsUpdate, checkingUpdate, defaultUpdate})
+	if err != ErrWrongSequence {
+		t.Fatalf(`ChangePasswordWithWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if want := []WalletConflict{{WalletId: "savings", Sequence: 1}, {WalletId: "checking", Sequence: 0}}; !reflect.DeepEqual(want, conflicts) {
+		t.Errorf("Expected conflicts %+v, got %+v", want, conflicts)
+	}
+
+	// Nothing changed, including the wallet that was updated before the error
+	expectAccountMatch(t, &s, email.Normalize(), email, oldPassword, oldSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, "my-enc-wallet-old", 1, "my-hmac-old")
+
+	_, conflicts, err = s.ChangePasswordWithWallet(email, oldPassword, newPassword, newSeed, []WalletUpdate{savingsUpdate, defaultUpdate})
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Unexpected error in ChangePasswordWithWallet: %+v, conflicts: %+v", err, conflicts)
+	}
+	expectAccountMatch(t, &s, email.Normalize(), email, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, "my-enc-wallet-new", 2, "my-hmac-new")
+	expectGetWallet(t, &s, userId, "savings", "my-enc-savings-new", 2, "my-hmac-savings-new")
+}
+
 func TestStoreChangePasswordNoWalletSuccess(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
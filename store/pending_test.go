@@ -0,0 +1,139 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+func TestStoreCreatePendingAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	const seed = auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+
+	if err := s.CreatePendingAccount("Abc@Example.Com", "123", seed, verifyToken, "pt-BR"); err != nil {
+		t.Fatalf("Unexpected error in CreatePendingAccount: %+v", err)
+	}
+	// Unverified, with no expiration
+	expectAccountMatch(t, &s, "abc@example.com", "Abc@Example.Com", "123", seed, &verifyToken, nil, time.Now().UTC(), time.Now().UTC())
+
+	// Only the server operator can verify it
+	if _, err := s.VerifyAccount(verifyToken); err != ErrNoTokenForUser {
+		t.Errorf("Expected ErrNoTokenForUser, got %+v", err)
+	}
+	if _, err := s.GetUserId("abc@example.com", "123"); err != ErrNotVerified {
+		t.Errorf("Expected ErrNotVerified, got %+v", err)
+	}
+
+	if err := s.CreatePendingAccount("abc@example.com", "123", seed, "other-token", ""); err != ErrDuplicateAccount {
+		t.Errorf("Expected ErrDuplicateAccount, got %+v", err)
+	}
+}
+
+func TestStoreGetPendingAccounts(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// Verified, so not pending
+	makeTestUser(t, &s, nil, nil)
+
+	if accounts, err := s.GetPendingAccounts(); err != nil || len(accounts) != 0 {
+		t.Errorf("Expected no pending accounts, got %+v %+v", accounts, err)
+	}
+
+	const seed = auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	if err := s.CreatePendingAccount("def@example.com", "123", seed, "token-1", "pt-BR"); err != nil {
+		t.Fatalf("Unexpected error in CreatePendingAccount: %+v", err)
+	}
+	// Never clicked the link, from EmailVerify mode
+	emailVerifyToken := auth.VerifyTokenString("token-2")
+	if err := s.CreateAccount("ghi@example.com", "123", seed, &emailVerifyToken, ""); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+
+	accounts, err := s.GetPendingAccounts()
+	if err != nil {
+		t.Fatalf("Unexpected error in GetPendingAccounts: %+v", err)
+	}
+	if len(accounts) != 2 || accounts[0].Email != "def@example.com" || accounts[0].Locale != "pt-BR" || accounts[1].Email != "ghi@example.com" {
+		t.Errorf("Unexpected pending accounts: %+v", accounts)
+	}
+	if time.Since(accounts[0].Created) > time.Minute {
+		t.Errorf("Unexpected created time: %v", accounts[0].Created)
+	}
+}
+
+func TestStoreApproveAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	const seed = auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	if err := s.CreatePendingAccount("Abc@Example.Com", "123", seed, "token-1", "pt-BR"); err != nil {
+		t.Fatalf("Unexpected error in CreatePendingAccount: %+v", err)
+	}
+	accounts, err := s.GetPendingAccounts()
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("Expected a pending account, got %+v %+v", accounts, err)
+	}
+	userId := accounts[0].UserId
+
+	email, locale, err := s.ApproveAccount(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in ApproveAccount: %+v", err)
+	}
+	if email != "Abc@Example.Com" || locale != "pt-BR" {
+		t.Errorf("Unexpected email and locale: %s %s", email, locale)
+	}
+	expectAccountMatch(t, &s, "abc@example.com", "Abc@Example.Com", "123", seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+
+	// Already verified
+	if _, _, err := s.ApproveAccount(userId); err != ErrNotPending {
+		t.Errorf("Expected ErrNotPending, got %+v", err)
+	}
+	if _, _, err := s.ApproveAccount(userId + 1); err != ErrNotPending {
+		t.Errorf("Expected ErrNotPending for an account that doesn't exist, got %+v", err)
+	}
+}
+
+func TestStoreRejectAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	verifiedUserId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	const seed = auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	if err := s.CreatePendingAccount("def@example.com", "123", seed, "token-1", ""); err != nil {
+		t.Fatalf("Unexpected error in CreatePendingAccount: %+v", err)
+	}
+	accounts, err := s.GetPendingAccounts()
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("Expected a pending account, got %+v %+v", accounts, err)
+	}
+
+	email, err := s.RejectAccount(accounts[0].UserId)
+	if err != nil {
+		t.Fatalf("Unexpected error in RejectAccount: %+v", err)
+	}
+	if email != "def@example.com" {
+		t.Errorf("Unexpected email: %s", email)
+	}
+	if _, err := s.GetClientSaltSeed("def@example.com"); err != ErrWrongCredentials {
+		t.Errorf("Expected the account to be gone, got %+v", err)
+	}
+
+	// The email is free again
+	if err := s.CreatePendingAccount("def@example.com", "123", seed, "token-1", ""); err != nil {
+		t.Errorf("Unexpected error in CreatePendingAccount: %+v", err)
+	}
+
+	// Verified accounts stay put
+	if _, err := s.RejectAccount(verifiedUserId); err != ErrNotPending {
+		t.Errorf("Expected ErrNotPending, got %+v", err)
+	}
+	if _, err := s.GetAccountInfo(verifiedUserId); err != nil {
+		t.Errorf("Expected the verified account to still be there, got %+v", err)
+	}
+}
@@ -2,16 +2,26 @@ package store
 
 // TODO - DeviceId - What about clients that lie about deviceId? Maybe require a certain format to make sure it gives a real value? Something it wouldn't come up with by accident.
 
+// The store doesn't log, apart from Init failing on startup. It returns errors,
+// and the handler that called it logs them with the request's logger, so they
+// carry the request id. Keep it that way, or pass a context.Context in first.
+
 import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blobstore"
+	"lbryio/wallet-sync-server/compression"
+	"lbryio/wallet-sync-server/logging"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/wallet"
 )
 
@@ -21,25 +31,54 @@ var (
 	ErrNoTokenForUser       = fmt.Errorf("Token does not exist for this user")
 
 	ErrDuplicateWallet = fmt.Errorf("Wallet already exists for this user")
+	ErrTooManyWallets  = fmt.Errorf("User has too many wallets")
 
 	ErrNoWallet = fmt.Errorf("Wallet does not exist for this user")
 
 	ErrUnexpectedWallet = fmt.Errorf("Wallet unexpectedly exist for this user")
 	ErrWrongSequence    = fmt.Errorf("Wallet could not be updated to this sequence")
+	ErrMissingWallet    = fmt.Errorf("User has a wallet that was not included")
 
 	ErrDuplicateEmail   = fmt.Errorf("Email already exists for this user")
 	ErrDuplicateAccount = fmt.Errorf("User already has an account")
 
 	ErrWrongCredentials = fmt.Errorf("No match for email and/or password")
 	ErrNotVerified      = fmt.Errorf("User account is not verified")
+	ErrAccountMigrated  = fmt.Errorf("User account has moved to another server")
+	ErrNotMigrated      = fmt.Errorf("User account has not moved to another server")
+
+	ErrNoUpload         = fmt.Errorf("Upload does not exist for this user, or has expired")
+	ErrTooManyUploads   = fmt.Errorf("User has too many uploads in progress")
+	ErrUploadTooLarge   = fmt.Errorf("Upload is too large")
+	ErrIncompleteUpload = fmt.Errorf("Upload is missing parts")
+
+	ErrInvalidInviteCode = fmt.Errorf("Invite code does not exist or is used up")
+	ErrDuplicateInvite   = fmt.Errorf("Invite code already exists")
+	ErrInviteQuota       = fmt.Errorf("User has given out all of their invites")
+
+	ErrNotPending = fmt.Errorf("Account does not exist or is already verified")
 )
 
 const (
 	AuthTokenLifespan   = time.Hour * 24 * 14
 	VerifyTokenLifespan = time.Hour * 24 * 2
 
-	// Eventually it could become variable when we introduce server switching. A user
-	// might be on a later sequence when they switch from another server.
+	// Long enough to get through a bad connection, short enough that abandoned
+	// uploads don't sit around taking up space
+	UploadLifespan = time.Hour * 24
+
+	// So one user can't fill up the staging tables
+	MaxUploadsPerUser = 5
+
+	// Named wallets are cheap for a client to create, so cap them
+	MaxWalletsPerUser = 20
+
+	// DeleteUnreferencedBlobs leaves newer blobs alone, since they may belong to
+	// a wallet that's being saved right now
+	BlobGracePeriod = time.Hour
+
+	// The sequence of a brand new wallet. A wallet brought over from another
+	// server (see ImportAccount) keeps the sequence it was on there instead.
 	InitialWalletSequence = 1
 )
 
@@ -47,30 +86,95 @@ const (
 type StoreInterface interface {
 	SaveToken(*auth.AuthToken) error
 	GetToken(auth.AuthTokenString) (*auth.AuthToken, error)
-	SetWallet(auth.UserId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac) error
-	GetWallet(auth.UserId) (wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, error)
+	SetWallet(auth.UserId, wallet.WalletId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac) error
+	GetWallet(auth.UserId, wallet.WalletId) (wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, error)
+	GetWalletHead(auth.UserId, wallet.WalletId) (wallet.Sequence, wallet.WalletHmac, time.Time, error)
+	ListWallets(auth.UserId) ([]WalletHead, error)
+	CreateWallet(auth.UserId, wallet.WalletId, wallet.EncryptedWallet, wallet.WalletHmac) error
+	DeleteWallet(auth.UserId, wallet.WalletId, wallet.Sequence) error
+	CreateUpload(auth.UserId) (UploadId, time.Time, error)
+	SaveUploadPart(auth.UserId, UploadId, int, string, int64) error
+	GetUploadParts(auth.UserId, UploadId) ([]int, time.Time, error)
+	CommitUpload(auth.UserId, UploadId, int, wallet.WalletId, wallet.Sequence, wallet.WalletHmac) error
+	DeleteExpiredUploads() (int64, error)
+	DeleteUnreferencedBlobs() (int64, error)
 	GetUserId(auth.Email, auth.Password) (auth.UserId, error)
-	CreateAccount(auth.Email, auth.Password, auth.ClientSaltSeed, *auth.VerifyTokenString) error
-	UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) error
-	VerifyAccount(auth.VerifyTokenString) error
-	ChangePasswordWithWallet(auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac) (auth.UserId, error)
+	CreateAccount(auth.Email, auth.Password, auth.ClientSaltSeed, *auth.VerifyTokenString, auth.Locale) error
+	UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) (auth.Locale, error)
+	VerifyAccount(auth.VerifyTokenString) (auth.UserId, error)
+	ChangePasswordWithWallet(auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed, []WalletUpdate) (auth.UserId, []WalletConflict, error)
 	ChangePasswordNoWallet(auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed) (auth.UserId, error)
 	GetClientSaltSeed(auth.Email) (auth.ClientSaltSeed, error)
+	StartEmailChange(auth.UserId, auth.Password, auth.Email, auth.Password, auth.ClientSaltSeed, []WalletUpdate, auth.VerifyTokenString) (auth.Email, auth.Locale, error)
+	ConfirmEmailChange(auth.VerifyTokenString) (auth.UserId, auth.Email, auth.Email, error)
+	ExportAccount(auth.UserId, auth.Password, string) (auth.Email, auth.ClientSaltSeed, auth.KDFKey, auth.ServerSalt, []WalletUpdate, error)
+	ImportAccount(auth.Email, auth.Password, auth.ClientSaltSeed, []WalletUpdate) (auth.UserId, error)
+	GetMigratedTo(auth.Email) (string, error)
+	CancelMigration(auth.Email, auth.Password) (auth.UserId, error)
+	GetAccountInfo(auth.UserId) (AccountInfo, error)
+	GetDataExport(auth.UserId) (DataExport, error)
+	IsNewDevice(auth.UserId, auth.DeviceId) (bool, error)
+	SetNotificationsOff(auth.UserId, bool) error
+	CreateAccountWithInviteCode(auth.Email, auth.Password, auth.ClientSaltSeed, auth.Locale, auth.InviteCode) error
+	CreateInviteCode(auth.InviteCode, int, auth.UserId, int) (InviteCode, error)
+	GetInviteCodes(auth.UserId) ([]InviteCode, error)
+	CreatePendingAccount(auth.Email, auth.Password, auth.ClientSaltSeed, auth.VerifyTokenString, auth.Locale) error
+	GetPendingAccounts() ([]PendingAccount, error)
+	ApproveAccount(auth.UserId) (auth.Email, auth.Locale, error)
+	RejectAccount(auth.UserId) (auth.Email, error)
+	Ping() error
+	SchemaVersion() (int, error)
+	GetStats() (Stats, error)
+	AddAuditEvent(AuditEvent) error
+	AddAuditEventForEmail(auth.Email, AuditEvent) error
+	GetAuditEvents(auth.UserId, int) ([]AuditEvent, error)
+	ExportAuditEvents(time.Time, func(AuditEvent) error) error
+}
+
+// Either the database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Either the database or a transaction, for reads
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type Store struct {
 	db *sql.DB
+
+	// How to compress wallets when saving them. Whatever it was set to when a
+	// wallet was saved, GetWallet will figure it out.
+	WalletCompression compression.Encoding
+
+	// If set, new and updated wallets go here instead of the database
+	Blobs blobstore.BlobStore
+
+	// Putting a blob takes the read lock, and DeleteUnreferencedBlobs takes the
+	// write lock to check and delete one. See deleteBlobIfUnreferenced.
+	blobsLock *sync.RWMutex
+}
+
+// Call with defer at the top of a store method
+func observeQueryDuration(query string, start time.Time) {
+	metrics.StoreQueryDuration.With(prometheus.Labels{"query": query}).Observe(time.Since(start).Seconds())
 }
 
 func (s *Store) Init(fileName string) {
 	db, err := sql.Open("sqlite3", "file:"+fileName+"?_foreign_keys=on")
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error opening database", logging.Err(err))
 	}
 	s.db = db
+	s.blobsLock = &sync.RWMutex{}
 }
 
-func (s *Store) Migrate() error {
+// Each migration is run once, in order, in a transaction. The database's
+// user_version records how many have been run so far. Only ever append to this
+// list; never edit a migration that has been released.
+var migrations = []string{
 	// We use the `sequence` field for transaction safety. For instance, let's
 	// say two different clients are trying to update the sequence from 5 to 6.
 	// The update command will specify "WHERE sequence=5". Only one of these
@@ -88,7 +192,7 @@ func (s *Store) Migrate() error {
 	// security in case we screw up the random generator). However the primary
 	// key should still be (user_id, device_id) so that a device's row can be
 	// updated with a new token.
-	query := `
+	`
 		CREATE TABLE IF NOT EXISTS auth_tokens(
 			token TEXT NOT NULL UNIQUE,
 			user_id INTEGER NOT NULL,
@@ -150,10 +254,268 @@ func (s *Store) Migrate() error {
 			  server_salt <> ''
 			)
 		);
+	`,
+
+	// Security audit log. user_id is nullable (and not a foreign key) since
+	// some events, like a failed login for an email nobody has, aren't tied to
+	// an account. The triggers keep it append-only.
+	`
+		CREATE TABLE audit_events(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			device_id TEXT,
+			event_type TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			created DATETIME NOT NULL,
+			CHECK (
+			  event_type <> ''
+			)
+		);
+		CREATE INDEX audit_events_user_id_created ON audit_events(user_id, created);
+		CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_events is append-only');
+		END;
+		CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_events is append-only');
+		END;
+	`,
+
+	// How encrypted_wallet is compressed, if at all. If so, it holds a blob
+	// rather than text.
+	`
+		ALTER TABLE wallets ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+	`,
+
+	// Staging for wallets uploaded in parts. A part can be sent again (i.e. if
+	// the connection dropped) and it replaces the old one. Parts are deleted
+	// along with their upload.
+	`
+		CREATE TABLE uploads(
+			upload_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			expiration DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+		);
+		CREATE INDEX uploads_user_id ON uploads(user_id);
+		CREATE INDEX uploads_expiration ON uploads(expiration);
+		CREATE TABLE upload_parts(
+			upload_id INTEGER NOT NULL,
+			part INTEGER NOT NULL,
+			data TEXT NOT NULL,
+			PRIMARY KEY (upload_id, part),
+			FOREIGN KEY (upload_id) REFERENCES uploads(upload_id) ON DELETE CASCADE,
+			CHECK (
+			  data <> '' AND
+			  part >= 0
+			)
+		);
+	`,
+
+	// Wallets can be kept in a blob store, with only the reference here. SQLite
+	// can't change a CHECK, so this rebuilds the table. blob_size is the size
+	// in the blob store, for stats.
+	`
+		CREATE TABLE wallets_new(
+			user_id INTEGER NOT NULL,
+			encrypted_wallet TEXT NOT NULL,
+			encoding TEXT NOT NULL DEFAULT '',
+			blob_ref TEXT,
+			blob_size INTEGER,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			updated DATETIME NOT NULL,
+
+			PRIMARY KEY (user_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  -- The wallet is either here or in the blob store, not both
+			  (encrypted_wallet <> '') <> (blob_ref IS NOT NULL) AND
+			  hmac <> '' AND
+			  sequence <> 0
+			)
+		);
+		INSERT INTO wallets_new (user_id, encrypted_wallet, encoding, sequence, hmac, updated)
+			SELECT user_id, encrypted_wallet, encoding, sequence, hmac, updated FROM wallets;
+		DROP TABLE wallets;
+		ALTER TABLE wallets_new RENAME TO wallets;
+		CREATE INDEX wallets_blob_ref ON wallets(blob_ref);
+	`,
+
+	// A user can have more than one wallet, each with its own sequence. The one
+	// they already have becomes the default wallet, which is what clients that
+	// don't name a wallet get.
+	`
+		CREATE TABLE wallets_new(
+			user_id INTEGER NOT NULL,
+			wallet_id TEXT NOT NULL DEFAULT 'default_wallet',
+			encrypted_wallet TEXT NOT NULL,
+			encoding TEXT NOT NULL DEFAULT '',
+			blob_ref TEXT,
+			blob_size INTEGER,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			updated DATETIME NOT NULL,
+
+			PRIMARY KEY (user_id, wallet_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  -- The wallet is either here or in the blob store, not both
+			  (encrypted_wallet <> '') <> (blob_ref IS NOT NULL) AND
+			  wallet_id <> '' AND
+			  hmac <> '' AND
+			  sequence <> 0
+			)
+		);
+		INSERT INTO wallets_new (user_id, encrypted_wallet, encoding, blob_ref, blob_size, sequence, hmac, updated)
+			SELECT user_id, encrypted_wallet, encoding, blob_ref, blob_size, sequence, hmac, updated FROM wallets;
+		DROP TABLE wallets;
+		ALTER TABLE wallets_new RENAME TO wallets;
+		CREATE INDEX wallets_blob_ref ON wallets(blob_ref);
+	`,
+
+	// Where the account went, if it was moved to another server. Null means it
+	// lives here.
+	`
+		ALTER TABLE accounts ADD COLUMN migrated_to TEXT;
+	`,
+
+	// An email change waiting for the user to confirm the new address. The
+	// client salt depends on the email, so the new key, client salt seed and
+	// re-encrypted wallets all come with the request and wait here until the
+	// swap. One per user; asking again replaces it.
+	`
+		CREATE TABLE email_changes(
+			user_id INTEGER NOT NULL,
+			new_email TEXT NOT NULL,
+			key TEXT NOT NULL,
+			server_salt TEXT NOT NULL,
+			client_salt_seed TEXT NOT NULL,
+			token TEXT NOT NULL UNIQUE,
+			expiration DATETIME NOT NULL,
+			PRIMARY KEY (user_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  new_email <> '' AND
+			  token <> ''
+			)
+		);
+		CREATE TABLE email_change_wallets(
+			user_id INTEGER NOT NULL,
+			wallet_id TEXT NOT NULL,
+			encrypted_wallet TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			PRIMARY KEY (user_id, wallet_id)
+			FOREIGN KEY (user_id) REFERENCES email_changes(user_id)
+		);
+	`,
+
+	// Whether the user opted out of emails about their account, i.e. password
+	// changes
+	`
+		ALTER TABLE accounts ADD COLUMN notifications_off BOOLEAN NOT NULL DEFAULT false;
+	`,
+
+	// What language to email the user in, as the client told us at signup.
+	// Empty means the default.
+	`
+		ALTER TABLE accounts ADD COLUMN locale TEXT NOT NULL DEFAULT '';
+	`,
+
+	// For InviteCode mode. created_by is null for codes the server operator
+	// made. Each account that signed up with a code gets a row in
+	// invite_code_uses, so we know who invited whom.
 	`
+		CREATE TABLE invite_codes(
+			code TEXT NOT NULL PRIMARY KEY,
+			created_by INTEGER,
+			max_uses INTEGER NOT NULL,
+			uses INTEGER NOT NULL DEFAULT 0,
+			created DATETIME NOT NULL,
+			FOREIGN KEY (created_by) REFERENCES accounts(user_id)
+			CHECK (
+			  code <> '' AND
+			  max_uses > 0 AND
+			  uses <= max_uses
+			)
+		);
+		CREATE INDEX invite_codes_created_by ON invite_codes(created_by);
+		CREATE TABLE invite_code_uses(
+			user_id INTEGER NOT NULL,
+			code TEXT NOT NULL,
+			created DATETIME NOT NULL,
+			PRIMARY KEY (user_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			FOREIGN KEY (code) REFERENCES invite_codes(code)
+		);
+	`,
+}
+
+// The schema version that Migrate brings the database to. If the database
+// reports anything else, this binary and the database don't agree.
+func ExpectedSchemaVersion() int {
+	return len(migrations)
+}
+
+// The schema version the database is at, i.e. how many migrations it has had
+func (s *Store) SchemaVersion() (version int, err error) {
+	defer observeQueryDuration("schema-version", time.Now())
 
-	_, err := s.db.Exec(query)
-	return err
+	err = s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return
+}
+
+func (s *Store) Migrate() (err error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema version %d is newer than this server knows about (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		err = s.migrate(version)
+		if err != nil {
+			return fmt.Errorf("Error running migration %d: %+v", version+1, err)
+		}
+	}
+	return
+}
+
+// Run the migration at the given index (which brings the db to version
+// index + 1)
+func (s *Store) migrate(index int) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	_, err = tx.Exec(migrations[index])
+	if err != nil {
+		return
+	}
+
+	// PRAGMA doesn't take query parameters, but this is just an int.
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", index+1))
+	return
+}
+
+// For health checks
+func (s *Store) Ping() error {
+	defer observeQueryDuration("ping", time.Now())
+
+	return s.db.Ping()
 }
 
 ////////////////
@@ -168,6 +530,8 @@ func (s *Store) Migrate() error {
 // Assumption: User is verified (as it was necessary to call SaveToken to begin
 // with)
 func (s *Store) GetToken(token auth.AuthTokenString) (authToken *auth.AuthToken, err error) {
+	defer observeQueryDuration("get-token", time.Now())
+
 	expirationCutoff := time.Now().UTC()
 
 	authToken = &(auth.AuthToken{})
@@ -230,6 +594,8 @@ func (s *Store) updateToken(authToken *auth.AuthToken, experation time.Time) (er
 // Assumption: User is verified (as they have been identified with GetUserId
 // which requires users be verified)
 func (s *Store) SaveToken(token *auth.AuthToken) (err error) {
+	defer observeQueryDuration("save-token", time.Now())
+
 	// TODO: For psql, do upsert here instead of separate insertToken and updateToken functions
 	//       Actually it may even be available for SQLite?
 	//       But not for wallet, it probably makes sense to keep that separate because of the sequence variable
@@ -260,19 +626,167 @@ func (s *Store) SaveToken(token *auth.AuthToken) (err error) {
 	return
 }
 
+// A device that's logged in, i.e. an auth token without the token itself
+type Device struct {
+	DeviceId   auth.DeviceId
+	Scope      auth.AuthScope
+	Expiration time.Time
+}
+
+// Ordered by device id. Expired tokens are included, since we still have
+// them. Empty (not an error) if the user has none.
+func (s *Store) ListDevices(userId auth.UserId) (devices []Device, err error) {
+	defer observeQueryDuration("list-devices", time.Now())
+	return listDevices(s.db, userId)
+}
+
+func listDevices(db querier, userId auth.UserId) (devices []Device, err error) {
+	rows, err := db.Query(
+		"SELECT device_id, scope, expiration FROM auth_tokens WHERE user_id=? ORDER BY device_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	devices = []Device{}
+	for rows.Next() {
+		var device Device
+		if err = rows.Scan(&device.DeviceId, &device.Scope, &device.Expiration); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	err = rows.Err()
+	return
+}
+
+// Whether this is the first time the user logs in from this device, going by
+// the audit log. (Auth tokens don't tell us, since a password change deletes
+// all of them.) The user's very first login doesn't count, since there's no
+// other device it's new compared to.
+//
+// Call it before recording the login.
+func (s *Store) IsNewDevice(userId auth.UserId, deviceId auth.DeviceId) (newDevice bool, err error) {
+	defer observeQueryDuration("is-new-device", time.Now())
+
+	var logins, loginsFromDevice int
+	err = s.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(device_id=?), 0) FROM audit_events WHERE user_id=? AND event_type=?",
+		deviceId, userId, AuditEventLogin,
+	).Scan(&logins, &loginsFromDevice)
+	newDevice = logins > 0 && loginsFromDevice == 0
+	return
+}
+
 ////////////
 // Wallet //
 ////////////
 
+// What goes in the wallets table's columns for a given wallet
+type storedWallet struct {
+	// The encrypted_wallet column. Empty if the wallet is in the blob store.
+	data     interface{}
+	encoding compression.Encoding
+
+	// Nil unless the wallet is in the blob store
+	blobRef  *blobstore.Ref
+	blobSize *int
+}
+
+// Compresses the wallet if we're set to, and puts it in the blob store if
+// there is one. A wallet put in the blob store that doesn't end up in the
+// wallets table (i.e. wrong sequence) is cleaned up by
+// DeleteUnreferencedBlobs.
+func (s *Store) encodeWallet(encryptedWallet wallet.EncryptedWallet) (stored storedWallet, err error) {
+	var data []byte
+	if s.WalletCompression == compression.Identity {
+		if s.Blobs == nil {
+			return storedWallet{data: encryptedWallet}, nil
+		}
+		data = []byte(encryptedWallet)
+	} else if data, err = compression.Compress(s.WalletCompression, []byte(encryptedWallet)); err != nil {
+		return
+	}
+	stored.encoding = s.WalletCompression
+
+	if s.Blobs == nil {
+		stored.data = data
+		return
+	}
+	s.blobsLock.RLock()
+	ref, err := s.Blobs.Put(data)
+	s.blobsLock.RUnlock()
+	if err != nil {
+		err = fmt.Errorf("Error putting wallet in blob store: %+v", err)
+		return
+	}
+	size := len(data)
+	stored.data, stored.blobRef, stored.blobSize = "", &ref, &size
+	return
+}
+
+// Takes the columns as they are in the wallets table
+func (s *Store) decodeWallet(data []byte, encoding compression.Encoding, blobRef *blobstore.Ref) (wallet.EncryptedWallet, error) {
+	if blobRef != nil {
+		if s.Blobs == nil {
+			return "", fmt.Errorf("Wallet is in the blob store, but there's no blob store configured")
+		}
+		var err error
+		if data, err = s.Blobs.Get(*blobRef); err != nil {
+			return "", fmt.Errorf("Error getting wallet from blob store: %+v", err)
+		}
+	}
+	decompressed, err := compression.Decompress(encoding, data)
+	if err != nil {
+		return "", fmt.Errorf("Error decompressing %s wallet: %+v", encoding, err)
+	}
+	return wallet.EncryptedWallet(decompressed), nil
+}
+
 // Assumption: Auth token has been checked (thus account is verified)
-func (s *Store) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+func (s *Store) GetWallet(userId auth.UserId, walletId wallet.WalletId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+	defer observeQueryDuration("get-wallet", time.Now())
+
+	var stored []byte
+	var encoding compression.Encoding
+	var blobRef *blobstore.Ref
 	err = s.db.QueryRow(
-		"SELECT encrypted_wallet, sequence, hmac FROM wallets WHERE user_id=?",
-		userId,
+		"SELECT encrypted_wallet, encoding, blob_ref, sequence, hmac FROM wallets WHERE user_id=? AND wallet_id=?",
+		userId, walletId,
+	).Scan(
+		&stored,
+		&encoding,
+		&blobRef,
+		&sequence,
+		&hmac,
+	)
+	if err == sql.ErrNoRows {
+		err = ErrNoWallet
+	}
+	if err != nil {
+		return
+	}
+	encryptedWallet, err = s.decodeWallet(stored, encoding, blobRef)
+	if err != nil {
+		sequence, hmac = 0, ""
+	}
+	return
+}
+
+// Everything but the wallet itself, for clients that want to know whether they
+// need to download it
+func (s *Store) GetWalletHead(userId auth.UserId, walletId wallet.WalletId) (sequence wallet.Sequence, hmac wallet.WalletHmac, updated time.Time, err error) {
+	defer observeQueryDuration("get-wallet-head", time.Now())
+
+	err = s.db.QueryRow(
+		"SELECT sequence, hmac, updated FROM wallets WHERE user_id=? AND wallet_id=?",
+		userId, walletId,
 	).Scan(
-		&encryptedWallet,
 		&sequence,
 		&hmac,
+		&updated,
 	)
 	if err == sql.ErrNoRows {
 		err = ErrNoWallet
@@ -280,18 +794,71 @@ func (s *Store) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedW
 	return
 }
 
+// What GetWalletHead gives, for each of a user's wallets
+type WalletHead struct {
+	WalletId wallet.WalletId
+	Sequence wallet.Sequence
+	Hmac     wallet.WalletHmac
+	Updated  time.Time
+}
+
+// Ordered by wallet id. Empty (not an error) if the user has no wallets.
+func (s *Store) ListWallets(userId auth.UserId) (heads []WalletHead, err error) {
+	defer observeQueryDuration("list-wallets", time.Now())
+
+	rows, err := s.db.Query(
+		"SELECT wallet_id, sequence, hmac, updated FROM wallets WHERE user_id=? ORDER BY wallet_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	heads = []WalletHead{}
+	for rows.Next() {
+		var head WalletHead
+		if err = rows.Scan(&head.WalletId, &head.Sequence, &head.Hmac, &head.Updated); err != nil {
+			return nil, err
+		}
+		heads = append(heads, head)
+	}
+	err = rows.Err()
+	return
+}
+
 func (s *Store) insertFirstWallet(
+	db execer,
 	userId auth.UserId,
+	walletId wallet.WalletId,
 	encryptedWallet wallet.EncryptedWallet,
 	hmac wallet.WalletHmac,
 ) (err error) {
+	stored, err := s.encodeWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+
 	// This will only be used to attempt to insert the first wallet (sequence=InitialWalletSequence).
 	//   The database will enforce that this will not be set if this user already
-	//   has a wallet.
-	_, err = s.db.Exec(
-		"INSERT INTO wallets (user_id, encrypted_wallet, sequence, hmac, updated) VALUES(?,?,?,?, datetime('now'))",
-		userId, encryptedWallet, InitialWalletSequence, hmac,
+	//   has a wallet with this id.
+	//
+	// The count leaves out this wallet id, so that if the wallet exists we
+	//   still get the primary key error rather than ErrTooManyWallets.
+	res, err := db.Exec(
+		`INSERT INTO wallets (user_id, wallet_id, encrypted_wallet, encoding, blob_ref, blob_size, sequence, hmac, updated)
+		 SELECT ?,?,?,?,?,?,?,?, datetime('now')
+		 WHERE (SELECT COUNT(*) FROM wallets WHERE user_id=? AND wallet_id<>?) < ?`,
+		userId, walletId, stored.data, stored.encoding, stored.blobRef, stored.blobSize, InitialWalletSequence, hmac,
+		userId, walletId, MaxWalletsPerUser,
 	)
+	if err == nil {
+		var numRows int64
+		numRows, err = res.RowsAffected()
+		if err == nil && numRows == 0 {
+			err = ErrTooManyWallets
+		}
+	}
 
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
@@ -308,18 +875,25 @@ func (s *Store) insertFirstWallet(
 }
 
 func (s *Store) updateWalletToSequence(
+	db execer,
 	userId auth.UserId,
+	walletId wallet.WalletId,
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
 ) (err error) {
+	stored, err := s.encodeWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+
 	// This will be used for wallets with sequence > InitialWalletSequence.
 	// Use the database to enforce that we only update if we are incrementing the sequence.
 	// This way, if two clients attempt to update at the same time, it will return
 	// an error for the second one.
-	res, err := s.db.Exec(
-		"UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, updated=datetime('now') WHERE user_id=? AND sequence=?",
-		encryptedWallet, sequence, hmac, userId, sequence-1,
+	res, err := db.Exec(
+		"UPDATE wallets SET encrypted_wallet=?, encoding=?, blob_ref=?, blob_size=?, sequence=?, hmac=?, updated=datetime('now') WHERE user_id=? AND wallet_id=? AND sequence=?",
+		stored.data, stored.encoding, stored.blobRef, stored.blobSize, sequence, hmac, userId, walletId, sequence-1,
 	)
 	if err != nil {
 		return
@@ -339,13 +913,20 @@ func (s *Store) updateWalletToSequence(
 
 // Assumption: Sequence has been validated (>=InitialWalletSequence)
 // Assumption: Auth token has been checked (thus account is verified)
-func (s *Store) SetWallet(userId auth.UserId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac) (err error) {
+func (s *Store) SetWallet(userId auth.UserId, walletId wallet.WalletId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac) (err error) {
+	defer observeQueryDuration("set-wallet", time.Now())
+
+	return s.setWallet(s.db, userId, walletId, encryptedWallet, sequence, hmac)
+}
+
+// SetWallet, but it can be part of a transaction
+func (s *Store) setWallet(db execer, userId auth.UserId, walletId wallet.WalletId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac) (err error) {
 	if sequence == InitialWalletSequence {
 		// If sequence == InitialWalletSequence, the client assumed that this is our first
 		// wallet. Try to insert. If we get a conflict, the client
 		// assumed incorrectly and we proceed below to return the latest
 		// wallet from the db.
-		err = s.insertFirstWallet(userId, encryptedWallet, hmac)
+		err = s.insertFirstWallet(db, userId, walletId, encryptedWallet, hmac)
 		if err == ErrDuplicateWallet {
 			// A wallet already exists. That means the input sequence should not be InitialWalletSequence.
 			// To the caller, this means the sequence was wrong.
@@ -356,7 +937,7 @@ func (s *Store) SetWallet(userId auth.UserId, encryptedWallet wallet.EncryptedWa
 		// with sequence - 1. Explicitly try to update the wallet with
 		// sequence - 1. If we updated no rows, the client assumed incorrectly
 		// and we proceed below to return the latest wallet from the db.
-		err = s.updateWalletToSequence(userId, encryptedWallet, sequence, hmac)
+		err = s.updateWalletToSequence(db, userId, walletId, encryptedWallet, sequence, hmac)
 		if err == ErrNoWallet {
 			// No wallet found to replace at the `sequence - 1`. To the caller, this
 			// means the sequence they put in was wrong.
@@ -366,15 +947,71 @@ func (s *Store) SetWallet(userId auth.UserId, encryptedWallet wallet.EncryptedWa
 	return
 }
 
+// Like SetWallet with InitialWalletSequence, but a wallet that already exists
+// is ErrDuplicateWallet rather than ErrWrongSequence
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) CreateWallet(userId auth.UserId, walletId wallet.WalletId, encryptedWallet wallet.EncryptedWallet, hmac wallet.WalletHmac) (err error) {
+	defer observeQueryDuration("create-wallet", time.Now())
+
+	return s.insertFirstWallet(s.db, userId, walletId, encryptedWallet, hmac)
+}
+
+// The sequence has to be the wallet's current one, so a client can't delete
+// a wallet that changed since it last looked. Its blob, if it has one, is left
+// for DeleteUnreferencedBlobs.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) DeleteWallet(userId auth.UserId, walletId wallet.WalletId, sequence wallet.Sequence) (err error) {
+	defer observeQueryDuration("delete-wallet", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	res, err := tx.Exec(
+		"DELETE FROM wallets WHERE user_id=? AND wallet_id=? AND sequence=?",
+		userId, walletId, sequence,
+	)
+	if err != nil {
+		return
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil || numRows > 0 {
+		return
+	}
+
+	// Nothing deleted. Figure out why.
+	var dummy int
+	err = tx.QueryRow("SELECT 1 FROM wallets WHERE user_id=? AND wallet_id=?", userId, walletId).Scan(&dummy)
+	if err == sql.ErrNoRows {
+		err = ErrNoWallet
+	} else if err == nil {
+		err = ErrWrongSequence
+	}
+	return
+}
+
 func (s *Store) GetUserId(email auth.Email, password auth.Password) (userId auth.UserId, err error) {
+	defer observeQueryDuration("get-user-id", time.Now())
+
 	var key auth.KDFKey
 	var salt auth.ServerSalt
 	var verified bool
+	var migrated bool
 
 	err = s.db.QueryRow(
-		`SELECT user_id, key, server_salt, verify_token is null from accounts WHERE normalized_email=?`,
+		`SELECT user_id, key, server_salt, verify_token is null, migrated_to is not null from accounts WHERE normalized_email=?`,
 		email.Normalize(),
-	).Scan(&userId, &key, &salt, &verified)
+	).Scan(&userId, &key, &salt, &verified, &migrated)
 	if err == sql.ErrNoRows {
 		err = ErrWrongCredentials
 	}
@@ -390,6 +1027,12 @@ func (s *Store) GetUserId(email auth.Email, password auth.Password) (userId auth
 		err = ErrNotVerified
 		userId = auth.UserId(0)
 	}
+	// Only after the password check, so that we don't tell just anybody where
+	// the account went
+	if err == nil && migrated {
+		err = ErrAccountMigrated
+		userId = auth.UserId(0)
+	}
 	return
 }
 
@@ -397,7 +1040,9 @@ func (s *Store) GetUserId(email auth.Email, password auth.Password) (userId auth
 // Account //
 /////////////
 
-func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) (err error) {
+func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString, locale auth.Locale) (err error) {
+	defer observeQueryDuration("create-account", time.Now())
+
 	key, salt, err := password.Create()
 	if err != nil {
 		return
@@ -409,10 +1054,24 @@ func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed aut
 		*verifyExpiration = time.Now().UTC().Add(VerifyTokenLifespan)
 	}
 
+	_, err = insertAccount(s.db, email, key, salt, seed, verifyToken, verifyExpiration, locale)
+	return
+}
+
+func insertAccount(
+	e execer,
+	email auth.Email,
+	key auth.KDFKey,
+	salt auth.ServerSalt,
+	seed auth.ClientSaltSeed,
+	verifyToken *auth.VerifyTokenString,
+	verifyExpiration *time.Time,
+	locale auth.Locale,
+) (userId auth.UserId, err error) {
 	// userId auto-increments
-	_, err = s.db.Exec(
-		"INSERT INTO accounts (normalized_email, email, key, server_salt, client_salt_seed, verify_token, verify_expiration, updated) VALUES(?,?,?,?,?,?,?, datetime('now'))",
-		email.Normalize(), email, key, salt, seed, verifyToken, verifyExpiration,
+	res, err := e.Exec(
+		"INSERT INTO accounts (normalized_email, email, key, server_salt, client_salt_seed, verify_token, verify_expiration, locale, updated) VALUES(?,?,?,?,?,?,?,?, datetime('now'))",
+		email.Normalize(), email, key, salt, seed, verifyToken, verifyExpiration, locale,
 	)
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
@@ -420,7 +1079,12 @@ func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed aut
 			err = ErrDuplicateAccount
 		}
 	}
+	if err != nil {
+		return
+	}
 
+	id, err := res.LastInsertId()
+	userId = auth.UserId(id)
 	return
 }
 
@@ -430,22 +1094,19 @@ func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed aut
 // This function should only work if the account is not already verified.
 // Otherwise we risk de-verifying accounts which would be confusing and
 // annoying if it were to ever get triggered.
-func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth.VerifyTokenString) (err error) {
+//
+// Return the account's locale as a convenience for the calling request
+// handler, for the email.
+func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth.VerifyTokenString) (locale auth.Locale, err error) {
+	defer observeQueryDuration("update-verify-token", time.Now())
+
 	expiration := time.Now().UTC().Add(VerifyTokenLifespan)
 
-	res, err := s.db.Exec(
-		`UPDATE accounts SET verify_token=?, verify_expiration=?, updated=datetime('now') WHERE normalized_email=? and verify_token is not null`,
+	err = s.db.QueryRow(
+		`UPDATE accounts SET verify_token=?, verify_expiration=?, updated=datetime('now') WHERE normalized_email=? and verify_token is not null RETURNING locale`,
 		verifyTokenString, expiration, email.Normalize(),
-	)
-	if err != nil {
-		return
-	}
-
-	numRows, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if numRows == 0 {
+	).Scan(&locale)
+	if err == sql.ErrNoRows {
 		// Since we got a miss (presumably not very common), let's do another check
 		// to see which error to return: invalid email or invalid token
 		var dummy int
@@ -463,31 +1124,100 @@ func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth
 	return
 }
 
-func (s *Store) VerifyAccount(verifyTokenString auth.VerifyTokenString) (err error) {
-	expirationCutoff := time.Now().UTC()
+// What we know about an account, besides its password and wallets
+type AccountInfo struct {
+	Email          auth.Email
+	ClientSaltSeed auth.ClientSaltSeed
+	Verified       bool
+	Created        time.Time
+	Updated        time.Time
+
+	// Opted out of emails about the account
+	NotificationsOff bool
+
+	// For emails. Empty means the default.
+	Locale auth.Locale
+}
+
+func (s *Store) GetAccountInfo(userId auth.UserId) (info AccountInfo, err error) {
+	defer observeQueryDuration("get-account-info", time.Now())
+	return getAccountInfo(s.db, userId)
+}
+
+func getAccountInfo(db querier, userId auth.UserId) (info AccountInfo, err error) {
+	err = db.QueryRow(
+		"SELECT email, client_salt_seed, verify_token is null, created, updated, notifications_off, locale FROM accounts WHERE user_id=?",
+		userId,
+	).Scan(&info.Email, &info.ClientSaltSeed, &info.Verified, &info.Created, &info.Updated, &info.NotificationsOff, &info.Locale)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	return
+}
+
+func (s *Store) SetNotificationsOff(userId auth.UserId, off bool) (err error) {
+	defer observeQueryDuration("set-notifications-off", time.Now())
 
 	res, err := s.db.Exec(
-		"UPDATE accounts SET verify_token=null, verify_expiration=null, updated=datetime('now') WHERE verify_token=? AND verify_expiration>?",
-		verifyTokenString, expirationCutoff,
+		"UPDATE accounts SET notifications_off=?, updated=datetime('now') WHERE user_id=?",
+		off, userId,
 	)
 	if err != nil {
 		return
 	}
-
 	numRows, err := res.RowsAffected()
-	if err != nil {
-		return
+	if err == nil && numRows == 0 {
+		err = ErrWrongCredentials
 	}
-	if numRows == 0 {
+	return
+}
+
+// Return userId as a convenience for the calling request handler
+func (s *Store) VerifyAccount(verifyTokenString auth.VerifyTokenString) (userId auth.UserId, err error) {
+	defer observeQueryDuration("verify-account", time.Now())
+
+	expirationCutoff := time.Now().UTC()
+
+	err = s.db.QueryRow(
+		"UPDATE accounts SET verify_token=null, verify_expiration=null, updated=datetime('now') WHERE verify_token=? AND verify_expiration>? RETURNING user_id",
+		verifyTokenString, expirationCutoff,
+	).Scan(&userId)
+	if err == sql.ErrNoRows {
 		err = ErrNoTokenForUser
 	}
 	return
 }
 
+// A wallet at a given sequence. One of the wallets to re-encrypt in a password
+// change, or to move between servers.
+type WalletUpdate struct {
+	WalletId        wallet.WalletId
+	EncryptedWallet wallet.EncryptedWallet
+	Sequence        wallet.Sequence
+	Hmac            wallet.WalletHmac
+}
+
+// A wallet that kept a password change from going through, and what the
+// client needs to know to try again
+type WalletConflict struct {
+	WalletId wallet.WalletId
+
+	// The wallet's current sequence, or 0 if the user has no such wallet
+	Sequence wallet.Sequence
+
+	// The user has this wallet, but it wasn't in the password change
+	Missing bool
+}
+
 // Change password. For the user, this requires changing their root password,
-// which changes the encryption key for the wallet as well. Thus, we should
-// update the wallet at the same time to avoid ever having a situation where
-// these two don't match.
+// which changes the encryption key for the wallets as well. Thus, we should
+// update the wallets at the same time to avoid ever having a situation where
+// these two don't match. Every one of the user's wallets has to be in
+// `wallets`, otherwise it's ErrMissingWallet and nothing changes.
+//
+// With ErrWrongSequence or ErrMissingWallet, `conflicts` has every wallet that
+// was stale, didn't exist, or was left out, so the client can fix them all
+// before trying again.
 //
 // Also delete all auth tokens to force clients to update their root password
 // to get a new token. This prevents other clients from posting a wallet
@@ -513,18 +1243,16 @@ func (s *Store) ChangePasswordWithWallet(
 	oldPassword auth.Password,
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
-	encryptedWallet wallet.EncryptedWallet,
-	sequence wallet.Sequence,
-	hmac wallet.WalletHmac,
-) (userId auth.UserId, err error) {
+	wallets []WalletUpdate,
+) (userId auth.UserId, conflicts []WalletConflict, err error) {
+	defer observeQueryDuration("change-password-with-wallet", time.Now())
+
 	return s.changePassword(
 		email,
 		oldPassword,
 		newPassword,
 		clientSaltSeed,
-		encryptedWallet,
-		sequence,
-		hmac,
+		wallets,
 	)
 }
 
@@ -542,15 +1270,16 @@ func (s *Store) ChangePasswordNoWallet(
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
 ) (userId auth.UserId, err error) {
-	return s.changePassword(
+	defer observeQueryDuration("change-password-no-wallet", time.Now())
+
+	userId, _, err = s.changePassword(
 		email,
 		oldPassword,
 		newPassword,
 		clientSaltSeed,
-		wallet.EncryptedWallet(""),
-		wallet.Sequence(0),
-		wallet.WalletHmac(""),
+		nil,
 	)
+	return
 }
 
 // Common code for for WithWallet and WithNoWallet password change functions
@@ -559,10 +1288,8 @@ func (s *Store) changePassword(
 	oldPassword auth.Password,
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
-	encryptedWallet wallet.EncryptedWallet,
-	sequence wallet.Sequence,
-	hmac wallet.WalletHmac,
-) (userId auth.UserId, err error) {
+	wallets []WalletUpdate,
+) (userId auth.UserId, conflicts []WalletConflict, err error) {
 
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -611,6 +1338,24 @@ func (s *Store) changePassword(
 		return
 	}
 
+	conflicts, err = s.replaceCredentials(tx, userId, newKey, newSalt, clientSaltSeed, wallets)
+	return
+}
+
+// Put in the new key and client salt seed along with the wallets re-encrypted
+// for them, and log out every client. Whatever changed the key, the rules are
+// the same as for a password change (see ChangePasswordWithWallet).
+//
+// Any email change in progress is dropped too, since it carries a key made
+// from the old password.
+func (s *Store) replaceCredentials(
+	tx *sql.Tx,
+	userId auth.UserId,
+	newKey auth.KDFKey,
+	newSalt auth.ServerSalt,
+	clientSaltSeed auth.ClientSaltSeed,
+	wallets []WalletUpdate,
+) (conflicts []WalletConflict, err error) {
 	res, err := tx.Exec(
 		"UPDATE accounts SET key=?, server_salt=?, client_salt_seed=?, updated=datetime('now') WHERE user_id=?",
 		newKey, newSalt, clientSaltSeed, userId,
@@ -628,39 +1373,61 @@ func (s *Store) changePassword(
 		return
 	}
 
-	if encryptedWallet != "" {
-		// With a wallet expected: update it.
-
-		res, err = tx.Exec(
-			`UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, updated=datetime('now')
-			 WHERE user_id=? AND sequence=?`,
-			encryptedWallet, sequence, hmac, userId, sequence-1,
-		)
-		if err != nil {
-			return
+	// With wallets expected: update each of them. Keep going past a stale one
+	// so that the client finds out about all of them at once. If the same
+	// wallet is in here twice, the second one has the wrong sequence by then.
+	sent := map[wallet.WalletId]bool{}
+	for _, w := range wallets {
+		err = s.updateWalletToSequence(tx, userId, w.WalletId, w.EncryptedWallet, w.Sequence, w.Hmac)
+		if err == ErrNoWallet {
+			conflict := WalletConflict{WalletId: w.WalletId}
+			err = tx.QueryRow(
+				"SELECT sequence FROM wallets WHERE user_id=? AND wallet_id=?", userId, w.WalletId,
+			).Scan(&conflict.Sequence)
+			if err == sql.ErrNoRows {
+				err = nil
+			}
+			conflicts = append(conflicts, conflict)
 		}
-		numRows, err = res.RowsAffected()
 		if err != nil {
 			return
 		}
-		if numRows == 0 {
-			err = ErrWrongSequence
+		sent[w.WalletId] = true
+	}
+	staleWallets := len(conflicts) > 0
+
+	// Assert that we updated all of them. With no wallets expected, this means
+	// asserting we have no wallet.
+	rows, err := tx.Query("SELECT wallet_id, sequence FROM wallets WHERE user_id=? ORDER BY wallet_id", userId)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		conflict := WalletConflict{Missing: true}
+		if err = rows.Scan(&conflict.WalletId, &conflict.Sequence); err != nil {
+			rows.Close()
 			return
 		}
-	} else {
-		// With no wallet expected: assert we have no wallet.
-
-		var dummy string
-		err = tx.QueryRow("SELECT 1 FROM wallets WHERE user_id=?", userId).Scan(&dummy)
-		if err != sql.ErrNoRows {
-			if err == nil {
-				// We expected no rows
-				err = ErrUnexpectedWallet
-				return
-			}
-			// Some other error
-			return
+		if !sent[conflict.WalletId] {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if staleWallets {
+		err = ErrWrongSequence
+		return
+	}
+	if len(conflicts) > 0 {
+		if len(wallets) == 0 {
+			err = ErrUnexpectedWallet
+		} else {
+			err = ErrMissingWallet
 		}
+		return
 	}
 
 	// Don't care how many I delete here. Might even be zero (no login token
@@ -668,11 +1435,18 @@ func (s *Store) changePassword(
 	// that we want to prevent any client from saving a subsequent wallet
 	// without changing its password first.
 	_, err = tx.Exec("DELETE FROM auth_tokens WHERE user_id=?", userId)
+	if err != nil {
+		return
+	}
+
+	err = deleteEmailChange(tx, userId)
 	return
 }
 
 // It's a public endpoint, we don't really care if the user is verified
 func (s *Store) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSeed, err error) {
+	defer observeQueryDuration("get-client-salt-seed", time.Now())
+
 	err = s.db.QueryRow(
 		`SELECT client_salt_seed from accounts WHERE normalized_email=?`,
 		email.Normalize(),
@@ -682,3 +1456,1259 @@ func (s *Store) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSeed, e
 	}
 	return
 }
+
+//////////////////
+// Invite Codes //
+//////////////////
+
+type InviteCode struct {
+	Code auth.InviteCode
+
+	// Zero if the server operator made it
+	CreatedBy auth.UserId
+
+	MaxUses int
+	Uses    int
+	Created time.Time
+}
+
+// Like CreateAccount, but for InviteCode mode: the account is verified from
+// the start, and uses up one use of the code. If the code doesn't exist or is
+// used up, there's no account.
+func (s *Store) CreateAccountWithInviteCode(
+	email auth.Email,
+	password auth.Password,
+	seed auth.ClientSaltSeed,
+	locale auth.Locale,
+	code auth.InviteCode,
+) (err error) {
+	defer observeQueryDuration("create-account-with-invite-code", time.Now())
+
+	key, salt, err := password.Create()
+	if err != nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	res, err := tx.Exec("UPDATE invite_codes SET uses=uses+1 WHERE code=? AND uses < max_uses", code)
+	if err != nil {
+		return
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrInvalidInviteCode
+		return
+	}
+
+	userId, err := insertAccount(tx, email, key, salt, seed, nil, nil, locale)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO invite_code_uses (user_id, code, created) VALUES(?,?,?)",
+		userId, code, time.Now().UTC(),
+	)
+	return
+}
+
+// createdBy is zero for the server operator, who has no quota. Users can give
+// out up to quota invites in total, counting every use of every code they've
+// made, whether or not they've been used yet.
+//
+// Returns the code as it was saved
+func (s *Store) CreateInviteCode(code auth.InviteCode, maxUses int, createdBy auth.UserId, quota int) (invite InviteCode, err error) {
+	defer observeQueryDuration("create-invite-code", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var creator *auth.UserId
+	if createdBy != 0 {
+		creator = &createdBy
+
+		var given int
+		err = tx.QueryRow(
+			"SELECT COALESCE(SUM(max_uses), 0) FROM invite_codes WHERE created_by=?", createdBy,
+		).Scan(&given)
+		if err != nil {
+			return
+		}
+		if given+maxUses > quota {
+			err = ErrInviteQuota
+			return
+		}
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO invite_codes (code, created_by, max_uses, created) VALUES(?,?,?,?) RETURNING code, COALESCE(created_by, 0), max_uses, uses, created",
+		code, creator, maxUses, time.Now().UTC(),
+	).Scan(&invite.Code, &invite.CreatedBy, &invite.MaxUses, &invite.Uses, &invite.Created)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintPrimaryKey) {
+			err = ErrDuplicateInvite
+		}
+	}
+	return
+}
+
+// The codes a user made, or with zero, every code (for the server operator).
+// Oldest first.
+func (s *Store) GetInviteCodes(createdBy auth.UserId) (codes []InviteCode, err error) {
+	defer observeQueryDuration("get-invite-codes", time.Now())
+
+	query := "SELECT code, COALESCE(created_by, 0), max_uses, uses, created FROM invite_codes"
+	args := []interface{}{}
+	if createdBy != 0 {
+		query += " WHERE created_by=?"
+		args = append(args, createdBy)
+	}
+
+	rows, err := s.db.Query(query+" ORDER BY created, code", args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	codes = []InviteCode{}
+	for rows.Next() {
+		var code InviteCode
+		if err = rows.Scan(&code.Code, &code.CreatedBy, &code.MaxUses, &code.Uses, &code.Created); err != nil {
+			return
+		}
+		codes = append(codes, code)
+	}
+	err = rows.Err()
+	return
+}
+
+//////////////////////
+// Pending Accounts //
+//////////////////////
+
+// An account that isn't verified yet. In AdminApproval mode, one waiting for
+// the server operator.
+type PendingAccount struct {
+	UserId  auth.UserId
+	Email   auth.Email
+	Locale  auth.Locale
+	Created time.Time
+}
+
+// Like CreateAccount, but for AdminApproval mode: the account is unverified
+// until ApproveAccount. verifyToken is only there to mark it unverified, and
+// nobody is sent it. It has no expiration, so VerifyAccount never matches it.
+func (s *Store) CreatePendingAccount(
+	email auth.Email,
+	password auth.Password,
+	seed auth.ClientSaltSeed,
+	verifyToken auth.VerifyTokenString,
+	locale auth.Locale,
+) (err error) {
+	defer observeQueryDuration("create-pending-account", time.Now())
+
+	key, salt, err := password.Create()
+	if err != nil {
+		return
+	}
+
+	_, err = insertAccount(s.db, email, key, salt, seed, &verifyToken, nil, locale)
+	return
+}
+
+// Every unverified account, oldest first. That includes accounts from
+// EmailVerify mode that never clicked their link, in case the server switched
+// modes, so the server operator can deal with those too.
+func (s *Store) GetPendingAccounts() (accounts []PendingAccount, err error) {
+	defer observeQueryDuration("get-pending-accounts", time.Now())
+
+	rows, err := s.db.Query(
+		"SELECT user_id, email, locale, created FROM accounts WHERE verify_token IS NOT NULL ORDER BY created, user_id",
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var account PendingAccount
+		if err = rows.Scan(&account.UserId, &account.Email, &account.Locale, &account.Created); err != nil {
+			return
+		}
+		accounts = append(accounts, account)
+	}
+	err = rows.Err()
+	return
+}
+
+// Verify the account. Return its email and locale as a convenience for the
+// calling request handler, to tell the user.
+func (s *Store) ApproveAccount(userId auth.UserId) (email auth.Email, locale auth.Locale, err error) {
+	defer observeQueryDuration("approve-account", time.Now())
+
+	err = s.db.QueryRow(
+		"UPDATE accounts SET verify_token=null, verify_expiration=null, updated=datetime('now') WHERE user_id=? AND verify_token IS NOT NULL RETURNING email, locale",
+		userId,
+	).Scan(&email, &locale)
+	if err == sql.ErrNoRows {
+		err = ErrNotPending
+	}
+	return
+}
+
+// Delete the account, freeing up the email to sign up again. Only for
+// unverified accounts, which can't have logged in, so there's nothing else of
+// theirs to delete.
+func (s *Store) RejectAccount(userId auth.UserId) (email auth.Email, err error) {
+	defer observeQueryDuration("reject-account", time.Now())
+
+	err = s.db.QueryRow(
+		"DELETE FROM accounts WHERE user_id=? AND verify_token IS NOT NULL RETURNING email",
+		userId,
+	).Scan(&email)
+	if err == sql.ErrNoRows {
+		err = ErrNotPending
+	}
+	return
+}
+
+//////////////////
+// Email Change //
+//////////////////
+
+// Start changing the account's email to newEmail. Since the client salt is
+// made from the email, the client sends everything that changes with it: the
+// password it derives from the new email, a client salt seed, and each wallet
+// re-encrypted with the new key, as for a password change. Nothing happens to
+// the account until the user confirms with the token (see ConfirmEmailChange).
+//
+// Any email change already in progress is replaced.
+//
+// Return the current email as a convenience for the calling request handler,
+// so it can tell the user at the old address.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) StartEmailChange(
+	userId auth.UserId,
+	password auth.Password,
+	newEmail auth.Email,
+	newPassword auth.Password,
+	clientSaltSeed auth.ClientSaltSeed,
+	wallets []WalletUpdate,
+	token auth.VerifyTokenString,
+) (oldEmail auth.Email, locale auth.Locale, err error) {
+	defer observeQueryDuration("start-email-change", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var key auth.KDFKey
+	var salt auth.ServerSalt
+	err = tx.QueryRow(
+		"SELECT email, key, server_salt, locale FROM accounts WHERE user_id=?", userId,
+	).Scan(&oldEmail, &key, &salt, &locale)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+	match, err := password.Check(key, salt)
+	if err == nil && !match {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+
+	// Checked again when confirming, since somebody could sign up with it in
+	// the meantime. This is so the user finds out now. Changing the email to a
+	// different capitalization of itself is fine.
+	var dummy int
+	err = tx.QueryRow(
+		"SELECT 1 FROM accounts WHERE normalized_email=? AND user_id<>?", newEmail.Normalize(), userId,
+	).Scan(&dummy)
+	if err == nil {
+		err = ErrDuplicateEmail
+		return
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	newKey, newSalt, err := newPassword.Create()
+	if err != nil {
+		return
+	}
+
+	if err = deleteEmailChange(tx, userId); err != nil {
+		return
+	}
+	_, err = tx.Exec(
+		"INSERT INTO email_changes (user_id, new_email, key, server_salt, client_salt_seed, token, expiration) VALUES(?,?,?,?,?,?,?)",
+		userId, newEmail, newKey, newSalt, clientSaltSeed, token, time.Now().UTC().Add(VerifyTokenLifespan),
+	)
+	if err != nil {
+		return
+	}
+	for _, w := range wallets {
+		_, err = tx.Exec(
+			"INSERT INTO email_change_wallets (user_id, wallet_id, encrypted_wallet, sequence, hmac) VALUES(?,?,?,?,?)",
+			userId, w.WalletId, w.EncryptedWallet, w.Sequence, w.Hmac,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// The user confirmed the new address. Swap in the new email along with
+// everything that came with it, in one transaction, keeping the user id. As
+// with a password change, every client is logged out, since they all have
+// keys made from the old email.
+//
+// If a wallet changed since the email change was started, the re-encrypted
+// wallets are out of date, so it's ErrWrongSequence, ErrMissingWallet or
+// ErrUnexpectedWallet (see changePassword) and the user has to start over.
+// ErrDuplicateEmail if somebody else took the new email in the meantime.
+//
+// Return userId and both emails as a convenience for the calling request
+// handler
+func (s *Store) ConfirmEmailChange(token auth.VerifyTokenString) (userId auth.UserId, oldEmail auth.Email, newEmail auth.Email, err error) {
+	defer observeQueryDuration("confirm-email-change", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var newKey auth.KDFKey
+	var newSalt auth.ServerSalt
+	var clientSaltSeed auth.ClientSaltSeed
+	err = tx.QueryRow(
+		"SELECT user_id, new_email, key, server_salt, client_salt_seed FROM email_changes WHERE token=? AND expiration>?",
+		token, time.Now().UTC(),
+	).Scan(&userId, &newEmail, &newKey, &newSalt, &clientSaltSeed)
+	if err == sql.ErrNoRows {
+		err = ErrNoTokenForUser
+	}
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.Query(
+		"SELECT wallet_id, encrypted_wallet, sequence, hmac FROM email_change_wallets WHERE user_id=? ORDER BY wallet_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	var wallets []WalletUpdate
+	for rows.Next() {
+		var w WalletUpdate
+		if err = rows.Scan(&w.WalletId, &w.EncryptedWallet, &w.Sequence, &w.Hmac); err != nil {
+			rows.Close()
+			return
+		}
+		wallets = append(wallets, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	err = tx.QueryRow("SELECT email FROM accounts WHERE user_id=?", userId).Scan(&oldEmail)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE accounts SET email=?, normalized_email=? WHERE user_id=?",
+		newEmail, newEmail.Normalize(), userId,
+	)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintUnique) {
+			err = ErrDuplicateEmail
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	// Also deletes the email change
+	_, err = s.replaceCredentials(tx, userId, newKey, newSalt, clientSaltSeed, wallets)
+	return
+}
+
+// Call within a transaction
+func deleteEmailChange(tx *sql.Tx, userId auth.UserId) (err error) {
+	_, err = tx.Exec("DELETE FROM email_change_wallets WHERE user_id=?", userId)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM email_changes WHERE user_id=?", userId)
+	return
+}
+
+///////////////
+// Migration //
+///////////////
+
+// Everything another server needs to recreate the account, for moving it
+// there. The wallets are at their current sequence.
+//
+// If migratedTo is set (to the other server's URL), the password is checked
+// (a stolen auth token shouldn't be enough to take the account away) and the
+// account is also marked as moved there, in the same transaction. After that nobody can log in to it
+// here (see GetUserId), and its auth tokens are deleted so that no client
+// saves a wallet here that the other server will never see. CancelMigration
+// undoes the mark if the import doesn't work out. Empty migratedTo leaves the
+// account as it is, i.e. for a copy.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) ExportAccount(userId auth.UserId, password auth.Password, migratedTo string) (
+	email auth.Email,
+	seed auth.ClientSaltSeed,
+	key auth.KDFKey,
+	salt auth.ServerSalt,
+	wallets []WalletUpdate,
+	err error,
+) {
+	defer observeQueryDuration("export-account", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = tx.QueryRow(
+		"SELECT email, client_salt_seed, key, server_salt FROM accounts WHERE user_id=?", userId,
+	).Scan(&email, &seed, &key, &salt)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+	if migratedTo != "" {
+		var match bool
+		match, err = password.Check(key, salt)
+		if err == nil && !match {
+			err = ErrWrongCredentials
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	rows, err := tx.Query(
+		"SELECT wallet_id, encrypted_wallet, encoding, blob_ref, sequence, hmac FROM wallets WHERE user_id=? ORDER BY wallet_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	wallets = []WalletUpdate{}
+	for rows.Next() {
+		var w WalletUpdate
+		var stored []byte
+		var encoding compression.Encoding
+		var blobRef *blobstore.Ref
+		if err = rows.Scan(&w.WalletId, &stored, &encoding, &blobRef, &w.Sequence, &w.Hmac); err != nil {
+			rows.Close()
+			return
+		}
+		if w.EncryptedWallet, err = s.decodeWallet(stored, encoding, blobRef); err != nil {
+			rows.Close()
+			return
+		}
+		wallets = append(wallets, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if migratedTo == "" {
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE accounts SET migrated_to=?, updated=datetime('now') WHERE user_id=?",
+		migratedTo, userId,
+	)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM auth_tokens WHERE user_id=?", userId)
+	return
+}
+
+// Recreate an account that was moved here from another server, with its
+// wallets at the sequences they were on there, so that the user's clients
+// carry on where they left off. The other server already verified the account,
+// so it starts out verified.
+//
+// Assumption: The account and wallets have been validated, i.e. there are at
+// most MaxWalletsPerUser wallets, with no wallet id twice.
+//
+// Return userId as a convenience for the calling request handler
+func (s *Store) ImportAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, wallets []WalletUpdate) (userId auth.UserId, err error) {
+	defer observeQueryDuration("import-account", time.Now())
+
+	key, salt, err := password.Create()
+	if err != nil {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// userId auto-increments
+	err = tx.QueryRow(
+		"INSERT INTO accounts (normalized_email, email, key, server_salt, client_salt_seed, updated) VALUES(?,?,?,?,?, datetime('now')) RETURNING user_id",
+		email.Normalize(), email, key, salt, seed,
+	).Scan(&userId)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintUnique) {
+			err = ErrDuplicateAccount
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	for _, w := range wallets {
+		var stored storedWallet
+		if stored, err = s.encodeWallet(w.EncryptedWallet); err != nil {
+			return
+		}
+		_, err = tx.Exec(
+			"INSERT INTO wallets (user_id, wallet_id, encrypted_wallet, encoding, blob_ref, blob_size, sequence, hmac, updated) VALUES(?,?,?,?,?,?,?,?, datetime('now'))",
+			userId, w.WalletId, stored.data, stored.encoding, stored.blobRef, stored.blobSize, w.Sequence, w.Hmac,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Where the account went, for redirecting clients that still come here. Only
+// call it after GetUserId gives ErrAccountMigrated, since that's what checks
+// the password.
+func (s *Store) GetMigratedTo(email auth.Email) (migratedTo string, err error) {
+	defer observeQueryDuration("get-migrated-to", time.Now())
+
+	err = s.db.QueryRow(
+		"SELECT migrated_to FROM accounts WHERE normalized_email=? AND migrated_to IS NOT NULL",
+		email.Normalize(),
+	).Scan(&migratedTo)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	return
+}
+
+// Undo ExportAccount marking the account as moved, for if the import on the
+// other server never went through. The account's tokens are gone by now, so
+// this checks the password instead, the same way GetUserId does.
+//
+// Return userId as a convenience for the calling request handler
+func (s *Store) CancelMigration(email auth.Email, password auth.Password) (userId auth.UserId, err error) {
+	defer observeQueryDuration("cancel-migration", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			userId = auth.UserId(0)
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var key auth.KDFKey
+	var salt auth.ServerSalt
+	var migrated bool
+
+	err = tx.QueryRow(
+		"SELECT user_id, key, server_salt, migrated_to IS NOT NULL FROM accounts WHERE normalized_email=?",
+		email.Normalize(),
+	).Scan(&userId, &key, &salt, &migrated)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+	match, err := password.Check(key, salt)
+	if err == nil && !match {
+		err = ErrWrongCredentials
+	}
+	if err == nil && !migrated {
+		err = ErrNotMigrated
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE accounts SET migrated_to=NULL, updated=datetime('now') WHERE user_id=?",
+		userId,
+	)
+	return
+}
+
+/////////////////
+// Data Export //
+/////////////////
+
+// A wallet's contents, and when it was last saved
+type ExportedWallet struct {
+	WalletId        wallet.WalletId
+	EncryptedWallet wallet.EncryptedWallet
+	Sequence        wallet.Sequence
+	Hmac            wallet.WalletHmac
+	Updated         time.Time
+}
+
+// Everything we have about an account, besides its password and audit events
+type DataExport struct {
+	Info    AccountInfo
+	Wallets []ExportedWallet
+	Devices []Device
+}
+
+// For the user to download. All read in one transaction, so that a wallet
+// saved or a device logging in partway through doesn't give the user an
+// export that never matched what we had. Wallets are ordered by wallet id,
+// and devices as in ListDevices.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) GetDataExport(userId auth.UserId) (export DataExport, err error) {
+	defer observeQueryDuration("get-data-export", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	// Read only
+	defer tx.Rollback()
+
+	if export.Info, err = getAccountInfo(tx, userId); err != nil {
+		return
+	}
+
+	rows, err := tx.Query(
+		"SELECT wallet_id, encrypted_wallet, encoding, blob_ref, sequence, hmac, updated FROM wallets WHERE user_id=? ORDER BY wallet_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	export.Wallets = []ExportedWallet{}
+	for rows.Next() {
+		var w ExportedWallet
+		var stored []byte
+		var encoding compression.Encoding
+		var blobRef *blobstore.Ref
+		if err = rows.Scan(&w.WalletId, &stored, &encoding, &blobRef, &w.Sequence, &w.Hmac, &w.Updated); err != nil {
+			rows.Close()
+			return
+		}
+		if w.EncryptedWallet, err = s.decodeWallet(stored, encoding, blobRef); err != nil {
+			rows.Close()
+			return
+		}
+		export.Wallets = append(export.Wallets, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	export.Devices, err = listDevices(tx, userId)
+	return
+}
+
+///////////
+// Stats //
+///////////
+
+// Upper bounds (in bytes, inclusive) for counting wallets by size. This is the
+// size as stored, so after compression if WalletCompression is on, whether in
+// the database or the blob store.
+var WalletSizeBuckets = []int{1000, 10000, 100000, 1000000}
+
+// Counts for the metrics dashboard
+type Stats struct {
+	Accounts         int
+	VerifiedAccounts int
+
+	// All wallets, including each of a user's named wallets
+	Wallets int
+
+	// Accounts with at least one wallet
+	AccountsWithWallets int
+
+	// Not expired
+	AuthTokens int
+
+	// Number of wallets at most each size in WalletSizeBuckets, in the same
+	// order. Cumulative, like a Prometheus histogram; Wallets is the count for
+	// "any size".
+	WalletsBySize []int
+}
+
+// Each of these is a full table scan, so don't call it too often on a big
+// database.
+func (s *Store) GetStats() (stats Stats, err error) {
+	defer observeQueryDuration("get-stats", time.Now())
+
+	// Verified accounts have a null verify_token
+	err = s.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(verify_token IS NULL), 0) FROM accounts",
+	).Scan(&stats.Accounts, &stats.VerifiedAccounts)
+	if err != nil {
+		return
+	}
+
+	err = s.db.QueryRow(
+		"SELECT COUNT(*) FROM auth_tokens WHERE expiration>?", time.Now().UTC(),
+	).Scan(&stats.AuthTokens)
+	if err != nil {
+		return
+	}
+
+	// All the size buckets in one pass over the wallets
+	query := "SELECT COUNT(*), COUNT(DISTINCT user_id)"
+	args := []interface{}{}
+	for _, bucket := range WalletSizeBuckets {
+		query += ", COALESCE(SUM(COALESCE(blob_size, LENGTH(encrypted_wallet)) <= ?), 0)"
+		args = append(args, bucket)
+	}
+	query += " FROM wallets"
+
+	stats.WalletsBySize = make([]int, len(WalletSizeBuckets))
+	dest := []interface{}{&stats.Wallets, &stats.AccountsWithWallets}
+	for i := range stats.WalletsBySize {
+		dest = append(dest, &stats.WalletsBySize[i])
+	}
+	err = s.db.QueryRow(query, args...).Scan(dest...)
+	return
+}
+
+///////////
+// Audit //
+///////////
+
+type AuditEventType string
+
+const (
+	AuditEventRegister             AuditEventType = "register"
+	AuditEventAccountVerified      AuditEventType = "account-verified"
+	AuditEventLogin                AuditEventType = "login"
+	AuditEventLoginFailed          AuditEventType = "login-failed"
+	AuditEventPasswordChange       AuditEventType = "password-change"
+	AuditEventPasswordChangeFailed AuditEventType = "password-change-failed"
+	AuditEventWalletUpdate         AuditEventType = "wallet-update"
+	AuditEventWalletDelete         AuditEventType = "wallet-delete"
+	AuditEventAccountExport        AuditEventType = "account-export"
+	AuditEventAccountImport        AuditEventType = "account-import"
+	AuditEventMigrationCancel      AuditEventType = "migration-cancel"
+	AuditEventDataExport           AuditEventType = "data-export"
+	AuditEventEmailChangeRequest   AuditEventType = "email-change-request"
+	AuditEventEmailChange          AuditEventType = "email-change"
+	AuditEventAccountApproved      AuditEventType = "account-approved"
+	AuditEventAccountRejected      AuditEventType = "account-rejected"
+)
+
+type AuditEvent struct {
+	// Zero if the event isn't tied to an account
+	UserId auth.UserId
+
+	// Empty if the event isn't tied to a device
+	DeviceId auth.DeviceId
+
+	Type      AuditEventType
+	IP        string
+	UserAgent string
+
+	// Set by the store when adding
+	Created time.Time
+}
+
+func (s *Store) AddAuditEvent(event AuditEvent) (err error) {
+	defer observeQueryDuration("add-audit-event", time.Now())
+
+	var userId *auth.UserId
+	if event.UserId != 0 {
+		userId = &event.UserId
+	}
+	var deviceId *auth.DeviceId
+	if event.DeviceId != "" {
+		deviceId = &event.DeviceId
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO audit_events (user_id, device_id, event_type, ip, user_agent, created) VALUES(?,?,?,?,?,?)",
+		userId, deviceId, event.Type, event.IP, event.UserAgent, time.Now().UTC(),
+	)
+	return
+}
+
+// For events where all we have is what the user typed in, like a failed
+// login. Attributed to the account with that email if there is one, otherwise
+// to nobody. (event.UserId is ignored.)
+func (s *Store) AddAuditEventForEmail(email auth.Email, event AuditEvent) (err error) {
+	defer observeQueryDuration("add-audit-event-for-email", time.Now())
+
+	var deviceId *auth.DeviceId
+	if event.DeviceId != "" {
+		deviceId = &event.DeviceId
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO audit_events (user_id, device_id, event_type, ip, user_agent, created) VALUES((SELECT user_id FROM accounts WHERE normalized_email=?),?,?,?,?,?)",
+		email.Normalize(), deviceId, event.Type, event.IP, event.UserAgent, time.Now().UTC(),
+	)
+	return
+}
+
+// Any extra destinations are for columns selected after the usual ones
+func scanAuditEvent(rows *sql.Rows, extra ...any) (event AuditEvent, err error) {
+	var userId sql.NullInt64
+	var deviceId sql.NullString
+	dest := []any{&userId, &deviceId, &event.Type, &event.IP, &event.UserAgent, &event.Created}
+	err = rows.Scan(append(dest, extra...)...)
+	event.UserId = auth.UserId(userId.Int64)
+	event.DeviceId = auth.DeviceId(deviceId.String)
+	return
+}
+
+// A user's most recent events, newest first
+func (s *Store) GetAuditEvents(userId auth.UserId, limit int) (events []AuditEvent, err error) {
+	defer observeQueryDuration("get-audit-events", time.Now())
+
+	rows, err := s.db.Query(
+		"SELECT user_id, device_id, event_type, ip, user_agent, created FROM audit_events WHERE user_id=? ORDER BY created DESC, id DESC LIMIT ?",
+		userId, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	events = []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		event, err = scanAuditEvent(rows)
+		if err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	return
+}
+
+// How many audit events ExportAuditEvents reads at a time. A var so tests can
+// make it small.
+var auditEventExportPageSize = 1000
+
+// Every event since the given time, oldest first, for all users. Passed to
+// `fn` one at a time so the caller can stream them out without holding the
+// whole log in memory. An error from `fn` stops the export and is returned.
+//
+// The events are read a page at a time, and `fn` is only called once a page's
+// rows are closed. `fn` is probably writing to a client that could be slow,
+// and an open read would block every write to the database in the meantime.
+func (s *Store) ExportAuditEvents(since time.Time, fn func(AuditEvent) error) (err error) {
+	defer observeQueryDuration("export-audit-events", time.Now())
+
+	var lastId int64
+	for {
+		var page []AuditEvent
+		if page, lastId, err = s.getAuditEventsPage(since, lastId); err != nil {
+			return
+		}
+		for _, event := range page {
+			if err = fn(event); err != nil {
+				return
+			}
+		}
+		if len(page) < auditEventExportPageSize {
+			return
+		}
+	}
+}
+
+// Up to auditEventExportPageSize events since the given time, after the one
+// with id `afterId`, along with the id of the last one
+func (s *Store) getAuditEventsPage(since time.Time, afterId int64) (events []AuditEvent, lastId int64, err error) {
+	rows, err := s.db.Query(
+		"SELECT user_id, device_id, event_type, ip, user_agent, created, id FROM audit_events WHERE created>=? AND id>? ORDER BY id LIMIT ?",
+		since.UTC(), afterId, auditEventExportPageSize,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	lastId = afterId
+	for rows.Next() {
+		var event AuditEvent
+		event, err = scanAuditEvent(rows, &lastId)
+		if err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	return
+}
+
+/////////////
+// Uploads //
+/////////////
+
+// Wallets too big to send in one request go up in parts. Once they're all
+// there, CommitUpload puts them together and saves the wallet like SetWallet
+// would.
+
+type UploadId int64
+
+// Pass `tx` to check as part of a transaction
+func checkUpload(tx *sql.Tx, userId auth.UserId, uploadId UploadId) (expiration time.Time, err error) {
+	err = tx.QueryRow(
+		"SELECT expiration FROM uploads WHERE upload_id=? AND user_id=? AND expiration>?",
+		uploadId, userId, time.Now().UTC(),
+	).Scan(&expiration)
+	if err == sql.ErrNoRows {
+		err = ErrNoUpload
+	}
+	return
+}
+
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) CreateUpload(userId auth.UserId) (uploadId UploadId, expiration time.Time, err error) {
+	defer observeQueryDuration("create-upload", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// Expired ones don't count. They'll get cleaned up eventually.
+	var numUploads int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM uploads WHERE user_id=? AND expiration>?",
+		userId, time.Now().UTC(),
+	).Scan(&numUploads)
+	if err != nil {
+		return
+	}
+	if numUploads >= MaxUploadsPerUser {
+		err = ErrTooManyUploads
+		return
+	}
+
+	expiration = time.Now().UTC().Add(UploadLifespan)
+	err = tx.QueryRow(
+		"INSERT INTO uploads (user_id, expiration) VALUES(?,?) RETURNING upload_id",
+		userId, expiration,
+	).Scan(&uploadId)
+	return
+}
+
+// Saves (or replaces) one part of an upload. Returns ErrUploadTooLarge if
+// this would make all of the parts together bigger than maxSize.
+func (s *Store) SaveUploadPart(userId auth.UserId, uploadId UploadId, part int, data string, maxSize int64) (err error) {
+	defer observeQueryDuration("save-upload-part", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = checkUpload(tx, userId, uploadId); err != nil {
+		return
+	}
+
+	// Not counting the part we're replacing, if any
+	var otherPartsSize int64
+	err = tx.QueryRow(
+		"SELECT COALESCE(SUM(LENGTH(CAST(data AS BLOB))), 0) FROM upload_parts WHERE upload_id=? AND part<>?",
+		uploadId, part,
+	).Scan(&otherPartsSize)
+	if err != nil {
+		return
+	}
+	if otherPartsSize+int64(len(data)) > maxSize {
+		err = ErrUploadTooLarge
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO upload_parts (upload_id, part, data) VALUES(?,?,?)",
+		uploadId, part, data,
+	)
+	return
+}
+
+// Which parts have been saved so far, in order, so a client can tell what
+// it still needs to send after losing its connection.
+func (s *Store) GetUploadParts(userId auth.UserId, uploadId UploadId) (parts []int, expiration time.Time, err error) {
+	defer observeQueryDuration("get-upload-parts", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	// Read only
+	defer tx.Rollback()
+
+	expiration, err = checkUpload(tx, userId, uploadId)
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.Query("SELECT part FROM upload_parts WHERE upload_id=? ORDER BY part", uploadId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	parts = []int{}
+	for rows.Next() {
+		var part int
+		if err = rows.Scan(&part); err != nil {
+			return
+		}
+		parts = append(parts, part)
+	}
+	err = rows.Err()
+	return
+}
+
+// Puts parts 0 through numParts-1 together and saves them as the wallet, with
+// the same sequence rules as SetWallet. The upload is deleted if it works.
+// Returns ErrIncompleteUpload if the saved parts aren't exactly those. If the
+// sequence is wrong, the upload is left alone (until it expires).
+//
+// Assumption: Sequence has been validated (>=InitialWalletSequence)
+func (s *Store) CommitUpload(userId auth.UserId, uploadId UploadId, numParts int, walletId wallet.WalletId, sequence wallet.Sequence, hmac wallet.WalletHmac) (err error) {
+	defer observeQueryDuration("commit-upload", time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = checkUpload(tx, userId, uploadId); err != nil {
+		return
+	}
+
+	rows, err := tx.Query("SELECT part, data FROM upload_parts WHERE upload_id=? ORDER BY part", uploadId)
+	if err != nil {
+		return
+	}
+	var encryptedWallet strings.Builder
+	expectedPart := 0
+	for rows.Next() {
+		var part int
+		var data string
+		if err = rows.Scan(&part, &data); err != nil {
+			rows.Close()
+			return
+		}
+		if part != expectedPart {
+			// A gap, or more parts than the client says there are
+			rows.Close()
+			err = ErrIncompleteUpload
+			return
+		}
+		encryptedWallet.WriteString(data)
+		expectedPart++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if expectedPart != numParts || numParts == 0 {
+		err = ErrIncompleteUpload
+		return
+	}
+
+	err = s.setWallet(tx, userId, walletId, wallet.EncryptedWallet(encryptedWallet.String()), sequence, hmac)
+	if err != nil {
+		return
+	}
+
+	// Takes the parts with it
+	_, err = tx.Exec("DELETE FROM uploads WHERE upload_id=?", uploadId)
+	return
+}
+
+// Uploads that were never committed. Returns how many were deleted.
+func (s *Store) DeleteExpiredUploads() (numDeleted int64, err error) {
+	defer observeQueryDuration("delete-expired-uploads", time.Now())
+
+	res, err := s.db.Exec("DELETE FROM uploads WHERE expiration<=?", time.Now().UTC())
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+///////////
+// Blobs //
+///////////
+
+// Deletes blobs that no wallet refers to: old versions of wallets, and ones
+// that were put in the blob store but never saved (i.e. wrong sequence).
+// Returns how many were deleted. Nothing to do if there's no blob store.
+func (s *Store) DeleteUnreferencedBlobs() (numDeleted int64, err error) {
+	defer observeQueryDuration("delete-unreferenced-blobs", time.Now())
+
+	if s.Blobs == nil {
+		return
+	}
+
+	// Collect them first rather than deleting while listing, which not every
+	// blob store would like
+	var candidates []blobstore.Ref
+	cutoff := time.Now().Add(-BlobGracePeriod)
+	err = s.Blobs.List(func(info blobstore.BlobInfo) error {
+		if info.Modified.Before(cutoff) {
+			candidates = append(candidates, info.Ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, ref := range candidates {
+		var deleted bool
+		if deleted, err = s.deleteBlobIfUnreferenced(ref, cutoff); err != nil {
+			return
+		}
+		if deleted {
+			numDeleted++
+		}
+	}
+	return
+}
+
+// Checked again right before deleting, since listing can take a while. Saving
+// a wallet puts the blob before referring to it, so a new wallet's blob is
+// always recent. An old blob comes back if a client saves the exact same
+// encrypted wallet again. Putting it marks it as recent, but that could
+// happen after we listed it, so we check the time again. Holding the write
+// lock means nobody puts it between that check and the delete.
+func (s *Store) deleteBlobIfUnreferenced(ref blobstore.Ref, cutoff time.Time) (deleted bool, err error) {
+	s.blobsLock.Lock()
+	defer s.blobsLock.Unlock()
+
+	modified, err := s.Blobs.Modified(ref)
+	if err == blobstore.ErrNotFound {
+		// Somebody beat us to it
+		return false, nil
+	}
+	if err != nil || !modified.Before(cutoff) {
+		return
+	}
+
+	var referenced bool
+	err = s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM wallets WHERE blob_ref=?)", ref).Scan(&referenced)
+	if err != nil || referenced {
+		return
+	}
+	if err = s.Blobs.Delete(ref); err != nil {
+		return
+	}
+	return true, nil
+}
@@ -1,12 +1,20 @@
 package store
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func StoreTestInit(t *testing.T) (s Store, tmpFile *os.File) {
@@ -68,3 +76,129 @@ func makeTestUser(
 	t.Fatalf("Error setting up account - no rows found")
 	return
 }
+
+func TestStoreMigrate(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error getting schema version: %+v", err)
+	}
+	if want, got := ExpectedSchemaVersion(), version; want != got {
+		t.Errorf("Expected schema version %d after migrating, got %d", want, got)
+	}
+
+	// Running it again should be a no-op
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Unexpected error migrating a second time: %+v", err)
+	}
+	version, _ = s.SchemaVersion()
+	if want, got := ExpectedSchemaVersion(), version; want != got {
+		t.Errorf("Expected schema version %d after migrating again, got %d", want, got)
+	}
+
+	// A database from a newer server
+	if _, err := s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", ExpectedSchemaVersion()+1)); err != nil {
+		t.Fatalf("Unexpected error setting schema version: %+v", err)
+	}
+	if err := s.Migrate(); err == nil {
+		t.Errorf("Expected an error migrating a database with a newer schema version")
+	}
+}
+
+func TestStorePing(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if err := s.Ping(); err != nil {
+		t.Errorf("Unexpected error pinging the database: %+v", err)
+	}
+}
+
+func TestStoreQueryDuration(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	sampleCount := func() uint64 {
+		var metric dto.Metric
+		histogram := metrics.StoreQueryDuration.With(prometheus.Labels{"query": "get-wallet"}).(prometheus.Histogram)
+		if err := histogram.Write(&metric); err != nil {
+			t.Fatalf("Error reading histogram: %+v", err)
+		}
+		return metric.Histogram.GetSampleCount()
+	}
+
+	before := sampleCount()
+	if _, _, _, err := s.GetWallet(auth.UserId(1), wallet.DefaultWalletId); err != ErrNoWallet {
+		t.Fatalf("Expected ErrNoWallet, got %+v", err)
+	}
+	if after := sampleCount(); after != before+1 {
+		t.Errorf("Expected one more get-wallet observation, went from %d to %d", before, after)
+	}
+}
+
+func TestStoreGetStats(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	stats, err := s.GetStats()
+	if err != nil {
+		t.Fatalf("Unexpected error getting stats for an empty database: %+v", err)
+	}
+	if !reflect.DeepEqual(stats, Stats{WalletsBySize: []int{0, 0, 0, 0}}) {
+		t.Errorf("Expected empty stats, got %+v", stats)
+	}
+
+	password, seed := auth.Password("123"), auth.ClientSaltSeed("abcd1234abcd1234")
+	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
+	if err := s.CreateAccount(auth.Email("unverified@example.com"), password, seed, &verifyToken, ""); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	for _, email := range []auth.Email{"small@example.com", "big@example.com"} {
+		if err := s.CreateAccount(email, password, seed, nil, ""); err != nil {
+			t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+		}
+	}
+
+	smallUserId, err := s.GetUserId("small@example.com", password)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	bigUserId, err := s.GetUserId("big@example.com", password)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	if err := s.SetWallet(smallUserId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-encrypted-wallet"), 1, wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	// A second wallet for the same account, which counts as a wallet but not
+	// another account with wallets
+	if err := s.SetWallet(smallUserId, "other", wallet.EncryptedWallet("my-other-encrypted-wallet"), 1, wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.SetWallet(bigUserId, wallet.DefaultWalletId, wallet.EncryptedWallet(strings.Repeat("a", 20000)), 1, wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	authToken := auth.AuthToken{Token: "seekrit", UserId: smallUserId, DeviceId: "dev-1", Scope: "*"}
+	if err := s.SaveToken(&authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	stats, err = s.GetStats()
+	if err != nil {
+		t.Fatalf("Unexpected error getting stats: %+v", err)
+	}
+	expectedStats := Stats{
+		Accounts:            3,
+		VerifiedAccounts:    2,
+		Wallets:             3,
+		AccountsWithWallets: 2,
+		AuthTokens:          1,
+		WalletsBySize:       []int{2, 2, 3, 3},
+	}
+	if !reflect.DeepEqual(stats, expectedStats) {
+		t.Errorf("Expected stats %+v, got %+v", expectedStats, stats)
+	}
+}
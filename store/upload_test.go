@@ -0,0 +1,173 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func expectUploadParts(t *testing.T, s *Store, userId auth.UserId, uploadId UploadId, expected []int) {
+	t.Helper()
+	parts, _, err := s.GetUploadParts(userId, uploadId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUploadParts: %+v", err)
+	}
+	if !reflect.DeepEqual(expected, parts) {
+		t.Errorf("Expected upload parts %+v, got %+v", expected, parts)
+	}
+}
+
+// Upload a wallet in parts, out of order and with a part sent twice, and
+// commit it
+func TestStoreUploadCommit(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	uploadId, expiration, err := s.CreateUpload(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in CreateUpload: %+v", err)
+	}
+	if expiration.Before(time.Now().Add(UploadLifespan - time.Minute)) {
+		t.Errorf("Expected expiration about %v from now, got %v", UploadLifespan, expiration)
+	}
+	expectUploadParts(t, &s, userId, uploadId, []int{})
+
+	for _, p := range []struct {
+		part int
+		data string
+	}{{1, "wallet-"}, {0, "WRONG"}, {2, "part-c"}, {0, "my-enc-"}} {
+		if err := s.SaveUploadPart(userId, uploadId, p.part, p.data, 100); err != nil {
+			t.Fatalf("Unexpected error in SaveUploadPart: %+v", err)
+		}
+	}
+	expectUploadParts(t, &s, userId, uploadId, []int{0, 1, 2})
+
+	// Client thinks there are more parts than there are
+	if err := s.CommitUpload(userId, uploadId, 4, wallet.DefaultWalletId, wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrIncompleteUpload {
+		t.Fatalf(`CommitUpload err: wanted "%+v", got "%+v"`, ErrIncompleteUpload, err)
+	}
+	// ...or fewer
+	if err := s.CommitUpload(userId, uploadId, 2, wallet.DefaultWalletId, wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrIncompleteUpload {
+		t.Fatalf(`CommitUpload err: wanted "%+v", got "%+v"`, ErrIncompleteUpload, err)
+	}
+	// Same sequence rules as SetWallet
+	if err := s.CommitUpload(userId, uploadId, 3, wallet.DefaultWalletId, wallet.Sequence(2), wallet.WalletHmac("my-hmac")); err != ErrWrongSequence {
+		t.Fatalf(`CommitUpload err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectWalletNotExists(t, &s, userId)
+
+	if err := s.CommitUpload(userId, uploadId, 3, wallet.DefaultWalletId, wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in CommitUpload: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-part-c"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
+
+	// Gone once it's committed
+	if _, _, err := s.GetUploadParts(userId, uploadId); err != ErrNoUpload {
+		t.Fatalf(`GetUploadParts err: wanted "%+v", got "%+v"`, ErrNoUpload, err)
+	}
+	var numParts int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM upload_parts").Scan(&numParts); err != nil || numParts != 0 {
+		t.Errorf("Expected the parts to be deleted with the upload, got %d, err %+v", numParts, err)
+	}
+}
+
+// A gap in the parts isn't a complete upload
+func TestStoreUploadCommitGap(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	uploadId, _, _ := s.CreateUpload(userId)
+
+	for _, part := range []int{0, 1, 3} {
+		if err := s.SaveUploadPart(userId, uploadId, part, "data", 100); err != nil {
+			t.Fatalf("Unexpected error in SaveUploadPart: %+v", err)
+		}
+	}
+	for _, numParts := range []int{0, 2, 3, 4} {
+		if err := s.CommitUpload(userId, uploadId, numParts, wallet.DefaultWalletId, wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrIncompleteUpload {
+			t.Errorf(`CommitUpload with %d parts err: wanted "%+v", got "%+v"`, numParts, ErrIncompleteUpload, err)
+		}
+	}
+}
+
+func TestStoreUploadLimits(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	otherUserId := userId + 1
+
+	var uploadId UploadId
+	for i := 0; i < MaxUploadsPerUser; i++ {
+		var err error
+		if uploadId, _, err = s.CreateUpload(userId); err != nil {
+			t.Fatalf("Unexpected error in CreateUpload: %+v", err)
+		}
+	}
+	if _, _, err := s.CreateUpload(userId); err != ErrTooManyUploads {
+		t.Fatalf(`CreateUpload err: wanted "%+v", got "%+v"`, ErrTooManyUploads, err)
+	}
+
+	// Someone else's upload
+	if err := s.SaveUploadPart(otherUserId, uploadId, 0, "data", 100); err != ErrNoUpload {
+		t.Fatalf(`SaveUploadPart err: wanted "%+v", got "%+v"`, ErrNoUpload, err)
+	}
+	if err := s.CommitUpload(otherUserId, uploadId, 1, wallet.DefaultWalletId, wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrNoUpload {
+		t.Fatalf(`CommitUpload err: wanted "%+v", got "%+v"`, ErrNoUpload, err)
+	}
+
+	// Size counts all of the parts, but a part being replaced only counts once
+	if err := s.SaveUploadPart(userId, uploadId, 0, "12345", 10); err != nil {
+		t.Fatalf("Unexpected error in SaveUploadPart: %+v", err)
+	}
+	if err := s.SaveUploadPart(userId, uploadId, 0, "1234567890", 10); err != nil {
+		t.Fatalf("Unexpected error in SaveUploadPart: %+v", err)
+	}
+	if err := s.SaveUploadPart(userId, uploadId, 1, "1", 10); err != ErrUploadTooLarge {
+		t.Fatalf(`SaveUploadPart err: wanted "%+v", got "%+v"`, ErrUploadTooLarge, err)
+	}
+	expectUploadParts(t, &s, userId, uploadId, []int{0})
+}
+
+func TestStoreDeleteExpiredUploads(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expiredId, _, _ := s.CreateUpload(userId)
+	activeId, _, _ := s.CreateUpload(userId)
+	for _, uploadId := range []UploadId{expiredId, activeId} {
+		if err := s.SaveUploadPart(userId, uploadId, 0, "data", 100); err != nil {
+			t.Fatalf("Unexpected error in SaveUploadPart: %+v", err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE uploads SET expiration=? WHERE upload_id=?", time.Now().UTC().Add(-time.Minute), expiredId); err != nil {
+		t.Fatalf("Error expiring upload: %+v", err)
+	}
+
+	// Expired uploads can't be used even before they're deleted
+	if err := s.SaveUploadPart(userId, expiredId, 1, "data", 100); err != ErrNoUpload {
+		t.Fatalf(`SaveUploadPart err: wanted "%+v", got "%+v"`, ErrNoUpload, err)
+	}
+
+	numDeleted, err := s.DeleteExpiredUploads()
+	if err != nil {
+		t.Fatalf("Unexpected error in DeleteExpiredUploads: %+v", err)
+	}
+	if numDeleted != 1 {
+		t.Errorf("Expected to delete 1 upload, deleted %d", numDeleted)
+	}
+	expectUploadParts(t, &s, userId, activeId, []int{0})
+
+	var numParts int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM upload_parts WHERE upload_id=?", expiredId).Scan(&numParts); err != nil || numParts != 0 {
+		t.Errorf("Expected the expired upload's parts to be deleted, got %d, err %+v", numParts, err)
+	}
+}
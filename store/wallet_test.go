@@ -2,12 +2,15 @@ package store
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/compression"
 	"lbryio/wallet-sync-server/wallet"
 )
 
@@ -105,7 +108,7 @@ func TestStoreInsertWallet(t *testing.T) {
 	expectWalletNotExists(t, &s, userId)
 
 	// Put in a first wallet
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.WalletHmac("my-hmac")); err != nil {
+	if err := s.insertFirstWallet(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet"), wallet.WalletHmac("my-hmac")); err != nil {
 		t.Fatalf("Unexpected error in insertFirstWallet: %+v", err)
 	}
 
@@ -113,7 +116,7 @@ func TestStoreInsertWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
 
 	// Put in a first wallet for a second time, have an error for trying
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.WalletHmac("my-hmac-2")); err != ErrDuplicateWallet {
+	if err := s.insertFirstWallet(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.WalletHmac("my-hmac-2")); err != ErrDuplicateWallet {
 		t.Fatalf(`insertFirstWallet err: wanted "%+v", got "%+v"`, ErrDuplicateToken, err)
 	}
 
@@ -134,7 +137,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// Try to update a wallet, fail for nothing to update
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != ErrNoWallet {
+	if err := s.updateWalletToSequence(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != ErrNoWallet {
 		t.Fatalf(`updateWalletToSequence err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
 	}
 
@@ -142,12 +145,12 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletNotExists(t, &s, userId)
 
 	// Put in a first wallet
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.insertFirstWallet(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.WalletHmac("my-hmac-a")); err != nil {
 		t.Fatalf("Unexpected error in insertFirstWallet: %+v", err)
 	}
 
 	// Try to update the wallet, fail for having the wrong sequence
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrNoWallet {
+	if err := s.updateWalletToSequence(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrNoWallet {
 		t.Fatalf(`updateWalletToSequence err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
 	}
 
@@ -155,7 +158,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Update the wallet successfully, with the right sequence
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+	if err := s.updateWalletToSequence(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
 		t.Fatalf("Unexpected error in updateWalletToSequence: %+v", err)
 	}
 
@@ -163,7 +166,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
 
 	// Update the wallet again successfully
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
+	if err := s.updateWalletToSequence(s.db, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
 		t.Fatalf("Unexpected error in updateWalletToSequence: %+v", err)
 	}
 
@@ -190,39 +193,39 @@ func TestStoreSetWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// Sequence 2 - fails - out of sequence (behind the scenes, tries to update but there's nothing there yet)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-a")); err != ErrWrongSequence {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-a")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	expectWalletNotExists(t, &s, userId)
 
 	// Sequence 1 - succeeds - out of sequence (behind the scenes, does an insert)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 1 - fails - out of sequence (behind the scenes, tries to insert but there's something there already)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	// Expect the *first* wallet to still be there
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 3 - fails - out of sequence (behind the scenes: tries via update, which is appropriate here)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	// Expect the *first* wallet to still be there
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 2 - succeeds - (behind the scenes, does an update. Tests successful update-after-insert)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
 
 	// Sequence 3 - succeeds - (behind the scenes, does an update. Tests successful update-after-update. Maybe gratuitous?)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"), time.Now().UTC())
@@ -237,22 +240,49 @@ func TestStoreGetWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// GetWallet fails when there's no wallet
-	encryptedWallet, sequence, hmac, err := s.GetWallet(userId)
+	encryptedWallet, sequence, hmac, err := s.GetWallet(userId, wallet.DefaultWalletId)
 	if len(encryptedWallet) != 0 || sequence != 0 || len(hmac) != 0 || err != ErrNoWallet {
 		t.Fatalf("Expected ErrNoWallet, and no wallet values. Instead got: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
 	}
 
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 
 	// GetWallet succeeds when there's a wallet
-	encryptedWallet, sequence, hmac, err = s.GetWallet(userId)
+	encryptedWallet, sequence, hmac, err = s.GetWallet(userId, wallet.DefaultWalletId)
 	if encryptedWallet != wallet.EncryptedWallet("my-enc-wallet-a") || sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-a") || err != nil {
 		t.Fatalf("Unexpected values for wallet: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
 	}
 }
 
+func TestStoreGetWalletHead(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// Get a valid userId
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// GetWalletHead fails when there's no wallet
+	sequence, hmac, updated, err := s.GetWalletHead(userId, wallet.DefaultWalletId)
+	if sequence != 0 || len(hmac) != 0 || !updated.IsZero() || err != ErrNoWallet {
+		t.Fatalf("Expected ErrNoWallet, and no wallet values. Instead got: sequence: %+v hmac: %+v updated: %+v err: %+v", sequence, hmac, updated, err)
+	}
+
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// GetWalletHead succeeds when there's a wallet
+	sequence, hmac, updated, err = s.GetWalletHead(userId, wallet.DefaultWalletId)
+	if sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-a") || err != nil {
+		t.Fatalf("Unexpected values for wallet head: sequence: %+v hmac: %+v err: %+v", sequence, hmac, err)
+	}
+	if diff := time.Now().UTC().Sub(updated); diff < -time.Second*2 || diff > time.Second*2 {
+		t.Errorf("Expected updated to be about now, got %+v", updated)
+	}
+}
+
 func TestStoreWalletEmptyFields(t *testing.T) {
 	// Make sure expiration doesn't get set if sanitization fails
 	tt := []struct {
@@ -281,7 +311,7 @@ func TestStoreWalletEmptyFields(t *testing.T) {
 
 			var sqliteErr sqlite3.Error
 
-			err := s.insertFirstWallet(userId, tc.encryptedWallet, tc.hmac)
+			err := s.insertFirstWallet(s.db, userId, wallet.DefaultWalletId, tc.encryptedWallet, tc.hmac)
 			if errors.As(err, &sqliteErr) {
 				if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintCheck) {
 					return // We got the error we expected
@@ -291,3 +321,151 @@ func TestStoreWalletEmptyFields(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreWalletCompression(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	encryptedWallet := wallet.EncryptedWallet(strings.Repeat("my-enc-wallet-a", 100))
+
+	expectStored := func(expectedEncoding compression.Encoding, expectPlain bool) {
+		t.Helper()
+		var stored []byte
+		var encoding compression.Encoding
+		if err := s.db.QueryRow("SELECT encrypted_wallet, encoding FROM wallets WHERE user_id=?", userId).Scan(&stored, &encoding); err != nil {
+			t.Fatalf("Unexpected error getting stored wallet: %+v", err)
+		}
+		if encoding != expectedEncoding {
+			t.Errorf("Expected wallet stored with encoding %q, got %q", expectedEncoding, encoding)
+		}
+		if isPlain := string(stored) == string(encryptedWallet); isPlain != expectPlain {
+			t.Errorf("Expected wallet stored as plain text: %t, got %t", expectPlain, isPlain)
+		}
+	}
+	expectGetWallet := func(expectedSequence wallet.Sequence) {
+		t.Helper()
+		gotWallet, sequence, _, err := s.GetWallet(userId, wallet.DefaultWalletId)
+		if err != nil || gotWallet != encryptedWallet || sequence != expectedSequence {
+			t.Errorf("Unexpected values for wallet: encrypted wallet: %+v sequence: %+v err: %+v", gotWallet, sequence, err)
+		}
+	}
+
+	s.WalletCompression = compression.Zstd
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, encryptedWallet, wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectStored(compression.Zstd, false)
+	expectGetWallet(1)
+
+	// Wallets saved before a change of setting are still readable
+	s.WalletCompression = compression.Identity
+	expectGetWallet(1)
+
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, encryptedWallet, wallet.Sequence(2), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectStored(compression.Identity, true)
+	expectGetWallet(2)
+
+	s.WalletCompression = compression.Gzip
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, encryptedWallet, wallet.Sequence(3), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectStored(compression.Gzip, false)
+	expectGetWallet(3)
+}
+
+// Each wallet has its own sequence, and the default wallet is just one of them
+func TestStoreNamedWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if heads, err := s.ListWallets(userId); err != nil || len(heads) != 0 {
+		t.Fatalf("Expected no wallets, got %+v, err %+v", heads, err)
+	}
+
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.SetWallet(userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// Sequence 1 for another wallet, even though the default is at 2
+	if err := s.CreateWallet(userId, "savings", wallet.EncryptedWallet("my-enc-savings-a"), wallet.WalletHmac("my-hmac-savings-a")); err != nil {
+		t.Fatalf("Unexpected error in CreateWallet: %+v", err)
+	}
+	if err := s.CreateWallet(userId, "savings", wallet.EncryptedWallet("my-enc-savings-a"), wallet.WalletHmac("my-hmac-savings-a")); err != ErrDuplicateWallet {
+		t.Fatalf(`CreateWallet err: wanted "%+v", got "%+v"`, ErrDuplicateWallet, err)
+	}
+	if err := s.SetWallet(userId, "savings", wallet.EncryptedWallet("my-enc-savings-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-savings-b")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if err := s.SetWallet(userId, "savings", wallet.EncryptedWallet("my-enc-savings-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-savings-b")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"))
+	expectGetWallet(t, &s, userId, "savings", wallet.EncryptedWallet("my-enc-savings-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-savings-b"))
+	if _, _, _, err := s.GetWallet(userId, "checking"); err != ErrNoWallet {
+		t.Fatalf(`GetWallet err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
+	}
+
+	heads, err := s.ListWallets(userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in ListWallets: %+v", err)
+	}
+	if len(heads) != 2 ||
+		heads[0].WalletId != wallet.DefaultWalletId || heads[0].Sequence != 2 || heads[0].Hmac != "my-hmac-b" ||
+		heads[1].WalletId != "savings" || heads[1].Sequence != 2 || heads[1].Hmac != "my-hmac-savings-b" {
+		t.Errorf("Unexpected wallet list: %+v", heads)
+	}
+
+	// Deleting takes the current sequence
+	if err := s.DeleteWallet(userId, "savings", wallet.Sequence(1)); err != ErrWrongSequence {
+		t.Fatalf(`DeleteWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if err := s.DeleteWallet(userId, "checking", wallet.Sequence(1)); err != ErrNoWallet {
+		t.Fatalf(`DeleteWallet err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
+	}
+	if err := s.DeleteWallet(userId, "savings", wallet.Sequence(2)); err != nil {
+		t.Fatalf("Unexpected error in DeleteWallet: %+v", err)
+	}
+	if _, _, _, err := s.GetWallet(userId, "savings"); err != ErrNoWallet {
+		t.Fatalf(`GetWallet err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
+	}
+	expectGetWallet(t, &s, userId, wallet.DefaultWalletId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"))
+}
+
+func TestStoreMaxWalletsPerUser(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	for i := 0; i < MaxWalletsPerUser; i++ {
+		walletId := wallet.WalletId(fmt.Sprintf("wallet-%d", i))
+		if err := s.SetWallet(userId, walletId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	if err := s.SetWallet(userId, "one-too-many", wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrTooManyWallets {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrTooManyWallets, err)
+	}
+	if err := s.CreateWallet(userId, "one-too-many", wallet.EncryptedWallet("my-enc-wallet"), wallet.WalletHmac("my-hmac")); err != ErrTooManyWallets {
+		t.Fatalf(`CreateWallet err: wanted "%+v", got "%+v"`, ErrTooManyWallets, err)
+	}
+
+	// At the limit, an existing wallet is still a sequence problem, not a
+	// limit problem
+	if err := s.SetWallet(userId, "wallet-0", wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if err := s.SetWallet(userId, "wallet-0", wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(2), wallet.WalletHmac("my-hmac")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+}
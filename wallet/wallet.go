@@ -3,3 +3,25 @@ package wallet
 type EncryptedWallet string
 type WalletHmac string
 type Sequence uint32
+
+// A user can have several wallets, each with its own sequence. Clients that
+// don't know about that get this one.
+type WalletId string
+
+const DefaultWalletId = WalletId("default_wallet")
+
+// Long enough for a name, short enough to not be a place to store data
+const maxWalletIdLength = 64
+
+// Letters, digits, dashes and underscores. It goes in URLs and log lines.
+func (id WalletId) Validate() bool {
+	if len(id) == 0 || len(id) > maxWalletIdLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}